@@ -0,0 +1,241 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ninedraft/audiobook-repack/repack"
+)
+
+// listFormats are outputs of list: an aligned table, JSON object per line or CSV with a header.
+var listFormats = []string{"table", "json", "csv"}
+
+func list(args []string) error {
+	flags := flag.NewFlagSet("list", flag.ExitOnError)
+	format := "table"
+	flags.Func("format", "output format: table (default), json (an object per line) or csv",
+		func(value string) error {
+			if !slices.Contains(listFormats, value) {
+				return fmt.Errorf("unknown format %q, want one of %s", value, strings.Join(listFormats, ", "))
+			}
+			format = value
+			return nil
+		})
+	durations := false
+	flags.BoolVar(&durations, "durations", durations, "read audio entries to list their durations")
+	passfile := ""
+	flags.StringVar(&passfile, "passfile", passfile, "read password of encrypted entries for -durations from the first line of file instead of asking for it")
+	_ = flags.Parse(args)
+	if flags.NArg() != 1 {
+		return usageError{errors.New("list requires exactly one archive")}
+	}
+
+	var password []byte
+	if durations {
+		var errPassword error
+		password, errPassword = archivePassword(flags.Arg(0), passfile)
+		if errPassword != nil {
+			return errPassword
+		}
+	}
+
+	printer := newEntryPrinter(os.Stdout, format, durations)
+	err := repack.ListArchive(flags.Arg(0), durations, password, printer.print)
+	if err != nil {
+		return fmt.Errorf("listing archive: %w", err)
+	}
+	return printer.flush()
+}
+
+func verify(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	sources := false
+	flags.BoolVar(&sources, "sources", sources, "also compare entries with their source files")
+	withHash := false
+	flags.BoolVar(&withHash, "hash", withHash, "compare SHA-256 with source files besides CRC and size, implies -sources")
+	skipTags := false
+	flags.BoolVar(&skipTags, "skip-tags", skipTags, "compare MP3 files with sources past ID3v2 tags, for archives packed with rewritten tags")
+	passfile := ""
+	flags.StringVar(&passfile, "passfile", passfile, "read password of encrypted entries from the first line of file instead of asking for it")
+	_ = flags.Parse(args)
+	if flags.NArg() != 1 {
+		return usageError{errors.New("verify requires exactly one archive")}
+	}
+
+	password, errPassword := archivePassword(flags.Arg(0), passfile)
+	if errPassword != nil {
+		return errPassword
+	}
+
+	if err := repack.VerifyArchive(flags.Arg(0), password); err != nil {
+		return fmt.Errorf("verifying archive: %w", err)
+	}
+
+	if sources || withHash {
+		if err := repack.VerifySources(flags.Arg(0), withHash, skipTags, password); err != nil {
+			return fmt.Errorf("verifying archive against sources: %w", err)
+		}
+	}
+	return nil
+}
+
+func extract(args []string) error {
+	flags := flag.NewFlagSet("extract", flag.ExitOnError)
+	flat := false
+	flags.BoolVar(&flat, "flat", flat, "unpack entries under their names instead of restoring book dirs from source paths")
+	passfile := ""
+	flags.StringVar(&passfile, "passfile", passfile, "read password of encrypted entries from the first line of file instead of asking for it")
+	_ = flags.Parse(args)
+	if flags.NArg() != 2 {
+		return usageError{errors.New("extract requires an archive and a target dir")}
+	}
+
+	password, errPassword := archivePassword(flags.Arg(0), passfile)
+	if errPassword != nil {
+		return errPassword
+	}
+
+	if err := repack.ExtractArchive(flags.Arg(0), flags.Arg(1), !flat, password); err != nil {
+		return fmt.Errorf("extracting archive: %w", err)
+	}
+	return nil
+}
+
+func diff(args []string) error {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	withHash := false
+	flags.BoolVar(&withHash, "hash", withHash, "compare SHA-256 of files of equal size besides CRC")
+	skipTags := false
+	flags.BoolVar(&skipTags, "skip-tags", skipTags, "compare MP3 files past ID3v2 tags, for archives packed with rewritten tags")
+	passfile := ""
+	flags.StringVar(&passfile, "passfile", passfile, "read password of encrypted entries from the first line of file instead of asking for it")
+	_ = flags.Parse(args)
+	if flags.NArg() != 2 {
+		return usageError{errors.New("diff requires an archive and a dir or another archive")}
+	}
+
+	password, errPassword := archivePassword(flags.Arg(0), passfile)
+	if errPassword != nil {
+		return errPassword
+	}
+
+	if err := repack.DiffArchive(flags.Arg(0), flags.Arg(1), withHash, skipTags, password, os.Stdout); err != nil {
+		return fmt.Errorf("comparing archive: %w", err)
+	}
+	return nil
+}
+
+func catalog(args []string) error {
+	if len(args) == 0 || args[0] != "search" {
+		return usageError{errors.New("catalog requires search command")}
+	}
+	flags := flag.NewFlagSet("catalog search", flag.ExitOnError)
+	filename := repack.DefaultCatalog()
+	flags.StringVar(&filename, "catalog", filename, "SQLite catalog file written by pack -catalog")
+	_ = flags.Parse(args[1:])
+	if flags.NArg() != 1 {
+		return usageError{errors.New("catalog search requires exactly one text to look for")}
+	}
+
+	books, errSearch := repack.SearchCatalog(filename, flags.Arg(0))
+	if errSearch != nil {
+		return fmt.Errorf("searching catalog: %w", errSearch)
+	}
+	table := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(table, "ARCHIVE\tPACKED\tTITLE\tFILES\tDURATION")
+	for _, b := range books {
+		fmt.Fprintf(table, "%s\t%s\t%s\t%d\t%s\n", b.Output, b.Packed.Local().Format(time.DateTime), b.Title, b.Files, b.Duration.Round(time.Second))
+	}
+	return table.Flush()
+}
+
+func merge(args []string) error {
+	flags := flag.NewFlagSet("merge", flag.ExitOnError)
+	opts := repack.Options{
+		Mode:          0600,
+		Format:        repack.FormatZip,
+		Globs:         []string{"**"},
+		OnCollision:   repack.CollisionFail,
+		MergeArchives: true,
+	}
+	flags.BoolVar(&opts.PrefixMerged, "prefix", opts.PrefixMerged, "prefix entries with the archive name without extension, like pack prefixes files with dir names")
+	flags.Func("x", "exclude entries matching glob, applied to relative path and file name, can be repeated",
+		func(pattern string) error {
+			if err := repack.ValidateGlob(pattern); err != nil {
+				return err
+			}
+			opts.Exclude = append(opts.Exclude, pattern)
+			return nil
+		})
+	flags.BoolVar(&opts.GlobsIgnoreCase, "iglob", opts.GlobsIgnoreCase, "match -x globs ignoring case of entry names")
+	flags.Func("on-collision", "what to do when different entries get the same name: fail (default) or suffix to rename them name_2.ext, name_3.ext, ...",
+		func(value string) error {
+			if value != repack.CollisionFail && value != repack.CollisionSuffix {
+				return fmt.Errorf("unknown policy %q, want %s or %s", value, repack.CollisionFail, repack.CollisionSuffix)
+			}
+			opts.OnCollision = value
+			return nil
+		})
+	flags.Func("compress", "zip entry compression, see pack -compress; entries compressed differently are recompressed",
+		func(value string) error {
+			if err := repack.ValidateCompression(value); err != nil {
+				return err
+			}
+			opts.Compression = append(opts.Compression, value)
+			return nil
+		})
+	flags.BoolVar(&opts.Manifest, "manifest", opts.Manifest, "add "+repack.ManifestName+" entry with checksums of merged entries")
+	dryRun := false
+	flags.BoolVar(&dryRun, "dry-run", dryRun, "print merged entries and name collisions without writing anything")
+	quiet := false
+	flags.BoolVar(&quiet, "quiet", quiet, "hide progress bars and lines, the summary is still logged")
+	_ = flags.Parse(args)
+	if flags.NArg() < 2 {
+		return usageError{errors.New("merge requires an output and at least one archive")}
+	}
+
+	opts.Output = flags.Arg(0)
+	archives := flags.Args()[1:]
+	if opts.Output == repack.StdoutOutput {
+		if err := checkStdoutOutput(); err != nil {
+			return err
+		}
+	}
+	for _, archive := range archives {
+		if !strings.EqualFold(filepath.Ext(archive), ".zip") {
+			return usageError{fmt.Errorf("%q: only zip archives can be merged", archive)}
+		}
+	}
+
+	ctx, stop := interruptContext()
+	defer stop()
+
+	progress, errProgress := newProgressOutput("", 1, quiet, &opts)
+	if errProgress != nil {
+		return usageError{errProgress}
+	}
+
+	packer, errNew := repack.New(opts)
+	if errNew != nil {
+		return errNew
+	}
+
+	if dryRun {
+		if err := packer.Plan(ctx, os.Stdout, archives); err != nil {
+			return fmt.Errorf("planning archive: %w", err)
+		}
+		return nil
+	}
+
+	stopProgress := progress.start(ctx)
+	errPack := packer.Pack(ctx, archives)
+	stopProgress(errPack)
+	return errPack
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/ninedraft/audiobook-repack/repack"
+)
+
+// completionShells are shells completion writes scripts for.
+var completionShells = []string{"bash", "zsh", "fish"}
+
+// commandSummaries describe subcommands in completion menus, pack goes first as the default one.
+var commandSummaries = [][2]string{
+	{"pack", "pack book dirs into an archive (default)"},
+	{"list", "list entries of an archive"},
+	{"verify", "check CRCs and checksums of an archive"},
+	{"extract", "unpack an archive into a dir"},
+	{"diff", "compare an archive with a dir or another archive"},
+	{"merge", "combine zip archives into one"},
+	{"catalog", "search the catalog of packed books"},
+	{"serve", "run pack jobs submitted over HTTP"},
+	{"completion", "print a shell completion script"},
+	{"self-update", "replace the binary with the latest release"},
+}
+
+// completionFlag is a flag as its command prints it with -h.
+type completionFlag struct {
+	name  string
+	usage string
+	// value is set for flags which take an argument, files for ones it may be a file name of
+	value, files bool
+	// values are suggested for the argument, file names are otherwise
+	values []string
+}
+
+// completionCommand is a subcommand with its flags, sub is a nested command like catalog search.
+type completionCommand struct {
+	name, summary, sub string
+	flags              []completionFlag
+}
+
+// completionValues are arguments suggested for flags of commands.
+func completionValues() map[string]map[string][]string {
+	return map[string]map[string][]string{
+		"pack": {
+			"format":            repack.Formats,
+			"sort":              repack.SortKeys,
+			"sanitize-names":    repack.SanitizeTargets,
+			"normalize-names":   repack.NormalizationForms,
+			"symlinks":          repack.SymlinkPolicies,
+			"on-collision":      {repack.CollisionFail, repack.CollisionSuffix},
+			"update-by":         {repack.UpdateByMTime, repack.UpdateByHash},
+			"validate-audio":    {repack.ValidateWarn, repack.ValidateSkip, repack.ValidateFail},
+			"bars":              {repack.BarsFile, repack.BarsDir, repack.BarsNone},
+			"progress":          {progressBars, progressPlain, progressJSON},
+			"log-level":         {"debug", "info", "warn", "error"},
+			"log-format":        {"text", "json"},
+			"order-by-duration": {"asc", "desc"},
+			"transcode":         {"opus", "mp3", "aac"},
+			"mtime":             {"source", "fixed:"},
+			"notify":            {repack.NotifyDesktop, repack.NotifyWebhookPrefix},
+			"profile":           sortedProfiles(),
+		},
+		"list":  {"format": listFormats},
+		"merge": {"on-collision": {repack.CollisionFail, repack.CollisionSuffix}},
+	}
+}
+
+// helpFlag matches flag lines of flag.PrintDefaults: "  -name type", the usage follows on the same line
+// after a tab for short ones or on the next line.
+var helpFlag = regexp.MustCompile(`^  -([^\s=]+)(?: ([a-z]+))?(?:\t(.*))?$`)
+
+func completion(args []string) error {
+	if len(args) != 1 || !slices.Contains(completionShells, args[0]) {
+		return usageError{fmt.Errorf("completion requires a shell: %s", strings.Join(completionShells, ", "))}
+	}
+
+	executable, errExecutable := os.Executable()
+	if errExecutable != nil {
+		return fmt.Errorf("finding own binary: %w", errExecutable)
+	}
+	values := completionValues()
+	commands := make([]completionCommand, 0, len(commandSummaries))
+	for _, summary := range commandSummaries {
+		command := completionCommand{name: summary[0], summary: summary[1]}
+		helpArgs := []string{command.name, "-h"}
+		switch command.name {
+		case "completion":
+			commands = append(commands, command)
+			continue
+		case "catalog":
+			command.sub = "search"
+			helpArgs = []string{command.name, command.sub, "-h"}
+		}
+		flags, err := commandFlags(executable, helpArgs)
+		if err != nil {
+			return fmt.Errorf("reading flags of %s: %w", command.name, err)
+		}
+		for i := range flags {
+			flags[i].values = values[command.name][flags[i].name]
+		}
+		command.flags = flags
+		commands = append(commands, command)
+	}
+
+	name := strings.TrimSuffix(filepath.Base(os.Args[0]), ".exe")
+	var script string
+	switch args[0] {
+	case "bash":
+		script = bashCompletion(name, commands)
+	case "zsh":
+		script = zshCompletion(name, commands)
+	case "fish":
+		script = fishCompletion(name, commands)
+	}
+	_, err := os.Stdout.WriteString(script)
+	return err
+}
+
+// commandFlags runs the binary with -h, flags are defined by commands as they run.
+func commandFlags(executable string, args []string) ([]completionFlag, error) {
+	output, errRun := exec.Command(executable, args...).CombinedOutput()
+	var exitErr *exec.ExitError
+	if errRun != nil && !errors.As(errRun, &exitErr) {
+		return nil, errRun
+	}
+
+	flags := []completionFlag{}
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if match := helpFlag.FindStringSubmatch(line); match != nil {
+			// numbers and durations aren't file names, strings and values of flag.Func may be
+			files := match[2] == "string" || match[2] == "value"
+			flags = append(flags, completionFlag{name: match[1], value: match[2] != "", files: files, usage: match[3]})
+			continue
+		}
+		usage, ok := strings.CutPrefix(line, "    \t")
+		if ok && len(flags) > 0 && flags[len(flags)-1].usage == "" {
+			flags[len(flags)-1].usage = usage
+		}
+	}
+	if len(flags) == 0 {
+		return nil, fmt.Errorf("no flags in help: %s", bytes.TrimSpace(output))
+	}
+	for i := range flags {
+		flags[i].usage = shortUsage(flags[i].usage)
+	}
+	return flags, nil
+}
+
+// shortUsage is the first clause of usage, menus show a line per flag.
+func shortUsage(usage string) string {
+	const maxUsage = 80
+	usage, _, _ = strings.Cut(usage, "; ")
+	usage, _, _ = strings.Cut(usage, " (default ")
+	if runes := []rune(usage); len(runes) > maxUsage {
+		usage = string(runes[:maxUsage])
+		if space := strings.LastIndexByte(usage, ' '); space > 0 {
+			usage = usage[:space]
+		}
+		usage += "..."
+	}
+	return usage
+}
+
+// notIdent are characters shell function names can't have.
+var notIdent = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// shellIdent makes a function name of the binary name.
+func shellIdent(name string) string {
+	return notIdent.ReplaceAllString(name, "_")
+}
+
+func commandNames(commands []completionCommand) []string {
+	names := make([]string, 0, len(commands))
+	for _, command := range commands {
+		names = append(names, command.name)
+	}
+	return names
+}
+
+func bashCompletion(name string, commands []completionCommand) string {
+	fn := "_" + shellIdent(name) + "_complete"
+	names := commandNames(commands)
+
+	script := &strings.Builder{}
+	fmt.Fprintf(script, "# bash completion for %s, generated by `%s completion bash`.\n", name, name)
+	fmt.Fprintf(script, "# Load it with: source <(%s completion bash)\n", name)
+	fmt.Fprintf(script, "%s() {\n", fn)
+	fmt.Fprintf(script, "\tlocal cur=${COMP_WORDS[COMP_CWORD]} prev=${COMP_WORDS[COMP_CWORD-1]} cmd=pack\n")
+	fmt.Fprintf(script, "\tcase ${COMP_WORDS[1]} in\n\t%s) cmd=${COMP_WORDS[1]} ;;\n\tesac\n", strings.Join(names[1:], "|"))
+	fmt.Fprintf(script, "\tif [[ $COMP_CWORD -eq 1 && $cur != -* ]]; then\n")
+	fmt.Fprintf(script, "\t\tCOMPREPLY=($(compgen -W %q -- \"$cur\") $(compgen -f -- \"$cur\"))\n\t\treturn\n\tfi\n", strings.Join(names, " "))
+	for _, command := range commands {
+		sub := command.sub
+		if command.name == "completion" {
+			sub = strings.Join(completionShells, " ")
+		}
+		if sub != "" {
+			fmt.Fprintf(script, "\tif [[ $cmd == %s && $COMP_CWORD -eq 2 ]]; then\n", command.name)
+			fmt.Fprintf(script, "\t\tCOMPREPLY=($(compgen -W %q -- \"$cur\"))\n\t\treturn\n\tfi\n", sub)
+		}
+	}
+
+	fmt.Fprintf(script, "\tcase \"$cmd $prev\" in\n")
+	for _, command := range commands {
+		for _, flag := range command.flags {
+			if len(flag.values) > 0 {
+				fmt.Fprintf(script, "\t\"%s -%s\")\n\t\tCOMPREPLY=($(compgen -W %q -- \"$cur\"))\n\t\treturn\n\t\t;;\n",
+					command.name, flag.name, strings.Join(flag.values, " "))
+			}
+		}
+	}
+	fmt.Fprintf(script, "\tesac\n")
+
+	fmt.Fprintf(script, "\tif [[ $cur == -* ]]; then\n\t\tcase $cmd in\n")
+	for _, command := range commands {
+		if len(command.flags) == 0 {
+			continue
+		}
+		flags := make([]string, 0, len(command.flags))
+		for _, flag := range command.flags {
+			flags = append(flags, "-"+flag.name)
+		}
+		fmt.Fprintf(script, "\t\t%s) COMPREPLY=($(compgen -W %q -- \"$cur\")) ;;\n", command.name, strings.Join(flags, " "))
+	}
+	fmt.Fprintf(script, "\t\tesac\n\t\treturn\n\tfi\n")
+	fmt.Fprintf(script, "\tCOMPREPLY=($(compgen -f -- \"$cur\"))\n}\n")
+	fmt.Fprintf(script, "complete -o filenames -F %s %s\n", fn, name)
+	return script.String()
+}
+
+// zshQuote quotes s for a single quoted zsh word.
+func zshQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// zshSpec is an _arguments spec of the flag, flags can be repeated.
+func zshSpec(flag completionFlag) string {
+	usage := strings.NewReplacer(`\`, `\\`, "[", `\[`, "]", `\]`).Replace(flag.usage)
+	spec := fmt.Sprintf("*-%s[%s]", flag.name, usage)
+	switch {
+	case !flag.value:
+	case len(flag.values) > 0:
+		values := make([]string, 0, len(flag.values))
+		for _, value := range flag.values {
+			values = append(values, strings.NewReplacer(`\`, `\\`, ":", `\:`, " ", `\ `).Replace(value))
+		}
+		spec += fmt.Sprintf(":%s:(%s)", flag.name, strings.Join(values, " "))
+	case flag.files:
+		spec += fmt.Sprintf(":%s:_files", flag.name)
+	default:
+		spec += fmt.Sprintf(":%s: ", flag.name)
+	}
+	return zshQuote(spec)
+}
+
+func zshCompletion(name string, commands []completionCommand) string {
+	fn := "_" + shellIdent(name)
+	names := commandNames(commands)
+
+	script := &strings.Builder{}
+	fmt.Fprintf(script, "#compdef %s\n", name)
+	fmt.Fprintf(script, "# zsh completion for %s, generated by `%s completion zsh`.\n", name, name)
+	fmt.Fprintf(script, "# Save it as %s in a dir of $fpath or load it with: source <(%s completion zsh)\n", fn, name)
+	fmt.Fprintf(script, "%s() {\n\tlocal -a commands\n\tcommands=(\n", fn)
+	for _, command := range commands {
+		fmt.Fprintf(script, "\t\t%s\n", zshQuote(command.name+":"+command.summary))
+	}
+	fmt.Fprintf(script, "\t)\n\tlocal cmd=pack\n\tcase ${words[2]} in\n")
+	fmt.Fprintf(script, "\t(%s)\n\t\tcmd=${words[2]}\n\t\tshift words\n\t\t(( CURRENT-- ))\n\t\t;;\n", strings.Join(names[1:], "|"))
+	fmt.Fprintf(script, "\t(*)\n\t\t(( CURRENT == 2 )) && [[ ${words[2]} != -* ]] && _describe -t commands command commands\n\t\t;;\n\tesac\n")
+
+	fmt.Fprintf(script, "\tcase $cmd in\n")
+	for _, command := range commands {
+		fmt.Fprintf(script, "\t(%s)\n", command.name)
+		if command.name == "completion" {
+			fmt.Fprintf(script, "\t\t_arguments ':shell:(%s)'\n\t\t;;\n", strings.Join(completionShells, " "))
+			continue
+		}
+		if command.sub != "" {
+			fmt.Fprintf(script, "\t\tif (( CURRENT == 2 )); then\n\t\t\t_values command %s\n\t\t\treturn\n\t\tfi\n", command.sub)
+			fmt.Fprintf(script, "\t\tshift words\n\t\t(( CURRENT-- ))\n")
+		}
+		fmt.Fprintf(script, "\t\t_arguments -S \\\n")
+		for _, flag := range command.flags {
+			fmt.Fprintf(script, "\t\t\t%s \\\n", zshSpec(flag))
+		}
+		fmt.Fprintf(script, "\t\t\t'*:file:_files'\n\t\t;;\n")
+	}
+	fmt.Fprintf(script, "\tesac\n}\n\n")
+	fmt.Fprintf(script, "if [[ $funcstack[1] == %s ]]; then\n\t%s \"$@\"\nelse\n\tcompdef %s %s\nfi\n", fn, fn, fn, name)
+	return script.String()
+}
+
+// fishQuote quotes s for a single quoted fish word.
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+}
+
+func fishCompletion(name string, commands []completionCommand) string {
+	fn := "__" + shellIdent(name) + "_command"
+	names := commandNames(commands)
+
+	script := &strings.Builder{}
+	fmt.Fprintf(script, "# fish completion for %s, generated by `%s completion fish`.\n", name, name)
+	fmt.Fprintf(script, "# Save it as ~/.config/fish/completions/%s.fish or load it with: %s completion fish | source\n", name, name)
+	fmt.Fprintf(script, "function %s\n\tset -l words (commandline -opc)\n\tswitch \"$words[2]\"\n", fn)
+	fmt.Fprintf(script, "\t\tcase %s\n\t\t\techo $words[2]\n\t\tcase '*'\n\t\t\techo pack\n\tend\nend\n\n", strings.Join(names[1:], " "))
+
+	for _, command := range commands {
+		fmt.Fprintf(script, "complete -c %s -n 'test (count (commandline -opc)) -eq 1' -a %s -d %s\n",
+			name, command.name, fishQuote(command.summary))
+	}
+	for _, command := range commands {
+		condition := fmt.Sprintf("test (%s) = %s", fn, command.name)
+		fmt.Fprintf(script, "\n# %s\n", command.name)
+		if command.name == "completion" {
+			fmt.Fprintf(script, "complete -c %s -n %s -f -a %s\n", name, fishQuote(condition), fishQuote(strings.Join(completionShells, " ")))
+			continue
+		}
+		if command.sub != "" {
+			fmt.Fprintf(script, "complete -c %s -n %s -f -a %s\n",
+				name, fishQuote(condition+"; and test (count (commandline -opc)) -eq 2"), command.sub)
+		}
+		for _, flag := range command.flags {
+			line := fmt.Sprintf("complete -c %s -n %s -o %s", name, fishQuote(condition), flag.name)
+			switch {
+			case !flag.value:
+			case len(flag.values) > 0:
+				line += " -x -a " + fishQuote(strings.Join(flag.values, " "))
+			case flag.files:
+				line += " -r -F"
+			default:
+				line += " -x"
+			}
+			fmt.Fprintf(script, "%s -d %s\n", line, fishQuote(flag.usage))
+		}
+	}
+	return script.String()
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// defaultConfigName is picked up from the working dir if -config is not set.
+const defaultConfigName = ".repack.toml"
+
+var errBadConfig = errors.New("bad config")
+
+// configValue is a single top level key from config file.
+// Arrays are expanded into several values, as if the flag was repeated.
+type configValue struct {
+	key    string
+	values []string
+	line   int
+}
+
+// applyConfigFile sets flags from a TOML file. Keys are flag names.
+// Flags set on the command line or by a profile take precedence over the file.
+// Profiles are applied before the file is read, so they can't be set in it.
+func applyConfigFile(flags *flag.FlagSet, filename string) error {
+	file, errFile := os.Open(filename)
+	if errFile != nil {
+		return fmt.Errorf("opening config: %w", errFile)
+	}
+	defer file.Close()
+
+	values, errParse := parseConfig(bufio.NewScanner(file))
+	if errParse != nil {
+		return fmt.Errorf("%s: %w", filename, errParse)
+	}
+
+	setOnCLI := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) { setOnCLI[f.Name] = true })
+
+	for _, value := range values {
+		if value.key == "config" || value.key == "profile" || flags.Lookup(value.key) == nil {
+			return fmt.Errorf("%s:%d: %w: unknown key %q", filename, value.line, errBadConfig, value.key)
+		}
+		if setOnCLI[value.key] {
+			continue
+		}
+		for _, v := range value.values {
+			if err := flags.Set(value.key, v); err != nil {
+				return fmt.Errorf("%s:%d: %w: key %q: %w", filename, value.line, errBadConfig, value.key, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// parseConfig reads a flat subset of TOML: key = value pairs with strings,
+// numbers, booleans and arrays of those. Tables are not supported.
+func parseConfig(scanner *bufio.Scanner) ([]configValue, error) {
+	values := []configValue{}
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			return nil, fmt.Errorf("line %d: %w: tables are not supported", lineNumber, errBadConfig)
+		}
+
+		key, raw, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: %w: expected key = value", lineNumber, errBadConfig)
+		}
+		key = strings.Trim(strings.TrimSpace(key), `"`)
+		raw = strings.TrimSpace(raw)
+
+		// multiline arrays continue until the closing bracket
+		start := lineNumber
+		for strings.HasPrefix(raw, "[") && !arrayClosed(raw) && scanner.Scan() {
+			lineNumber++
+			raw += "\n" + strings.TrimSpace(scanner.Text())
+		}
+
+		parsed, errValue := parseConfigValue(raw)
+		if errValue != nil {
+			return nil, fmt.Errorf("line %d: %w: %w", start, errBadConfig, errValue)
+		}
+		values = append(values, configValue{key: key, values: parsed, line: start})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return values, nil
+}
+
+func arrayClosed(raw string) bool {
+	_, rest, err := scanConfigArray(raw)
+	return err == nil && rest == ""
+}
+
+func parseConfigValue(raw string) ([]string, error) {
+	if strings.HasPrefix(raw, "[") {
+		values, rest, err := scanConfigArray(raw)
+		if err != nil {
+			return nil, err
+		}
+		if rest != "" {
+			return nil, fmt.Errorf("unexpected %q after array", rest)
+		}
+		return values, nil
+	}
+
+	value, rest, err := scanConfigScalar(raw)
+	if err != nil {
+		return nil, err
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("unexpected %q after value", rest)
+	}
+	return []string{value}, nil
+}
+
+func scanConfigArray(raw string) ([]string, string, error) {
+	raw = strings.TrimPrefix(raw, "[")
+	values := []string{}
+	for {
+		raw = trimConfigSpace(raw)
+		if strings.HasPrefix(raw, "]") {
+			return values, trimConfigSpace(raw[1:]), nil
+		}
+		if raw == "" {
+			return nil, "", errors.New("unclosed array")
+		}
+
+		value, rest, err := scanConfigScalar(raw)
+		if err != nil {
+			return nil, "", err
+		}
+		values = append(values, value)
+
+		rest = trimConfigSpace(rest)
+		raw = strings.TrimPrefix(rest, ",")
+		if raw == rest && !strings.HasPrefix(rest, "]") {
+			return nil, "", fmt.Errorf("expected , or ] in array, got %q", rest)
+		}
+	}
+}
+
+// scanConfigScalar reads a single string, number or boolean value from the start of raw.
+func scanConfigScalar(raw string) (string, string, error) {
+	switch {
+	case strings.HasPrefix(raw, `"`):
+		end := 1
+		for end < len(raw) && raw[end] != '"' {
+			if raw[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(raw) {
+			return "", "", errors.New("unclosed string")
+		}
+		value, err := strconv.Unquote(raw[:end+1])
+		return value, trimConfigSpace(raw[end+1:]), err
+	case strings.HasPrefix(raw, "'"):
+		end := strings.IndexByte(raw[1:], '\'')
+		if end < 0 {
+			return "", "", errors.New("unclosed string")
+		}
+		return raw[1 : end+1], trimConfigSpace(raw[end+2:]), nil
+	default:
+		end := strings.IndexAny(raw, ",]# \t\n")
+		if end < 0 {
+			end = len(raw)
+		}
+		value := strings.ReplaceAll(raw[:end], "_", "")
+		if value != "true" && value != "false" {
+			if _, err := strconv.ParseFloat(value, 64); err != nil {
+				return "", "", fmt.Errorf("bad value %q", raw[:end])
+			}
+		}
+		return value, trimConfigSpace(raw[end:]), nil
+	}
+}
+
+// trimConfigSpace skips whitespace, newlines and comments.
+func trimConfigSpace(raw string) string {
+	for {
+		raw = strings.TrimLeft(raw, " \t\n")
+		if !strings.HasPrefix(raw, "#") {
+			return raw
+		}
+		_, rest, ok := strings.Cut(raw, "\n")
+		if !ok {
+			return ""
+		}
+		raw = rest
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	httppprof "net/http/pprof"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"time"
+)
+
+// writeMemProfile writes the heap profile after a GC, so it shows live memory of the run.
+func writeMemProfile(filename string) {
+	file, errCreate := os.Create(filename)
+	if errCreate != nil {
+		slog.Error("writing memory profile", "err", errCreate)
+		return
+	}
+	defer file.Close()
+
+	runtime.GC()
+	if err := pprof.WriteHeapProfile(file); err != nil {
+		slog.Error("writing memory profile", "err", err)
+	}
+}
+
+// servePprof serves net/http/pprof handlers on addr until the returned func is called.
+// Profiles expose internals of the process, addr should be a loopback one.
+func servePprof(addr string) (stop func(), err error) {
+	listener, errListen := net.Listen("tcp", addr)
+	if errListen != nil {
+		return nil, fmt.Errorf("serving pprof: %w", errListen)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", httppprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", httppprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", httppprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", httppprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", httppprof.Trace)
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		err := server.Serve(listener)
+		if !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("serving pprof", "err", err)
+		}
+	}()
+	slog.Info("serving pprof", "url", "http://"+listener.Addr().String()+"/debug/pprof/")
+	return func() { _ = server.Close() }, nil
+}
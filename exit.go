@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+
+	"github.com/ninedraft/audiobook-repack/repack"
+)
+
+// Exit codes, scripts can tell failures apart without parsing messages.
+const (
+	exitFailure = 1 // anything not listed below
+	exitUsage   = 2 // bad flags or arguments, the flag package exits with it too
+	exitNoFiles = 3 // globs matched no files in a book dir
+	exitIO      = 4 // reading sources or writing output failed, or the output won't fit
+	exitVerify  = 5 // archive entries are corrupt or differ from sources
+	exitSkipped = 6 // archive is written, but some files were left out
+	exitDiff    = 7 // diff found added, removed or changed files
+	// exitInterrupted is the code of a shell process killed by SIGINT
+	exitInterrupted = 130
+)
+
+// usageError is a mistake in command line arguments or config.
+type usageError struct{ err error }
+
+func (e usageError) Error() string { return e.err.Error() }
+
+func (e usageError) Unwrap() error { return e.err }
+
+// exitCode maps an error returned by a command to the process exit code.
+func exitCode(err error) int {
+	var (
+		usage      usageError
+		pathErr    *fs.PathError
+		linkErr    *os.LinkError
+		syscallErr *os.SyscallError
+	)
+
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &usage), errors.Is(err, repack.ErrInvalidOptions):
+		return exitUsage
+	case errors.Is(err, context.Canceled):
+		return exitInterrupted
+	case errors.Is(err, repack.ErrNoFilesFound):
+		return exitNoFiles
+	case errors.Is(err, repack.ErrVerifyFailed):
+		return exitVerify
+	case errors.Is(err, repack.ErrFilesSkipped):
+		return exitSkipped
+	case errors.Is(err, repack.ErrDiffFound):
+		return exitDiff
+	case errors.Is(err, repack.ErrNoSpace),
+		errors.As(err, &pathErr), errors.As(err, &linkErr), errors.As(err, &syscallErr):
+		return exitIO
+	default:
+		return exitFailure
+	}
+}
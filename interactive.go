@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+
+	"github.com/ninedraft/audiobook-repack/repack"
+)
+
+// reviewHelp is the first line of the review screen.
+const reviewHelp = "space skip, shift+↑/↓ or K/J move, e rename, p pack, q quit"
+
+// reviewBooks shows discovered files in a full screen list, where files can be skipped,
+// moved within their book and renamed before packing starts. Quitting aborts packing.
+func reviewBooks(books []repack.ReviewBook) error {
+	model := newReviewModel(books)
+	final, errRun := tea.NewProgram(model, tea.WithAltScreen()).Run()
+	if errRun != nil {
+		return fmt.Errorf("interactive review: %w", errRun)
+	}
+	if !final.(*reviewModel).packed {
+		return fmt.Errorf("review quit without packing: %w", context.Canceled)
+	}
+	model.apply()
+	return nil
+}
+
+type reviewItem struct {
+	file repack.ReviewFile
+	name string
+	skip bool
+}
+
+// reviewRow is a line of the list, file is -1 for the header of a book.
+type reviewRow struct {
+	book, file int
+}
+
+type reviewModel struct {
+	books []repack.ReviewBook
+	items [][]reviewItem
+	rows  []reviewRow
+
+	cursor, offset int
+	width, height  int
+
+	// editing is set while the name of the file under cursor is typed into input
+	editing bool
+	input   []rune
+	status  string
+
+	packed bool
+}
+
+func newReviewModel(books []repack.ReviewBook) *reviewModel {
+	m := &reviewModel{books: books, items: make([][]reviewItem, len(books)), height: 24, width: 80}
+	for i, b := range books {
+		m.rows = append(m.rows, reviewRow{book: i, file: -1})
+		for j, file := range b.Files {
+			m.items[i] = append(m.items[i], reviewItem{file: file, name: file.Name})
+			m.rows = append(m.rows, reviewRow{book: i, file: j})
+		}
+	}
+	return m
+}
+
+// apply writes kept files in their order and with their names into books.
+func (m *reviewModel) apply() {
+	for i := range m.books {
+		files := []repack.ReviewFile{}
+		for _, item := range m.items[i] {
+			if item.skip {
+				continue
+			}
+			file := item.file
+			file.Name = item.name
+			files = append(files, file)
+		}
+		m.books[i].Files = files
+	}
+}
+
+func (m *reviewModel) Init() tea.Cmd {
+	return nil
+}
+
+func (m *reviewModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.width, m.height = msg.Width, msg.Height
+	case tea.KeyMsg:
+		if m.editing {
+			m.edit(msg)
+			break
+		}
+		m.status = ""
+		switch msg.String() {
+		case "q", "esc", "ctrl+c":
+			return m, tea.Quit
+		case "p":
+			m.packed = true
+			return m, tea.Quit
+		case "up", "k":
+			m.cursor = max(m.cursor-1, 0)
+		case "down", "j":
+			m.cursor = min(m.cursor+1, len(m.rows)-1)
+		case "pgup":
+			m.cursor = max(m.cursor-m.listHeight(), 0)
+		case "pgdown":
+			m.cursor = min(m.cursor+m.listHeight(), len(m.rows)-1)
+		case "home":
+			m.cursor = 0
+		case "end":
+			m.cursor = len(m.rows) - 1
+		case " ":
+			m.toggle()
+		case "shift+up", "K":
+			m.move(-1)
+		case "shift+down", "J":
+			m.move(1)
+		case "e", "enter":
+			if row := m.rows[m.cursor]; row.file >= 0 {
+				m.editing = true
+				m.input = []rune(m.items[row.book][row.file].name)
+			}
+		}
+	}
+	m.scroll()
+	return m, nil
+}
+
+// edit handles keys while a name is typed.
+func (m *reviewModel) edit(msg tea.KeyMsg) {
+	switch msg.Type {
+	case tea.KeyEnter:
+		name := strings.TrimSpace(string(m.input))
+		if name == "" {
+			m.status = "name can't be empty"
+			return
+		}
+		row := m.rows[m.cursor]
+		m.items[row.book][row.file].name = name
+		m.editing = false
+	case tea.KeyEsc, tea.KeyCtrlC:
+		m.editing = false
+	case tea.KeyBackspace:
+		if len(m.input) > 0 {
+			m.input = m.input[:len(m.input)-1]
+		}
+	case tea.KeyCtrlU:
+		m.input = m.input[:0]
+	case tea.KeyRunes, tea.KeySpace:
+		m.input = append(m.input, msg.Runes...)
+	}
+}
+
+// toggle skips or keeps the file under cursor, on a book header all files of the book.
+func (m *reviewModel) toggle() {
+	row := m.rows[m.cursor]
+	items := m.items[row.book]
+	if row.file >= 0 {
+		items[row.file].skip = !items[row.file].skip
+		return
+	}
+	skip := !items[0].skip
+	for i := range items {
+		items[i].skip = skip
+	}
+}
+
+// move swaps the file under cursor with its neighbour in the book, the cursor follows it.
+func (m *reviewModel) move(delta int) {
+	row := m.rows[m.cursor]
+	target := row.file + delta
+	if row.file < 0 || target < 0 || target >= len(m.items[row.book]) {
+		return
+	}
+	items := m.items[row.book]
+	items[row.file], items[target] = items[target], items[row.file]
+	m.cursor += delta
+}
+
+// listHeight is the number of rows fitting under the help line and above the status line.
+func (m *reviewModel) listHeight() int {
+	return max(m.height-2, 1)
+}
+
+// scroll keeps the cursor within visible rows.
+func (m *reviewModel) scroll() {
+	switch {
+	case m.cursor < m.offset:
+		m.offset = m.cursor
+	case m.cursor >= m.offset+m.listHeight():
+		m.offset = m.cursor - m.listHeight() + 1
+	}
+}
+
+func (m *reviewModel) View() string {
+	view := &strings.Builder{}
+	view.WriteString(m.fit(reviewHelp) + "\n")
+
+	end := min(m.offset+m.listHeight(), len(m.rows))
+	for i := m.offset; i < end; i++ {
+		pointer := "  "
+		if i == m.cursor {
+			pointer = "> "
+		}
+		view.WriteString(m.fit(pointer+m.rowText(m.rows[i])) + "\n")
+	}
+	for i := end - m.offset; i < m.listHeight(); i++ {
+		view.WriteString("\n")
+	}
+
+	switch {
+	case m.editing:
+		view.WriteString(m.fit("name: " + string(m.input) + "█  enter apply, esc cancel, ctrl+u clear"))
+	case m.status != "":
+		view.WriteString(m.fit(m.status))
+	default:
+		view.WriteString(m.fit(m.summary()))
+	}
+	return view.String()
+}
+
+func (m *reviewModel) rowText(row reviewRow) string {
+	items := m.items[row.book]
+	if row.file < 0 {
+		kept := 0
+		for _, item := range items {
+			if !item.skip {
+				kept++
+			}
+		}
+		return fmt.Sprintf("%s (%d of %d files)", m.books[row.book].Dir, kept, len(items))
+	}
+
+	item := items[row.file]
+	mark := "[x]"
+	if item.skip {
+		mark = "[ ]"
+	}
+	return fmt.Sprintf("  %s %s  <- %s", mark, item.name, item.file.Source)
+}
+
+// summary counts kept files and their size.
+func (m *reviewModel) summary() string {
+	files, size := 0, int64(0)
+	for _, items := range m.items {
+		for _, item := range items {
+			if !item.skip {
+				files++
+				size += item.file.Size
+			}
+		}
+	}
+	return fmt.Sprintf("%d files, %.1f MiB to pack", files, float64(size)/(1<<20))
+}
+
+// fit cuts line to the terminal width, wrapped lines would break scrolling.
+func (m *reviewModel) fit(line string) string {
+	runes := []rune(line)
+	if m.width > 0 && len(runes) > m.width {
+		return string(runes[:m.width])
+	}
+	return line
+}
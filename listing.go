@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ninedraft/audiobook-repack/repack"
+)
+
+// entryPrinter writes entries listed by list in one of listFormats.
+type entryPrinter struct {
+	format    string
+	durations bool
+	table     *tabwriter.Writer
+	csv       *csv.Writer
+	json      *json.Encoder
+	// header is written before the first entry
+	header bool
+}
+
+// listedEntry is a JSON line of list, durations are in seconds.
+type listedEntry struct {
+	Name           string   `json:"name"`
+	Size           int64    `json:"size"`
+	CompressedSize int64    `json:"compressedSize,omitempty"`
+	Method         string   `json:"method,omitempty"`
+	CRC32          string   `json:"crc32,omitempty"`
+	Modified       string   `json:"modified,omitempty"`
+	Duration       *float64 `json:"duration,omitempty"`
+	Source         string   `json:"source,omitempty"`
+}
+
+func newEntryPrinter(w io.Writer, format string, durations bool) *entryPrinter {
+	printer := &entryPrinter{format: format, durations: durations}
+	switch format {
+	case "json":
+		printer.json = json.NewEncoder(w)
+	case "csv":
+		printer.csv = csv.NewWriter(w)
+	default:
+		printer.table = tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	}
+	return printer
+}
+
+// fields are columns of the table and CSV, empty for unknown values.
+func (printer *entryPrinter) fields(entry repack.Entry) []string {
+	fields := []string{entry.Name, strconv.FormatInt(entry.Size, 10), "", entry.Method, "", ""}
+	if entry.Method != "" {
+		fields[2] = strconv.FormatInt(entry.CompressedSize, 10)
+		fields[4] = fmt.Sprintf("%08x", entry.CRC32)
+	}
+	if !entry.Modified.IsZero() {
+		fields[5] = entry.Modified.Format(time.DateTime)
+	}
+	if printer.durations {
+		duration := ""
+		if entry.Duration > 0 {
+			duration = entry.Duration.Round(time.Millisecond).String()
+			if printer.format == "csv" {
+				duration = strconv.FormatFloat(entry.Duration.Seconds(), 'f', 3, 64)
+			}
+		}
+		fields = append(fields, duration)
+	}
+	return append(fields, entry.Source)
+}
+
+func (printer *entryPrinter) print(entry repack.Entry) error {
+	switch printer.format {
+	case "json":
+		listed := listedEntry{
+			Name:   entry.Name,
+			Size:   entry.Size,
+			Method: entry.Method,
+			Source: entry.Source,
+		}
+		if entry.Method != "" {
+			listed.CompressedSize = entry.CompressedSize
+			listed.CRC32 = fmt.Sprintf("%08x", entry.CRC32)
+		}
+		if !entry.Modified.IsZero() {
+			listed.Modified = entry.Modified.Format(time.RFC3339)
+		}
+		if printer.durations {
+			seconds := entry.Duration.Seconds()
+			listed.Duration = &seconds
+		}
+		return printer.json.Encode(listed)
+	case "csv":
+		if !printer.header {
+			printer.header = true
+			if err := printer.csv.Write(printer.columns("name", "size", "compressed_size", "method", "crc32", "modified", "duration", "source")); err != nil {
+				return err
+			}
+		}
+		return printer.csv.Write(printer.fields(entry))
+	default:
+		if !printer.header {
+			printer.header = true
+			if err := printer.writeRow(printer.columns("NAME", "SIZE", "PACKED", "METHOD", "CRC32", "MODIFIED", "DURATION", "SOURCE")); err != nil {
+				return err
+			}
+		}
+		fields := printer.fields(entry)
+		for i, field := range fields {
+			if field == "" {
+				fields[i] = "-"
+			}
+		}
+		return printer.writeRow(fields)
+	}
+}
+
+// columns drops the duration column, the next to last, unless durations are listed.
+func (printer *entryPrinter) columns(names ...string) []string {
+	if printer.durations {
+		return names
+	}
+	return append(names[:len(names)-2:len(names)-2], names[len(names)-1])
+}
+
+func (printer *entryPrinter) writeRow(fields []string) error {
+	for i, field := range fields {
+		separator := "\t"
+		if i == len(fields)-1 {
+			separator = "\n"
+		}
+		if _, err := io.WriteString(printer.table, field+separator); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flush writes buffered rows out.
+func (printer *entryPrinter) flush() error {
+	switch {
+	case printer.table != nil:
+		return printer.table.Flush()
+	case printer.csv != nil:
+		printer.csv.Flush()
+		return printer.csv.Error()
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+// logOptions are -log-level and -log-format flags.
+type logOptions struct {
+	level  slog.Level
+	format string
+}
+
+func (opts *logOptions) setLevel(value string) error {
+	return opts.level.UnmarshalText([]byte(value))
+}
+
+func (opts *logOptions) setFormat(value string) error {
+	switch value {
+	case "text", "json":
+		opts.format = value
+		return nil
+	default:
+		return fmt.Errorf("unknown log format %q, want text or json", value)
+	}
+}
+
+// setupLogger makes a logger writing into w the default one.
+func setupLogger(w io.Writer, opts logOptions) {
+	handlerOpts := &slog.HandlerOptions{Level: opts.level}
+	var handler slog.Handler = slog.NewTextHandler(w, handlerOpts)
+	if opts.format == "json" {
+		handler = slog.NewJSONHandler(w, handlerOpts)
+	}
+	slog.SetDefault(slog.New(handler))
+}
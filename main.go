@@ -1,319 +1,751 @@
 package main
 
 import (
-	"archive/zip"
+	"bufio"
+	"context"
 	"embed"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/fs"
-	"log"
+	"log/slog"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime/pprof"
 	"slices"
 	"strconv"
 	"strings"
 	"syscall"
-	"unicode"
+	"time"
 
-	"github.com/vbauerster/mpb/v8"
-	"github.com/vbauerster/mpb/v8/decor"
+	"golang.org/x/text/language"
+
+	"github.com/ninedraft/audiobook-repack/repack"
 )
 
-//go:embed *.go *.mod *.sum *.md
+//go:embed *.go *.mod *.sum *.md repack/*.go
 var sourceCode embed.FS
 
+// commands are subcommands besides the default pack.
+var commands = map[string]func(args []string) error{
+	"list":        list,
+	"verify":      verify,
+	"extract":     extract,
+	"diff":        diff,
+	"merge":       merge,
+	"catalog":     catalog,
+	"serve":       serve,
+	"completion":  completion,
+	"self-update": selfUpdate,
+}
+
 func main() {
-	outputFilename := ""
-	flag.StringVar(&outputFilename, "o", outputFilename, "output zip file")
+	// logs go to stderr, so they don't mix with progress bars and listings on stdout
+	setupLogger(os.Stderr, logOptions{level: slog.LevelInfo, format: "text"})
+
+	err := run(os.Args[1:])
+	switch {
+	case err == nil:
+		return
+	case errors.Is(err, context.Canceled):
+		slog.Warn("interrupted")
+	default:
+		fmt.Fprintf(os.Stderr, "%s: %v\n", filepath.Base(os.Args[0]), err)
+	}
+	os.Exit(exitCode(err))
+}
+
+func run(args []string) error {
+	if len(args) > 0 {
+		if args[0] == "pack" {
+			return pack(args[1:])
+		}
+		if command, ok := commands[args[0]]; ok {
+			return command(args[1:])
+		}
+	}
+
+	// no subcommand means pack, as before subcommands were introduced
+	return pack(args)
+}
+
+func pack(args []string) error {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(),
+			"Usage: %s [pack] <flags> DIR1 DIR2 ...\n       %s list|verify ARCHIVE\n       %s extract ARCHIVE DIR\n       %s diff ARCHIVE DIR|ARCHIVE\n       %s merge <flags> OUTPUT ARCHIVE1 ARCHIVE2 ...\n       %s catalog search TEXT\n       %s serve <flags>\n       %s completion bash|zsh|fish\n       %s self-update <flags>\n\npack flags:\n",
+			os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
+
+	opts := repack.Options{
+		Mode:          0600,
+		Format:        repack.FormatZip,
+		OnCollision:   repack.CollisionFail,
+		UpdateBy:      repack.UpdateByMTime,
+		Covers:        true,
+		MetadataCache: repack.DefaultMetadataCache(),
+		FFmpeg:        "ffmpeg",
+		Workers:       1,
+	}
+
+	flag.StringVar(&opts.Output, "o", opts.Output, "output zip file, - for stdout, s3://BUCKET/KEY or webdav://HOST/PATH URL to upload it while it's written, or dir:PATH to copy files into a dir, e.g. a USB stick, instead of archiving them")
+
+	flag.Func("per-dir-output",
+		"write each book dir into an archive of its own named by Go template instead of -o, e.g. '{{.DirBase}}.zip'. "+
+			"Fields: DirBase, Dir, Index",
+		func(text string) error {
+			tmpl, err := repack.ParseNameTemplate(text)
+			opts.PerDirOutput = tmpl
+			return err
+		})
+
+	flag.Func("output-mode", "permission bits of the output file in octal, default 0600",
+		func(value string) error {
+			mode, err := strconv.ParseUint(value, 8, 32)
+			if err != nil {
+				return fmt.Errorf("parsing octal mode %q: %w", value, err)
+			}
+			if mode&^uint64(fs.ModePerm) != 0 {
+				return fmt.Errorf("mode %q has bits besides permissions", value)
+			}
+			opts.Mode = os.FileMode(mode)
+			return nil
+		})
+
+	flag.Func("format", "output format: zip, tar, tar.gz, m4b (requires ffmpeg, merges all files into one book with chapters), iso (disc image for MP3-CDs) or 7z",
+		func(value string) error {
+			if !slices.Contains(repack.Formats, value) {
+				return fmt.Errorf("unknown format %q", value)
+			}
+			opts.Format = value
+			return nil
+		})
+
+	flag.BoolVar(&opts.Manifest, "manifest", opts.Manifest, "add "+repack.ManifestName+" entry with checksums and source paths of archived files")
+	flag.BoolVar(&opts.Summary, "summary", opts.Summary, "set the zip comment to a summary of packed books: titles, file counts and durations, tool version and pack date")
+	flag.BoolVar(&opts.SummaryEntry, "summary-entry", opts.SummaryEntry, "add the summary of packed books as "+repack.SummaryName+" entry, for any format")
+
+	dryRun := false
+	flag.BoolVar(&dryRun, "dry-run", dryRun, "print planned archive entries and name collisions without writing anything")
+
+	flag.Func("compress",
+		"zip entry compression: store, deflate[:1-9] or zstd[:1-22] for non-audio files (default deflate), "+
+			"or EXT=METHOD to override an extension, e.g. wav=zstd:3. Audio is stored by default. Can be repeated",
+		func(value string) error {
+			if err := repack.ValidateCompression(value); err != nil {
+				return err
+			}
+			opts.Compression = append(opts.Compression, value)
+			return nil
+		})
+
+	flag.Func("split-size", "split output into numbered volumes (book.part01.zip, ...) of at most given size, e.g. 4GB or 700MiB; files are never split",
+		func(value string) error {
+			size, err := repack.ParseSize(value)
+			opts.SplitSize = size
+			return err
+		})
+
+	flag.Func("buffer-size", "size of reads from source files and writes into the output, e.g. 4MiB; larger ones help on NFS and spinning disks (default 1MiB)",
+		func(value string) error {
+			size, err := repack.ParseSize(value)
+			opts.BufferSize = int(size)
+			return err
+		})
+
+	flag.Func("bwlimit", "limit the rate source files are read at while copying, e.g. 20MB/s, so packing from a NAS leaves bandwidth for others",
+		func(value string) error {
+			rate, err := repack.ParseRate(value)
+			opts.BandwidthLimit = rate
+			return err
+		})
+
+	flag.Func("mtime", "entry modification times: source (default) or fixed:DATE for reproducible archives, e.g. fixed:2020-01-01",
+		func(value string) error {
+			t, err := parseMTime(value)
+			opts.FixedTime = t
+			return err
+		})
+
+	flag.Func("name-template",
+		"Go template of entry names, e.g. '{{.DirBase}}/{{printf \"%03d\" .Index}}{{.Ext}}'. "+
+			"Fields: DirBase, RelPath, FlatPath, Name, Ext, Index, Total, Title, Artist, Album, Track, Disc",
+		func(text string) error {
+			tmpl, err := repack.ParseNameTemplate(text)
+			opts.NameTemplate = tmpl
+			return err
+		})
+
+	flag.Func("on-collision", "what to do when several files get the same entry name: fail (default) or suffix to rename them name_2.ext, name_3.ext, ...",
+		func(value string) error {
+			if value != repack.CollisionFail && value != repack.CollisionSuffix {
+				return fmt.Errorf("unknown policy %q, want %s or %s", value, repack.CollisionFail, repack.CollisionSuffix)
+			}
+			opts.OnCollision = value
+			return nil
+		})
+
+	flag.IntVar(&opts.PadNumbers, "pad-numbers", opts.PadNumbers, "zero pad numbers in entry names to N digits (Chapter 1 -> Chapter 001 for N=3), so byte order sorting plays files in order")
+
+	flag.BoolVar(&opts.Update, "update", opts.Update, "update existing zip output: copy entries of unchanged files as is and write only new or changed ones")
+
+	flag.Func("update-by", "how -update detects changed files: mtime (default, size and modification time) or hash (size and CRC-32)",
+		func(value string) error {
+			if value != repack.UpdateByMTime && value != repack.UpdateByHash {
+				return fmt.Errorf("unknown mode %q, want %s or %s", value, repack.UpdateByMTime, repack.UpdateByHash)
+			}
+			opts.UpdateBy = value
+			return nil
+		})
+
+	flag.BoolVar(&opts.Resume, "resume", opts.Resume,
+		"journal written entries in OUTPUT.state and keep the incomplete output when interrupted, so a rerun with the same flags copies entries of unchanged files instead of repacking them")
+
+	flag.BoolVar(&opts.IncludeHidden, "include-hidden", opts.IncludeHidden, "pack dotfiles and system files and dirs like Thumbs.db, desktop.ini or Synology @eaDir, which are skipped by default")
+
+	interactive := false
+	flag.BoolVar(&interactive, "interactive", interactive, "review discovered files in a full screen list before packing: skip files, move them within books and rename entries")
+
+	watch := false
+	flag.BoolVar(&watch, "watch", watch, "keep running and repack when files under book dirs change, combine with -update to write only new files")
+	watchDelay := defaultWatchDelay
+	flag.DurationVar(&watchDelay, "watch-delay", watchDelay, "how long -watch waits for changes to settle before repacking")
+
+	flag.BoolVar(&opts.KeepDirs, "keep-dirs", opts.KeepDirs, "keep directory structure of books (Book/Disc 1/01.mp3) instead of flattening paths")
+
+	flag.BoolVar(&opts.Reproducible, "reproducible", opts.Reproducible,
+		"byte-identical output for the same inputs: fixed timestamps (unless -mtime fixed:DATE is set) and no OS-specific zip extra fields")
+
+	encrypt := false
+	flag.BoolVar(&encrypt, "encrypt", encrypt, "encrypt zip entries with AES-256, the password is asked on the terminal unless -passfile is set; entry names stay visible, source paths aren't recorded")
+	passfile := ""
+	flag.StringVar(&passfile, "passfile", passfile, "read -encrypt password from the first line of file")
 
 	printSourceCode := false
 	flag.BoolVar(&printSourceCode, "sauce", printSourceCode, "print source code")
 
-	fileGlobs := []string{"*.mp3"}
+	printVersion := false
+	flag.BoolVar(&printVersion, "version", printVersion, "print version, commit, build date and Go version of the tool")
+
 	flag.Func("g",
-		"file globs to append int output archive. Default values: "+strings.Join(fileGlobs, ", "),
+		"glob of files to pack, can be repeated; replaces defaults, which match audio files in any case: "+strings.Join(repack.DefaultGlobs, ", ")+
+			"; m4b output reads durations of "+strings.Join(repack.DefaultM4BGlobs, ", ")+" only and packs them by default",
 		func(pattern string) error {
-			_, err := filepath.Match(pattern, "")
+			err := repack.ValidateGlob(pattern)
 			if err != nil {
 				return err
 			}
 
-			fileGlobs = append(fileGlobs, pattern)
+			opts.Globs = append(opts.Globs, pattern)
 			return nil
 		})
 
-	done := func() {}
-	flag.Func("cpu-profile", "enable pprof for CPU and write to specified file",
+	flag.BoolVar(&opts.GlobsIgnoreCase, "iglob", opts.GlobsIgnoreCase, "match -g and -x globs ignoring case of names, so *.mp3 matches 01.MP3 too")
+
+	flag.Func("order-by-duration",
+		"order files by duration (asc or desc) and rename entries to sequential NN.ext",
+		func(order string) error {
+			if order != "asc" && order != "desc" {
+				return fmt.Errorf("unknown order %q: want asc or desc", order)
+			}
+			opts.OrderByDuration = order
+			return nil
+		})
+
+	flag.Func("sort-locale", "collate file names by rules of a language, e.g. ru or de, instead of byte order of letters; numbers are compared by value either way",
+		func(locale string) error {
+			if _, err := language.Parse(locale); err != nil {
+				return err
+			}
+			opts.SortLocale = locale
+			return nil
+		})
+	flag.BoolVar(&opts.SortIgnoreCase, "sort-ignore-case", opts.SortIgnoreCase, "compare letters of file names regardless of case while sorting")
+	flag.Func("sort", "key files of each book are ordered by: track (default, ID3 disc and track numbers, then names), name, mtime or size",
+		func(key string) error {
+			if !slices.Contains(repack.SortKeys, key) {
+				return fmt.Errorf("unknown sort key %q, want one of %s", key, strings.Join(repack.SortKeys, ", "))
+			}
+			opts.SortBy = key
+			return nil
+		})
+	flag.Func("sanitize-names", "make entry names extractable on a filesystem: fat32, ntfs or posix; illegal characters like :?*\"<>| are replaced with _, names are shortened to fit length limits",
+		func(target string) error {
+			if !slices.Contains(repack.SanitizeTargets, target) {
+				return fmt.Errorf("unknown filesystem %q, want one of %s", target, strings.Join(repack.SanitizeTargets, ", "))
+			}
+			opts.SanitizeNames = target
+			return nil
+		})
+	flag.Func("normalize-names", "bring entry names to a Unicode normalization form: nfc (composed, like most systems), nfd (decomposed, like macOS), nfkc or nfkd",
+		func(form string) error {
+			if !slices.Contains(repack.NormalizationForms, form) {
+				return fmt.Errorf("unknown normalization form %q, want one of %s", form, strings.Join(repack.NormalizationForms, ", "))
+			}
+			opts.NormalizeNames = form
+			return nil
+		})
+	flag.BoolVar(&opts.Transliterate, "transliterate", opts.Transliterate, "romanize Cyrillic letters and strip diacritics in entry names (Глава 1 -> Glava 1, Café -> Cafe) for players which show only ASCII")
+	flag.Func("symlinks", "what to do with symbolic links to files and dirs of books: error (default) on links to matched files, dir links are left out then, skip or follow them",
+		func(policy string) error {
+			if !slices.Contains(repack.SymlinkPolicies, policy) {
+				return fmt.Errorf("unknown symlink policy %q, want one of %s", policy, strings.Join(repack.SymlinkPolicies, ", "))
+			}
+			opts.Symlinks = policy
+			return nil
+		})
+	flag.IntVar(&opts.FolderFiles, "folder-files", opts.FolderFiles, "put files of each book into a folder named after it, books of more than N files into several folders BOOK - 01, BOOK - 02, ...; 0 keeps entries where they are")
+	flag.IntVar(&opts.NameLength, "name-length", opts.NameLength, "shorten file and folder names of entries to N characters keeping extensions, 0 means no limit")
+	flag.BoolVar(&opts.WarnIncompatible, "warn-incompatible", opts.WarnIncompatible, "warn about audio files which aren't constant bitrate MP3, the only audio many car stereos play")
+	flag.BoolVar(&opts.RenumberDiscs, "renumber-discs", opts.RenumberDiscs, "name files of books split into disc subdirs (CD1, Disc 02, ...) NN - NAME.ext numbered across discs, combine with -fix-tags to number tracks the same way")
+	flag.BoolVar(&opts.Reverse, "reverse", opts.Reverse, "reverse the order of files of each book, e.g. -sort mtime -reverse packs the newest first")
+	flag.BoolVar(&opts.SortRoman, "sort-roman", opts.SortRoman, "order uppercase Roman numerals in file names, like Chapter IV or Part_XII, by value among Arabic numbers")
+
+	listedDirs := []string{}
+	flag.Func("dirs-from",
+		"read newline separated book dirs from file, relative paths are resolved against the file's dir",
 		func(filename string) error {
-			f, err := os.Create(filename)
+			dirs, err := readPathList(filename)
 			if err != nil {
 				return err
 			}
-			done = func() {
-				pprof.StopCPUProfile()
-				_ = f.Close()
+			listedDirs = append(listedDirs, dirs...)
+			return nil
+		})
+
+	flag.Func("files-from",
+		"read newline separated files from file, - for stdin, and pack them without searching dirs; "+
+			"files are grouped into books by their dirs, -g and -x don't apply",
+		func(filename string) error {
+			files, err := readPathList(filename)
+			if err != nil {
+				return err
 			}
-			return pprof.StartCPUProfile(f)
+			opts.Files = append(opts.Files, files...)
+			return nil
 		})
 
-	flag.Parse()
+	flag.BoolVar(&opts.Dedup, "dedup", opts.Dedup,
+		"leave out files byte-identical to an earlier file of any book, found by size and SHA-256; they are listed in the report and noted in -manifest")
 
-	defer done()
+	flag.BoolVar(&opts.BookDividers, "book-dividers", opts.BookDividers, "add a marker entry named after the book before its files")
 
-	if printSourceCode {
-		sauce()
-		return
-	}
+	flag.BoolVar(&opts.Playlists, "playlists", opts.Playlists, "add BOOK.m3u8 playlist of audio entries in playback order after each book")
 
-	dirs := flag.Args()
+	flag.StringVar(&opts.ReportFile, "report", opts.ReportFile, "write JSON summary of the run with per-book and per-file sizes and durations into file")
+	flag.Func("notify", "send the run summary when packing finishes or fails: desktop for a desktop notification or webhook:URL to POST it as JSON, can be repeated",
+		func(target string) error {
+			if err := repack.ValidateNotify(target); err != nil {
+				return err
+			}
+			opts.Notify = append(opts.Notify, target)
+			return nil
+		})
+	flag.StringVar(&opts.PreHook, "pre-hook", opts.PreHook, "shell command run before packing, REPACK_DIRS lists book dirs a line each; a failure aborts packing")
+	flag.StringVar(&opts.PostHook, "post-hook", opts.PostHook, "shell command run after outputs are written, with REPACK_OUTPUTS, REPACK_BOOKS, REPACK_FILES, REPACK_BYTES and REPACK_DURATION")
+	flag.StringVar(&opts.PreBookHook, "pre-book-hook", opts.PreBookHook, "shell command run before files of each book are written, with REPACK_DIR, REPACK_TITLE and REPACK_FILES")
+	flag.StringVar(&opts.PostBookHook, "post-book-hook", opts.PostBookHook, "shell command run for each book after the output is written, with REPACK_DIR, REPACK_TITLE, REPACK_FILES, REPACK_BYTES and REPACK_DURATION")
+	flag.StringVar(&opts.Catalog, "catalog", opts.Catalog, "record packed books, checksums of their files, the output and date into SQLite catalog file, catalog search reads "+repack.DefaultCatalog()+" by default")
+
+	flag.BoolVar(&opts.CueSheets, "cue-sheets", opts.CueSheets,
+		"add BOOK.cue with a track per audio file after each book, tracks of -merge-per-book files are indexed by their offsets")
+
+	flag.BoolVar(&opts.BookMetadata, "book-metadata", opts.BookMetadata,
+		"add Audiobookshelf compatible "+repack.MetadataName+" with title, authors, narrators and chapters from ID3 tags after each book")
+
+	flag.BoolVar(&opts.Verify, "verify", opts.Verify, "after packing reopen the archive and compare size and CRC of every entry with its source file")
+	flag.BoolVar(&opts.VerifyHash, "verify-hash", opts.VerifyHash, "like -verify, also compare SHA-256 checksums")
+
+	flag.BoolVar(&opts.VerifySize, "verify-size", opts.VerifySize, "fail if copied size of a file differs from its size when opened")
+
+	flag.Func("bars", "progress bars below the total one: file (default) for books and files, dir for books only, none",
+		func(value string) error {
+			switch value {
+			case repack.BarsFile, repack.BarsDir, repack.BarsNone:
+				opts.Bars = value
+				return nil
+			default:
+				return fmt.Errorf("unknown bars %q, want file, dir or none", value)
+			}
+		})
 
-	if len(dirs) == 0 {
-		panic("at least one book dir must be defined")
-	}
+	flag.IntVar(&opts.MaxBars, "max-bars", opts.MaxBars, "display at most N per-file progress bars at once, completed ones are removed and files waiting for a bar get their slots, 0 means unlimited")
 
-	output, errOutput := os.OpenFile(outputFilename, os.O_CREATE|os.O_WRONLY|syscall.O_NOFOLLOW, 0600)
-	if errOutput != nil {
-		panic("creating output archive: " + errOutput.Error())
-	}
-	defer output.Close()
+	flag.BoolVar(&opts.Covers, "covers", opts.Covers, "add cover images of book dirs, see -cover-glob")
 
-	archive := zip.NewWriter(output)
-	defer archive.Close()
+	flag.Func("cover-glob",
+		"case-insensitive glob of cover images in the root of book dirs, in order of preference; replaces defaults: "+strings.Join(repack.DefaultCoverGlobs, ", "),
+		func(pattern string) error {
+			if err := repack.ValidateGlob(pattern); err != nil {
+				return err
+			}
+			opts.CoverGlobs = append(opts.CoverGlobs, pattern)
+			return nil
+		})
 
-	p := newProcessor()
+	flag.BoolVar(&opts.FixTags, "fix-tags", opts.FixTags,
+		"rewrite ID3 tags of MP3 files: album from the book dir name, the most common artist as album artist, "+
+			"tracks numbered across discs, comments removed")
 
-	if err := p.process(archive, dirs, fileGlobs); err != nil {
-		panic("processing dirs: " + err.Error())
-	}
-}
+	flag.BoolVar(&opts.FetchMetadata, "fetch-metadata", opts.FetchMetadata,
+		"look books up in Google Books by 'Author - Title' dir names and use title, authors and cover for -fix-tags, "+
+			"missing covers and -book-metadata; results are cached")
+	flag.StringVar(&opts.MetadataCache, "metadata-cache", opts.MetadataCache, "dir of cached -fetch-metadata results and covers")
 
-type fileRecord struct {
-	path, name string
-}
+	flag.BoolVar(&opts.EmbedCover, "embed-cover", opts.EmbedCover, "embed book cover into ID3 tags of MP3 files without a picture")
+
+	flag.BoolVar(&opts.SharedCover, "shared-cover", opts.SharedCover, "add cover image from the parent dir to books without their own cover")
+
+	flag.DurationVar(&opts.Gap, "gap", opts.Gap, "insert a silent mp3 track of given duration between books, e.g. 3s")
+
+	flag.Func("validate-audio",
+		"check MP3 frames and MP4 boxes of audio files before packing: warn to pack corrupt files anyway, "+
+			"skip to leave them out and report at the end, fail to abort",
+		func(mode string) error {
+			switch mode {
+			case repack.ValidateWarn, repack.ValidateSkip, repack.ValidateFail:
+				opts.ValidateAudio = mode
+				return nil
+			default:
+				return fmt.Errorf("unknown mode %q, want warn, skip or fail", mode)
+			}
+		})
+
+	flag.BoolVar(&opts.MergePerBook, "merge-per-book", opts.MergePerBook,
+		"concatenate MP3 files of each book into a single BOOK.mp3 with ID3v2 chapters (CHAP/CTOC) named after the files, "+
+			"files must have the same MPEG version, sample rate and channels")
+
+	flag.StringVar(&opts.FFmpeg, "ffmpeg", opts.FFmpeg, "ffmpeg binary used by -transcode, -normalize and m4b format, looked up in PATH if it's not a path")
+
+	flag.Func("transcode",
+		"re-encode audio files with ffmpeg as CODEC[:BITRATE] before packing, entries get the codec extension. "+
+			"Codecs: opus (default 32k), mp3 (64k), aac (64k), e.g. opus:24k",
+		func(value string) error {
+			opts.Transcode = value
+			return repack.ValidateTranscode(value)
+		})
+	flag.Func("normalize",
+		"normalize loudness of audio files with two-pass ffmpeg loudnorm filter: ebur128[:TARGET], default target is -18LUFS. "+
+			"Files are re-encoded with their own codec at its -transcode default bitrate, unless -transcode is set",
+		func(value string) error {
+			loudness, err := repack.ParseNormalize(value)
+			opts.Normalize = loudness
+			return err
+		})
+
+	flag.BoolVar(&opts.Force, "force", opts.Force, "pack even if the estimated output size exceeds free space of the output filesystem")
+	flag.BoolVar(&opts.KeepGoing, "keep-going", opts.KeepGoing, "skip files and book dirs which can't be read and list them in the summary instead of aborting, exit code is 6; a file failing mid-copy is skipped only with dir: and iso outputs, zip, tar and 7z can't drop a started entry and abort")
+
+	flag.BoolVar(&opts.VerifyOnClose, "verify-on-close", opts.VerifyOnClose, "check CRC of each entry recorded by archive against data copied from source")
 
-var flattenPath = strings.NewReplacer(
-	string([]rune{filepath.Separator}), "_",
-).Replace
+	flag.IntVar(&opts.Workers, "j", opts.Workers, "number of dirs to scan and, for zip output, of compressed files to pack in parallel, entries are still written to archive in order")
 
-var errNoFilesFound = errors.New("no files found")
+	flag.IntVar(&opts.MaxFiles, "max-files", opts.MaxFiles, "abort before copying if dirs contain more than N files in total, 0 means unlimited")
 
-func searchRecords(dir string, fsys fs.FS, fileGlobs []string) ([]fileRecord, error) {
-	found := []fileRecord{}
+	flag.Func("min-size", "leave out files matched by -g smaller than size, e.g. 1 for empty placeholders or 100KiB",
+		func(value string) error {
+			size, err := repack.ParseSize(value)
+			opts.MinSize = size
+			return err
+		})
 
-	errWalk := fs.WalkDir(fsys, ".",
-		func(path string, d fs.DirEntry, err error) error {
-			if err != nil || d.IsDir() {
+	flag.Func("max-size", "leave out files matched by -g larger than size, e.g. 500MiB for stray videos",
+		func(value string) error {
+			size, err := repack.ParseSize(value)
+			opts.MaxSize = size
+			return err
+		})
+
+	flag.DurationVar(&opts.MinDuration, "min-duration", opts.MinDuration, "leave out MP3 and MP4 audio files shorter than duration, e.g. 5s for jingles; durations of other formats aren't read")
+
+	flag.Func("x",
+		"exclude files matching glob, applied after -g to relative path and file name, can be repeated",
+		func(pattern string) error {
+			err := repack.ValidateGlob(pattern)
+			if err != nil {
 				return err
 			}
 
-			for _, pattern := range fileGlobs {
-				ok, _ := filepath.Match(pattern, path)
-				if ok {
-					name := sanitizeDirPrefix(dir) + flattenPath(path)
-					log.Printf("found file %q -> %q", path, name)
-					found = append(found, fileRecord{
-						name: name,
-						path: filepath.Join(dir, path),
-					})
-					return nil
-				}
+			opts.Exclude = append(opts.Exclude, pattern)
+			return nil
+		})
+
+	quiet := false
+	flag.BoolVar(&quiet, "quiet", quiet, "hide progress bars and lines, the summary is still logged")
+
+	progressMode := ""
+	flag.Func("progress",
+		"progress output: bars (default on a terminal), plain lines every 10s (default otherwise) "+
+			"or json lines with an event per book and file start, progress tick and completion",
+		func(mode string) error {
+			switch mode {
+			case progressBars, progressPlain, progressJSON:
+				progressMode = mode
+				return nil
+			default:
+				return fmt.Errorf("unknown progress output %q, want bars, plain or json", mode)
+			}
+		})
+	progressFD := 1
+	flag.IntVar(&progressFD, "progress-fd", progressFD, "file descriptor plain and json progress is written into, e.g. 3 for a pipe of a wrapper")
+
+	logging := logOptions{level: slog.LevelInfo, format: "text"}
+	flag.Func("log-level", "minimal level of logged messages: debug, info (default), warn or error; debug lists every found file",
+		logging.setLevel)
+	flag.Func("log-format", "format of log lines on stderr: text (default) or json", logging.setFormat)
+
+	done := func() {}
+	flag.Func("cpu-profile", "enable pprof for CPU and write to specified file",
+		func(filename string) error {
+			f, err := os.Create(filename)
+			if err != nil {
+				return err
+			}
+			done = func() {
+				pprof.StopCPUProfile()
+				_ = f.Close()
+			}
+			return pprof.StartCPUProfile(f)
+		})
+	memProfile := ""
+	flag.StringVar(&memProfile, "mem-profile", memProfile, "write heap profile to specified file when the run ends")
+	pprofAddr := ""
+	flag.StringVar(&pprofAddr, "pprof-addr", pprofAddr, "serve net/http/pprof on address during the run, e.g. localhost:6060")
+
+	configFile := ""
+	flag.StringVar(&configFile, "config", configFile,
+		"read flags from TOML file, keys are flag names, command line flags take precedence. Default: "+defaultConfigName+" in working dir, if exists")
+
+	flag.Func("profile", "preset of flags, command line flags override or extend it, available: "+profileNames(),
+		func(name string) error {
+			// applied before parsing, see profileFromArgs
+			if _, ok := profiles[name]; !ok {
+				return fmt.Errorf("%w %q", errUnknownProfile, name)
 			}
 			return nil
 		})
-	if errWalk != nil {
-		return nil, fmt.Errorf("walking dir: %w", errWalk)
-	}
 
-	if len(found) == 0 {
-		return nil, errNoFilesFound
+	if name := profileFromArgs(args); name != "" {
+		if err := applyProfile(flag.CommandLine, name); err != nil {
+			return usageError{err}
+		}
 	}
 
-	return found, nil
-}
+	_ = flag.CommandLine.Parse(args)
 
-func sortFileRecords(records []fileRecord) {
-	slices.SortStableFunc(records, func(a, b fileRecord) int {
-		if a == b {
-			return 0
+	if configFile == "" {
+		if _, err := os.Stat(defaultConfigName); err == nil {
+			configFile = defaultConfigName
 		}
-		if naturalLess(a.name, b.name) {
-			return -1
+	}
+	if configFile != "" {
+		if err := applyConfigFile(flag.CommandLine, configFile); err != nil {
+			return usageError{fmt.Errorf("loading config: %w", err)}
 		}
-		return 1
-	})
-
-}
+	}
 
-type processor struct {
-	bar *mpb.Progress
-}
+	setupLogger(os.Stderr, logging)
 
-func newProcessor() *processor {
-	return &processor{
-		bar: mpb.New(),
+	if printVersion {
+		fmt.Println(repack.BuildInfo())
+		return nil
 	}
-}
 
-func (p *processor) process(archive *zip.Writer, dirs, fileGlobs []string) error {
-	for _, dir := range dirs {
-		if err := p.processDir(archive, dir, fileGlobs); err != nil {
-			return fmt.Errorf("dir %q: %w", dir, err)
+	defer done()
+	if memProfile != "" {
+		defer writeMemProfile(memProfile)
+	}
+	if pprofAddr != "" {
+		stopPprof, err := servePprof(pprofAddr)
+		if err != nil {
+			return err
 		}
+		defer stopPprof()
 	}
 
-	p.bar.Wait()
+	if printSourceCode {
+		return sauce()
+	}
 
-	return nil
-}
+	dirs := append(flag.Args(), listedDirs...)
 
-func (p *processor) processDir(archive *zip.Writer, dir string, fileGlobs []string) error {
-	fsys := os.DirFS(dir)
-	found, errFind := searchRecords(dir, fsys, fileGlobs)
-	if errFind != nil {
-		return fmt.Errorf("searching files: %w", errFind)
+	if len(dirs) == 0 && len(opts.Files) == 0 {
+		return usageError{errors.New("at least one book dir or -files-from list must be defined")}
 	}
 
-	sortFileRecords(found)
-
-	bar := p.bar.AddBar(int64(len(found)),
-		mpb.PrependDecorators(
-			decor.Name(dir),
-			decor.Percentage(decor.WCSyncSpace),
-			decor.OnComplete(
-				decor.Spinner(nil, decor.WCSyncSpace), "done",
-			),
-		),
-	)
-
-	for _, record := range found {
-		wr, errCreate := archive.CreateHeader(&zip.FileHeader{
-			Name:    record.name,
-			Comment: record.path,
-		})
-		if errCreate != nil {
-			return fmt.Errorf("creating zip file record: %w", errCreate)
+	if opts.Output == repack.StdoutOutput {
+		if err := checkStdoutOutput(); err != nil {
+			return err
+		}
+		if watch {
+			return usageError{errors.New("-watch can't write into stdout, each run would append an archive")}
 		}
+	}
 
-		if err := p.copyFileTo(wr, record.path); err != nil {
-			return fmt.Errorf("writing file to archive: %w", err)
+	if encrypt {
+		password, err := readPassword(passfile, true)
+		if err != nil {
+			return err
 		}
-		bar.Increment()
+		opts.Password = password
+	} else if passfile != "" {
+		return usageError{errors.New("-passfile requires -encrypt")}
 	}
 
-	return nil
-}
+	ctx, stop := interruptContext()
+	defer stop()
+
+	progress, errProgress := newProgressOutput(progressMode, progressFD, quiet, &opts)
+	if errProgress != nil {
+		return usageError{errProgress}
+	}
 
-func (p *processor) copyFileTo(dst io.Writer, filename string) error {
-	file, errFile := os.OpenFile(filename, os.O_RDONLY|syscall.O_NOFOLLOW, 0600)
-	if errFile != nil {
-		return fmt.Errorf("unable to open file %q: %w", filename, errFile)
+	if interactive {
+		if watch {
+			return usageError{errors.New("-interactive can't be used with -watch")}
+		}
+		if !isTerminal(os.Stdin) || !isTerminal(os.Stdout) {
+			return usageError{errors.New("-interactive requires a terminal")}
+		}
+		opts.Hooks.Review = reviewBooks
 	}
-	defer file.Close()
 
-	info, errInfo := file.Stat()
-	if errInfo != nil {
-		return fmt.Errorf("unable to open file %q: %w", filename, errFile)
+	packer, errNew := repack.New(opts)
+	if errNew != nil {
+		return errNew
 	}
 
-	bar := p.bar.AddBar(info.Size(),
-		mpb.PrependDecorators(
-			decor.Name(file.Name()),
-			decor.Counters(decor.SizeB1024(0), " % .1f / % .1f"),
-			decor.Percentage(decor.WCSyncSpace),
-		))
+	if dryRun {
+		if watch {
+			return usageError{errors.New("-watch can't be used with -dry-run")}
+		}
+		if err := packer.Plan(ctx, os.Stdout, dirs); err != nil {
+			return fmt.Errorf("planning archive: %w", err)
+		}
+		return nil
+	}
 
-	progress := bar.ProxyWriter(dst)
-	defer progress.Close()
+	pack := func(ctx context.Context) error {
+		if packer == nil {
+			var errNew error
+			if packer, errNew = repack.New(opts); errNew != nil {
+				return errNew
+			}
+		}
+		// a Packer is good for a single run, -watch makes a new one for the next
+		defer func() { packer = nil }()
 
-	_, errCopy := io.Copy(progress, file)
-	if errCopy != nil {
-		return fmt.Errorf("unable to write file %q: %w", filename, errCopy)
+		stopProgress := progress.start(ctx)
+		errPack := packer.Pack(ctx, dirs)
+		stopProgress(errPack)
+		return errPack
+	}
+	if !watch {
+		return pack(ctx)
 	}
 
-	bar.Wait()
+	ignored := []string{opts.Output, volumePrefix(opts.Output), opts.ReportFile}
+	if dir, ok := repack.DirOutput(opts.Output); ok {
+		ignored = append(ignored, dir)
+	}
+	return watchAndPack(ctx, watchedDirs(dirs, opts.Files), watchDelay, ignored, pack)
+}
 
+// checkStdoutOutput refuses to write an archive into a terminal, -o - is for pipes.
+func checkStdoutOutput() error {
+	if isTerminal(os.Stdout) {
+		return usageError{errors.New("refusing to write archive into a terminal, pipe or redirect stdout")}
+	}
 	return nil
 }
 
-// MIT License
-// Copyright (c) 2013 Dan Kirkwood
-// https://github.com/dangogh/naturally
-func naturalLess(strA, strB string) bool {
-	for {
-		// get chars up to 1st digit
-		posA := strings.IndexFunc(strA, unicode.IsDigit)
-		posB := strings.IndexFunc(strB, unicode.IsDigit)
-
-		if posA == -1 {
-			// no digits in A
-			if posB == -1 {
-				// or B -- straight string compare
-				return strA < strB
-			}
-			return false // B is Less
-		} else if posB == -1 {
-			return true // A is Less
-		}
-		subA, subB := strA[:posA], strB[:posB]
-		if subA != subB {
-			return subA < subB
-		}
-		strA, strB = strA[posA:], strB[posB:]
-
-		// get chars up to 1st non-digit
-		posA = strings.IndexFunc(strA, isNonDigit)
-		posB = strings.IndexFunc(strB, isNonDigit)
-		if posA == -1 {
-			// no non-digits in A - allow numeric compare
-			//fmt.Println(posA, " pos in ", strA)
-			posA = len(strA)
-		}
-		if posB == -1 {
-			// no non-digits in B - allow numeric compare
-			posB = len(strB)
+// watchedDirs are book dirs and dirs of listed files.
+func watchedDirs(dirs, files []string) []string {
+	watched := slices.Clone(dirs)
+	for _, file := range files {
+		if dir := filepath.Dir(file); !slices.Contains(watched, dir) {
+			watched = append(watched, dir)
 		}
+	}
+	return watched
+}
 
-		// grab numeric part of each
-		valA, err := strconv.Atoi(strA[:posA])
-		if err != nil {
-			panic(fmt.Sprintf("Can't convert %s to a number", strA[:posA]))
-		}
-		valB, err := strconv.Atoi(strB[:posB])
-		if err != nil {
-			panic(fmt.Sprintf("Can't convert %s to a number", strA[:posA]))
-		}
-		if valA != valB {
-			return valA < valB
-		}
-		if posA != posB {
-			return posA < posB
-		}
-		if posA >= len(strA) || posB >= len(strB) {
-			// should only happen if strings equal
-			return true
-		}
-		strA, strB = strA[posA:], strB[posB:]
+// volumePrefix is the common prefix of -split-size volumes of output, book.zip -> book.part.
+func volumePrefix(output string) string {
+	if output == "" {
+		return ""
 	}
+	return strings.TrimSuffix(output, filepath.Ext(output)) + ".part"
 }
 
-func isNonDigit(ch rune) bool {
-	return !unicode.IsDigit(ch)
+// interruptContext is canceled by SIGINT or SIGTERM, the next signal kills the process right away.
+func interruptContext() (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	return ctx, stop
 }
 
-func sanitizeDirPrefix(dir string) string {
-	dir = filepath.Base(dir)
-	dir = filepath.Clean(dir)
-	if dir == "." {
-		return ""
+// parseMTime parses -mtime value, zero time means source mtimes.
+// Fixed dates are RFC 3339 timestamps or plain dates in UTC.
+func parseMTime(value string) (time.Time, error) {
+	if value == "source" {
+		return time.Time{}, nil
 	}
 
-	return dir + "_"
+	date, ok := strings.CutPrefix(value, "fixed:")
+	if !ok {
+		return time.Time{}, fmt.Errorf("unknown mtime mode %q, want source or fixed:DATE", value)
+	}
+
+	for _, layout := range []string{time.DateOnly, time.DateTime, time.RFC3339} {
+		if t, err := time.ParseInLocation(layout, date, time.UTC); err == nil {
+			return t.UTC(), nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("bad fixed date %q, want YYYY-MM-DD or RFC 3339", date)
+}
+
+// readPathList reads paths from a text file, one per line, "-" reads stdin.
+// Blank lines and lines starting with # are skipped.
+// Relative paths are resolved against the dir containing the list file,
+// paths read from stdin are kept relative to the working dir.
+func readPathList(filename string) ([]string, error) {
+	src, base := io.Reader(os.Stdin), ""
+	if filename != "-" {
+		file, errFile := os.Open(filename)
+		if errFile != nil {
+			return nil, fmt.Errorf("opening list: %w", errFile)
+		}
+		defer file.Close()
+		src, base = file, filepath.Dir(filename)
+	}
+
+	paths := []string{}
+	scanner := bufio.NewScanner(src)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if base != "" && !filepath.IsAbs(line) {
+			line = filepath.Join(base, line)
+		}
+		paths = append(paths, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading list %q: %w", filename, err)
+	}
+
+	return paths, nil
 }
 
-func sauce() {
+func sauce() error {
 	err := fs.WalkDir(sourceCode, ".", func(path string, d fs.DirEntry, err error) error {
 		if err != nil || d.IsDir() {
 			return err
@@ -334,6 +766,7 @@ func sauce() {
 		return nil
 	})
 	if err != nil {
-		panic("print souce code: " + err.Error())
+		return fmt.Errorf("printing source code: %w", err)
 	}
+	return nil
 }
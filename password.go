@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/term"
+
+	"github.com/ninedraft/audiobook-repack/repack"
+)
+
+// readPassword takes the password from the first line of passfile, or asks for it on the terminal
+// if passfile is empty. With confirm it's asked twice, a typo would lock the archive for good.
+func readPassword(passfile string, confirm bool) ([]byte, error) {
+	if passfile != "" {
+		return readPassfile(passfile)
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return nil, usageError{errors.New("stdin is not a terminal to ask for a password, use -passfile")}
+	}
+
+	password, errPrompt := promptPassword("Password: ")
+	if errPrompt != nil {
+		return nil, errPrompt
+	}
+	if len(password) == 0 {
+		return nil, usageError{errors.New("empty password")}
+	}
+	if confirm {
+		again, err := promptPassword("Repeat password: ")
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(password, again) {
+			return nil, usageError{errors.New("passwords don't match")}
+		}
+	}
+	return password, nil
+}
+
+// promptPassword reads a line from the terminal without echoing it, the prompt goes into stderr.
+func promptPassword(prompt string) ([]byte, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	defer fmt.Fprintln(os.Stderr)
+	password, err := term.ReadPassword(int(os.Stdin.Fd()))
+	if err != nil {
+		return nil, fmt.Errorf("reading password: %w", err)
+	}
+	return password, nil
+}
+
+// readPassfile returns the first line of file without the line break, the rest is ignored.
+func readPassfile(filename string) ([]byte, error) {
+	file, errOpen := os.Open(filename)
+	if errOpen != nil {
+		return nil, fmt.Errorf("reading passfile: %w", errOpen)
+	}
+	defer file.Close()
+
+	line, errRead := bufio.NewReader(file).ReadBytes('\n')
+	line = bytes.TrimRight(line, "\r\n")
+	if len(line) == 0 {
+		if errRead != nil && !errors.Is(errRead, io.EOF) {
+			return nil, fmt.Errorf("reading passfile: %w", errRead)
+		}
+		return nil, usageError{fmt.Errorf("passfile %s has an empty first line", filename)}
+	}
+	return line, nil
+}
+
+// archivePassword reads the password of an archive with encrypted entries,
+// archives without them need none and nil is returned.
+func archivePassword(archive, passfile string) ([]byte, error) {
+	if passfile != "" {
+		return readPassfile(passfile)
+	}
+	encrypted, err := repack.IsEncrypted(archive)
+	if err != nil {
+		return nil, fmt.Errorf("reading archive: %w", err)
+	}
+	if !encrypted {
+		return nil, nil
+	}
+	return readPassword("", false)
+}
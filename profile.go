@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/ninedraft/audiobook-repack/repack"
+)
+
+// profileSetting is a flag value set by a profile.
+type profileSetting struct {
+	flag, value string
+}
+
+// profiles are named presets of flags. They are applied before command line
+// flags, so scalar flags given explicitly win and repeatable ones add to the preset.
+var profiles = map[string][]profileSetting{
+	// booklets, ebooks, cue sheets and release notes next to the audio, -g replaces default globs
+	"audiobook": append(defaultGlobSettings(),
+		profileSetting{"g", "*.pdf"},
+		profileSetting{"g", "*.epub"},
+		profileSetting{"g", "*.cue"},
+		profileSetting{"g", "*.nfo"},
+	),
+	// car stereos read FAT32 sticks, show only ASCII, limit files per folder and play only CBR MP3
+	"car": {
+		{"folder-files", "255"},
+		{"name-length", "64"},
+		{"pad-numbers", "3"},
+		{"sanitize-names", "fat32"},
+		{"transliterate", "true"},
+		{"warn-incompatible", "true"},
+	},
+}
+
+func defaultGlobSettings() []profileSetting {
+	settings := []profileSetting{}
+	for _, glob := range repack.DefaultGlobs {
+		settings = append(settings, profileSetting{"g", glob})
+	}
+	return settings
+}
+
+var errUnknownProfile = errors.New("unknown profile")
+
+// sortedProfiles are names of profiles in alphabetical order.
+func sortedProfiles() []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func profileNames() string {
+	return strings.Join(sortedProfiles(), ", ")
+}
+
+// profileFromArgs finds -profile value among flags of args without parsing them.
+func profileFromArgs(args []string) string {
+	name := ""
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		key, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "-") || key != "profile" {
+			continue
+		}
+		switch {
+		case hasValue:
+			name = value
+		case i+1 < len(args):
+			name = args[i+1]
+		}
+	}
+	return name
+}
+
+// applyProfile sets flags of the named profile.
+func applyProfile(flags *flag.FlagSet, name string) error {
+	settings, ok := profiles[name]
+	if !ok {
+		return fmt.Errorf("%w %q, known profiles: %s", errUnknownProfile, name, profileNames())
+	}
+
+	for _, setting := range settings {
+		if err := flags.Set(setting.flag, setting.value); err != nil {
+			return fmt.Errorf("profile %q: flag %q: %w", name, setting.flag, err)
+		}
+	}
+	return nil
+}
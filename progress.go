@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ninedraft/audiobook-repack/repack"
+)
+
+// plainProgressInterval is how often progress lines are printed when stdout isn't a terminal.
+const plainProgressInterval = 10 * time.Second
+
+// isTerminal reports whether file is a character device, like a terminal is.
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// plainProgress prints a line with the number of packed files periodically,
+// it replaces progress bars in logs of cron jobs and CI.
+type plainProgress struct {
+	w io.Writer
+
+	mu          sync.Mutex
+	total, done int
+	book        string
+	printed     int
+}
+
+// hooks track progress of a Packer.
+func (pp *plainProgress) hooks() repack.Hooks {
+	return repack.Hooks{
+		Discovered: func(_, entries int) {
+			pp.mu.Lock()
+			defer pp.mu.Unlock()
+			// -watch reports every run from scratch
+			pp.total, pp.done, pp.printed = entries, 0, 0
+		},
+		BookStarted: func(dir string, _ int) {
+			pp.mu.Lock()
+			defer pp.mu.Unlock()
+			pp.book = dir
+		},
+		FileWritten: func(_, _, _ string) {
+			pp.mu.Lock()
+			defer pp.mu.Unlock()
+			pp.done++
+		},
+	}
+}
+
+// run prints progress every interval until ctx is done.
+func (pp *plainProgress) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			pp.print()
+		}
+	}
+}
+
+// print writes a progress line if anything was packed since the last one.
+func (pp *plainProgress) print() {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	if pp.total == 0 || pp.done == pp.printed {
+		return
+	}
+	pp.printed = pp.done
+	fmt.Fprintf(pp.w, "packed %d/%d files (%d%%), book %s\n", pp.done, pp.total, pp.done*100/pp.total, pp.book)
+}
+
+// Values of -progress.
+const (
+	progressBars  = "bars"
+	progressPlain = "plain"
+	progressJSON  = "json"
+)
+
+// progressOutput reports progress of packing in the way chosen by -progress and -quiet.
+type progressOutput struct {
+	plain  *plainProgress
+	events *jsonProgress
+}
+
+// newProgressOutput sets progress fields of opts. Empty mode picks bars for a terminal
+// and plain lines otherwise, plain lines and JSON events are written into file descriptor fd.
+// Progress goes to stderr instead of stdout if the archive is written into stdout.
+func newProgressOutput(mode string, fd int, quiet bool, opts *repack.Options) (*progressOutput, error) {
+	if quiet {
+		opts.Progress = nil
+		return &progressOutput{}, nil
+	}
+	stdout := os.Stdout
+	if opts.Output == repack.StdoutOutput {
+		stdout = os.Stderr
+	}
+	if mode == "" {
+		mode = progressBars
+		if !isTerminal(stdout) {
+			// bars are escape sequences redrawn in place, in files they are garbage
+			mode = progressPlain
+		}
+	}
+	if mode == progressBars {
+		opts.Progress = stdout
+		return &progressOutput{}, nil
+	}
+
+	w := stdout
+	if fd != int(os.Stdout.Fd()) {
+		w = os.NewFile(uintptr(fd), "progress")
+		if _, err := w.Stat(); err != nil {
+			return nil, fmt.Errorf("progress fd %d: %w", fd, err)
+		}
+	}
+
+	opts.Progress = nil
+	if mode == progressJSON {
+		events := newJSONProgress(w)
+		opts.Hooks = events.hooks()
+		return &progressOutput{events: events}, nil
+	}
+	plain := &plainProgress{w: w}
+	opts.Hooks = plain.hooks()
+	return &progressOutput{plain: plain}, nil
+}
+
+// start reports progress until the returned function is called with the result of packing.
+func (po *progressOutput) start(ctx context.Context) func(err error) {
+	if po.plain != nil {
+		ctx, stop := context.WithCancel(ctx)
+		go po.plain.run(ctx, plainProgressInterval)
+		return func(error) { stop() }
+	}
+	if po.events != nil {
+		return po.events.done
+	}
+	return func(error) {}
+}
+
+// jsonTickInterval limits file_progress events to one per interval for each file.
+const jsonTickInterval = 250 * time.Millisecond
+
+// progressEvent is a line of -progress json output.
+type progressEvent struct {
+	Time    time.Time `json:"time"`
+	Event   string    `json:"event"`
+	Dir     string    `json:"dir,omitempty"`
+	Source  string    `json:"source,omitempty"`
+	Name    string    `json:"name,omitempty"`
+	Books   int       `json:"books,omitempty"`
+	Files   int       `json:"files,omitempty"`
+	Size    int64     `json:"size,omitempty"`
+	Written int64     `json:"written,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// jsonProgress writes a JSON object per line for every book and file started and done,
+// with progress ticks of files in between.
+type jsonProgress struct {
+	mu       sync.Mutex
+	enc      *json.Encoder
+	lastTick time.Time
+}
+
+func newJSONProgress(w io.Writer) *jsonProgress {
+	return &jsonProgress{enc: json.NewEncoder(w)}
+}
+
+func (jp *jsonProgress) emit(event progressEvent) {
+	jp.mu.Lock()
+	defer jp.mu.Unlock()
+
+	event.Time = time.Now().UTC()
+	if event.Event == "file_progress" {
+		if event.Time.Sub(jp.lastTick) < jsonTickInterval && event.Written < event.Size {
+			return
+		}
+		jp.lastTick = event.Time
+	}
+	// a reader gone away must not stop packing
+	_ = jp.enc.Encode(event)
+}
+
+func (jp *jsonProgress) hooks() repack.Hooks {
+	return repack.Hooks{
+		Discovered: func(books, entries int) {
+			jp.emit(progressEvent{Event: "discovered", Books: books, Files: entries})
+		},
+		BookStarted: func(dir string, entries int) {
+			jp.emit(progressEvent{Event: "book_start", Dir: dir, Files: entries})
+		},
+		FileStarted: func(source, name string, size int64) {
+			jp.emit(progressEvent{Event: "file_start", Source: source, Name: name, Size: size})
+		},
+		FileProgress: func(source string, written, size int64) {
+			jp.emit(progressEvent{Event: "file_progress", Source: source, Written: written, Size: size})
+		},
+		FileWritten: func(dir, source, name string) {
+			jp.emit(progressEvent{Event: "file_done", Dir: dir, Source: source, Name: name})
+		},
+		BookDone: func(dir string) {
+			jp.emit(progressEvent{Event: "book_done", Dir: dir})
+		},
+	}
+}
+
+// done writes the last event with the error packing failed with, if any.
+func (jp *jsonProgress) done(err error) {
+	event := progressEvent{Event: "done"}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	jp.emit(event)
+}
@@ -0,0 +1,244 @@
+package repack
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+)
+
+// packAhead compresses files of books in worker goroutines while earlier entries are written,
+// the archive takes them in order as raw zip entries. Only entries which get compressed are packed ahead,
+// stored ones are copied by the writer, reading them into temporary files first would only double reads.
+type packAhead struct {
+	workers     int
+	compression compressionPolicy
+	compressors map[uint16]zip.Compressor
+
+	// jobs are packed in order of records, next is the first one not taken by the writer
+	jobs []*packedFile
+	next int
+	// slots limit number of packed files waiting for the writer
+	slots  chan struct{}
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// packedFile is a record compressed into a temporary file.
+type packedFile struct {
+	record fileRecord
+	// done is closed once the file is packed or packing failed
+	done chan struct{}
+	file *os.File
+	raw  rawData
+	// sum is SHA-256 of the source, it's computed for the manifest only
+	sum []byte
+	err error
+}
+
+func newPackAhead(workers int, compression compressionPolicy) (*packAhead, error) {
+	compressors, err := newCompressors(compression)
+	if err != nil {
+		return nil, err
+	}
+	return &packAhead{workers: workers, compression: compression, compressors: compressors}, nil
+}
+
+// packs reports whether record is packed ahead: a plain file which is compressed as is.
+func (a *packAhead) packs(p *processor, record fileRecord) bool {
+	return len(record.parts) == 0 && record.zipped == nil && record.tagEdit == nil &&
+		(p.transcoder == nil || !isAudio(record.path)) &&
+		a.compression.forName(record.name).method != zip.Store
+}
+
+// start packs records of books in the background, stop cancels it and removes files not taken.
+func (a *packAhead) start(ctx context.Context, p *processor, books []book) (stop func()) {
+	for _, b := range books {
+		for _, record := range b.records {
+			if a.packs(p, record) {
+				a.jobs = append(a.jobs, &packedFile{record: record, done: make(chan struct{})})
+			}
+		}
+	}
+
+	ctx, a.cancel = context.WithCancel(ctx)
+	a.slots = make(chan struct{}, 2*a.workers)
+	jobs := make(chan *packedFile)
+	go func() {
+		defer close(jobs)
+		for _, job := range a.jobs {
+			select {
+			case a.slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			jobs <- job
+		}
+	}()
+
+	for range a.workers {
+		a.wg.Add(1)
+		go func() {
+			defer a.wg.Done()
+			buf := make([]byte, len(p.copyBuf))
+			for job := range jobs {
+				job.err = a.pack(ctx, p, job, buf)
+				close(job.done)
+			}
+		}()
+	}
+
+	return func() {
+		a.cancel()
+		a.wg.Wait()
+		for _, job := range a.jobs[a.next:] {
+			job.remove()
+		}
+	}
+}
+
+// pack compresses the source of job into a temporary file.
+func (a *packAhead) pack(ctx context.Context, p *processor, job *packedFile, buf []byte) error {
+	source, info, errOpen := openSourceFile(job.record.path)
+	if errOpen != nil {
+		return errOpen
+	}
+	defer source.Close()
+
+	tmp, errTmp := os.CreateTemp("", "audiobook-repack-*")
+	if errTmp != nil {
+		return errTmp
+	}
+	job.file = tmp
+
+	method := a.compression.forName(job.record.name).method
+	compressed := &countingWriter{dst: tmp}
+	compressor, errCompressor := a.compressors[method](compressed)
+	if errCompressor != nil {
+		return errCompressor
+	}
+
+	crc := crc32.NewIEEE()
+	dst := io.MultiWriter(compressor, crc)
+	var sum hash.Hash
+	if p.hashFiles {
+		sum = sha256.New()
+		dst = io.MultiWriter(dst, sum)
+	}
+	size := &countingWriter{dst: dst}
+	if err := p.copyBuffer(ctx, size, source, source.Name(), info.Size(), buf); err != nil {
+		return err
+	}
+	if err := compressor.Close(); err != nil {
+		return fmt.Errorf("compressing %q: %w", job.record.path, err)
+	}
+
+	job.raw = rawData{
+		method:         method,
+		crc32:          crc.Sum32(),
+		compressedSize: uint64(compressed.n),
+		size:           uint64(size.n),
+	}
+	if sum != nil {
+		job.sum = sum.Sum(nil)
+	}
+	return nil
+}
+
+// take waits for record to be packed, packed is nil if record isn't packed ahead.
+// Records are taken in order, jobs of records the writer left out before record are removed.
+func (a *packAhead) take(ctx context.Context, record fileRecord) (*packedFile, error) {
+	if a == nil {
+		return nil, nil
+	}
+	found := -1
+	for i := a.next; i < len(a.jobs); i++ {
+		if a.jobs[i].record.path == record.path && a.jobs[i].record.name == record.name {
+			found = i
+			break
+		}
+	}
+	if found < 0 {
+		return nil, nil
+	}
+
+	for ; a.next <= found; a.next++ {
+		job := a.jobs[a.next]
+		select {
+		case <-job.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		<-a.slots
+		if a.next < found {
+			job.remove()
+		}
+	}
+
+	job := a.jobs[found]
+	if job.err != nil {
+		job.remove()
+		return nil, job.err
+	}
+	return job, nil
+}
+
+// remove deletes the temporary file of a packed record, it does nothing for nil.
+func (f *packedFile) remove() {
+	if f == nil || f.file == nil {
+		return
+	}
+	_ = f.file.Close()
+	_ = os.Remove(f.file.Name())
+	f.file = nil
+}
+
+// writePacked adds record packed ahead as a raw zip entry.
+// It's false if archive has to compress the entry itself, then nothing is written.
+func (p *processor) writePacked(ctx context.Context, archive archiveWriter, record fileRecord, info fs.FileInfo, packed *packedFile) (bool, error) {
+	raw, ok := archive.(rawArchiveWriter)
+	if !ok {
+		return false, nil
+	}
+	wr, copied, errCreate := raw.createRaw(archiveEntry{
+		name:    record.name,
+		source:  record.path,
+		size:    int64(packed.raw.size),
+		modTime: p.entryTime(info),
+	}, packed.raw)
+	if errCreate != nil || !copied {
+		return false, errCreate
+	}
+
+	if _, err := packed.file.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	size, compressed := int64(packed.raw.size), int64(packed.raw.compressedSize)
+	dst := p.trackEntry(wr, record, size)
+	if progress, ok := dst.(*progressWriter); ok {
+		// hooks count bytes of the source like for other entries, not the compressed ones written
+		report := progress.fn
+		progress.fn = func(written int64) {
+			if written < compressed {
+				written = int64(float64(written) / float64(compressed) * float64(size))
+			} else {
+				written = size
+			}
+			report(written)
+		}
+	}
+	if _, err := io.CopyBuffer(dst, contextReader{ctx: ctx, src: packed.file}, p.copyBuf); err != nil {
+		return false, fmt.Errorf("writing packed file %q: %w", record.path, err)
+	}
+
+	if p.hashFiles {
+		p.manifest = append(p.manifest, manifestLine{sum: packed.sum, name: record.name, source: record.path})
+	}
+	return true, nil
+}
@@ -0,0 +1,140 @@
+package repack
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeFiles creates files of dir with contents by slash separated names.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		filename := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filename), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filename, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// pack packs dirs with opts into a file of a temporary dir and returns its path.
+func pack(t *testing.T, opts Options, dirs ...string) (string, error) {
+	t.Helper()
+	if opts.Output == "" {
+		opts.Output = filepath.Join(t.TempDir(), "out.zip")
+	}
+	packer, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return opts.Output, packer.Pack(context.Background(), dirs)
+}
+
+// compressibleBooks creates book dirs with files large enough to span several copy buffers.
+func compressibleBooks(t *testing.T) []string {
+	t.Helper()
+	root := t.TempDir()
+	var dirs []string
+	for _, book := range []string{"Book One", "Книга два", "Book Three"} {
+		dir := filepath.Join(root, book)
+		files := map[string]string{}
+		for i := range 4 {
+			files[fmt.Sprintf("%02d трек.mp3", i+1)] = strings.Repeat(fmt.Sprintf("%s frame %d\n", book, i), 40_000)
+		}
+		writeFiles(t, dir, files)
+		dirs = append(dirs, dir)
+	}
+	return dirs
+}
+
+func TestPackAheadOutput(t *testing.T) {
+	dirs := compressibleBooks(t)
+	// generated entries get the time of the run otherwise
+	fixedTime := time.Date(2024, 5, 6, 7, 8, 10, 0, time.Local)
+	for _, reproducible := range []bool{false, true} {
+		t.Run(fmt.Sprintf("reproducible=%v", reproducible), func(t *testing.T) {
+			outputs := map[int][]byte{}
+			for _, workers := range []int{1, 4} {
+				output, err := pack(t, Options{
+					Workers:        workers,
+					Compression:    []string{"mp3=zstd:3"},
+					Reproducible:   reproducible,
+					FixedTime:      fixedTime,
+					BandwidthLimit: 1 << 30,
+					BufferSize:     64 << 10,
+					Manifest:       true,
+				}, dirs...)
+				if err != nil {
+					t.Fatalf("-j %d: %v", workers, err)
+				}
+				data, err := os.ReadFile(output)
+				if err != nil {
+					t.Fatal(err)
+				}
+				outputs[workers] = data
+			}
+			if !bytes.Equal(outputs[1], outputs[4]) {
+				t.Errorf("-j 4 output of %d bytes differs from -j 1 output of %d bytes", len(outputs[4]), len(outputs[1]))
+			}
+		})
+	}
+}
+
+func TestPackAheadHooks(t *testing.T) {
+	dirs := compressibleBooks(t)
+
+	mu := sync.Mutex{}
+	started := map[string]int64{}
+	finished := map[string]int64{}
+	var order []string
+	_, err := pack(t, Options{
+		Workers:     4,
+		Compression: []string{"mp3=deflate"},
+		Hooks: Hooks{
+			FileStarted: func(source, name string, size int64) {
+				mu.Lock()
+				defer mu.Unlock()
+				started[source] = size
+				order = append(order, name)
+			},
+			FileProgress: func(source string, written, size int64) {
+				mu.Lock()
+				defer mu.Unlock()
+				finished[source] = written
+			},
+		},
+	}, dirs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for source, size := range started {
+		info, err := os.Stat(source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != info.Size() {
+			t.Errorf("%s started with size %d, source has %d bytes", source, size, info.Size())
+		}
+		if finished[source] != size {
+			t.Errorf("%s progress ended at %d of %d bytes", source, finished[source], size)
+		}
+	}
+	if len(order) != 12 {
+		t.Fatalf("started %d files, want 12", len(order))
+	}
+	for i, name := range order[:4] {
+		if want := fmt.Sprintf("Book One_%02d трек.mp3", i+1); name != want {
+			t.Errorf("entry %d is %q, want %q", i, name, want)
+		}
+	}
+}
@@ -0,0 +1,518 @@
+package repack
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	FormatZip   = "zip"
+	FormatTar   = "tar"
+	FormatTarGz = "tar.gz"
+	FormatM4B   = "m4b"
+	FormatISO   = "iso"
+	// FormatSevenZip is 7z with LZMA2 compression, audio is stored like in zip
+	FormatSevenZip = "7z"
+)
+
+var Formats = []string{FormatZip, FormatTar, FormatTarGz, FormatM4B, FormatISO, FormatSevenZip}
+
+// archiveEntry describes a single file inside of output archive.
+type archiveEntry struct {
+	name string
+	// source is the original file path, empty for generated entries
+	source  string
+	size    int64
+	modTime time.Time
+	// raw describes compressed data of an entry read from zip, nil for tar
+	raw *rawData
+}
+
+// archiveWriter is an output container, entries are written one after another.
+type archiveWriter interface {
+	// create adds a new entry, the previous one is finished.
+	create(entry archiveEntry) (io.Writer, error)
+	Close() error
+}
+
+// rawArchiveWriter is an output taking compressed zip entries as is.
+type rawArchiveWriter interface {
+	// createRaw adds an entry with content compressed as raw describes.
+	// If the entry has to be recompressed, nothing is added and copied is false.
+	createRaw(entry archiveEntry, raw rawData) (wr io.Writer, copied bool, err error)
+}
+
+// entryDropper is an output which can leave out the entry being written,
+// so -keep-going skips a source failing mid-copy. Zip, tar and 7z streams can't.
+type entryDropper interface {
+	dropEntry() error
+}
+
+// rawData describes compressed content of a zip entry.
+type rawData struct {
+	method, flags  uint16
+	crc32          uint32
+	compressedSize uint64
+	size           uint64
+}
+
+func rawDataOf(file *zip.File) rawData {
+	return rawData{
+		method:         file.Method,
+		flags:          file.Flags,
+		crc32:          file.CRC32,
+		compressedSize: file.CompressedSize64,
+		size:           file.UncompressedSize64,
+	}
+}
+
+var errUnsupportedArchive = errors.New("unsupported archive format")
+
+// archiveOptions are format specific settings of archive writer.
+type archiveOptions struct {
+	// verifyCRC enables CRC check of each zip entry against copied data
+	verifyCRC bool
+	// compression of zip entries
+	compression compressionPolicy
+	// reproducible drops zip extra fields which depend on OS and time zone
+	reproducible bool
+	// entryDone is called with a zip entry once it's finished and flushed, offset is where its data starts
+	entryDone func(header *zip.FileHeader, offset int64) error
+	// sync makes written data durable before entryDone is called, nil skips it
+	sync func() error
+	// password encrypts zip entries with AES-256, empty writes them in plain
+	password []byte
+	// bufferSize is size of writes into an output file, 0 writes through
+	bufferSize int
+	// writeAt overwrites written data of an output file, nil for streams
+	writeAt func(p []byte, offset int64) error
+	// volume is the disc label of an iso image
+	volume string
+}
+
+func newArchiveWriter(format string, dst io.Writer, opts archiveOptions) (archiveWriter, error) {
+	switch format {
+	case FormatZip:
+		written := &countingWriter{dst: dst}
+		zw := zip.NewWriter(written)
+		compressors, errCompressors := registerCompressors(zw, opts.compression)
+		if errCompressors != nil {
+			return nil, errCompressors
+		}
+		z := &zipArchive{
+			zw:           zw,
+			written:      written,
+			verifyCRC:    opts.verifyCRC,
+			compression:  opts.compression,
+			reproducible: opts.reproducible,
+			entryDone:    opts.entryDone,
+			sync:         opts.sync,
+			encrypt:      len(opts.password) > 0,
+		}
+		if z.encrypt {
+			registerEncryption(zw, compressors, opts.password, func() (*zip.FileHeader, uint16) { return z.creating, z.method })
+		}
+		return z, nil
+	case FormatTar, FormatTarGz:
+		if opts.verifyCRC {
+			return nil, fmt.Errorf("%w: CRC verification is available for zip only", errUnsupportedArchive)
+		}
+		if format == FormatTar {
+			return &tarArchive{tw: tar.NewWriter(dst)}, nil
+		}
+		gz := gzip.NewWriter(dst)
+		return &tarArchive{tw: tar.NewWriter(gz), compressor: gz}, nil
+	case FormatISO:
+		if opts.verifyCRC {
+			return nil, fmt.Errorf("%w: CRC verification is available for zip only", errUnsupportedArchive)
+		}
+		return newISOArchive(dst, opts.writeAt, opts.volume)
+	case FormatSevenZip:
+		if opts.verifyCRC {
+			return nil, fmt.Errorf("%w: CRC verification is available for zip only", errUnsupportedArchive)
+		}
+		return newSevenZipArchive(dst, opts.writeAt, opts.compression)
+	default:
+		return nil, fmt.Errorf("%w: %q", errUnsupportedArchive, format)
+	}
+}
+
+type zipArchive struct {
+	zw      *zip.Writer
+	written *countingWriter
+
+	// verifyCRC enables CRC check of each entry against copied data
+	verifyCRC   bool
+	unverified  *crcCheck
+	compression compressionPolicy
+	// reproducible writes MS-DOS timestamps only, without extended timestamp field
+	reproducible bool
+	// encrypt writes entries as zipAES without source paths in comments,
+	// creating is the entry being created and method is its real one
+	encrypt  bool
+	creating *zip.FileHeader
+	method   uint16
+
+	// entryDone is notified about finished entries, last is the one being written
+	entryDone  func(header *zip.FileHeader, offset int64) error
+	sync       func() error
+	last       *zip.FileHeader
+	lastOffset int64
+}
+
+func (z *zipArchive) header(entry archiveEntry) *zip.FileHeader {
+	header := &zip.FileHeader{
+		Name:     entry.name,
+		Comment:  entry.source,
+		Method:   z.compression.forName(entry.name).method,
+		Modified: entry.modTime,
+	}
+	if z.reproducible {
+		header.Modified = time.Time{}
+		header.ModifiedDate, header.ModifiedTime = msdosTime(entry.modTime)
+	}
+	if z.encrypt {
+		const encrypted = 0x1
+		// sources would give away what the encrypted entries are
+		header.Comment = ""
+		z.creating, z.method = header, header.Method
+		header.Method = zipAES
+		header.Flags |= encrypted
+		header.Extra = append(header.Extra, aesExtra(z.method)...)
+	}
+	return header
+}
+
+func (z *zipArchive) create(entry archiveEntry) (io.Writer, error) {
+	header := z.header(entry)
+	wr, errCreate := z.zw.CreateHeader(header)
+	if errCreate != nil {
+		return nil, fmt.Errorf("creating zip file record: %w", errCreate)
+	}
+
+	// creating a new entry closes the previous one, so its CRC is final now
+	if err := z.verifyLastCRC(); err != nil {
+		return nil, err
+	}
+	if err := z.finishLast(header); err != nil {
+		return nil, err
+	}
+
+	if !z.verifyCRC {
+		return wr, nil
+	}
+
+	sum := crc32.NewIEEE()
+	z.unverified = &crcCheck{header: header, sum: sum}
+	return io.MultiWriter(wr, sum), nil
+}
+
+// createRaw copies compressed data if it's compressed with the method the entry would get.
+// Encrypted entries and CRC verification need the data decompressed.
+func (z *zipArchive) createRaw(entry archiveEntry, raw rawData) (io.Writer, bool, error) {
+	const encrypted = 0x1
+	header := z.header(entry)
+	if z.encrypt || header.Method != raw.method || raw.flags&encrypted != 0 || z.verifyCRC {
+		return nil, false, nil
+	}
+	header.CRC32 = raw.crc32
+	header.CompressedSize64 = raw.compressedSize
+	header.UncompressedSize64 = raw.size
+	prepareRawHeader(header)
+
+	wr, errCreate := z.zw.CreateRaw(header)
+	if errCreate != nil {
+		return nil, false, fmt.Errorf("creating zip file record: %w", errCreate)
+	}
+	if err := z.verifyLastCRC(); err != nil {
+		return nil, false, err
+	}
+	if err := z.finishLast(header); err != nil {
+		return nil, false, err
+	}
+	return wr, true, nil
+}
+
+// finishLast notifies entryDone about the entry closed by creating next,
+// next becomes the last entry. Nil next is an entry which isn't reported.
+func (z *zipArchive) finishLast(next *zip.FileHeader) error {
+	if z.entryDone == nil {
+		return nil
+	}
+	// the local header of next is buffered, its data starts right after it
+	if err := z.zw.Flush(); err != nil {
+		return err
+	}
+	last, lastOffset := z.last, z.lastOffset
+	z.last, z.lastOffset = next, z.written.n
+	if last == nil {
+		return nil
+	}
+
+	if z.sync != nil {
+		if err := z.sync(); err != nil {
+			return err
+		}
+	}
+	return z.entryDone(last, lastOffset)
+}
+
+func (z *zipArchive) setComment(comment string) error {
+	return z.zw.SetComment(comment)
+}
+
+func (z *zipArchive) Close() error {
+	if err := z.zw.Close(); err != nil {
+		return err
+	}
+	return z.verifyLastCRC()
+}
+
+// prepareRawHeader sets fields of a CreateRaw header the way CreateHeader does,
+// so an entry copied as is comes out byte for byte as if it was compressed while writing:
+// versions 2.0, UTF-8 flag, MS-DOS time of Modified with an extended timestamp,
+// and CRC and sizes written into a data descriptor after the data instead of the local header.
+func prepareRawHeader(header *zip.FileHeader) {
+	const (
+		dataDescriptor = 0x8
+		utf8Names      = 0x800
+		zipVersion20   = 20
+	)
+	nameValid, nameRequires := zipUTF8(header.Name)
+	commentValid, commentRequires := zipUTF8(header.Comment)
+	if (nameRequires || commentRequires) && nameValid && commentValid {
+		header.Flags |= utf8Names
+	}
+	header.Flags |= dataDescriptor
+	header.CreatorVersion = header.CreatorVersion&0xff00 | zipVersion20
+	header.ReaderVersion = zipVersion20
+
+	if header.Modified.IsZero() {
+		return
+	}
+	// like CreateHeader, time fields are in the location of Modified
+	t := header.Modified
+	header.ModifiedDate = uint16(t.Day() + int(t.Month())<<5 + (t.Year()-1980)<<9)
+	header.ModifiedTime = uint16(t.Second()/2 + t.Minute()<<5 + t.Hour()<<11)
+	const extendedTimeID, modTimeOnly = 0x5455, 1
+	header.Extra = binary.LittleEndian.AppendUint16(header.Extra, extendedTimeID)
+	header.Extra = binary.LittleEndian.AppendUint16(header.Extra, 5)
+	header.Extra = append(header.Extra, modTimeOnly)
+	header.Extra = binary.LittleEndian.AppendUint32(header.Extra, uint32(t.Unix()))
+}
+
+// zipUTF8 reports whether s is valid UTF-8 and if it needs the UTF-8 flag,
+// it's the check of zip writer: CP-437 compatible ASCII goes without the flag.
+func zipUTF8(s string) (valid, require bool) {
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		i += size
+		if r < 0x20 || r > 0x7d || r == 0x5c {
+			if r == utf8.RuneError && size == 1 {
+				return false, false
+			}
+			require = true
+		}
+	}
+	return true, require
+}
+
+// msdosTime encodes t as MS-DOS date and time with 2 second precision.
+// Zip writer adds an extended timestamp field for non-zero header.Modified,
+// setting legacy fields instead keeps headers free of extra fields.
+func msdosTime(t time.Time) (date, clock uint16) {
+	t = t.UTC()
+	if t.Year() < 1980 {
+		t = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	date = uint16(t.Day() + int(t.Month())<<5 + (t.Year()-1980)<<9)
+	clock = uint16(t.Second()/2 + t.Minute()<<5 + t.Hour()<<11)
+	return date, clock
+}
+
+var errCRCMismatch = errors.New("crc mismatch")
+
+// crcCheck pairs an archive entry with the checksum of data copied into it.
+type crcCheck struct {
+	header *zip.FileHeader
+	sum    hash.Hash32
+}
+
+// verifyLastCRC compares the CRC recorded by the zip writer for the last
+// closed entry with the one computed during the copy.
+func (z *zipArchive) verifyLastCRC() error {
+	check := z.unverified
+	if check == nil {
+		return nil
+	}
+	z.unverified = nil
+
+	if got := check.sum.Sum32(); check.header.CRC32 != got {
+		return fmt.Errorf("%w: entry %q: archive recorded %08x, copied data has %08x",
+			errCRCMismatch, check.header.Name, check.header.CRC32, got)
+	}
+
+	return nil
+}
+
+type tarArchive struct {
+	tw *tar.Writer
+	// compressor wraps tar stream, nil for plain tar
+	compressor io.WriteCloser
+}
+
+func (t *tarArchive) create(entry archiveEntry) (io.Writer, error) {
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     entry.name,
+		Size:     entry.size,
+		Mode:     0644,
+		ModTime:  entry.modTime,
+		Format:   tar.FormatPAX,
+	}
+	if entry.source != "" {
+		header.PAXRecords = map[string]string{"comment": entry.source}
+	}
+
+	if err := t.tw.WriteHeader(header); err != nil {
+		return nil, fmt.Errorf("creating tar file record: %w", err)
+	}
+
+	return t.tw, nil
+}
+
+func (t *tarArchive) Close() error {
+	if err := t.tw.Close(); err != nil {
+		return err
+	}
+	if t.compressor != nil {
+		return t.compressor.Close()
+	}
+	return nil
+}
+
+// archiveFormatOf guesses archive format by file extension, zip is the default.
+func archiveFormatOf(filename string) string {
+	lower := strings.ToLower(filename)
+	switch {
+	case strings.HasSuffix(lower, ".tar"):
+		return FormatTar
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return FormatTarGz
+	default:
+		return FormatZip
+	}
+}
+
+// readArchive calls fn for each entry of a zip, tar or tar.gz archive in order.
+// Content is valid only until fn returns.
+func readArchive(filename string, password []byte, fn func(entry archiveEntry, content io.Reader) error) error {
+	format := archiveFormatOf(filename)
+	if format == FormatZip {
+		return readZip(filename, password, fn)
+	}
+
+	file, errFile := os.Open(filename)
+	if errFile != nil {
+		return fmt.Errorf("opening archive: %w", errFile)
+	}
+	defer file.Close()
+
+	var src io.Reader = file
+	if format == FormatTarGz {
+		gz, errGz := gzip.NewReader(file)
+		if errGz != nil {
+			return fmt.Errorf("opening gzip stream: %w", errGz)
+		}
+		defer gz.Close()
+		src = gz
+	}
+
+	tr := tar.NewReader(src)
+	for {
+		header, errNext := tr.Next()
+		if errors.Is(errNext, io.EOF) {
+			return nil
+		}
+		if errNext != nil {
+			return fmt.Errorf("reading tar: %w", errNext)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		entry := archiveEntry{
+			name:    header.Name,
+			source:  header.PAXRecords["comment"],
+			size:    header.Size,
+			modTime: header.ModTime,
+		}
+		if err := fn(entry, tr); err != nil {
+			return fmt.Errorf("entry %q: %w", header.Name, err)
+		}
+	}
+}
+
+// readZip decrypts AES entries with password, without it reading them fails with errEncrypted.
+func readZip(filename string, password []byte, fn func(entry archiveEntry, content io.Reader) error) error {
+	zr, errOpen := zip.OpenReader(filename)
+	if errOpen != nil {
+		return fmt.Errorf("opening archive: %w", errOpen)
+	}
+	defer zr.Close()
+	registerDecompressors(&zr.Reader)
+
+	for _, file := range zr.File {
+		if file.FileInfo().IsDir() {
+			continue
+		}
+
+		content, errContent := openZipEntry(file, password)
+		if errContent != nil {
+			return fmt.Errorf("entry %q: %w", file.Name, errContent)
+		}
+
+		raw := rawDataOf(file)
+		if file.Method == zipAES {
+			// listed by the method data is compressed with before encryption
+			raw.method, _, _, _ = parseAESExtra(file.Extra)
+		}
+		entry := archiveEntry{
+			name:    file.Name,
+			source:  file.Comment,
+			size:    int64(file.UncompressedSize64),
+			modTime: file.Modified,
+			raw:     &raw,
+		}
+		errFn := fn(entry, content)
+		_ = content.Close()
+		if errFn != nil {
+			return fmt.Errorf("entry %q: %w", file.Name, errFn)
+		}
+	}
+
+	return nil
+}
+
+// openZipEntry opens a plain or AES encrypted entry. Without password an encrypted
+// entry can be listed, but reading it fails.
+func openZipEntry(file *zip.File, password []byte) (io.ReadCloser, error) {
+	if file.Method != zipAES {
+		return file.Open()
+	}
+	if len(password) == 0 {
+		return io.NopCloser(errReader{errEncrypted}), nil
+	}
+	return openEncrypted(file, password)
+}
@@ -0,0 +1,168 @@
+package repack
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	// registers the sqlite driver
+	_ "modernc.org/sqlite"
+)
+
+// catalogSchema keeps a row per packed book and its files, books of an output are replaced when it's packed again.
+const catalogSchema = `
+CREATE TABLE IF NOT EXISTS books (
+	id       INTEGER PRIMARY KEY,
+	title    TEXT NOT NULL,
+	dir      TEXT NOT NULL,
+	output   TEXT NOT NULL,
+	packed   TEXT NOT NULL,
+	files    INTEGER NOT NULL,
+	bytes    INTEGER NOT NULL,
+	duration REAL NOT NULL
+);
+CREATE INDEX IF NOT EXISTS books_output ON books (output);
+CREATE TABLE IF NOT EXISTS files (
+	book_id  INTEGER NOT NULL REFERENCES books (id),
+	name     TEXT NOT NULL,
+	source   TEXT NOT NULL,
+	bytes    INTEGER NOT NULL,
+	duration REAL NOT NULL,
+	sha256   TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS files_book ON files (book_id);
+`
+
+// CatalogBook is a book recorded in the catalog, Output is the archive it was packed into.
+type CatalogBook struct {
+	Title    string
+	Dir      string
+	Output   string
+	Packed   time.Time
+	Files    int
+	Bytes    int64
+	Duration time.Duration
+}
+
+// DefaultCatalog is the per-user catalog file.
+func DefaultCatalog() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "audiobook-repack", "catalog.db")
+}
+
+func openCatalog(filename string) (*sql.DB, error) {
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return nil, err
+	}
+	db, errOpen := sql.Open("sqlite", filename)
+	if errOpen != nil {
+		return nil, errOpen
+	}
+	if _, err := db.Exec(catalogSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// recordCatalog adds books of the report to the catalog as packed into output.
+// Books recorded for the output before are dropped, it's overwritten.
+func (p *processor) recordCatalog(filename, output string) error {
+	db, errOpen := openCatalog(filename)
+	if errOpen != nil {
+		return errOpen
+	}
+	defer db.Close()
+
+	sums := make(map[string]string, len(p.manifest))
+	for _, line := range p.manifest {
+		sums[line.name] = hex.EncodeToString(line.sum)
+	}
+
+	tx, errBegin := db.Begin()
+	if errBegin != nil {
+		return errBegin
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM files WHERE book_id IN (SELECT id FROM books WHERE output = ?)`, output); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM books WHERE output = ?`, output); err != nil {
+		return err
+	}
+
+	packed := p.started.UTC().Format(time.RFC3339)
+	for _, b := range p.report.Books {
+		title := p.titles[b.Dir]
+		if title == "" {
+			title = bookTitle(book{dir: b.Dir})
+		}
+		result, errBook := tx.Exec(`INSERT INTO books (title, dir, output, packed, files, bytes, duration) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			title, b.Dir, output, packed, len(b.Files), b.Bytes, b.Duration)
+		if errBook != nil {
+			return errBook
+		}
+		id, errID := result.LastInsertId()
+		if errID != nil {
+			return errID
+		}
+		for _, f := range b.Files {
+			if _, err := tx.Exec(`INSERT INTO files (book_id, name, source, bytes, duration, sha256) VALUES (?, ?, ?, ?, ?, ?)`,
+				id, f.Name, f.Source, f.Bytes, f.Duration, sums[f.Name]); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// SearchCatalog finds books with text in their titles, dirs or names and sources of their files,
+// ignoring ASCII case. Recently packed books go first.
+func SearchCatalog(filename, text string) ([]CatalogBook, error) {
+	// opening creates a missing file, an empty catalog is most likely a wrong path
+	if _, err := os.Stat(filename); err != nil {
+		return nil, err
+	}
+	db, errOpen := openCatalog(filename)
+	if errOpen != nil {
+		return nil, errOpen
+	}
+	defer db.Close()
+
+	pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(text) + "%"
+	rows, errQuery := db.Query(`
+		SELECT title, dir, output, packed, files, bytes, duration FROM books
+		WHERE title LIKE ?1 ESCAPE '\' OR dir LIKE ?1 ESCAPE '\' OR id IN (
+			SELECT book_id FROM files WHERE name LIKE ?1 ESCAPE '\' OR source LIKE ?1 ESCAPE '\'
+		)
+		ORDER BY packed DESC, output, id`, pattern)
+	if errQuery != nil {
+		return nil, errQuery
+	}
+	defer rows.Close()
+
+	books := []CatalogBook{}
+	for rows.Next() {
+		var b CatalogBook
+		var packed string
+		var duration float64
+		if err := rows.Scan(&b.Title, &b.Dir, &b.Output, &packed, &b.Files, &b.Bytes, &duration); err != nil {
+			return nil, err
+		}
+		var errTime error
+		if b.Packed, errTime = time.Parse(time.RFC3339, packed); errTime != nil {
+			return nil, fmt.Errorf("book %q: %w", b.Dir, errTime)
+		}
+		b.Duration = time.Duration(duration * float64(time.Second))
+		books = append(books, b)
+	}
+	return books, rows.Err()
+}
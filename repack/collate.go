@@ -0,0 +1,48 @@
+package repack
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/text/collate"
+	"golang.org/x/text/language"
+)
+
+// nameCollation compares text between numbers of file names, numbers are always compared by value.
+type nameCollation struct {
+	// locale selects Unicode collation rules, language.Und keeps byte order
+	locale     language.Tag
+	ignoreCase bool
+	// roman compares words which are Roman numerals like numbers, see replaceRomanNumerals
+	roman bool
+}
+
+// newNameCollation parses locale, an empty one keeps byte order of letters.
+func newNameCollation(locale string, ignoreCase bool) (nameCollation, error) {
+	if locale == "" {
+		return nameCollation{locale: language.Und, ignoreCase: ignoreCase}, nil
+	}
+	tag, err := language.Parse(locale)
+	if err != nil {
+		return nameCollation{}, fmt.Errorf("sort locale %q: %w", locale, err)
+	}
+	return nameCollation{locale: tag, ignoreCase: ignoreCase}, nil
+}
+
+// compare returns a comparison of text, a collator isn't safe for concurrent use,
+// so each sort gets its own.
+func (c nameCollation) compare() func(a, b string) int {
+	if c.locale != language.Und {
+		var opts []collate.Option
+		if c.ignoreCase {
+			opts = append(opts, collate.IgnoreCase)
+		}
+		return collate.New(c.locale, opts...).CompareString
+	}
+	if c.ignoreCase {
+		return func(a, b string) int {
+			return strings.Compare(strings.ToLower(a), strings.ToLower(b))
+		}
+	}
+	return strings.Compare
+}
@@ -0,0 +1,70 @@
+package repack
+
+import (
+	"fmt"
+	"log/slog"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// splitFolders moves file entries of each book into a folder named after the book,
+// books of more than folderFiles entries into several folders "BOOK - 01", "BOOK - 02"
+// and so on, because car stereos and other players limit files in a folder.
+// Generated entries, like playlists, stay where they are.
+func (p *processor) splitFolders(books []book) {
+	if p.folderFiles == 0 {
+		return
+	}
+	for i := range books {
+		records := books[i].records
+		prefix := sanitizeDirPrefix(books[i].dir)
+		base := strings.TrimSuffix(prefix, "_")
+		folders := (len(records) + p.folderFiles - 1) / p.folderFiles
+		width := max(2, len(strconv.Itoa(folders)))
+		for j := range records {
+			folder := base
+			switch {
+			case folders > 1 && base == "":
+				folder = fmt.Sprintf("%0*d", width, j/p.folderFiles+1)
+			case folders > 1:
+				folder = fmt.Sprintf("%s - %0*d", base, width, j/p.folderFiles+1)
+			}
+			name := path.Base(records[j].name)
+			if trimmed := strings.TrimPrefix(name, prefix); trimmed != "" {
+				name = trimmed
+			}
+			records[j].name = path.Join(folder, name)
+		}
+	}
+}
+
+// warnIncompatible logs audio files which aren't constant bitrate MP3, the only audio
+// many car stereos play. Transcoded files are judged by the codec they're encoded with.
+func (p *processor) warnIncompatible(books []book) {
+	if !p.warnCodecs {
+		return
+	}
+	for _, b := range books {
+		for _, record := range b.records {
+			if record.rel == "" || record.zipped != nil || !isAudio(record.path) {
+				continue
+			}
+			switch ext := strings.ToLower(filepath.Ext(record.name)); {
+			case ext != ".mp3":
+				slog.Warn("audio isn't MP3, players may skip it", "file", record.path, "codec", strings.TrimPrefix(ext, "."))
+			case p.transcoder != nil:
+				// lame encodes with a constant bitrate
+			default:
+				vbr, err := mp3IsVBR(record.path)
+				switch {
+				case err != nil:
+					slog.Warn("checking bitrate", "file", record.path, "err", err)
+				case vbr:
+					slog.Warn("MP3 has variable bitrate, players may skip it or show wrong times", "file", record.path)
+				}
+			}
+		}
+	}
+}
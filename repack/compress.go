@@ -0,0 +1,176 @@
+package repack
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// zipZstd is zip compression method id assigned to Zstandard.
+const zipZstd uint16 = 93
+
+// compression is a zip compression method with level, 0 level means method default.
+type compression struct {
+	method uint16
+	level  int
+}
+
+var errBadCompression = errors.New("bad compression")
+
+// parseCompression parses store, deflate[:1-9] and zstd[:1-22].
+func parseCompression(value string) (compression, error) {
+	name, levelStr, hasLevel := strings.Cut(value, ":")
+
+	c := compression{}
+	maxLevel := 0
+	switch name {
+	case "store":
+		c.method = zip.Store
+	case "deflate":
+		c.method, maxLevel = zip.Deflate, flate.BestCompression
+	case "zstd":
+		c.method, maxLevel = zipZstd, 22
+	default:
+		return compression{}, fmt.Errorf("%w: unknown method %q", errBadCompression, name)
+	}
+
+	if !hasLevel {
+		return c, nil
+	}
+
+	level, err := strconv.Atoi(levelStr)
+	if err != nil || level < 1 || level > maxLevel {
+		return compression{}, fmt.Errorf("%w: %s level must be in 1..%d, got %q", errBadCompression, name, maxLevel, levelStr)
+	}
+	c.level = level
+
+	return c, nil
+}
+
+// storedExts are Formats which are already compressed,
+// deflating them burns CPU for nothing.
+var storedExts = audioExts
+
+// compressionPolicy picks compression of zip entries by file extension.
+type compressionPolicy struct {
+	// fallback is used for extensions without explicit setting
+	fallback compression
+	byExt    map[string]compression
+}
+
+// defaultCompressionPolicy stores audio and deflates extras like text and images.
+func defaultCompressionPolicy() compressionPolicy {
+	policy := compressionPolicy{
+		fallback: compression{method: zip.Deflate},
+		byExt:    map[string]compression{},
+	}
+	for _, ext := range storedExts {
+		policy.byExt[ext] = compression{method: zip.Store}
+	}
+	return policy
+}
+
+// set parses METHOD[:LEVEL] for extras or EXT=METHOD[:LEVEL] for an extension.
+func (policy *compressionPolicy) set(value string) error {
+	ext, method, perExt := strings.Cut(value, "=")
+	if !perExt {
+		method = value
+	}
+
+	c, err := parseCompression(method)
+	if err != nil {
+		return err
+	}
+
+	if !perExt {
+		policy.fallback = c
+		return nil
+	}
+
+	ext = strings.ToLower(ext)
+	if !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	policy.byExt[ext] = c
+	return nil
+}
+
+func (policy compressionPolicy) forName(name string) compression {
+	if c, ok := policy.byExt[strings.ToLower(path.Ext(name))]; ok {
+		return c
+	}
+	return policy.fallback
+}
+
+// registerCompressors sets up writers for compression methods with levels.
+func registerCompressors(zw *zip.Writer, policy compressionPolicy) (map[uint16]zip.Compressor, error) {
+	compressors, err := newCompressors(policy)
+	if err != nil {
+		return nil, err
+	}
+	for method, compressor := range compressors {
+		if method != zip.Store {
+			zw.RegisterCompressor(method, compressor)
+		}
+	}
+	return compressors, nil
+}
+
+// newCompressors returns writers for compression methods of policy by method.
+// Zip writer holds a single compressor per method, so a method can't be used with different levels.
+func newCompressors(policy compressionPolicy) (map[uint16]zip.Compressor, error) {
+	compressors := map[uint16]zip.Compressor{
+		zip.Store: func(w io.Writer) (io.WriteCloser, error) {
+			return nopWriteCloser{w}, nil
+		},
+	}
+	levels := map[uint16]int{policy.fallback.method: policy.fallback.level}
+	for ext, c := range policy.byExt {
+		if level, ok := levels[c.method]; ok && level != c.level {
+			return nil, fmt.Errorf("%w: %s uses method %d with level %d, but %d is already used", errBadCompression, ext, c.method, c.level, level)
+		}
+		levels[c.method] = c.level
+	}
+
+	if level, ok := levels[zip.Deflate]; ok {
+		if level == 0 {
+			level = flate.DefaultCompression
+		}
+		compressors[zip.Deflate] = func(w io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(w, level)
+		}
+	}
+
+	if level, ok := levels[zipZstd]; ok {
+		encoderLevel := zstd.SpeedDefault
+		if level > 0 {
+			encoderLevel = zstd.EncoderLevelFromZstd(level)
+		}
+		compressors[zipZstd] = func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w, zstd.WithEncoderLevel(encoderLevel), zstd.WithEncoderConcurrency(1))
+		}
+	}
+	return compressors, nil
+}
+
+// registerDecompressors lets zip reader open zstd entries.
+func registerDecompressors(zr *zip.Reader) {
+	zr.RegisterDecompressor(zipZstd, func(r io.Reader) io.ReadCloser {
+		decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return io.NopCloser(errReader{err})
+		}
+		return decoder.IOReadCloser()
+	})
+}
+
+type errReader struct{ err error }
+
+func (e errReader) Read([]byte) (int, error) { return 0, e.err }
@@ -0,0 +1,111 @@
+package repack
+
+import (
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// DefaultCoverGlobs are well known cover image names, in order of preference.
+var DefaultCoverGlobs = []string{
+	"cover.jpg", "cover.jpeg", "cover.png",
+	"folder.jpg", "folder.jpeg", "folder.png",
+}
+
+// findCovers returns paths of images in dir matching any of globs case-insensitively,
+// ordered by the first matching glob.
+func findCovers(dir string, globs []string) ([]string, error) {
+	entries, errRead := os.ReadDir(dir)
+	if errRead != nil {
+		return nil, errRead
+	}
+
+	covers := []string{}
+	for _, glob := range globs {
+		for _, entry := range entries {
+			cover := filepath.Join(dir, entry.Name())
+			if entry.Type().IsRegular() && matchGlob(strings.ToLower(glob), strings.ToLower(entry.Name())) &&
+				!slices.Contains(covers, cover) {
+				covers = append(covers, cover)
+			}
+		}
+	}
+
+	return covers, nil
+}
+
+// coverRecords returns records of cover images of the book from dir, which are
+// not among found records already. A cover from the parent of dir is used for
+// books without their own if sharedCover is set.
+// Covers are named to sort before the book files, the preferred one is 00_cover.
+// The cover of meta found online is the last resort.
+// Found MP3 files get the preferred cover for embedding, if embedCover is set.
+func (p *processor) coverRecords(dir string, found []fileRecord, meta *fetchedMetadata) ([]fileRecord, error) {
+	covers, errFind := findCovers(dir, p.coverGlobs)
+	if errFind != nil {
+		return nil, errFind
+	}
+	if !p.covers {
+		// own covers are still good for embedding and suppress shared ones
+		covers = covers[:min(len(covers), 1)]
+	}
+
+	include := p.covers
+	if len(covers) == 0 && p.sharedCover {
+		abs, errAbs := filepath.Abs(dir)
+		if errAbs != nil {
+			return nil, errAbs
+		}
+		shared, errShared := findCovers(filepath.Dir(abs), p.coverGlobs)
+		if errShared != nil {
+			return nil, errShared
+		}
+		if len(shared) > 0 {
+			slog.Debug("using shared cover", "cover", shared[0], "dir", dir)
+			covers, include = shared[:1], true
+		}
+	}
+	if len(covers) == 0 && meta != nil && meta.cover != "" {
+		slog.Debug("using downloaded cover", "cover", meta.cover, "dir", dir)
+		covers, include = []string{meta.cover}, true
+	}
+	if len(covers) == 0 {
+		return nil, nil
+	}
+
+	if p.embedCover {
+		for i := range found {
+			if isMP3(found[i].path) {
+				found[i].edit().cover = covers[0]
+			}
+		}
+	}
+
+	if !include {
+		return nil, nil
+	}
+
+	records := []fileRecord{}
+	for i, cover := range covers {
+		if slices.ContainsFunc(found, func(record fileRecord) bool { return record.path == cover }) {
+			continue
+		}
+
+		name := "00_" + strings.ToLower(filepath.Base(cover))
+		if i == 0 {
+			name = "00_cover" + strings.ToLower(filepath.Ext(cover))
+		}
+		if p.keepDirs {
+			name = path.Join(strings.TrimSuffix(sanitizeDirPrefix(dir), "_"), name)
+		} else {
+			name = sanitizeDirPrefix(dir) + name
+		}
+
+		records = append(records, fileRecord{name: name, path: cover})
+	}
+
+	return records, nil
+}
@@ -0,0 +1,79 @@
+package repack
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"strings"
+)
+
+// cueName is named after the book, it lies in the archive root like playlists.
+func cueName(dir string) string {
+	return filepath.Base(filepath.Clean(dir)) + ".cue"
+}
+
+// cueSheet describes audio records of the book from dir: a track per source file,
+// indexed by offset inside of merged files. FILE paths are entry names.
+func (p *processor) cueSheet(dir string, records []fileRecord) string {
+	meta := readBookMetadata(dir, records, p.fixTags)
+
+	content := &strings.Builder{}
+	if len(meta.Authors) > 0 {
+		fmt.Fprintf(content, "PERFORMER %s\n", cueQuote(meta.Authors[0]))
+	}
+	fmt.Fprintf(content, "TITLE %s\n", cueQuote(meta.Title))
+
+	chapters := meta.Chapters
+	track := 0
+	for _, record := range records {
+		if !isAudio(record.path) && len(record.parts) == 0 {
+			continue
+		}
+
+		fileType := "WAVE"
+		if isMP3(record.name) {
+			fileType = "MP3"
+		}
+		fmt.Fprintf(content, "FILE %s %s\n", cueQuote(record.name), fileType)
+
+		sources := record.sources()
+		start := chapters[0].Start
+		for _, chapter := range chapters[:len(sources)] {
+			track++
+			fmt.Fprintf(content, "  TRACK %02d AUDIO\n", track)
+			fmt.Fprintf(content, "    TITLE %s\n", cueQuote(chapter.Title))
+			fmt.Fprintf(content, "    INDEX 01 %s\n", cueTime(chapter.Start-start))
+		}
+		chapters = chapters[len(sources):]
+	}
+	return content.String()
+}
+
+// cueQuote quotes s, CUE has no escapes, so double quotes become single ones.
+func cueQuote(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, "'") + `"`
+}
+
+// cueTime Formats seconds as MM:SS:FF with 75 frames per second.
+func cueTime(seconds float64) string {
+	frames := int64(seconds*75 + 0.5)
+	return fmt.Sprintf("%02d:%02d:%02d", frames/75/60, frames/75%60, frames%75)
+}
+
+// writeCueSheet adds a cue sheet of written records of the book from dir.
+func (p *processor) writeCueSheet(archive archiveWriter, dir string, records []fileRecord) error {
+	content := p.cueSheet(dir, records)
+	wr, errCreate := archive.create(archiveEntry{
+		name:    p.generatedName(cueName(dir)),
+		size:    int64(len(content)),
+		modTime: p.entryTime(nil),
+	})
+	if errCreate != nil {
+		return errCreate
+	}
+
+	slog.Debug("writing cue sheet", "name", cueName(dir))
+	_, errWrite := io.WriteString(wr, content)
+	return errWrite
+}
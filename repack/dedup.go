@@ -0,0 +1,139 @@
+package repack
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// duplicateFile is a source left out by -dedup, name is the entry of the identical file kept.
+// link is set for hardlinks of the kept file.
+type duplicateFile struct {
+	path, name string
+	link       bool
+}
+
+// fileKey is device and inode numbers of a file, names of the same file share it.
+type fileKey struct {
+	dev, ino uint64
+}
+
+// dropLinked leaves out files which are hardlinks of an earlier file of any book,
+// so content of the same inode is packed once. Unlike dropIdentical nothing is hashed.
+func (p *processor) dropLinked(books []book) error {
+	kept := map[fileKey]string{}
+	for i := range books {
+		records := books[i].records[:0]
+		for _, record := range books[i].records {
+			if record.rel == "" || record.zipped != nil {
+				records = append(records, record)
+				continue
+			}
+			info, err := os.Stat(record.path)
+			if err != nil {
+				return err
+			}
+			key, ok := inodeKey(info)
+			if !ok {
+				records = append(records, record)
+				continue
+			}
+			if name, ok := kept[key]; ok {
+				slog.Info("skipping hardlink", "file", record.path, "kept", name)
+				p.duplicates = append(p.duplicates, duplicateFile{path: record.path, name: name, link: true})
+				p.report.Duplicates = append(p.report.Duplicates, duplicateReport{Path: record.path, Of: name, Link: true})
+				continue
+			}
+			kept[key] = record.name
+			records = append(records, record)
+		}
+		books[i].records = records
+	}
+	return nil
+}
+
+// dropIdentical leaves out files byte-identical to an earlier file of any book.
+// Only files of the same size are hashed. Covers are kept, each book needs its own.
+func (p *processor) dropIdentical(books []book) error {
+	bySize := map[int64]int{}
+	sizes := map[string]int64{}
+	for _, b := range books {
+		for _, record := range b.records {
+			if record.rel == "" {
+				continue
+			}
+			size, err := sourceSize(record)
+			if err != nil {
+				return err
+			}
+			sizes[record.path] = size
+			bySize[size]++
+		}
+	}
+
+	kept := map[[sha256.Size]byte]string{}
+	for i := range books {
+		records := books[i].records[:0]
+		for _, record := range books[i].records {
+			size, ok := sizes[record.path]
+			if !ok || bySize[size] < 2 {
+				records = append(records, record)
+				continue
+			}
+
+			sum, err := sourceSum(record)
+			if err != nil {
+				return err
+			}
+			if name, ok := kept[sum]; ok {
+				slog.Info("skipping duplicate", "file", record.path, "kept", name)
+				p.duplicates = append(p.duplicates, duplicateFile{path: record.path, name: name})
+				p.report.Duplicates = append(p.report.Duplicates, duplicateReport{Path: record.path, Of: name})
+				continue
+			}
+			kept[sum] = record.name
+			records = append(records, record)
+		}
+		books[i].records = records
+	}
+	return nil
+}
+
+// sourceSize is size of the file or zip entry a record is packed from.
+func sourceSize(record fileRecord) (int64, error) {
+	if record.zipped != nil {
+		return int64(record.zipped.UncompressedSize64), nil
+	}
+	info, err := os.Stat(record.path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// sourceSum is SHA-256 of the file or zip entry a record is packed from.
+func sourceSum(record fileRecord) ([sha256.Size]byte, error) {
+	var src io.ReadCloser
+	if record.zipped != nil {
+		content, err := record.zipped.Open()
+		if err != nil {
+			return [sha256.Size]byte{}, fmt.Errorf("reading %q: %w", record.path, err)
+		}
+		src = content
+	} else {
+		file, _, err := openSourceFile(record.path)
+		if err != nil {
+			return [sha256.Size]byte{}, err
+		}
+		src = file
+	}
+	defer src.Close()
+
+	sum := sha256.New()
+	if _, err := io.Copy(sum, src); err != nil {
+		return [sha256.Size]byte{}, fmt.Errorf("hashing %q: %w", record.path, err)
+	}
+	return [sha256.Size]byte(sum.Sum(nil)), nil
+}
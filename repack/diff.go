@@ -0,0 +1,193 @@
+package repack
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// ErrDiffFound means compared archives or an archive and a dir have different files.
+var ErrDiffFound = errors.New("files differ")
+
+// diffItem is a compared file, crc is known if it's digested, sum if it's hashed too.
+type diffItem struct {
+	fileDigest
+	digested bool
+}
+
+// diffCompare compares a file of the other side with the entry of the same key, read digests the file.
+type diffCompare func(key string, item diffItem, read func() (diffItem, error)) error
+
+// diffOptions are how files are compared.
+type diffOptions struct {
+	withHash, skipTags bool
+	password           []byte
+}
+
+// needsContent reports whether the file name has to be read to compare it, sizes and CRCs of headers aren't enough.
+func (opts diffOptions) needsContent(name string) bool {
+	return opts.withHash || opts.skipTags && isMP3(name)
+}
+
+// DiffArchive compares entries of an archive with entries of another one or with files of a dir
+// and writes a line per difference into w: "- NAME" for entries missing in other, "+ NAME" for files
+// found only in other and "~ NAME: REASON" for changed ones. Entries of archives are matched by names.
+// A dir is the root books were packed from: entries with source paths are matched with files at paths
+// extract restores them to, see bookPath, generated entries are left out.
+// Files of equal size are compared by CRC and with withHash by SHA-256 too, zip CRCs are taken from headers.
+// With skipTags MP3 files are compared past their ID3v2 tags. Password decrypts entries of both archives.
+func DiffArchive(filename, other string, withHash, skipTags bool, password []byte, w io.Writer) error {
+	opts := diffOptions{withHash: withHash, skipTags: skipTags, password: password}
+
+	info, errStat := os.Stat(other)
+	if errStat != nil {
+		return errStat
+	}
+	keys, items, errItems := diffArchiveItems(filename, info.IsDir(), opts)
+	if errItems != nil {
+		return fmt.Errorf("reading %q: %w", filename, errItems)
+	}
+
+	same, changed, added := 0, 0, 0
+	seen := make(map[string]bool, len(items))
+	var compare diffCompare = func(key string, item diffItem, read func() (diffItem, error)) error {
+		want, ok := items[key]
+		if !ok {
+			added++
+			_, err := fmt.Fprintf(w, "+ %s\n", key)
+			return err
+		}
+		seen[key] = true
+
+		// sizes of MP3 files past tags are known once they're read
+		if !item.digested && (want.size == item.size || opts.needsContent(key)) {
+			var errRead error
+			if item, errRead = read(); errRead != nil {
+				return fmt.Errorf("reading %q: %w", key, errRead)
+			}
+		}
+		reason := ""
+		switch {
+		case want.size != item.size:
+			reason = fmt.Sprintf("size %d -> %d", want.size, item.size)
+		case want.crc != item.crc:
+			reason = fmt.Sprintf("crc %08x -> %08x", want.crc, item.crc)
+		case !bytes.Equal(want.sum, item.sum):
+			reason = fmt.Sprintf("sha256 %x -> %x", want.sum, item.sum)
+		}
+		if reason == "" {
+			same++
+			return nil
+		}
+		changed++
+		_, err := fmt.Fprintf(w, "~ %s: %s\n", key, reason)
+		return err
+	}
+
+	var errCompare error
+	if info.IsDir() {
+		errCompare = diffDir(other, opts, compare)
+	} else {
+		errCompare = diffOtherArchive(other, opts, compare)
+	}
+	if errCompare != nil {
+		return fmt.Errorf("reading %q: %w", other, errCompare)
+	}
+
+	removed := 0
+	for _, key := range keys {
+		if seen[key] {
+			continue
+		}
+		removed++
+		if _, err := fmt.Fprintf(w, "- %s\n", key); err != nil {
+			return err
+		}
+	}
+
+	slog.Info("compared", "same", same, "changed", changed, "added", added, "removed", removed)
+	if changed+added+removed > 0 {
+		return fmt.Errorf("%w: %d changed, %d added, %d removed", ErrDiffFound, changed, added, removed)
+	}
+	return nil
+}
+
+// diffArchiveItems digests entries of the archive keyed by names or, byBook, by book paths of their sources.
+// Keys are in order of entries.
+func diffArchiveItems(filename string, byBook bool, opts diffOptions) ([]string, map[string]diffItem, error) {
+	keys := []string{}
+	items := map[string]diffItem{}
+	err := readArchive(filename, opts.password, func(entry archiveEntry, content io.Reader) error {
+		key := entry.name
+		if byBook {
+			if entry.source == "" {
+				return nil
+			}
+			key = bookPath(entry.name, entry.source)
+		}
+
+		item, errItem := entryDiffItem(entry, content, opts)
+		if errItem != nil {
+			return errItem
+		}
+		if _, ok := items[key]; !ok {
+			keys = append(keys, key)
+		}
+		items[key] = item
+		return nil
+	})
+	return keys, items, err
+}
+
+// entryDiffItem reads the entry only if its header isn't enough to compare it.
+func entryDiffItem(entry archiveEntry, content io.Reader, opts diffOptions) (diffItem, error) {
+	const encrypted = 0x1
+	if entry.raw != nil && entry.raw.flags&encrypted == 0 && !opts.needsContent(entry.name) {
+		return diffItem{fileDigest: fileDigest{size: entry.size, crc: entry.raw.crc32}, digested: true}, nil
+	}
+	d, err := digestContent(content, entry.name, opts.withHash, opts.skipTags)
+	if err != nil {
+		return diffItem{}, err
+	}
+	return diffItem{fileDigest: d, digested: true}, nil
+}
+
+// diffOtherArchive compares entries of the other archive by names.
+func diffOtherArchive(filename string, opts diffOptions, compare diffCompare) error {
+	return readArchive(filename, opts.password, func(entry archiveEntry, content io.Reader) error {
+		item, errItem := entryDiffItem(entry, content, opts)
+		if errItem != nil {
+			return errItem
+		}
+		// entries are digested already
+		return compare(entry.name, item, nil)
+	})
+}
+
+// diffDir compares regular files under dir by slash separated relative paths, they are read only if sizes match.
+func diffDir(dir string, opts diffOptions, compare diffCompare) error {
+	return filepath.WalkDir(dir, func(filename string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return err
+		}
+		info, errInfo := entry.Info()
+		if errInfo != nil {
+			return errInfo
+		}
+		rel, errRel := filepath.Rel(dir, filename)
+		if errRel != nil {
+			return errRel
+		}
+
+		item := diffItem{fileDigest: fileDigest{size: info.Size()}}
+		return compare(filepath.ToSlash(rel), item, func() (diffItem, error) {
+			d, err := digestFile(filename, opts.withHash, opts.skipTags)
+			return diffItem{fileDigest: d, digested: true}, err
+		})
+	})
+}
@@ -0,0 +1,124 @@
+package repack
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DirOutputPrefix marks an output dir, like dir:/media/usb, entries are copied into it as files.
+const DirOutputPrefix = "dir:"
+
+// DirOutput returns the dir of a dir: output.
+func DirOutput(output string) (string, bool) {
+	dir, ok := strings.CutPrefix(output, DirOutputPrefix)
+	return dir, ok && dir != ""
+}
+
+// dirArchive copies entries into files of a dir tree, it implements outputArchive.
+// An entry is written into name.tmp and renamed into place when the next one is created,
+// so files in the dir are always complete. Finished files are kept on discard.
+type dirArchive struct {
+	dir     string
+	report  *Report
+	current *os.File
+	// entry is the current one, target is its file
+	entry   archiveEntry
+	target  string
+	counter *countingWriter
+	// written counts bytes of finished entries
+	written int64
+	closed  bool
+}
+
+func createDirArchive(dir string, report *Report) (*dirArchive, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &dirArchive{dir: dir, report: report}, nil
+}
+
+func (a *dirArchive) create(entry archiveEntry) (io.Writer, error) {
+	if err := a.finish(); err != nil {
+		return nil, err
+	}
+
+	name := filepath.FromSlash(entry.name)
+	if !filepath.IsLocal(name) {
+		return nil, fmt.Errorf("entry %q would be written outside of %s", entry.name, a.dir)
+	}
+	target := filepath.Join(a.dir, name)
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return nil, err
+	}
+	file, errFile := openNoFollow(target+tmpSuffix, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if errFile != nil {
+		return nil, errFile
+	}
+	a.current, a.entry, a.target = file, entry, target
+	a.counter = &countingWriter{dst: file}
+	return a.counter, nil
+}
+
+// finish closes the current entry file and puts it in place with the entry mtime.
+func (a *dirArchive) finish() error {
+	if a.current == nil {
+		return nil
+	}
+	file := a.current
+	a.current = nil
+	a.written += a.counter.n
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Chtimes(file.Name(), a.entry.modTime, a.entry.modTime); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), a.target)
+}
+
+// dropEntry removes the file of the current entry, nothing of it is counted.
+func (a *dirArchive) dropEntry() error {
+	if a.current == nil {
+		return nil
+	}
+	file := a.current
+	a.current = nil
+	_ = file.Close()
+	return os.Remove(file.Name())
+}
+
+func (a *dirArchive) Close() error {
+	if a.closed {
+		return nil
+	}
+	a.closed = true
+	return a.finish()
+}
+
+func (a *dirArchive) commit() error {
+	if err := a.Close(); err != nil {
+		return err
+	}
+	a.report.upload(DirOutputPrefix+a.dir, a.written)
+	return nil
+}
+
+// discard removes the unfinished entry, files copied before stay.
+func (a *dirArchive) discard() {
+	if a.current == nil {
+		return
+	}
+	_ = a.current.Close()
+	removeIncomplete(a.current.Name())
+	a.current = nil
+	a.closed = true
+	slog.Info("kept copied files", "dir", a.dir)
+}
+
+func (a *dirArchive) outputDir() string {
+	return a.dir
+}
@@ -0,0 +1,63 @@
+package repack
+
+import (
+	"fmt"
+	"log/slog"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// discDirPattern matches names of disc subdirs like CD1, CD 02, Disc_1, Disk-3 or Part 2.
+var discDirPattern = regexp.MustCompile(`(?i)^(?:cd|dis[ck]|part)[\s._-]*(\d{1,3})$`)
+
+// trackPrefix is a track number leading a file name, like "01 - " or "1. ".
+var trackPrefix = regexp.MustCompile(`^\d{1,3}(?:[\s._-]+|$)`)
+
+// discNumber returns the number of the disc subdir a file at rel lies in, 0 outside of disc subdirs.
+func discNumber(rel string) int {
+	first, _, nested := strings.Cut(rel, "/")
+	if !nested {
+		return 0
+	}
+	match := discDirPattern.FindStringSubmatch(first)
+	if match == nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(match[1])
+	return n
+}
+
+// renumberDiscs renames records of a book with files in two or more disc subdirs
+// to "NN - NAME.ext" numbered continuously in packing order, so players which
+// don't know discs play the whole book in order. Track numbers leading NAME are dropped.
+func renumberDiscs(dir string, records []fileRecord, keepDirs bool) {
+	discs := map[int]bool{}
+	for _, record := range records {
+		if n := discNumber(record.rel); n > 0 {
+			discs[n] = true
+		}
+	}
+	if len(discs) < 2 {
+		return
+	}
+
+	prefix := sanitizeDirPrefix(dir)
+	if keepDirs && prefix != "" {
+		prefix = strings.TrimSuffix(prefix, "_") + "/"
+	}
+	width := max(2, len(strconv.Itoa(len(records))))
+	for i := range records {
+		base := path.Base(records[i].rel)
+		ext := path.Ext(base)
+		title := trackPrefix.ReplaceAllString(strings.TrimSuffix(base, ext), "")
+
+		name := fmt.Sprintf("%s%0*d%s", prefix, width, i+1, ext)
+		if title != "" {
+			name = fmt.Sprintf("%s%0*d - %s%s", prefix, width, i+1, title, ext)
+		}
+		slog.Debug("renumbered file", "file", records[i].rel, "name", name)
+		records[i].name = name
+	}
+}
@@ -0,0 +1,191 @@
+package repack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"path"
+	"strings"
+)
+
+// plannedEntry is an archive entry which is going to be written.
+type plannedEntry struct {
+	name string
+	// source is the original file path, empty for generated entries
+	source string
+}
+
+// plan lists entries in the same order process writes them.
+func (p *processor) plan(books []book) []plannedEntry {
+	entries := []plannedEntry{}
+	for i, b := range books {
+		if i > 0 && p.gap > 0 {
+			entries = append(entries, plannedEntry{name: p.generatedName(gapName(books[i-1].dir))})
+		}
+		if p.bookDividers {
+			entries = append(entries, plannedEntry{name: p.generatedName(dividerName(b.dir))})
+		}
+		for _, record := range b.records {
+			entries = append(entries, plannedEntry{name: record.name, source: record.path})
+		}
+		if p.playlists {
+			entries = append(entries, plannedEntry{name: p.generatedName(playlistName(b.dir))})
+		}
+		if p.cueSheets {
+			entries = append(entries, plannedEntry{name: p.generatedName(cueName(b.dir))})
+		}
+		if p.bookMetadata {
+			entries = append(entries, plannedEntry{name: p.generatedName(p.metadataEntryName(b.dir))})
+		}
+	}
+	return entries
+}
+
+// collisions groups entries sharing the same name, in order of first occurrence.
+func collisions(entries []plannedEntry) [][]plannedEntry {
+	byName := map[string][]plannedEntry{}
+	names := []string{}
+	for _, entry := range entries {
+		if _, ok := byName[entry.name]; !ok {
+			names = append(names, entry.name)
+		}
+		byName[entry.name] = append(byName[entry.name], entry)
+	}
+
+	groups := [][]plannedEntry{}
+	for _, name := range names {
+		if len(byName[name]) > 1 {
+			groups = append(groups, byName[name])
+		}
+	}
+	return groups
+}
+
+const (
+	CollisionFail   = "fail"
+	CollisionSuffix = "suffix"
+)
+
+var errNameCollision = errors.New("entry name collision")
+
+// resolveCollisions fails on entries sharing a name or, with suffix policy,
+// renames all but the first one to name_2.ext, name_3.ext and so on.
+// Generated entries are never renamed.
+func (p *processor) resolveCollisions(books []book) error {
+	groups := collisions(p.plan(books))
+	if len(groups) > 0 && p.onCollision == CollisionSuffix {
+		p.suffixCollisions(books)
+		groups = collisions(p.plan(books))
+	}
+	if len(groups) == 0 {
+		return nil
+	}
+
+	report := []string{}
+	for _, group := range groups {
+		sources := make([]string, 0, len(group))
+		for _, entry := range group {
+			source := entry.source
+			if source == "" {
+				source = "(generated)"
+			}
+			sources = append(sources, source)
+		}
+		report = append(report, fmt.Sprintf("%q is produced by %s", group[0].name, strings.Join(sources, ", ")))
+	}
+
+	return fmt.Errorf("%w: %s", errNameCollision, strings.Join(report, "; "))
+}
+
+func (p *processor) suffixCollisions(books []book) {
+	used := map[string]bool{}
+	seen := map[string]bool{}
+	for _, entry := range p.plan(books) {
+		used[entry.name] = true
+		if entry.source == "" {
+			seen[entry.name] = true
+		}
+	}
+
+	for _, b := range books {
+		for i, record := range b.records {
+			if !seen[record.name] {
+				seen[record.name] = true
+				continue
+			}
+
+			ext := path.Ext(record.name)
+			base := strings.TrimSuffix(record.name, ext)
+			for n := 2; ; n++ {
+				candidate := fmt.Sprintf("%s_%d%s", base, n, ext)
+				if !used[candidate] {
+					slog.Info("renaming colliding entry", "name", record.name, "to", candidate)
+					b.records[i].name = candidate
+					used[candidate], seen[candidate] = true, true
+					break
+				}
+			}
+		}
+	}
+}
+
+// dryRun prints planned archive layout to w.
+func (p *processor) dryRun(ctx context.Context, w io.Writer, dirs, fileGlobs []string) error {
+	books, errDiscover := p.discover(ctx, dirs, fileGlobs)
+	if errDiscover != nil {
+		return errDiscover
+	}
+
+	if p.mergeArchives {
+		dropDuplicates(books)
+	}
+	if !p.mergePerBook {
+		if err := p.dropLinked(books); err != nil {
+			return fmt.Errorf("looking for hardlinks: %w", err)
+		}
+	}
+	if p.dedup {
+		if err := p.dropIdentical(books); err != nil {
+			return fmt.Errorf("looking for duplicates: %w", err)
+		}
+	}
+
+	books, errReview := p.review(books)
+	if errReview != nil {
+		return errReview
+	}
+	p.splitFolders(books)
+	if err := p.sanitizeNames(books); err != nil {
+		return err
+	}
+	p.warnIncompatible(books)
+
+	if p.onCollision == CollisionSuffix {
+		p.suffixCollisions(books)
+	}
+
+	entries := p.plan(books)
+	for _, entry := range entries {
+		source := entry.source
+		if source == "" {
+			source = "(generated)"
+		}
+		if _, err := fmt.Fprintf(w, "%s\t<- %s\n", entry.name, source); err != nil {
+			return err
+		}
+	}
+
+	groups := collisions(entries)
+	for _, group := range groups {
+		fmt.Fprintf(w, "collision: %q is produced by:\n", group[0].name)
+		for _, entry := range group {
+			fmt.Fprintf(w, "\t%s\n", entry.source)
+		}
+	}
+
+	fmt.Fprintf(w, "%d entries, %d collisions\n", len(entries), len(groups))
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package repack
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+var errUnsupportedFormat = errors.New("unsupported audio format")
+
+// audioExts are extensions of audio files, they are all compressed already.
+var audioExts = []string{
+	".mp3", ".m4a", ".m4b", ".aac", ".flac", ".ogg", ".oga", ".opus", ".wma",
+}
+
+func isAudio(filename string) bool {
+	return slices.Contains(audioExts, strings.ToLower(filepath.Ext(filename)))
+}
+
+// audioDuration returns play time of an audio file, picking parser by extension.
+func audioDuration(filename string) (time.Duration, error) {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".mp3":
+		return mp3Duration(filename)
+	case ".m4a", ".m4b", ".mp4":
+		return mp4Duration(filename)
+	default:
+		return 0, fmt.Errorf("%w: %q", errUnsupportedFormat, filename)
+	}
+}
+
+// readDuration is audioDuration of size bytes of audio read from a stream, like an archive entry.
+func readDuration(name string, re io.Reader, size int64) (time.Duration, error) {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".mp3":
+		return readMP3Duration(bufio.NewReaderSize(re, 64*1024))
+	case ".m4a", ".m4b", ".mp4":
+		return readMP4Duration(&forwardReaderAt{re: re}, size)
+	default:
+		return 0, fmt.Errorf("%w: %q", errUnsupportedFormat, name)
+	}
+}
+
+// forwardReaderAt reads a stream at growing offsets, skipping bytes in between,
+// which is enough to walk MP4 boxes. A moov box after media data is found by reading through it.
+type forwardReaderAt struct {
+	re     io.Reader
+	offset int64
+}
+
+func (f *forwardReaderAt) ReadAt(p []byte, offset int64) (int, error) {
+	if offset < f.offset {
+		return 0, fmt.Errorf("reading at %d behind the stream at %d", offset, f.offset)
+	}
+	if _, err := io.CopyN(io.Discard, f.re, offset-f.offset); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(f.re, p)
+	f.offset = offset + int64(n)
+	return n, err
+}
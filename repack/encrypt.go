@@ -0,0 +1,355 @@
+package repack
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// WinZip AES encryption: entries get method 99 and an extra field with the real method,
+// data is salt, password verifier, AES-CTR encrypted compressed data and HMAC-SHA1 code.
+// Entries are AE-1, CRC of plain data is kept in headers.
+const (
+	zipAES        = 99
+	aesExtraID    = 0x9901
+	aesVersion    = 1 // AE-1
+	aesStrength   = 3 // AES-256
+	aesSaltSize   = 16
+	aesVerifySize = 2
+	aesMACSize    = 10
+	aesIterations = 1000
+	// aesReaderVersion is the version needed to extract AES entries, 5.1
+	aesReaderVersion = 51
+)
+
+var (
+	errEncrypted     = errors.New("entry is encrypted, a password is needed")
+	errWrongPassword = errors.New("wrong password")
+	errAuthFailed    = errors.New("encrypted data is corrupt or tampered with")
+)
+
+// aesExtra is the extra field of an encrypted entry compressed with method.
+func aesExtra(method uint16) []byte {
+	extra := make([]byte, 0, 11)
+	extra = binary.LittleEndian.AppendUint16(extra, aesExtraID)
+	extra = binary.LittleEndian.AppendUint16(extra, 7)
+	extra = binary.LittleEndian.AppendUint16(extra, aesVersion)
+	extra = append(extra, 'A', 'E', aesStrength)
+	return binary.LittleEndian.AppendUint16(extra, method)
+}
+
+// parseAESExtra finds the AES extra field and returns the real method, version and salt size.
+func parseAESExtra(extra []byte) (method, version uint16, saltSize int, err error) {
+	for len(extra) >= 4 {
+		id, size := binary.LittleEndian.Uint16(extra), int(binary.LittleEndian.Uint16(extra[2:]))
+		extra = extra[4:]
+		if size > len(extra) {
+			break
+		}
+		if id == aesExtraID && size >= 7 {
+			field := extra[:size]
+			saltSizes := map[byte]int{1: 8, 2: 12, 3: 16}
+			saltSize, ok := saltSizes[field[4]]
+			if !ok {
+				return 0, 0, 0, fmt.Errorf("unknown AES strength %d", field[4])
+			}
+			return binary.LittleEndian.Uint16(field[5:]), binary.LittleEndian.Uint16(field), saltSize, nil
+		}
+		extra = extra[size:]
+	}
+	return 0, 0, 0, errors.New("AES extra field is missing")
+}
+
+// aesKeys derives encryption and authentication keys and the password verifier.
+func aesKeys(password, salt []byte) (encKey, macKey, verifier []byte) {
+	keySize := len(salt) * 2 // 16 bytes for 8 bytes of salt, up to 32 for 16
+	derived := pbkdf2SHA1(password, salt, aesIterations, 2*keySize+aesVerifySize)
+	return derived[:keySize], derived[keySize : 2*keySize], derived[2*keySize:]
+}
+
+// pbkdf2SHA1 is PBKDF2 of RFC 8018 with HMAC-SHA1.
+func pbkdf2SHA1(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha1.New, password)
+	derived := make([]byte, 0, keyLen+sha1.Size)
+	u := make([]byte, sha1.Size)
+	for block := uint32(1); len(derived) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(binary.BigEndian.AppendUint32(nil, block))
+		u = prf.Sum(u[:0])
+		t := bytes.Clone(u)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			subtle.XORBytes(t, t, u)
+		}
+		derived = append(derived, t...)
+	}
+	return derived[:keyLen]
+}
+
+// aesCTR is the WinZip flavor of CTR mode: the counter is little-endian and starts at 1.
+type aesCTR struct {
+	block   cipher.Block
+	counter [aes.BlockSize]byte
+	stream  [aes.BlockSize]byte
+	used    int
+}
+
+func newAESCTR(key []byte) (*aesCTR, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &aesCTR{block: block, used: aes.BlockSize}, nil
+}
+
+func (c *aesCTR) XORKeyStream(dst, src []byte) {
+	for i := range src {
+		if c.used == aes.BlockSize {
+			for j := range c.counter {
+				c.counter[j]++
+				if c.counter[j] != 0 {
+					break
+				}
+			}
+			c.block.Encrypt(c.stream[:], c.counter[:])
+			c.used = 0
+		}
+		dst[i] = src[i] ^ c.stream[c.used]
+		c.used++
+	}
+}
+
+// aesWriter encrypts compressed data of an entry, the authentication code is written on Close.
+type aesWriter struct {
+	dst io.Writer
+	ctr *aesCTR
+	mac hash.Hash
+	buf []byte
+	// header is salt and password verifier, zip writer creates compressors
+	// before it writes the local header, so they are written with the first data
+	header []byte
+}
+
+// newAESWriter derives keys, salt and password verifier precede encrypted data in dst.
+func newAESWriter(dst io.Writer, password []byte) (*aesWriter, error) {
+	salt := make([]byte, aesSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	encKey, macKey, verifier := aesKeys(password, salt)
+	ctr, errCTR := newAESCTR(encKey)
+	if errCTR != nil {
+		return nil, errCTR
+	}
+	return &aesWriter{dst: dst, ctr: ctr, mac: hmac.New(sha1.New, macKey), header: append(salt, verifier...)}, nil
+}
+
+func (w *aesWriter) writeHeader() error {
+	if w.header == nil {
+		return nil
+	}
+	_, err := w.dst.Write(w.header)
+	w.header = nil
+	return err
+}
+
+func (w *aesWriter) Write(p []byte) (int, error) {
+	if err := w.writeHeader(); err != nil {
+		return 0, err
+	}
+	w.buf = append(w.buf[:0], p...)
+	w.ctr.XORKeyStream(w.buf, w.buf)
+	w.mac.Write(w.buf)
+	return w.dst.Write(w.buf)
+}
+
+func (w *aesWriter) Close() error {
+	if err := w.writeHeader(); err != nil {
+		return err
+	}
+	_, err := w.dst.Write(w.mac.Sum(nil)[:aesMACSize])
+	return err
+}
+
+// encryptingCompressor compresses with the real method of the entry and encrypts the result.
+type encryptingCompressor struct {
+	compressor io.WriteCloser
+	encryptor  *aesWriter
+}
+
+func (c *encryptingCompressor) Write(p []byte) (int, error) {
+	return c.compressor.Write(p)
+}
+
+func (c *encryptingCompressor) Close() error {
+	if err := c.compressor.Close(); err != nil {
+		return err
+	}
+	return c.encryptor.Close()
+}
+
+// registerEncryption makes zip writer encrypt entries of method zipAES,
+// entry returns the header of the entry being created and its real method.
+func registerEncryption(zw *zip.Writer, compressors map[uint16]zip.Compressor, password []byte, entry func() (*zip.FileHeader, uint16)) {
+	zw.RegisterCompressor(zipAES, func(w io.Writer) (io.WriteCloser, error) {
+		header, method := entry()
+		// CreateHeader resets the version before it creates the compressor and writes the local header after.
+		// Entries over 4 GiB get 4.5 of ZIP64 in the central directory when they are closed.
+		header.ReaderVersion = aesReaderVersion
+		encryptor, errEncrypt := newAESWriter(w, password)
+		if errEncrypt != nil {
+			return nil, errEncrypt
+		}
+		compress, ok := compressors[method]
+		if !ok {
+			return nil, fmt.Errorf("%w: method %d", zip.ErrAlgorithm, method)
+		}
+		compressor, errCompress := compress(encryptor)
+		if errCompress != nil {
+			return nil, errCompress
+		}
+		return &encryptingCompressor{compressor: compressor, encryptor: encryptor}, nil
+	})
+}
+
+// openEncrypted decrypts and decompresses an AES entry, checking the authentication code and CRC at the end.
+func openEncrypted(file *zip.File, password []byte) (io.ReadCloser, error) {
+	if len(password) == 0 {
+		return nil, errEncrypted
+	}
+	method, version, saltSize, errExtra := parseAESExtra(file.Extra)
+	if errExtra != nil {
+		return nil, errExtra
+	}
+	overhead := uint64(saltSize + aesVerifySize + aesMACSize)
+	if file.CompressedSize64 < overhead {
+		return nil, zip.ErrFormat
+	}
+
+	raw, errRaw := file.OpenRaw()
+	if errRaw != nil {
+		return nil, errRaw
+	}
+	header := make([]byte, saltSize+aesVerifySize)
+	if _, err := io.ReadFull(raw, header); err != nil {
+		return nil, err
+	}
+	encKey, macKey, verifier := aesKeys(password, header[:saltSize])
+	if !bytes.Equal(verifier, header[saltSize:]) {
+		return nil, errWrongPassword
+	}
+	ctr, errCTR := newAESCTR(encKey)
+	if errCTR != nil {
+		return nil, errCTR
+	}
+
+	decrypted := &aesReader{
+		src: io.LimitReader(raw, int64(file.CompressedSize64-overhead)),
+		raw: raw,
+		ctr: ctr,
+		mac: hmac.New(sha1.New, macKey),
+	}
+
+	var content io.ReadCloser
+	switch method {
+	case zip.Store:
+		content = io.NopCloser(decrypted)
+	case zip.Deflate:
+		content = flate.NewReader(decrypted)
+	case zipZstd:
+		decoder, err := zstd.NewReader(decrypted, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		content = decoder.IOReadCloser()
+	default:
+		return nil, fmt.Errorf("%w: method %d", zip.ErrAlgorithm, method)
+	}
+
+	check := &crcReader{src: content, crc: crc32.NewIEEE(), want: file.CRC32, size: file.UncompressedSize64, decrypted: decrypted}
+	// AE-2 entries have no CRC, the authentication code covers them
+	check.skipCRC = version == 2
+	return check, nil
+}
+
+// aesReader decrypts entry data and checks the authentication code which follows it.
+type aesReader struct {
+	src io.Reader
+	raw io.Reader
+	ctr *aesCTR
+	mac hash.Hash
+	// checked is set once the authentication code matched
+	checked bool
+}
+
+func (r *aesReader) Read(p []byte) (int, error) {
+	if r.checked {
+		return 0, io.EOF
+	}
+	n, err := r.src.Read(p)
+	r.mac.Write(p[:n])
+	r.ctr.XORKeyStream(p[:n], p[:n])
+	if errors.Is(err, io.EOF) {
+		code := make([]byte, aesMACSize)
+		if _, errCode := io.ReadFull(r.raw, code); errCode != nil {
+			return n, errCode
+		}
+		if !hmac.Equal(code, r.mac.Sum(nil)[:aesMACSize]) {
+			return n, errAuthFailed
+		}
+		r.checked = true
+	}
+	return n, err
+}
+
+// crcReader checks size and CRC of decrypted content once it's read to the end.
+type crcReader struct {
+	src       io.ReadCloser
+	decrypted *aesReader
+	crc       hash.Hash32
+	want      uint32
+	size      uint64
+	read      uint64
+	skipCRC   bool
+}
+
+func (r *crcReader) Read(p []byte) (int, error) {
+	n, err := r.src.Read(p)
+	r.crc.Write(p[:n])
+	r.read += uint64(n)
+	if !errors.Is(err, io.EOF) {
+		return n, err
+	}
+	// the decompressor may stop before the authentication code is read
+	if _, errRest := io.Copy(io.Discard, r.decrypted); errRest != nil {
+		return n, errRest
+	}
+	switch {
+	case r.read != r.size:
+		return n, fmt.Errorf("%w: read %d bytes, header says %d", zip.ErrFormat, r.read, r.size)
+	case !r.skipCRC && r.crc.Sum32() != r.want:
+		return n, zip.ErrChecksum
+	}
+	return n, err
+}
+
+func (r *crcReader) Close() error {
+	return r.src.Close()
+}
@@ -0,0 +1,272 @@
+package repack
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// googleBooksURL is the volume search endpoint of Google Books API, it needs no key.
+const googleBooksURL = "https://www.googleapis.com/books/v1/volumes"
+
+// fetchTimeout limits a single metadata or cover request.
+const fetchTimeout = 15 * time.Second
+
+var errFetch = errors.New("fetching metadata")
+
+// fetchedMetadata is a book found online. Empty Title means nothing was found,
+// such results are cached too, so books are looked up once.
+type fetchedMetadata struct {
+	Title       string   `json:"title"`
+	Authors     []string `json:"authors"`
+	Publisher   string   `json:"publisher"`
+	Published   string   `json:"publishedDate"`
+	Description string   `json:"description"`
+	ISBN        string   `json:"isbn"`
+	Genres      []string `json:"genres"`
+	Language    string   `json:"language"`
+	CoverURL    string   `json:"coverURL"`
+
+	// cover is path of the downloaded cover image in cache, empty if there is none
+	cover string
+}
+
+// metadataFetcher looks books up in Google Books, keeping responses and covers in cacheDir.
+// Cached books are never requested again, so repeated runs work offline.
+type metadataFetcher struct {
+	client   *http.Client
+	endpoint string
+	cacheDir string
+}
+
+func newMetadataFetcher(cacheDir string) *metadataFetcher {
+	return &metadataFetcher{
+		client:   &http.Client{Timeout: fetchTimeout},
+		endpoint: googleBooksURL,
+		cacheDir: cacheDir,
+	}
+}
+
+// DefaultMetadataCache is the per-user dir of cached lookups.
+func DefaultMetadataCache() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "audiobook-repack", "metadata")
+}
+
+// decorations are bracketed parts of dir names like "(2019)" or "[Unabridged]".
+var decorations = regexp.MustCompile(`\s*[\(\[][^\)\]]*[\)\]]`)
+
+// parseBookDir guesses title and author from the book dir name "Author - Title".
+func parseBookDir(dir string) (title, author string) {
+	name := decorations.ReplaceAllString(filepath.Base(filepath.Clean(dir)), "")
+	name = strings.Join(strings.Fields(strings.ReplaceAll(name, "_", " ")), " ")
+	if before, after, ok := strings.Cut(name, " - "); ok {
+		return strings.TrimSpace(after), strings.TrimSpace(before)
+	}
+	return name, ""
+}
+
+// lookup returns metadata of the book from dir, nil if it's not found.
+func (f *metadataFetcher) lookup(ctx context.Context, dir string) (*fetchedMetadata, error) {
+	title, author := parseBookDir(dir)
+	if title == "" {
+		return nil, nil
+	}
+
+	query := "intitle:" + title
+	if author != "" {
+		query += " inauthor:" + author
+	}
+	key := sha256.Sum256([]byte(query))
+	cached := filepath.Join(f.cacheDir, hex.EncodeToString(key[:16]))
+
+	meta, errCache := readCachedMetadata(cached + ".json")
+	if errors.Is(errCache, fs.ErrNotExist) {
+		meta, errCache = f.search(ctx, query)
+		if errCache == nil {
+			errCache = writeCached(cached+".json", meta)
+		}
+	}
+	if errCache != nil {
+		return nil, fmt.Errorf("%w: %q: %w", errFetch, query, errCache)
+	}
+	if meta.Title == "" {
+		slog.Info("no metadata found", "query", query)
+		return nil, nil
+	}
+
+	if meta.CoverURL != "" {
+		cover, errCover := f.cover(ctx, cached, meta.CoverURL)
+		if errCover != nil {
+			slog.Warn("downloading cover", "title", meta.Title, "err", errCover)
+		}
+		meta.cover = cover
+	}
+
+	slog.Info("found metadata", "dir", dir, "title", meta.Title, "authors", strings.Join(meta.Authors, ", "))
+	return meta, nil
+}
+
+func readCachedMetadata(filename string) (*fetchedMetadata, error) {
+	content, errRead := os.ReadFile(filename)
+	if errRead != nil {
+		return nil, errRead
+	}
+	meta := &fetchedMetadata{}
+	if err := json.Unmarshal(content, meta); err != nil {
+		return nil, fmt.Errorf("reading cache %q: %w", filename, err)
+	}
+	return meta, nil
+}
+
+// writeCached stores meta through a temporary file, so parallel lookups never see half written entries.
+func writeCached(filename string, meta *fetchedMetadata) error {
+	content, errJSON := json.Marshal(meta)
+	if errJSON != nil {
+		return errJSON
+	}
+	return writeCacheFile(filename, content)
+}
+
+func writeCacheFile(filename string, content []byte) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0o700); err != nil {
+		return err
+	}
+	tmp, errTmp := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+"*"+tmpSuffix)
+	if errTmp != nil {
+		return errTmp
+	}
+	_, errWrite := tmp.Write(content)
+	if err := errors.Join(errWrite, tmp.Close()); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// googleVolumes is the subset of Google Books search response in use.
+type googleVolumes struct {
+	Items []struct {
+		VolumeInfo struct {
+			Title               string   `json:"title"`
+			Subtitle            string   `json:"subtitle"`
+			Authors             []string `json:"authors"`
+			Publisher           string   `json:"publisher"`
+			PublishedDate       string   `json:"publishedDate"`
+			Description         string   `json:"description"`
+			Categories          []string `json:"categories"`
+			Language            string   `json:"language"`
+			IndustryIdentifiers []struct {
+				Type       string `json:"type"`
+				Identifier string `json:"identifier"`
+			} `json:"industryIdentifiers"`
+			ImageLinks map[string]string `json:"imageLinks"`
+		} `json:"volumeInfo"`
+	} `json:"items"`
+}
+
+// search requests the best match of query, empty metadata means there is none.
+func (f *metadataFetcher) search(ctx context.Context, query string) (*fetchedMetadata, error) {
+	body, errGet := f.get(ctx, f.endpoint+"?"+url.Values{"q": {query}, "maxResults": {"1"}}.Encode())
+	if errGet != nil {
+		return nil, errGet
+	}
+	defer body.Close()
+
+	volumes := googleVolumes{}
+	if err := json.NewDecoder(body).Decode(&volumes); err != nil {
+		return nil, fmt.Errorf("decoding response: %w", err)
+	}
+	if len(volumes.Items) == 0 {
+		return &fetchedMetadata{}, nil
+	}
+
+	info := volumes.Items[0].VolumeInfo
+	meta := &fetchedMetadata{
+		Title:       info.Title,
+		Authors:     info.Authors,
+		Publisher:   info.Publisher,
+		Published:   info.PublishedDate,
+		Description: info.Description,
+		Genres:      info.Categories,
+		Language:    info.Language,
+	}
+	if info.Subtitle != "" {
+		meta.Title += ": " + info.Subtitle
+	}
+	for _, id := range info.IndustryIdentifiers {
+		if id.Type == "ISBN_13" || id.Type == "ISBN_10" && meta.ISBN == "" {
+			meta.ISBN = id.Identifier
+		}
+	}
+	for _, size := range []string{"extraLarge", "large", "medium", "thumbnail"} {
+		if link := info.ImageLinks[size]; link != "" {
+			meta.CoverURL = strings.Replace(link, "http://", "https://", 1)
+			break
+		}
+	}
+
+	return meta, nil
+}
+
+// cover returns path of the cover image downloaded once into cached.jpg or cached.png.
+func (f *metadataFetcher) cover(ctx context.Context, cached, link string) (string, error) {
+	for _, ext := range []string{".jpg", ".png"} {
+		if _, err := os.Stat(cached + ext); err == nil {
+			return cached + ext, nil
+		}
+	}
+
+	body, errGet := f.get(ctx, link)
+	if errGet != nil {
+		return "", errGet
+	}
+	defer body.Close()
+
+	image, errRead := io.ReadAll(io.LimitReader(body, 16<<20))
+	if errRead != nil {
+		return "", errRead
+	}
+
+	ext := ".jpg"
+	if mimeType, _, _ := mime.ParseMediaType(http.DetectContentType(image)); mimeType == "image/png" {
+		ext = ".png"
+	}
+	if err := writeCacheFile(cached+ext, image); err != nil {
+		return "", err
+	}
+	return cached + ext, nil
+}
+
+func (f *metadataFetcher) get(ctx context.Context, link string) (io.ReadCloser, error) {
+	req, errReq := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+	if errReq != nil {
+		return nil, errReq
+	}
+	resp, errDo := f.client.Do(req)
+	if errDo != nil {
+		return nil, errDo
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", link, resp.Status)
+	}
+	return resp.Body, nil
+}
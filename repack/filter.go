@@ -0,0 +1,52 @@
+package repack
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"time"
+)
+
+// fileFilter drops files found in book dirs and zip inputs by size and duration, zero fields don't limit.
+type fileFilter struct {
+	minSize, maxSize int64
+	minDuration      time.Duration
+}
+
+// keep reports whether file name of fsys passes the filter, source is the file in logs.
+// Only MP3 and MP4 durations are known, other files and files with unreadable durations pass minDuration.
+func (f fileFilter) keep(fsys fs.FS, name, source string) (bool, error) {
+	if f == (fileFilter{}) {
+		return true, nil
+	}
+	info, errStat := fs.Stat(fsys, name)
+	if errStat != nil {
+		return false, errStat
+	}
+	size := info.Size()
+	if size < f.minSize || f.maxSize > 0 && size > f.maxSize {
+		slog.Debug("filtered file by size", "file", source, "size", formatSize(size))
+		return false, nil
+	}
+	if f.minDuration == 0 {
+		return true, nil
+	}
+
+	file, errOpen := fsys.Open(name)
+	if errOpen != nil {
+		return false, errOpen
+	}
+	defer file.Close()
+	duration, errDuration := readDuration(name, file, size)
+	switch {
+	case errors.Is(errDuration, errUnsupportedFormat):
+		return true, nil
+	case errDuration != nil:
+		slog.Warn("unknown duration", "file", source, "err", errDuration)
+		return true, nil
+	case duration < f.minDuration:
+		slog.Debug("filtered file by duration", "file", source, "duration", duration)
+		return false, nil
+	}
+	return true, nil
+}
@@ -0,0 +1,84 @@
+package repack
+
+import (
+	"path"
+	"slices"
+	"strings"
+)
+
+// DefaultGlobs match audio files by their extensions in any case, they're used when Options.Globs is nil.
+var DefaultGlobs = func() []string {
+	globs := make([]string, 0, len(audioExts))
+	for _, ext := range audioExts {
+		globs = append(globs, "*"+ext)
+	}
+	return globs
+}()
+
+// DefaultM4BGlobs replace DefaultGlobs for m4b output, chapters need durations, which are known for MP3 and MP4 only.
+var DefaultM4BGlobs = []string{"*.mp3", "*.m4a", "*.m4b", "*.mp4"}
+
+// globSegments splits pattern by slashes. A "**" segment matches zero or more
+// path segments, "**" leading a segment ("**.mp3") is the same as "**/*.mp3".
+// Elsewhere "**" acts like a single "*".
+func globSegments(pattern string) []string {
+	segments := []string{}
+	for _, segment := range strings.Split(pattern, "/") {
+		switch {
+		case segment == "**":
+			segments = append(segments, segment)
+		case strings.HasPrefix(segment, "**"):
+			segments = append(segments, "**", "*"+strings.TrimLeft(segment, "*"))
+		default:
+			segments = append(segments, strings.ReplaceAll(segment, "**", "*"))
+		}
+	}
+	return segments
+}
+
+// ValidateGlob reports malformed patterns up front, as matchGlob ignores them.
+func ValidateGlob(pattern string) error {
+	for _, segment := range globSegments(pattern) {
+		if _, err := path.Match(segment, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matchGlob matches slash separated name against pattern with "**" support.
+func matchGlob(pattern, name string) bool {
+	return matchGlobSegments(globSegments(pattern), strings.Split(name, "/"))
+}
+
+// matchFileGlob matches name against an include or exclude glob, ignoring case if fold is set.
+// DefaultGlobs and DefaultM4BGlobs ignore case anyway.
+func matchFileGlob(pattern, name string, fold bool) bool {
+	if fold || slices.Contains(DefaultGlobs, pattern) || slices.Contains(DefaultM4BGlobs, pattern) {
+		pattern, name = strings.ToLower(pattern), strings.ToLower(name)
+	}
+	return matchGlob(pattern, name)
+}
+
+func matchGlobSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchGlobSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+
+	return len(name) == 0
+}
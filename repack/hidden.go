@@ -0,0 +1,23 @@
+package repack
+
+import "strings"
+
+// systemNames are files and dirs made by file managers, NAS boxes and archivers.
+var systemNames = map[string]bool{
+	"thumbs.db":                 true,
+	"ehthumbs.db":               true,
+	"desktop.ini":               true,
+	"@eadir":                    true, // Synology thumbnails and metadata
+	"#recycle":                  true,
+	"#snapshot":                 true,
+	"$recycle.bin":              true,
+	"system volume information": true,
+	"__macosx":                  true, // resource forks in zips made on macOS
+	"lost+found":                true,
+}
+
+// isHidden reports whether a file or dir named name is a dotfile, like .DS_Store,
+// or a system file, see systemNames.
+func isHidden(name string) bool {
+	return strings.HasPrefix(name, ".") || systemNames[strings.ToLower(name)]
+}
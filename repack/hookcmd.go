@@ -0,0 +1,78 @@
+package repack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// ErrHookFailed means a -pre-hook, -post-hook or a book hook command failed.
+var ErrHookFailed = errors.New("hook failed")
+
+// hookCommands are shell commands run around packing, empty ones are skipped.
+type hookCommands struct {
+	pre, post, preBook, postBook string
+	// env describes the output to every command
+	env []string
+}
+
+// run runs command with the shell and env added to the environment.
+// Its output goes to stderr, so it doesn't mix with an archive written into stdout.
+func (hooks hookCommands) run(ctx context.Context, name, command string, env ...string) error {
+	if command == "" {
+		return nil
+	}
+	shell, flag := hookShell()
+	cmd := exec.CommandContext(ctx, shell, flag, command)
+	cmd.Env = append(append(os.Environ(), hooks.env...), env...)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	slog.Debug("running hook", "hook", name, "command", command)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrHookFailed, name, err)
+	}
+	return nil
+}
+
+// runPreBookHook runs -pre-book-hook before files of the book are written.
+func (p *processor) runPreBookHook(ctx context.Context, b book) error {
+	return p.commands.run(ctx, "pre-book-hook", p.commands.preBook,
+		"REPACK_DIR="+b.dir,
+		"REPACK_TITLE="+bookTitle(b),
+		"REPACK_FILES="+strconv.Itoa(len(b.records)),
+	)
+}
+
+// runPostHooks runs -post-book-hook for every packed book and -post-hook once the outputs are written.
+func (p *processor) runPostHooks(ctx context.Context, outputs []string) error {
+	if p.commands.postBook != "" {
+		for _, b := range p.report.Books {
+			title := p.titles[b.Dir]
+			if title == "" {
+				title = bookTitle(book{dir: b.Dir})
+			}
+			err := p.commands.run(ctx, "post-book-hook", p.commands.postBook,
+				"REPACK_DIR="+b.Dir,
+				"REPACK_TITLE="+title,
+				"REPACK_FILES="+strconv.Itoa(len(b.Files)),
+				"REPACK_BYTES="+strconv.FormatInt(b.Bytes, 10),
+				"REPACK_DURATION="+strconv.FormatFloat(b.Duration, 'f', 3, 64),
+			)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return p.commands.run(ctx, "post-hook", p.commands.post,
+		"REPACK_OUTPUTS="+strings.Join(outputs, "\n"),
+		"REPACK_BOOKS="+strconv.Itoa(len(p.report.Books)),
+		"REPACK_FILES="+strconv.Itoa(p.report.Files),
+		"REPACK_BYTES="+strconv.FormatInt(p.report.BytesOut, 10),
+		"REPACK_DURATION="+strconv.FormatFloat(p.report.Duration, 'f', 3, 64),
+	)
+}
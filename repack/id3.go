@@ -0,0 +1,282 @@
+package repack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// id3Tag is a parsed ID3v2 tag. Nil tag means the file has no tag.
+type id3Tag struct {
+	version byte
+	frames  []id3Frame
+}
+
+type id3Frame struct {
+	id string
+	// flags are v2.3 and v2.4 frame flags, unsynchronisation and data length indicator are already undone
+	flags uint16
+	data  []byte
+}
+
+// id3v22Frames maps ID3v2.2 three letter frame ids to their v2.3 names.
+var id3v22Frames = map[string]string{
+	"TT2": "TIT2", "TAL": "TALB", "TP1": "TPE1", "TP2": "TPE2",
+	"TRK": "TRCK", "TPA": "TPOS", "TYE": "TYER", "TCM": "TCOM",
+	"COM": "COMM", "PIC": "APIC", "TCO": "TCON",
+}
+
+func readID3v2File(filename string) (*id3Tag, error) {
+	file, errFile := openNoFollow(filename, os.O_RDONLY, 0600)
+	if errFile != nil {
+		return nil, fmt.Errorf("unable to open file %q: %w", filename, errFile)
+	}
+	defer file.Close()
+
+	return readID3v2(file)
+}
+
+// readID3v2 parses ID3v2 tag at the start of re.
+func readID3v2(re io.Reader) (*id3Tag, error) {
+	header := make([]byte, 10)
+	if _, err := io.ReadFull(re, header); err != nil {
+		return nil, nil
+	}
+
+	size := id3v2Size(header)
+	if size == 0 {
+		return nil, nil
+	}
+
+	body := make([]byte, syncsafeInt(header[6:10]))
+	if _, err := io.ReadFull(re, body); err != nil {
+		return nil, fmt.Errorf("reading id3 tag: %w", err)
+	}
+
+	tag := &id3Tag{version: header[3]}
+	flags := header[5]
+	if flags&0x80 != 0 && tag.version < 4 {
+		body = removeUnsync(body)
+	}
+
+	if flags&0x40 != 0 && tag.version >= 3 {
+		// skip extended header
+		if len(body) < 4 {
+			return tag, nil
+		}
+		extSize := int(binary.BigEndian.Uint32(body))
+		if tag.version == 4 {
+			extSize = syncsafeInt(body[:4])
+		} else {
+			extSize += 4
+		}
+		if extSize > len(body) {
+			return tag, nil
+		}
+		body = body[extSize:]
+	}
+
+	tag.frames = parseID3Frames(tag.version, body)
+
+	return tag, nil
+}
+
+func parseID3Frames(version byte, body []byte) []id3Frame {
+	idSize, headerSize := 4, 10
+	if version == 2 {
+		idSize, headerSize = 3, 6
+	}
+
+	frames := []id3Frame{}
+	for len(body) >= headerSize && body[0] != 0 {
+		id := string(body[:idSize])
+
+		size := 0
+		flags := uint16(0)
+		switch version {
+		case 2:
+			size = int(body[3])<<16 | int(body[4])<<8 | int(body[5])
+		case 3:
+			size = int(binary.BigEndian.Uint32(body[4:8]))
+			flags = binary.BigEndian.Uint16(body[8:10])
+		default:
+			size = syncsafeInt(body[4:8])
+			flags = binary.BigEndian.Uint16(body[8:10])
+		}
+
+		if size > len(body)-headerSize {
+			break
+		}
+		data := body[headerSize : headerSize+size]
+		body = body[headerSize+size:]
+
+		if version == 2 {
+			if mapped, ok := id3v22Frames[id]; ok {
+				id = mapped
+			}
+		}
+
+		if version == 4 {
+			if flags&0x0001 != 0 && len(data) >= 4 {
+				// data length indicator
+				data = data[4:]
+			}
+			if flags&0x0002 != 0 {
+				data = removeUnsync(data)
+			}
+			flags &^= 0x0003
+		}
+
+		frames = append(frames, id3Frame{id: id, flags: flags, data: data})
+	}
+
+	return frames
+}
+
+// encode serializes v2.3 or v2.4 tag without padding, extended header and unsynchronisation.
+func (t *id3Tag) encode() []byte {
+	body := &bytes.Buffer{}
+	for _, frame := range t.frames {
+		header := make([]byte, 10)
+		copy(header, frame.id)
+		if t.version == 4 {
+			putSyncsafeInt(header[4:8], len(frame.data))
+		} else {
+			binary.BigEndian.PutUint32(header[4:8], uint32(len(frame.data)))
+		}
+		binary.BigEndian.PutUint16(header[8:10], frame.flags)
+		body.Write(header)
+		body.Write(frame.data)
+	}
+
+	tag := make([]byte, 10, 10+body.Len())
+	copy(tag, "ID3")
+	tag[3] = t.version
+	putSyncsafeInt(tag[6:10], body.Len())
+	return append(tag, body.Bytes()...)
+}
+
+func putSyncsafeInt(b []byte, n int) {
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i] = byte(n & 0x7F)
+		n >>= 7
+	}
+}
+
+// set replaces all frames with the same id by frame.
+func (t *id3Tag) set(frame id3Frame) {
+	t.remove(frame.id)
+	t.frames = append(t.frames, frame)
+}
+
+// remove drops all frames with id.
+func (t *id3Tag) remove(id string) {
+	t.frames = slices.DeleteFunc(t.frames, func(frame id3Frame) bool { return frame.id == id })
+}
+
+// textFrame encodes text frame for tag version, UTF-8 for v2.4,
+// ISO-8859-1 or UTF-16 with BOM for v2.3.
+func textFrame(version byte, id, text string) id3Frame {
+	data := &bytes.Buffer{}
+	switch {
+	case version == 4:
+		data.WriteByte(3)
+		data.WriteString(text)
+	case isLatin1(text):
+		data.WriteByte(0)
+		for _, r := range text {
+			data.WriteByte(byte(r))
+		}
+	default:
+		data.Write([]byte{1, 0xFF, 0xFE})
+		for _, unit := range utf16.Encode([]rune(text)) {
+			_ = binary.Write(data, binary.LittleEndian, unit)
+		}
+	}
+	return id3Frame{id: id, data: data.Bytes()}
+}
+
+func isLatin1(text string) bool {
+	for _, r := range text {
+		if r > 0xFF {
+			return false
+		}
+	}
+	return true
+}
+
+// has reports if the tag has a frame with id.
+func (t *id3Tag) has(id string) bool {
+	return t != nil && slices.ContainsFunc(t.frames, func(frame id3Frame) bool { return frame.id == id })
+}
+
+// removeUnsync reverts ID3 unsynchronisation: 0xFF 0x00 -> 0xFF.
+func removeUnsync(data []byte) []byte {
+	return bytes.ReplaceAll(data, []byte{0xFF, 0x00}, []byte{0xFF})
+}
+
+// text returns decoded value of the first text frame with id.
+func (t *id3Tag) text(id string) string {
+	if t == nil {
+		return ""
+	}
+	for _, frame := range t.frames {
+		if frame.id == id && len(frame.data) > 0 {
+			return decodeID3Text(frame.data[0], frame.data[1:])
+		}
+	}
+	return ""
+}
+
+// decodeID3Text decodes text frame payload, only the first value is returned.
+func decodeID3Text(encoding byte, data []byte) string {
+	switch encoding {
+	case 1, 2:
+		order := binary.ByteOrder(binary.BigEndian)
+		if len(data) >= 2 {
+			switch {
+			case data[0] == 0xFF && data[1] == 0xFE:
+				order, data = binary.LittleEndian, data[2:]
+			case data[0] == 0xFE && data[1] == 0xFF:
+				data = data[2:]
+			}
+		}
+		units := make([]uint16, 0, len(data)/2)
+		for i := 0; i+1 < len(data); i += 2 {
+			unit := order.Uint16(data[i:])
+			if unit == 0 {
+				break
+			}
+			units = append(units, unit)
+		}
+		return string(utf16.Decode(units))
+	case 3:
+		text, _, _ := strings.Cut(string(data), "\x00")
+		return text
+	default:
+		runes := make([]rune, 0, len(data))
+		for _, b := range data {
+			if b == 0 {
+				break
+			}
+			runes = append(runes, rune(b))
+		}
+		return string(runes)
+	}
+}
+
+// id3Number parses "N" or "N/M" values of TRCK and TPOS frames.
+func id3Number(value string) (int, bool) {
+	value, _, _ = strings.Cut(strings.TrimSpace(value), "/")
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return n, true
+}
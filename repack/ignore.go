@@ -0,0 +1,98 @@
+package repack
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// IgnoreFileName is a file of a book dir or its subdirs with gitignore patterns of files to leave out.
+// Patterns are relative to the dir of the file, ones of deeper files take precedence.
+const IgnoreFileName = ".repackignore"
+
+// ignoreRule is a pattern of an ignore file.
+type ignoreRule struct {
+	// base is the slash separated dir of the ignore file relative to the book dir, "." for the book dir
+	base    string
+	pattern string
+	// anchored patterns are matched against paths relative to base, others against names
+	negate, dirOnly, anchored bool
+}
+
+// ignoreRules are patterns of ignore files found so far, later ones win.
+type ignoreRules []ignoreRule
+
+// readIgnoreFile parses the ignore file of dir of fsys, it returns no rules if there is none.
+func readIgnoreFile(fsys fs.FS, dir string) (ignoreRules, error) {
+	data, errRead := fs.ReadFile(fsys, path.Join(dir, IgnoreFileName))
+	if errors.Is(errRead, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if errRead != nil {
+		return nil, errRead
+	}
+
+	rules := ignoreRules{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if !strings.HasSuffix(line, `\ `) {
+			line = strings.TrimRight(line, " \t")
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule := ignoreRule{base: dir}
+		if rule.negate = strings.HasPrefix(line, "!"); rule.negate {
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+			line = line[1:]
+		}
+		if rule.dirOnly = strings.HasSuffix(line, "/"); rule.dirOnly {
+			line = strings.TrimRight(line, "/")
+		}
+		// a slash at the start or in the middle ties the pattern to the dir of the file
+		rule.anchored = strings.Contains(line, "/")
+		rule.pattern = strings.TrimPrefix(line, "/")
+		if rule.pattern == "" {
+			continue
+		}
+		if err := ValidateGlob(rule.pattern); err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", path.Join(dir, IgnoreFileName), n, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+// ignored reports whether slash separated name relative to the book dir is left out by the rules.
+func (rules ignoreRules) ignored(name string, dir bool) bool {
+	ignored := false
+	for _, rule := range rules {
+		if rule.match(name, dir) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+func (rule ignoreRule) match(name string, dir bool) bool {
+	if rule.dirOnly && !dir {
+		return false
+	}
+	if rule.base != "." {
+		var ok bool
+		if name, ok = strings.CutPrefix(name, rule.base+"/"); !ok {
+			return false
+		}
+	}
+	if rule.anchored {
+		return matchGlob(rule.pattern, name)
+	}
+	return matchGlob(rule.pattern, path.Base(name))
+}
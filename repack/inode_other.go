@@ -0,0 +1,10 @@
+//go:build !unix
+
+package repack
+
+import "io/fs"
+
+// inodeKey identifies the file behind info, there are no inode numbers here.
+func inodeKey(info fs.FileInfo) (fileKey, bool) {
+	return fileKey{}, false
+}
@@ -0,0 +1,17 @@
+//go:build unix
+
+package repack
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// inodeKey identifies the file behind info by device and inode numbers.
+func inodeKey(info fs.FileInfo) (fileKey, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileKey{}, false
+	}
+	return fileKey{dev: uint64(stat.Dev), ino: uint64(stat.Ino)}, true
+}
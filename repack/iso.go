@@ -0,0 +1,503 @@
+package repack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// ISO 9660 image with Joliet names, which data CD players and every OS read.
+// System area and volume descriptors take the first sectors, file data follows them
+// and path tables and directories of both name trees are written after all files,
+// so descriptors pointing at them are written last, over the reserved sectors.
+const (
+	isoSector      = 2048
+	isoSystemArea  = 16
+	isoDataStart   = isoSystemArea + 3 // primary, Joliet and terminator descriptors
+	isoMaxFileSize = 1<<32 - 1
+	// level 2 identifiers of the primary tree, Joliet allows 64 UCS-2 characters
+	isoMaxName    = 30
+	jolietMaxName = 64
+)
+
+// name trees of an image
+const (
+	isoTree = iota
+	jolietTree
+)
+
+var errISOFileTooLarge = errors.New("file is too large for ISO 9660, 4 GiB at most")
+
+type isoFile struct {
+	ident   [2]string
+	start   uint32
+	size    int64
+	modTime time.Time
+}
+
+type isoDir struct {
+	ident  [2]string
+	parent *isoDir
+	dirs   map[string]*isoDir
+	files  map[string]*isoFile
+	// extent, size and path table number in each tree
+	extent [2]uint32
+	size   [2]uint32
+	number [2]int
+}
+
+// isoArchive writes entries as files of an ISO 9660 image, writeAt overwrites the reserved descriptors.
+type isoArchive struct {
+	dst     io.Writer
+	writeAt func(p []byte, offset int64) error
+	volume  string
+
+	offset  int64
+	root    *isoDir
+	current *isoFile
+	// currentDir lists current as currentName
+	currentDir  *isoDir
+	currentName string
+	// modTime is the latest entry time, used for dirs and the volume
+	modTime time.Time
+}
+
+func newISOArchive(dst io.Writer, writeAt func(p []byte, offset int64) error, volume string) (*isoArchive, error) {
+	if writeAt == nil {
+		return nil, fmt.Errorf("%w: iso format needs a local output file", errUnsupportedArchive)
+	}
+	a := &isoArchive{dst: dst, writeAt: writeAt, volume: volume, root: newISODir(nil)}
+	// descriptors are written on Close
+	if err := a.write(make([]byte, isoDataStart*isoSector)); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func newISODir(parent *isoDir) *isoDir {
+	return &isoDir{parent: parent, dirs: map[string]*isoDir{}, files: map[string]*isoFile{}}
+}
+
+func (a *isoArchive) write(p []byte) error {
+	n, err := a.dst.Write(p)
+	a.offset += int64(n)
+	return err
+}
+
+func (a *isoArchive) Write(p []byte) (int, error) {
+	if a.current.size+int64(len(p)) > isoMaxFileSize {
+		return 0, errISOFileTooLarge
+	}
+	err := a.write(p)
+	a.current.size += int64(len(p))
+	return len(p), err
+}
+
+func (a *isoArchive) create(entry archiveEntry) (io.Writer, error) {
+	if err := a.finish(); err != nil {
+		return nil, err
+	}
+	if entry.size > isoMaxFileSize {
+		return nil, fmt.Errorf("%w: %q", errISOFileTooLarge, entry.name)
+	}
+
+	dir := a.root
+	elements := strings.Split(entry.name, "/")
+	for _, element := range elements[:len(elements)-1] {
+		child, ok := dir.dirs[element]
+		if !ok {
+			child = newISODir(dir)
+			dir.dirs[element] = child
+		}
+		dir = child
+	}
+	name := elements[len(elements)-1]
+	if _, ok := dir.files[name]; ok {
+		return nil, fmt.Errorf("duplicate entry %q", entry.name)
+	}
+
+	a.current = &isoFile{start: uint32(a.offset / isoSector), modTime: entry.modTime.UTC()}
+	dir.files[name] = a.current
+	a.currentDir, a.currentName = dir, name
+	if entry.modTime.After(a.modTime) {
+		a.modTime = entry.modTime.UTC()
+	}
+	return a, nil
+}
+
+// finish pads data of the current file to a sector boundary.
+func (a *isoArchive) finish() error {
+	if a.current == nil {
+		return nil
+	}
+	a.current = nil
+	if rest := a.offset % isoSector; rest != 0 {
+		return a.write(make([]byte, isoSector-rest))
+	}
+	return nil
+}
+
+// dropEntry unlists the current file, its sectors stay in the image unreferenced.
+func (a *isoArchive) dropEntry() error {
+	if a.current == nil {
+		return nil
+	}
+	delete(a.currentDir.files, a.currentName)
+	return a.finish()
+}
+
+func (a *isoArchive) Close() error {
+	if err := a.finish(); err != nil {
+		return err
+	}
+
+	a.root.name()
+	orders := [2][]*isoDir{a.root.walk(isoTree), a.root.walk(jolietTree)}
+
+	// path tables, then dirs of both trees, sizes don't depend on extents
+	sector := uint32(a.offset / isoSector)
+	var tableSize [2]int
+	var tables [2][2]uint32
+	for tree, order := range orders {
+		tableSize[tree] = len(pathTable(order, tree, binary.LittleEndian))
+		tables[tree][0], tables[tree][1] = sector, sector+sectors(tableSize[tree])
+		sector += 2 * sectors(tableSize[tree])
+	}
+	for tree, order := range orders {
+		for _, dir := range order {
+			dir.size[tree] = sectors(len(a.dirData(dir, tree))) * isoSector
+			dir.extent[tree] = sector
+			sector += dir.size[tree] / isoSector
+		}
+	}
+
+	for tree, order := range orders {
+		for _, byteOrder := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+			if err := a.write(padSector(pathTable(order, tree, byteOrder))); err != nil {
+				return err
+			}
+		}
+	}
+	for tree, order := range orders {
+		for _, dir := range order {
+			if err := a.write(padSector(a.dirData(dir, tree))); err != nil {
+				return err
+			}
+		}
+	}
+
+	descriptors := &bytes.Buffer{}
+	for tree := range orders {
+		descriptors.Write(a.volumeDescriptor(tree, sector, tableSize[tree], tables[tree]))
+	}
+	terminator := make([]byte, isoSector)
+	terminator[0] = 255
+	copy(terminator[1:], "CD001")
+	terminator[6] = 1
+	descriptors.Write(terminator)
+	return a.writeAt(descriptors.Bytes(), isoSystemArea*isoSector)
+}
+
+// name gives unique identifiers to children of d in both trees, recursively.
+func (d *isoDir) name() {
+	for tree := range d.ident {
+		used := map[string]bool{}
+		for _, name := range sortedKeys(d.dirs) {
+			d.dirs[name].ident[tree] = uniqueIdent(used, name, tree, true)
+		}
+		for _, name := range sortedKeys(d.files) {
+			d.files[name].ident[tree] = uniqueIdent(used, name, tree, false)
+		}
+	}
+	for _, dir := range d.dirs {
+		dir.name()
+	}
+}
+
+// walk lists dirs breadth first with children ordered by identifiers, the order of path tables.
+func (d *isoDir) walk(tree int) []*isoDir {
+	order := []*isoDir{d}
+	for i := 0; i < len(order); i++ {
+		order[i].number[tree] = i + 1
+		order = append(order, order[i].subdirs(tree)...)
+	}
+	return order
+}
+
+func (d *isoDir) subdirs(tree int) []*isoDir {
+	dirs := make([]*isoDir, 0, len(d.dirs))
+	for _, dir := range d.dirs {
+		dirs = append(dirs, dir)
+	}
+	slices.SortFunc(dirs, func(a, b *isoDir) int { return strings.Compare(a.ident[tree], b.ident[tree]) })
+	return dirs
+}
+
+// dirData is the extent of dir: records of itself, its parent and its children ordered by identifiers.
+// A record never crosses a sector boundary.
+func (a *isoArchive) dirData(dir *isoDir, tree int) []byte {
+	parent := dir.parent
+	if parent == nil {
+		parent = dir
+	}
+	records := [][]byte{
+		dirRecord([]byte{0}, dir.extent[tree], dir.size[tree], a.modTime, true),
+		dirRecord([]byte{1}, parent.extent[tree], parent.size[tree], a.modTime, true),
+	}
+
+	type child struct {
+		ident  string
+		record []byte
+	}
+	children := []child{}
+	for _, sub := range dir.dirs {
+		children = append(children, child{sub.ident[tree], dirRecord(identBytes(sub.ident[tree], tree, true), sub.extent[tree], sub.size[tree], a.modTime, true)})
+	}
+	for _, file := range dir.files {
+		children = append(children, child{file.ident[tree], dirRecord(identBytes(file.ident[tree], tree, false), file.start, uint32(file.size), file.modTime, false)})
+	}
+	slices.SortFunc(children, func(a, b child) int { return strings.Compare(a.ident, b.ident) })
+	for _, c := range children {
+		records = append(records, c.record)
+	}
+
+	data := []byte{}
+	for _, record := range records {
+		if rest := isoSector - len(data)%isoSector; rest < len(record) {
+			data = append(data, make([]byte, rest)...)
+		}
+		data = append(data, record...)
+	}
+	return data
+}
+
+func dirRecord(ident []byte, extent, size uint32, modTime time.Time, dir bool) []byte {
+	record := make([]byte, 33, 34+len(ident))
+	putBoth32(record[2:], extent)
+	putBoth32(record[10:], size)
+	copy(record[18:25], recordTime(modTime))
+	if dir {
+		record[25] = 0x02
+	}
+	putBoth16(record[28:], 1) // volume sequence number
+	record[32] = byte(len(ident))
+	record = append(record, ident...)
+	if len(ident)%2 == 0 {
+		record = append(record, 0)
+	}
+	record[0] = byte(len(record))
+	return record
+}
+
+// pathTable lists dirs in walk order with their extents and parent numbers.
+func pathTable(order []*isoDir, tree int, byteOrder binary.ByteOrder) []byte {
+	table := []byte{}
+	for _, dir := range order {
+		ident, parent := []byte{0}, 1
+		if dir.parent != nil {
+			ident, parent = identBytes(dir.ident[tree], tree, true), dir.parent.number[tree]
+		}
+		entry := make([]byte, 8, 9+len(ident))
+		entry[0] = byte(len(ident))
+		byteOrder.PutUint32(entry[2:], dir.extent[tree])
+		byteOrder.PutUint16(entry[6:], uint16(parent))
+		entry = append(entry, ident...)
+		if len(ident)%2 == 1 {
+			entry = append(entry, 0)
+		}
+		table = append(table, entry...)
+	}
+	return table
+}
+
+// volumeDescriptor is the primary descriptor of the ISO tree or the supplementary one of Joliet names.
+func (a *isoArchive) volumeDescriptor(tree int, totalSectors uint32, tableSize int, tables [2]uint32) []byte {
+	desc := make([]byte, isoSector)
+	desc[0] = 1
+	copy(desc[1:], "CD001")
+	desc[6] = 1
+	volume := isoVolumeID(a.volume)
+	if tree == jolietTree {
+		desc[0] = 2
+		copy(desc[88:], "%/E") // UCS-2 level 3
+		fillUCS2(desc[8:40], "")
+		fillUCS2(desc[40:72], a.volume)
+		for _, field := range [][2]int{{190, 318}, {318, 446}, {446, 574}, {574, 702}, {702, 739}, {739, 776}, {776, 813}} {
+			fillUCS2(desc[field[0]:field[1]], "")
+		}
+	} else {
+		fillASCII(desc[8:40], "")
+		fillASCII(desc[40:72], volume)
+		fillASCII(desc[190:813], "")
+	}
+	if tree == jolietTree {
+		fillUCS2(desc[574:702], "audiobook-repack")
+	} else {
+		fillASCII(desc[574:702], "AUDIOBOOK-REPACK")
+	}
+	putBoth32(desc[80:], totalSectors)
+	putBoth16(desc[120:], 1)
+	putBoth16(desc[124:], 1)
+	putBoth16(desc[128:], isoSector)
+	putBoth32(desc[132:], uint32(tableSize))
+	binary.LittleEndian.PutUint32(desc[140:], tables[0])
+	binary.BigEndian.PutUint32(desc[148:], tables[1])
+	copy(desc[156:190], dirRecord([]byte{0}, a.root.extent[tree], a.root.size[tree], a.modTime, true))
+	created := volumeTime(a.modTime)
+	copy(desc[813:], created)
+	copy(desc[830:], created)
+	copy(desc[847:], volumeTime(time.Time{}))
+	copy(desc[864:], volumeTime(time.Time{}))
+	desc[881] = 1
+	return desc
+}
+
+// uniqueIdent makes an identifier of name for tree, names taken in used get ~N before the extension.
+func uniqueIdent(used map[string]bool, name string, tree int, dir bool) string {
+	ident := isoIdent(name, dir, "")
+	if tree == jolietTree {
+		ident = jolietIdent(name, "")
+	}
+	for n := 2; used[strings.ToUpper(ident)]; n++ {
+		suffix := "~" + strconv.Itoa(n)
+		ident = isoIdent(name, dir, suffix)
+		if tree == jolietTree {
+			ident = jolietIdent(name, suffix)
+		}
+	}
+	used[strings.ToUpper(ident)] = true
+	return ident
+}
+
+// isoIdent is an ISO 9660 level 2 identifier: uppercase letters, digits and _, with
+// transliterated letters, at most 30 characters for files and 31 for dirs.
+func isoIdent(name string, dir bool, suffix string) string {
+	toDChars := func(s string) string {
+		return strings.Map(func(r rune) rune {
+			if 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || r == '_' {
+				return r
+			}
+			return '_'
+		}, strings.ToUpper(transliterate(s)))
+	}
+
+	if dir {
+		base := toDChars(name)
+		return base[:min(len(base), isoMaxName+1-len(suffix))] + suffix
+	}
+	ext := path.Ext(name)
+	base, ext := toDChars(strings.TrimSuffix(name, ext)), toDChars(strings.TrimPrefix(ext, "."))
+	ext = ext[:min(len(ext), 8)]
+	if base == "" {
+		base = "_"
+	}
+	base = base[:min(len(base), isoMaxName-1-len(ext)-len(suffix))] + suffix
+	if ext == "" {
+		return base
+	}
+	return base + "." + ext
+}
+
+// jolietIdent replaces characters Joliet doesn't allow and shortens name to 64 UCS-2 characters.
+func jolietIdent(name, suffix string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0xffff || strings.ContainsRune(`*/:;?\`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	return shortenElement(base, jolietMaxName-len(ext)-len(suffix), utf16Len) + suffix + ext
+}
+
+// identBytes encodes an identifier of tree, ISO file identifiers get version ;1.
+func identBytes(ident string, tree int, dir bool) []byte {
+	if tree == jolietTree {
+		encoded := []byte{}
+		for _, unit := range utf16.Encode([]rune(ident)) {
+			encoded = binary.BigEndian.AppendUint16(encoded, unit)
+		}
+		return encoded
+	}
+	if dir {
+		return []byte(ident)
+	}
+	return []byte(ident + ";1")
+}
+
+func isoVolumeID(volume string) string {
+	id := isoIdent(volume, true, "")
+	return id[:min(len(id), 32)]
+}
+
+func recordTime(t time.Time) []byte {
+	if t.IsZero() {
+		return make([]byte, 7)
+	}
+	t = t.UTC()
+	return []byte{byte(t.Year() - 1900), byte(t.Month()), byte(t.Day()), byte(t.Hour()), byte(t.Minute()), byte(t.Second()), 0}
+}
+
+func volumeTime(t time.Time) []byte {
+	if t.IsZero() {
+		return append([]byte("0000000000000000"), 0)
+	}
+	return append([]byte(t.UTC().Format("20060102150405")+"00"), 0)
+}
+
+func putBoth16(b []byte, v uint16) {
+	binary.LittleEndian.PutUint16(b, v)
+	binary.BigEndian.PutUint16(b[2:], v)
+}
+
+func putBoth32(b []byte, v uint32) {
+	binary.LittleEndian.PutUint32(b, v)
+	binary.BigEndian.PutUint32(b[4:], v)
+}
+
+func fillASCII(field []byte, s string) {
+	n := copy(field, s)
+	for i := n; i < len(field); i++ {
+		field[i] = ' '
+	}
+}
+
+func fillUCS2(field []byte, s string) {
+	units := utf16.Encode([]rune(s))
+	for i := 0; i+1 < len(field); i += 2 {
+		unit := uint16(' ')
+		if i/2 < len(units) {
+			unit = units[i/2]
+		}
+		binary.BigEndian.PutUint16(field[i:], unit)
+	}
+}
+
+func sectors(size int) uint32 {
+	return uint32((size + isoSector - 1) / isoSector)
+}
+
+func padSector(data []byte) []byte {
+	if rest := len(data) % isoSector; rest != 0 {
+		data = append(data, make([]byte, isoSector-rest)...)
+	}
+	return data
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -0,0 +1,230 @@
+package repack
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vbauerster/mpb/v8"
+	"github.com/vbauerster/mpb/v8/decor"
+)
+
+// m4bBitrate is AAC bitrate used for m4b output, plenty for speech.
+const m4bBitrate = "64k"
+
+var errNoFFmpeg = errors.New("ffmpeg not found in PATH")
+
+// chapter is a single source track inside of merged output.
+type chapter struct {
+	title      string
+	path       string
+	start, end time.Duration
+}
+
+var imageExts = []string{".jpg", ".jpeg", ".png"}
+
+func isImage(filename string) bool {
+	ext := strings.ToLower(filepath.Ext(filename))
+	for _, imageExt := range imageExts {
+		if ext == imageExt {
+			return true
+		}
+	}
+	return false
+}
+
+// chaptersOf lays out tracks of books one after another.
+// The first image found is returned as cover, other images are ignored.
+func chaptersOf(books []book) ([]chapter, string, error) {
+	chapters := []chapter{}
+	cover := ""
+	offset := time.Duration(0)
+	for _, b := range books {
+		for _, record := range b.records {
+			if record.zipped != nil {
+				return nil, "", fmt.Errorf("%w: %q is inside of a zip, ffmpeg reads files on disk only", errZipInput, record.path)
+			}
+			if isImage(record.path) {
+				if cover == "" {
+					cover = record.path
+				}
+				continue
+			}
+
+			d, err := audioDuration(record.path)
+			if err != nil {
+				return nil, "", fmt.Errorf("file %q: %w", record.path, err)
+			}
+
+			chapters = append(chapters, chapter{
+				title: strings.TrimSuffix(filepath.Base(record.path), filepath.Ext(record.path)),
+				path:  record.path,
+				start: offset,
+				end:   offset + d,
+			})
+			offset += d
+		}
+	}
+
+	return chapters, cover, nil
+}
+
+// processM4B merges audio files of all dirs into a single m4b file with chapters using ffmpeg.
+func (p *processor) processM4B(ctx context.Context, output string, dirs, fileGlobs []string) error {
+	ffmpeg, errLook := exec.LookPath(p.ffmpeg)
+	if errLook != nil {
+		return fmt.Errorf("%w: %w", errNoFFmpeg, errLook)
+	}
+
+	books, errDiscover := p.discover(ctx, dirs, fileGlobs)
+	if errDiscover != nil {
+		return errDiscover
+	}
+
+	chapters, cover, errChapters := chaptersOf(books)
+	if errChapters != nil {
+		return fmt.Errorf("reading chapters: %w", errChapters)
+	}
+	if len(chapters) == 0 {
+		return ErrNoFilesFound
+	}
+	for _, b := range books {
+		if err := p.runPreBookHook(ctx, b); err != nil {
+			return err
+		}
+		for _, record := range b.records {
+			if info, err := os.Stat(record.path); err == nil {
+				p.report.add(b.dir, record, info.Size(), fileDuration(record.path))
+			}
+		}
+	}
+
+	tmp, errTmp := os.MkdirTemp("", "audiobook-repack-*")
+	if errTmp != nil {
+		return fmt.Errorf("creating temp dir: %w", errTmp)
+	}
+	defer os.RemoveAll(tmp)
+
+	listFile := filepath.Join(tmp, "list.ffconcat")
+	if err := os.WriteFile(listFile, ffconcatList(chapters), 0600); err != nil {
+		return fmt.Errorf("writing concat list: %w", err)
+	}
+
+	title := filepath.Base(filepath.Clean(books[0].dir))
+	metaFile := filepath.Join(tmp, "chapters.ffmeta")
+	if err := os.WriteFile(metaFile, ffmetadata(title, chapters), 0600); err != nil {
+		return fmt.Errorf("writing chapters: %w", err)
+	}
+
+	args := []string{
+		"-hide_banner", "-loglevel", "error", "-nostats", "-progress", "pipe:1", "-y",
+		"-f", "concat", "-safe", "0", "-i", listFile,
+		"-i", metaFile,
+	}
+	if cover != "" {
+		args = append(args, "-i", cover, "-map", "2:v", "-c:v", "copy", "-disposition:v", "attached_pic")
+	}
+	args = append(args,
+		"-map", "0:a", "-map_metadata", "1", "-map_chapters", "1",
+		"-c:a", "aac", "-b:a", m4bBitrate,
+		"-f", "ipod", output,
+	)
+
+	total := chapters[len(chapters)-1].end
+	bar := p.bar.AddBar(total.Microseconds(),
+		mpb.PrependDecorators(
+			decor.Name(filepath.Base(output)),
+			decor.Percentage(decor.WCSyncSpace),
+		),
+	)
+
+	if err := runFFmpeg(ctx, ffmpeg, args, bar); err != nil {
+		bar.Abort(false)
+		return err
+	}
+	bar.SetCurrent(total.Microseconds())
+	p.bar.Wait()
+
+	slog.Info("wrote chapters", "chapters", len(chapters), "output", output)
+	return p.skipReport()
+}
+
+// runFFmpeg runs ffmpeg and feeds its -progress output to bar.
+func runFFmpeg(ctx context.Context, ffmpeg string, args []string, bar *mpb.Bar) error {
+	cmd := exec.CommandContext(ctx, ffmpeg, args...)
+	cmd.Stderr = os.Stderr
+
+	stdout, errPipe := cmd.StdoutPipe()
+	if errPipe != nil {
+		return fmt.Errorf("ffmpeg stdout: %w", errPipe)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("starting ffmpeg: %w", err)
+	}
+
+	trackFFmpegProgress(stdout, bar)
+
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("running ffmpeg: %w", err)
+	}
+
+	return nil
+}
+
+func trackFFmpegProgress(progress io.Reader, bar *mpb.Bar) {
+	scanner := bufio.NewScanner(progress)
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(scanner.Text(), "=")
+		if key != "out_time_us" {
+			continue
+		}
+		us, err := strconv.ParseInt(value, 10, 64)
+		if err == nil && us > 0 {
+			bar.SetCurrent(us)
+		}
+	}
+}
+
+// ffconcatList builds input list for ffmpeg concat demuxer.
+func ffconcatList(chapters []chapter) []byte {
+	list := &strings.Builder{}
+	list.WriteString("ffconcat version 1.0\n")
+	for _, ch := range chapters {
+		abs, err := filepath.Abs(ch.path)
+		if err != nil {
+			abs = ch.path
+		}
+		fmt.Fprintf(list, "file '%s'\n", strings.ReplaceAll(abs, "'", `'\''`))
+	}
+	return []byte(list.String())
+}
+
+var escapeFFMetadata = strings.NewReplacer(
+	`\`, `\\`,
+	"=", `\=`,
+	";", `\;`,
+	"#", `\#`,
+	"\n", "\\\n",
+).Replace
+
+// ffmetadata builds ffmpeg metadata file with chapter markers.
+func ffmetadata(title string, chapters []chapter) []byte {
+	meta := &strings.Builder{}
+	meta.WriteString(";FFMETADATA1\n")
+	fmt.Fprintf(meta, "title=%s\n", escapeFFMetadata(title))
+	for _, ch := range chapters {
+		fmt.Fprintf(meta, "\n[CHAPTER]\nTIMEBASE=1/1000\nSTART=%d\nEND=%d\ntitle=%s\n",
+			ch.start.Milliseconds(), ch.end.Milliseconds(), escapeFFMetadata(ch.title))
+	}
+	return []byte(meta.String())
+}
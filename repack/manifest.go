@@ -0,0 +1,72 @@
+package repack
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ManifestName is the checksum list entry, compatible with sha256sum -c.
+const ManifestName = "MANIFEST.sha256"
+
+// manifestLine is a checksum of a single archived file.
+type manifestLine struct {
+	sum    []byte
+	name   string
+	source string
+}
+
+// writeManifest adds checksum list of all archived files as the last entry.
+// Source paths, files left out by -dedup and hardlinks of packed files are written
+// as comment lines, which sha256sum skips.
+func (p *processor) writeManifest(archive archiveWriter) error {
+	content := &strings.Builder{}
+	for _, line := range p.manifest {
+		fmt.Fprintf(content, "# %s\n%x  %s\n", line.source, line.sum, line.name)
+	}
+	for _, duplicate := range p.duplicates {
+		kind := "duplicate"
+		if duplicate.link {
+			kind = "hardlink"
+		}
+		fmt.Fprintf(content, "# %s %s is packed as %s\n", kind, duplicate.path, duplicate.name)
+	}
+
+	wr, errCreate := archive.create(archiveEntry{
+		name:    ManifestName,
+		size:    int64(content.Len()),
+		modTime: p.entryTime(nil),
+	})
+	if errCreate != nil {
+		return errCreate
+	}
+
+	_, errWrite := io.WriteString(wr, content.String())
+	return errWrite
+}
+
+// parseManifest reads entry checksums, keyed by entry name.
+func parseManifest(re io.Reader) (map[string][]byte, error) {
+	sums := map[string][]byte{}
+	scanner := bufio.NewScanner(re)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		sum, name, ok := strings.Cut(line, "  ")
+		if !ok {
+			return nil, fmt.Errorf("malformed manifest line %q", line)
+		}
+		decoded, err := hex.DecodeString(sum)
+		if err != nil {
+			return nil, fmt.Errorf("malformed checksum of %q: %w", name, err)
+		}
+		sums[name] = decoded
+	}
+
+	return sums, scanner.Err()
+}
@@ -0,0 +1,259 @@
+package repack
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+var errMerge = errors.New("can't merge files")
+
+// mp3Span is a range of MPEG frames of a file without tags and Xing/Info header frame.
+type mp3Span struct {
+	start, end int64
+	frame      mp3Frame
+	duration   time.Duration
+}
+
+// scanMP3Span walks MPEG frames of file, a cut off last frame is left out.
+func scanMP3Span(filename string) (mp3Span, error) {
+	file, errFile := openNoFollow(filename, os.O_RDONLY, 0600)
+	if errFile != nil {
+		return mp3Span{}, fmt.Errorf("unable to open file %q: %w", filename, errFile)
+	}
+	defer file.Close()
+
+	info, errStat := file.Stat()
+	if errStat != nil {
+		return mp3Span{}, errStat
+	}
+	size := info.Size()
+
+	re := bufio.NewReaderSize(file, 64*1024)
+	span := mp3Span{}
+	offset := int64(0)
+	head, _ := re.Peek(10)
+	if tagSize := id3v2Size(head); tagSize > 0 {
+		if _, err := re.Discard(tagSize); err != nil {
+			return mp3Span{}, errNotMP3
+		}
+		offset = int64(tagSize)
+	}
+
+	first := true
+	for offset < size {
+		header, _ := re.Peek(4)
+		frame, ok := parseMP3Frame(header)
+		if !ok {
+			if !first {
+				// trailing tags or garbage
+				break
+			}
+			if _, err := re.Discard(1); err != nil {
+				break
+			}
+			offset++
+			continue
+		}
+		if offset+int64(frame.size()) > size {
+			break
+		}
+
+		if first {
+			first = false
+			span.frame, span.start = frame, offset
+			// header frame of the first file would be wrong for the merged one
+			if _, vbr := vbrFrameCount(re, frame); vbr {
+				span.start += int64(frame.size())
+			} else {
+				span.duration += frame.duration()
+			}
+		} else {
+			span.duration += frame.duration()
+		}
+
+		if _, err := re.Discard(frame.size()); err != nil {
+			return mp3Span{}, err
+		}
+		offset += int64(frame.size())
+		span.end = offset
+	}
+
+	if span.duration == 0 {
+		return mp3Span{}, fmt.Errorf("%q: %w", filename, errNotMP3)
+	}
+	return span, nil
+}
+
+// mergedName is name of the single MP3 file of a merged book.
+func (p *processor) mergedName(dir string) string {
+	base := filepath.Base(filepath.Clean(dir))
+	if abs, err := filepath.Abs(dir); err == nil {
+		base = filepath.Base(abs)
+	}
+	if p.keepDirs {
+		return path.Join(base, base+".mp3")
+	}
+	return base + ".mp3"
+}
+
+// mergeRecords replaces MP3 records of the book from dir by a single record in place of the first one.
+func (p *processor) mergeRecords(dir string, records []fileRecord) []fileRecord {
+	merged := fileRecord{path: dir, name: p.mergedName(dir)}
+	result := make([]fileRecord, 0, len(records))
+	at := -1
+	for _, record := range records {
+		if !isMP3(record.path) {
+			result = append(result, record)
+			continue
+		}
+		if at < 0 {
+			at = len(result)
+			result = append(result, merged)
+		}
+		merged.parts = append(merged.parts, record)
+	}
+	if at < 0 {
+		return records
+	}
+
+	result[at] = merged
+	slog.Debug("merging files", "files", len(merged.parts), "dir", dir, "name", merged.name)
+	return result
+}
+
+// mergedTag builds ID3v2.3 tag of merged book with a chapter per source file.
+func (p *processor) mergedTag(record fileRecord, spans []mp3Span) ([]byte, error) {
+	meta := readBookMetadata(record.path, record.parts, p.fixTags)
+	tag := &id3Tag{version: 3}
+	tag.set(textFrame(tag.version, "TIT2", meta.Title))
+	tag.set(textFrame(tag.version, "TALB", meta.Title))
+	if len(meta.Authors) > 0 {
+		tag.set(textFrame(tag.version, "TPE1", meta.Authors[0]))
+		tag.set(textFrame(tag.version, "TPE2", meta.Authors[0]))
+	}
+	if len(meta.Narrators) > 0 {
+		tag.set(textFrame(tag.version, "TCOM", meta.Narrators[0]))
+	}
+	if edit := record.parts[0].tagEdit; edit != nil && edit.cover != "" {
+		cover, errCover := p.coverFrame(edit.cover)
+		if errCover != nil {
+			return nil, errCover
+		}
+		tag.frames = append(tag.frames, cover)
+	}
+
+	if len(spans) > 255 {
+		return nil, fmt.Errorf("%w: %d chapters, at most 255 fit into table of contents", errMerge, len(spans))
+	}
+
+	toc := &bytes.Buffer{}
+	toc.WriteString("toc\x00")
+	toc.WriteByte(0x03) // top level, ordered
+	toc.WriteByte(byte(len(spans)))
+
+	start := time.Duration(0)
+	chapters := []id3Frame{}
+	for i, span := range spans {
+		id := fmt.Sprintf("ch%d", i)
+		toc.WriteString(id + "\x00")
+
+		title := textFrame(tag.version, "TIT2", meta.Chapters[i].Title)
+		chapter := &bytes.Buffer{}
+		chapter.WriteString(id + "\x00")
+		times := []uint32{
+			uint32(start.Milliseconds()), uint32((start + span.duration).Milliseconds()),
+			// byte offsets are not used
+			0xFFFFFFFF, 0xFFFFFFFF,
+		}
+		_ = binary.Write(chapter, binary.BigEndian, times)
+		chapter.Write((&id3Tag{version: tag.version, frames: []id3Frame{title}}).encode()[10:])
+
+		chapters = append(chapters, id3Frame{id: "CHAP", data: chapter.Bytes()})
+		start += span.duration
+	}
+
+	tag.frames = append(tag.frames, id3Frame{id: "CTOC", data: toc.Bytes()})
+	tag.frames = append(tag.frames, chapters...)
+	return tag.encode(), nil
+}
+
+// writeMerged writes MPEG frames of record parts one after another under a single tag with chapters.
+// All parts must have the same MPEG version, layer, sample rate and channel mode.
+func (p *processor) writeMerged(ctx context.Context, archive archiveWriter, record fileRecord) error {
+	spans := make([]mp3Span, len(record.parts))
+	size, sourceSize, duration := int64(0), int64(0), time.Duration(0)
+	for i, part := range record.parts {
+		span, errSpan := scanMP3Span(part.path)
+		if errSpan != nil {
+			return fmt.Errorf("%w: %w", errMerge, errSpan)
+		}
+		first := spans[0].frame
+		if i > 0 && (span.frame.version != first.version || span.frame.layer != first.layer ||
+			span.frame.sampleRate != first.sampleRate || span.frame.mono != first.mono) {
+			return fmt.Errorf("%w: %q and %q have different MPEG versions, layers, sample rates or channels",
+				errMerge, record.parts[0].path, part.path)
+		}
+		if info, err := os.Stat(part.path); err == nil {
+			sourceSize += info.Size()
+		}
+		spans[i] = span
+		size += span.end - span.start
+		duration += span.duration
+	}
+
+	tag, errTag := p.mergedTag(record, spans)
+	if errTag != nil {
+		return errTag
+	}
+
+	wr, errCreate := archive.create(archiveEntry{
+		name:    record.name,
+		source:  record.path,
+		size:    int64(len(tag)) + size,
+		modTime: p.entryTime(nil),
+	})
+	if errCreate != nil {
+		return errCreate
+	}
+
+	dst := p.trackEntry(wr, record, int64(len(tag))+size)
+	sum := sha256.New()
+	if p.hashFiles {
+		dst = io.MultiWriter(dst, sum)
+	}
+	if _, err := dst.Write(tag); err != nil {
+		return fmt.Errorf("writing tags of %q: %w", record.name, err)
+	}
+
+	for i, part := range record.parts {
+		file, _, errOpen := openSourceFile(part.path)
+		if errOpen != nil {
+			return errOpen
+		}
+		errCopy := rewind(file, spans[i].start)
+		if errCopy == nil {
+			errCopy = p.copyFileTo(ctx, dst, file, spans[i].end-spans[i].start)
+		}
+		_ = file.Close()
+		if errCopy != nil {
+			return errCopy
+		}
+	}
+
+	if p.hashFiles {
+		p.manifest = append(p.manifest, manifestLine{sum: sum.Sum(nil), name: record.name, source: record.path})
+	}
+	p.report.add(record.path, record, sourceSize, duration)
+	return nil
+}
@@ -0,0 +1,160 @@
+package repack
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// MetadataName is a sidecar file which Audiobookshelf reads from book dirs.
+const MetadataName = "metadata.json"
+
+// bookMetadata is a subset of Audiobookshelf metadata.json.
+type bookMetadata struct {
+	Title       string            `json:"title"`
+	Authors     []string          `json:"authors"`
+	Narrators   []string          `json:"narrators"`
+	Genres      []string          `json:"genres"`
+	Year        string            `json:"publishedYear,omitempty"`
+	Publisher   string            `json:"publisher,omitempty"`
+	Description string            `json:"description,omitempty"`
+	ISBN        string            `json:"isbn,omitempty"`
+	Language    string            `json:"language,omitempty"`
+	Duration    float64           `json:"duration"`
+	Chapters    []metadataChapter `json:"chapters"`
+}
+
+// metadataChapter is a single audio file of the book, times are in seconds.
+type metadataChapter struct {
+	ID    int     `json:"id"`
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+	Title string  `json:"title"`
+}
+
+// metadataEntryName places the sidecar next to the book files,
+// inside of the book dir with -keep-dirs.
+func (p *processor) metadataEntryName(dir string) string {
+	if p.keepDirs {
+		return path.Join(strings.TrimSuffix(sanitizeDirPrefix(dir), "_"), MetadataName)
+	}
+	return sanitizeDirPrefix(dir) + MetadataName
+}
+
+// readBookMetadata collects metadata of audio records from their ID3 tags.
+// Title falls back to the dir name, audio of unknown duration makes a zero length chapter.
+func readBookMetadata(dir string, records []fileRecord, useDirTitle bool) bookMetadata {
+	albums, artists, narrators, genres, years := map[string]int{}, map[string]int{}, map[string]int{}, map[string]int{}, map[string]int{}
+	meta := bookMetadata{Authors: []string{}, Narrators: []string{}, Genres: []string{}, Chapters: []metadataChapter{}}
+
+	offset := 0.0
+	sources := []fileRecord{}
+	for _, record := range records {
+		sources = append(sources, record.sources()...)
+	}
+	for _, record := range sources {
+		if !isAudio(record.path) {
+			continue
+		}
+
+		tag, errTag := readID3v2File(record.path)
+		if errTag != nil {
+			slog.Warn("reading tags", "file", record.path, "err", errTag)
+		}
+		count := func(counts map[string]int, ids ...string) {
+			for _, id := range ids {
+				if value := tag.text(id); value != "" {
+					counts[value]++
+					return
+				}
+			}
+		}
+		count(albums, "TALB")
+		count(artists, "TPE2", "TPE1")
+		count(narrators, "TCOM")
+		count(genres, "TCON")
+		count(years, "TYER", "TDRC")
+
+		d, errDuration := audioDuration(record.path)
+		if errDuration != nil {
+			slog.Warn("unknown duration", "file", record.path, "err", errDuration)
+		}
+		title := tag.text("TIT2")
+		if title == "" {
+			title = strings.TrimSuffix(filepath.Base(record.path), filepath.Ext(record.path))
+		}
+		meta.Chapters = append(meta.Chapters, metadataChapter{
+			ID:    len(meta.Chapters),
+			Start: offset,
+			End:   offset + d.Seconds(),
+			Title: title,
+		})
+		offset += d.Seconds()
+	}
+
+	meta.Title = mostCommon(albums)
+	if meta.Title == "" || useDirTitle {
+		meta.Title = filepath.Base(filepath.Clean(dir))
+	}
+	for _, list := range []struct {
+		dst    *[]string
+		counts map[string]int
+	}{{&meta.Authors, artists}, {&meta.Narrators, narrators}, {&meta.Genres, genres}} {
+		if value := mostCommon(list.counts); value != "" {
+			*list.dst = append(*list.dst, value)
+		}
+	}
+	if year := mostCommon(years); len(year) >= 4 {
+		meta.Year = year[:4]
+	}
+	meta.Duration = offset
+
+	return meta
+}
+
+// withFetched overrides book fields with ones found online, chapters are kept.
+func (meta bookMetadata) withFetched(fetched *fetchedMetadata) bookMetadata {
+	if fetched == nil {
+		return meta
+	}
+	meta.Title = fetched.Title
+	if len(fetched.Authors) > 0 {
+		meta.Authors = fetched.Authors
+	}
+	if len(fetched.Genres) > 0 {
+		meta.Genres = fetched.Genres
+	}
+	if len(fetched.Published) >= 4 {
+		meta.Year = fetched.Published[:4]
+	}
+	meta.Publisher = fetched.Publisher
+	meta.Description = fetched.Description
+	meta.ISBN = fetched.ISBN
+	meta.Language = fetched.Language
+	return meta
+}
+
+// writeMetadata adds metadata sidecar of written records of the book from dir.
+func (p *processor) writeMetadata(archive archiveWriter, dir string, records []fileRecord, fetched *fetchedMetadata) error {
+	meta := readBookMetadata(dir, records, p.fixTags).withFetched(fetched)
+	content, errJSON := json.MarshalIndent(meta, "", "  ")
+	if errJSON != nil {
+		return fmt.Errorf("encoding metadata: %w", errJSON)
+	}
+	content = append(content, '\n')
+
+	wr, errCreate := archive.create(archiveEntry{
+		name:    p.generatedName(p.metadataEntryName(dir)),
+		size:    int64(len(content)),
+		modTime: p.entryTime(nil),
+	})
+	if errCreate != nil {
+		return errCreate
+	}
+
+	_, errWrite := wr.Write(content)
+	return errWrite
+}
@@ -0,0 +1,317 @@
+package repack
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+var errNotMP3 = errors.New("no mpeg audio frames found")
+
+type mp3Frame struct {
+	version    int // 1 = MPEG1, 2 = MPEG2, 25 = MPEG2.5
+	layer      int
+	bitrate    int // bits per second
+	sampleRate int
+	padding    int
+	mono       bool
+}
+
+var mp3Bitrates = map[[2]int][16]int{
+	{1, 1}: {0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448, -1},
+	{1, 2}: {0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384, -1},
+	{1, 3}: {0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, -1},
+	{2, 1}: {0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256, -1},
+	{2, 2}: {0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, -1},
+	{2, 3}: {0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, -1},
+}
+
+var mp3SampleRates = map[int][3]int{
+	1:  {44100, 48000, 32000},
+	2:  {22050, 24000, 16000},
+	25: {11025, 12000, 8000},
+}
+
+// parseMP3Frame decodes a 4 byte MPEG audio frame header.
+func parseMP3Frame(header []byte) (mp3Frame, bool) {
+	if len(header) < 4 || header[0] != 0xFF || header[1]&0xE0 != 0xE0 {
+		return mp3Frame{}, false
+	}
+
+	frame := mp3Frame{}
+	switch (header[1] >> 3) & 0x03 {
+	case 0:
+		frame.version = 25
+	case 2:
+		frame.version = 2
+	case 3:
+		frame.version = 1
+	default:
+		return mp3Frame{}, false
+	}
+
+	frame.layer = 4 - int((header[1]>>1)&0x03)
+	if frame.layer == 4 {
+		return mp3Frame{}, false
+	}
+
+	tableVersion := frame.version
+	if tableVersion == 25 {
+		tableVersion = 2
+	}
+	kbps := mp3Bitrates[[2]int{tableVersion, frame.layer}][header[2]>>4]
+	if kbps <= 0 {
+		// free format and bad bitrates can't be walked frame by frame
+		return mp3Frame{}, false
+	}
+	frame.bitrate = kbps * 1000
+
+	rateIndex := (header[2] >> 2) & 0x03
+	if rateIndex == 3 {
+		return mp3Frame{}, false
+	}
+	frame.sampleRate = mp3SampleRates[frame.version][rateIndex]
+	frame.padding = int((header[2] >> 1) & 0x01)
+	frame.mono = header[3]>>6 == 3
+
+	return frame, true
+}
+
+func (f mp3Frame) samples() int {
+	switch {
+	case f.layer == 1:
+		return 384
+	case f.layer == 3 && f.version != 1:
+		return 576
+	default:
+		return 1152
+	}
+}
+
+// size returns full frame length in bytes, header included.
+func (f mp3Frame) size() int {
+	if f.layer == 1 {
+		return (12*f.bitrate/f.sampleRate + f.padding) * 4
+	}
+	return f.samples()/8*f.bitrate/f.sampleRate + f.padding
+}
+
+func (f mp3Frame) duration() time.Duration {
+	return time.Duration(f.samples()) * time.Second / time.Duration(f.sampleRate)
+}
+
+// sideInfoSize is the length of layer III side information following the header.
+func (f mp3Frame) sideInfoSize() int {
+	switch {
+	case f.version == 1 && f.mono:
+		return 17
+	case f.version == 1:
+		return 32
+	case f.mono:
+		return 9
+	default:
+		return 17
+	}
+}
+
+// id3v2Size returns full length of ID3v2 tag in the header, or 0 if there is no tag.
+func id3v2Size(header []byte) int {
+	if len(header) < 10 || string(header[:3]) != "ID3" {
+		return 0
+	}
+	size := syncsafeInt(header[6:10]) + 10
+	if header[5]&0x10 != 0 {
+		size += 10 // footer
+	}
+	return size
+}
+
+func syncsafeInt(b []byte) int {
+	n := 0
+	for _, c := range b {
+		n = n<<7 | int(c&0x7F)
+	}
+	return n
+}
+
+// mp3Duration walks through MPEG audio frames of file and sums their duration.
+// Xing/Info and VBRI headers are used as a shortcut when present.
+func mp3Duration(filename string) (time.Duration, error) {
+	file, errFile := openNoFollow(filename, os.O_RDONLY, 0600)
+	if errFile != nil {
+		return 0, fmt.Errorf("unable to open file %q: %w", filename, errFile)
+	}
+	defer file.Close()
+
+	return readMP3Duration(bufio.NewReaderSize(file, 64*1024))
+}
+
+func readMP3Duration(re *bufio.Reader) (time.Duration, error) {
+	head, _ := re.Peek(10)
+	if tagSize := id3v2Size(head); tagSize > 0 {
+		if _, err := re.Discard(tagSize); err != nil {
+			return 0, errNotMP3
+		}
+	}
+
+	total := time.Duration(0)
+	first := true
+	for {
+		header, errPeek := re.Peek(4)
+		if len(header) < 4 {
+			if errPeek != nil && !errors.Is(errPeek, io.EOF) {
+				return 0, errPeek
+			}
+			break
+		}
+
+		frame, ok := parseMP3Frame(header)
+		if !ok {
+			// resync on garbage between frames
+			if _, err := re.Discard(1); err != nil {
+				break
+			}
+			continue
+		}
+
+		if first {
+			first = false
+			if frames, ok := vbrFrameCount(re, frame); ok {
+				return time.Duration(frames) * frame.duration(), nil
+			}
+		}
+
+		total += frame.duration()
+		if _, err := re.Discard(frame.size()); err != nil {
+			break
+		}
+	}
+
+	if total == 0 {
+		return 0, errNotMP3
+	}
+
+	return total, nil
+}
+
+// vbrFrameCount looks up total frame count in the Xing/Info or VBRI header of the first frame.
+func vbrFrameCount(re *bufio.Reader, frame mp3Frame) (int, bool) {
+	data, _ := re.Peek(frame.size())
+
+	xing := 4 + frame.sideInfoSize()
+	if len(data) >= xing+12 {
+		tag := string(data[xing : xing+4])
+		flags := binary.BigEndian.Uint32(data[xing+4:])
+		if (tag == "Xing" || tag == "Info") && flags&0x01 != 0 {
+			return int(binary.BigEndian.Uint32(data[xing+8:])), true
+		}
+	}
+
+	const vbri = 4 + 32
+	if len(data) >= vbri+18 && string(data[vbri:vbri+4]) == "VBRI" {
+		return int(binary.BigEndian.Uint32(data[vbri+14:])), true
+	}
+
+	return 0, false
+}
+
+// mp3IsVBR reports whether an MP3 file has variable bitrate: its first frame is a Xing
+// or VBRI header, or bitrates of its first frames differ. Info headers mark constant bitrate.
+func mp3IsVBR(filename string) (bool, error) {
+	file, errFile := openNoFollow(filename, os.O_RDONLY, 0600)
+	if errFile != nil {
+		return false, fmt.Errorf("unable to open file %q: %w", filename, errFile)
+	}
+	defer file.Close()
+
+	re := bufio.NewReaderSize(file, 64*1024)
+	head, _ := re.Peek(10)
+	if tagSize := id3v2Size(head); tagSize > 0 {
+		if _, err := re.Discard(tagSize); err != nil {
+			return false, errNotMP3
+		}
+	}
+
+	const checkedFrames = 100
+	frames, bitrate := 0, 0
+	for frames < checkedFrames {
+		header, _ := re.Peek(4)
+		if len(header) < 4 {
+			break
+		}
+		frame, ok := parseMP3Frame(header)
+		if !ok {
+			if _, err := re.Discard(1); err != nil {
+				break
+			}
+			continue
+		}
+
+		if frames == 0 {
+			data, _ := re.Peek(frame.size())
+			if tag := vbrHeaderTag(data, frame); tag != "" {
+				return tag != "Info", nil
+			}
+		}
+		if frames > 0 && frame.bitrate != bitrate {
+			return true, nil
+		}
+		frames, bitrate = frames+1, frame.bitrate
+		if _, err := re.Discard(frame.size()); err != nil {
+			break
+		}
+	}
+
+	if frames == 0 {
+		return false, errNotMP3
+	}
+	return false, nil
+}
+
+// vbrHeaderTag returns Xing, Info or VBRI if data of the first frame is such a header.
+func vbrHeaderTag(data []byte, frame mp3Frame) string {
+	xing := 4 + frame.sideInfoSize()
+	if len(data) >= xing+4 {
+		if tag := string(data[xing : xing+4]); tag == "Xing" || tag == "Info" {
+			return tag
+		}
+	}
+	const vbri = 4 + 32
+	if len(data) >= vbri+4 && string(data[vbri:vbri+4]) == "VBRI" {
+		return "VBRI"
+	}
+	return ""
+}
+
+// silentFrame is a MPEG1 layer III 32kbps 44.1kHz mono frame.
+// Zeroed side info and main data decode to silence.
+var silentFrame = func() []byte {
+	frame := mp3Frame{version: 1, layer: 3, bitrate: 32000, sampleRate: 44100, mono: true}
+	data := make([]byte, frame.size())
+	copy(data, []byte{0xFF, 0xFB, 0x10, 0xC0})
+	return data
+}()
+
+func silentFrameCount(d time.Duration) int {
+	frame, _ := parseMP3Frame(silentFrame)
+	return int((d + frame.duration() - 1) / frame.duration())
+}
+
+// silenceSize returns number of bytes writeSilence produces for duration d.
+func silenceSize(d time.Duration) int64 {
+	return int64(silentFrameCount(d) * len(silentFrame))
+}
+
+// writeSilence writes enough silent frames to cover duration d.
+func writeSilence(dst io.Writer, d time.Duration) error {
+	for range silentFrameCount(d) {
+		if _, err := dst.Write(silentFrame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package repack
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+var errNotMP4 = errors.New("not an mp4 file")
+
+// mp4Duration reads duration of M4A/M4B file from movie header of moov box.
+func mp4Duration(filename string) (time.Duration, error) {
+	file, errFile := openNoFollow(filename, os.O_RDONLY, 0600)
+	if errFile != nil {
+		return 0, fmt.Errorf("unable to open file %q: %w", filename, errFile)
+	}
+	defer file.Close()
+
+	info, errStat := file.Stat()
+	if errStat != nil {
+		return 0, errStat
+	}
+	return readMP4Duration(file, info.Size())
+}
+
+// readMP4Duration finds the movie header of an MP4 file of given size, boxes are read in order of offsets.
+func readMP4Duration(file io.ReaderAt, size int64) (time.Duration, error) {
+	moov, errMoov := findMP4Box(file, 0, size, "moov")
+	if errMoov != nil {
+		return 0, errMoov
+	}
+	mvhd, errMvhd := findMP4Box(file, moov.start, moov.end, "mvhd")
+	if errMvhd != nil {
+		return 0, errMvhd
+	}
+
+	return readMVHD(io.NewSectionReader(file, mvhd.start, mvhd.end-mvhd.start))
+}
+
+// mp4Box is content range of a box without its header.
+type mp4Box struct {
+	start, end int64
+}
+
+// findMP4Box looks for box of given type among boxes in [start, end) of file.
+func findMP4Box(file io.ReaderAt, start, end int64, boxType string) (mp4Box, error) {
+	found, ok := mp4Box{}, false
+	errWalk := walkMP4Boxes(file, start, end, func(t string, box mp4Box) bool {
+		found, ok = box, t == boxType
+		return !ok
+	})
+	if errWalk != nil {
+		return mp4Box{}, errWalk
+	}
+	if !ok {
+		return mp4Box{}, fmt.Errorf("%w: no %q box", errNotMP4, boxType)
+	}
+	return found, nil
+}
+
+// walkMP4Boxes calls fn for boxes in [start, end) of file until it returns false.
+// Boxes which don't fit into the range are errors.
+func walkMP4Boxes(file io.ReaderAt, start, end int64, fn func(boxType string, box mp4Box) bool) error {
+	header := make([]byte, 16)
+	for offset := start; offset < end; {
+		if end-offset < 8 {
+			return fmt.Errorf("%w: %d stray bytes at %d", errNotMP4, end-offset, offset)
+		}
+		if _, err := file.ReadAt(header[:8], offset); err != nil {
+			return fmt.Errorf("%w: %w", errNotMP4, err)
+		}
+		size := int64(binary.BigEndian.Uint32(header[:4]))
+		headerSize := int64(8)
+		switch size {
+		case 0:
+			// the box lasts until the end of its parent
+			size = end - offset
+		case 1:
+			if _, err := file.ReadAt(header[8:16], offset+8); err != nil {
+				return fmt.Errorf("%w: %w", errNotMP4, err)
+			}
+			size, headerSize = int64(binary.BigEndian.Uint64(header[8:16])), 16
+		}
+		if size < headerSize || offset+size > end {
+			return fmt.Errorf("%w: bad %q box size at %d", errNotMP4, header[4:8], offset)
+		}
+
+		if !fn(string(header[4:8]), mp4Box{start: offset + headerSize, end: offset + size}) {
+			return nil
+		}
+		offset += size
+	}
+	return nil
+}
+
+// readMVHD decodes duration from movie header box content.
+func readMVHD(re io.Reader) (time.Duration, error) {
+	version := make([]byte, 4)
+	if _, err := io.ReadFull(re, version); err != nil {
+		return 0, fmt.Errorf("%w: %w", errNotMP4, err)
+	}
+
+	var timescale uint32
+	var duration uint64
+	switch version[0] {
+	case 0:
+		fields := struct{ Created, Modified, Timescale, Duration uint32 }{}
+		if err := binary.Read(re, binary.BigEndian, &fields); err != nil {
+			return 0, fmt.Errorf("%w: %w", errNotMP4, err)
+		}
+		timescale, duration = fields.Timescale, uint64(fields.Duration)
+	case 1:
+		fields := struct {
+			Created, Modified uint64
+			Timescale         uint32
+			Duration          uint64
+		}{}
+		if err := binary.Read(re, binary.BigEndian, &fields); err != nil {
+			return 0, fmt.Errorf("%w: %w", errNotMP4, err)
+		}
+		timescale, duration = fields.Timescale, fields.Duration
+	default:
+		return 0, fmt.Errorf("%w: unknown mvhd version %d", errNotMP4, version[0])
+	}
+	if timescale == 0 {
+		return 0, fmt.Errorf("%w: zero timescale", errNotMP4)
+	}
+
+	seconds := duration / uint64(timescale)
+	rest := duration % uint64(timescale)
+	return time.Duration(seconds)*time.Second + time.Duration(rest)*time.Second/time.Duration(timescale), nil
+}
@@ -0,0 +1,119 @@
+package repack
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+var errBadEntryName = errors.New("bad entry name")
+
+// entryNameFields are values available to -name-template.
+type entryNameFields struct {
+	// DirBase is base name of the book dir
+	DirBase string
+	// RelPath is slash separated path of the file relative to the book dir
+	RelPath string
+	// FlatPath is RelPath with separators replaced by underscores
+	FlatPath string
+	// Name is file name without extension, Ext is extension with the dot
+	Name, Ext string
+	// Index is 1-based position of the file in the book, Total is number of files
+	Index, Total int
+
+	// tag fields are empty or zero for files without ID3 tags
+	Title, Artist, Album string
+	Track, Disc          int
+}
+
+// keepDirsTemplate names entries by their paths inside of book dir, used by -keep-dirs.
+const keepDirsTemplate = "{{if .DirBase}}{{.DirBase}}/{{end}}{{.RelPath}}"
+
+// ParseNameTemplate parses -name-template value, missing fields are errors.
+func ParseNameTemplate(text string) (*template.Template, error) {
+	return template.New("name").Option("missingkey=error").Parse(text)
+}
+
+// applyNameTemplate renames records of a book dir in their current order.
+func applyNameTemplate(tmpl *template.Template, dir string, records []fileRecord) error {
+	dirBase := strings.TrimSuffix(sanitizeDirPrefix(dir), "_")
+	for i := range records {
+		rel := filepath.ToSlash(records[i].rel)
+		ext := path.Ext(rel)
+		fields := entryNameFields{
+			DirBase:  dirBase,
+			RelPath:  rel,
+			FlatPath: strings.ReplaceAll(rel, "/", "_"),
+			Name:     strings.TrimSuffix(path.Base(rel), ext),
+			Ext:      ext,
+			Index:    i + 1,
+			Total:    len(records),
+		}
+
+		tag := (*id3Tag)(nil)
+		if records[i].zipped == nil {
+			var errTag error
+			tag, errTag = readID3v2File(records[i].path)
+			if errTag != nil {
+				slog.Warn("reading tags", "file", records[i].path, "err", errTag)
+			}
+		}
+		fields.Title = tag.text("TIT2")
+		fields.Artist = tag.text("TPE1")
+		fields.Album = tag.text("TALB")
+		fields.Track, _ = id3Number(tag.text("TRCK"))
+		fields.Disc, _ = id3Number(tag.text("TPOS"))
+
+		name := &strings.Builder{}
+		if err := tmpl.Execute(name, fields); err != nil {
+			return fmt.Errorf("naming %q: %w", records[i].path, err)
+		}
+		if !fs.ValidPath(name.String()) || name.String() == "." {
+			return fmt.Errorf("%w: %q for %q", errBadEntryName, name.String(), records[i].path)
+		}
+
+		slog.Debug("named file", "file", records[i].path, "name", name.String())
+		records[i].name = name.String()
+	}
+
+	return nil
+}
+
+// padNumbers left pads runs of ASCII digits in name to width with zeros,
+// so plain byte ordering matches natural ordering. Extension is kept as is.
+func padNumbers(name string, width int) string {
+	ext := path.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+
+	padded := &strings.Builder{}
+	for len(stem) > 0 {
+		digits := strings.IndexFunc(stem, isASCIIDigit)
+		if digits < 0 {
+			padded.WriteString(stem)
+			break
+		}
+		padded.WriteString(stem[:digits])
+		stem = stem[digits:]
+
+		end := strings.IndexFunc(stem, func(ch rune) bool { return !isASCIIDigit(ch) })
+		if end < 0 {
+			end = len(stem)
+		}
+		if end < width {
+			padded.WriteString(strings.Repeat("0", width-end))
+		}
+		padded.WriteString(stem[:end])
+		stem = stem[end:]
+	}
+
+	return padded.String() + ext
+}
+
+func isASCIIDigit(ch rune) bool {
+	return '0' <= ch && ch <= '9'
+}
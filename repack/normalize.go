@@ -0,0 +1,80 @@
+package repack
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+const (
+	// loudnessTruePeak is the true peak ceiling of normalized audio in dBTP
+	loudnessTruePeak = -1.5
+	// loudnessRange is the target loudness range in LU
+	loudnessRange = 11
+)
+
+// ParseNormalize parses -normalize value ebur128[:TARGET], e.g. ebur128:-18LUFS.
+func ParseNormalize(value string) (float64, error) {
+	method, target, _ := strings.Cut(value, ":")
+	if method != "ebur128" {
+		return 0, fmt.Errorf("unknown normalization %q, want ebur128", method)
+	}
+	if target == "" {
+		return -18, nil
+	}
+
+	target = strings.TrimSpace(target)
+	if len(target) > 4 && strings.EqualFold(target[len(target)-4:], "lufs") {
+		target = strings.TrimSpace(target[:len(target)-4])
+	}
+	lufs, err := strconv.ParseFloat(target, 64)
+	if err != nil || lufs < -70 || lufs > -5 {
+		return 0, fmt.Errorf("bad loudness target %q, want -70..-5 LUFS", target)
+	}
+	return lufs, nil
+}
+
+// loudnormStats are measurements printed by the first loudnorm pass.
+type loudnormStats struct {
+	InputI       string `json:"input_i"`
+	InputTP      string `json:"input_tp"`
+	InputLRA     string `json:"input_lra"`
+	InputThresh  string `json:"input_thresh"`
+	TargetOffset string `json:"target_offset"`
+}
+
+// loudnorm measures loudness of source and returns the filter of the second pass,
+// which applies linear gain to reach the target.
+func (t *transcoder) loudnorm(ctx context.Context, source string) (string, error) {
+	target := fmt.Sprintf("I=%g:TP=%g:LRA=%g", t.loudness, loudnessTruePeak, float64(loudnessRange))
+
+	stderr := &bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, t.ffmpeg,
+		"-hide_banner", "-nostdin", "-nostats",
+		"-i", source,
+		"-vn", "-af", "loudnorm="+target+":print_format=json",
+		"-f", "null", "-",
+	)
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("running ffmpeg: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	// statistics are the last JSON object of the log
+	output := stderr.Bytes()
+	start := bytes.LastIndexByte(output, '{')
+	if start < 0 {
+		return "", fmt.Errorf("no loudnorm statistics in ffmpeg output")
+	}
+	stats := loudnormStats{}
+	if err := json.Unmarshal(bytes.TrimSpace(output[start:]), &stats); err != nil {
+		return "", fmt.Errorf("reading loudnorm statistics: %w", err)
+	}
+
+	return fmt.Sprintf("loudnorm=%s:measured_I=%s:measured_TP=%s:measured_LRA=%s:measured_thresh=%s:offset=%s:linear=true",
+		target, stats.InputI, stats.InputTP, stats.InputLRA, stats.InputThresh, stats.TargetOffset), nil
+}
@@ -0,0 +1,155 @@
+package repack
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// NotifyDesktop shows a desktop notification: with notify-send on Linux and BSDs, osascript on macOS
+// and a PowerShell balloon tip on Windows.
+// NotifyWebhookPrefix followed by a URL posts the summary as JSON.
+const (
+	NotifyDesktop       = "desktop"
+	NotifyWebhookPrefix = "webhook:"
+)
+
+// notifyTimeout limits a single notification, a run is notified even if it was interrupted.
+const notifyTimeout = 30 * time.Second
+
+var errBadNotify = errors.New("bad notification target")
+
+// ValidateNotify checks a notification target: desktop or webhook:URL with http or https URL.
+func ValidateNotify(target string) error {
+	if target == NotifyDesktop {
+		return nil
+	}
+	link, ok := strings.CutPrefix(target, NotifyWebhookPrefix)
+	if !ok {
+		return fmt.Errorf("%w: %q, want %s or %sURL", errBadNotify, target, NotifyDesktop, NotifyWebhookPrefix)
+	}
+	parsed, err := url.Parse(link)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errBadNotify, err)
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" || parsed.Host == "" {
+		return fmt.Errorf("%w: webhook needs http or https URL, got %q", errBadNotify, parsed.Redacted())
+	}
+	return nil
+}
+
+// webhookPayload is posted to webhooks. Text is the summary, chat services like Slack show it as is.
+type webhookPayload struct {
+	Text   string  `json:"text"`
+	OK     bool    `json:"ok"`
+	Error  string  `json:"error,omitempty"`
+	Report *Report `json:"report"`
+}
+
+// notify sends the summary of the run which ended with err to every target.
+// Failed notifications are logged, they don't fail the run.
+func (pk *Packer) notify(ctx context.Context, err error) {
+	if len(pk.opts.Notify) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), notifyTimeout)
+	defer cancel()
+
+	report := &pk.p.report
+	title, text := "audiobook-repack: done", report.text()
+	payload := webhookPayload{Text: text, OK: err == nil, Report: report}
+	if err != nil {
+		title = "audiobook-repack: failed"
+		if errors.Is(err, ErrFilesSkipped) {
+			title = "audiobook-repack: done with skipped files"
+		}
+		text = err.Error() + "\n" + text
+		payload.Text, payload.Error = text, err.Error()
+	}
+
+	for _, target := range pk.opts.Notify {
+		var errNotify error
+		if target == NotifyDesktop {
+			errNotify = notifyDesktop(ctx, title, text)
+		} else {
+			errNotify = postWebhook(ctx, strings.TrimPrefix(target, NotifyWebhookPrefix), payload)
+		}
+		if errNotify != nil {
+			// webhook paths often hold tokens
+			if parsed, err := url.Parse(strings.TrimPrefix(target, NotifyWebhookPrefix)); err == nil && parsed.Host != "" {
+				target = NotifyWebhookPrefix + parsed.Host
+			}
+			slog.Warn("notifying", "target", target, "err", errNotify)
+		}
+	}
+}
+
+// text is a short summary of the run for notifications.
+func (r *Report) text() string {
+	text := fmt.Sprintf("%d books, %d files, %s of audio, wrote %s", len(r.Books), r.Files, formatDuration(r.Duration), formatSize(r.BytesOut))
+	if len(r.Outputs) > 0 {
+		text += " into " + strings.Join(r.Outputs, ", ")
+	}
+	if len(r.Skipped) > 0 {
+		text += fmt.Sprintf(", %d skipped", len(r.Skipped))
+	}
+	return text
+}
+
+func notifyDesktop(ctx context.Context, title, text string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		script := fmt.Sprintf("display notification %s with title %s", appleScriptString(text), appleScriptString(title))
+		cmd = exec.CommandContext(ctx, "osascript", "-e", script)
+	case "windows":
+		script := "Add-Type -AssemblyName System.Windows.Forms; $n = New-Object System.Windows.Forms.NotifyIcon; " +
+			"$n.Icon = [System.Drawing.SystemIcons]::Information; $n.Visible = $true; " +
+			fmt.Sprintf("$n.ShowBalloonTip(10000, %s, %s, 'Info'); Start-Sleep 10; $n.Dispose()", powerShellString(title), powerShellString(text))
+		cmd = exec.CommandContext(ctx, "powershell", "-NoProfile", "-NonInteractive", "-Command", script)
+	case "plan9", "js", "wasip1":
+		return fmt.Errorf("%w: no desktop notifications on %s", errBadNotify, runtime.GOOS)
+	default:
+		cmd = exec.CommandContext(ctx, "notify-send", "--app-name=audiobook-repack", title, text)
+	}
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %w: %s", cmd.Path, err, bytes.TrimSpace(output))
+	}
+	return nil
+}
+
+// appleScriptString quotes s as AppleScript string literal.
+func appleScriptString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// powerShellString quotes s as PowerShell verbatim string.
+func powerShellString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+func postWebhook(ctx context.Context, link string, payload webhookPayload) error {
+	body, errJSON := json.Marshal(payload)
+	if errJSON != nil {
+		return errJSON
+	}
+	req, errReq := http.NewRequestWithContext(ctx, http.MethodPost, link, bytes.NewReader(body))
+	if errReq != nil {
+		return errReq
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, errDo := http.DefaultClient.Do(req)
+	if errDo != nil {
+		return errDo
+	}
+	return checkStatus(resp)
+}
@@ -0,0 +1,25 @@
+//go:build !unix
+
+package repack
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+)
+
+var errSymlink = errors.New("refusing to follow symbolic link")
+
+// openNoFollow opens a file, failing if the last path element is a symlink.
+// There is no O_NOFOLLOW here, so the link is checked with Lstat right before opening.
+func openNoFollow(filename string, flag int, perm os.FileMode) (*os.File, error) {
+	info, errStat := os.Lstat(filename)
+	switch {
+	case errStat == nil && info.Mode()&fs.ModeSymlink != 0:
+		return nil, &fs.PathError{Op: "open", Path: filename, Err: errSymlink}
+	case errStat != nil && !errors.Is(errStat, fs.ErrNotExist):
+		return nil, errStat
+	}
+
+	return os.OpenFile(filename, flag, perm)
+}
@@ -0,0 +1,13 @@
+//go:build unix
+
+package repack
+
+import (
+	"os"
+	"syscall"
+)
+
+// openNoFollow opens a file, failing if the last path element is a symlink.
+func openNoFollow(filename string, flag int, perm os.FileMode) (*os.File, error) {
+	return os.OpenFile(filename, flag|syscall.O_NOFOLLOW, perm)
+}
@@ -0,0 +1,151 @@
+package repack
+
+import (
+	"bufio"
+	"cmp"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// OrderFileName is a file of a book dir listing its files in playback order, one path
+// relative to the dir per line. Listed files go first in that order, the rest follow
+// sorted as usual. Blank lines and lines starting with # are ignored.
+const OrderFileName = ".repack-order"
+
+// readOrderFile returns paths listed in the order file of dir, nil if there is none.
+func readOrderFile(dir string) ([]string, error) {
+	file, errOpen := os.Open(filepath.Join(dir, OrderFileName))
+	if errors.Is(errOpen, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if errOpen != nil {
+		return nil, errOpen
+	}
+	defer file.Close()
+
+	var names []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		names = append(names, path.Clean(filepath.ToSlash(line)))
+	}
+	return names, scanner.Err()
+}
+
+// applyOrderFile moves records listed in the order file of dir before the rest, in listed order.
+func applyOrderFile(dir string, records []fileRecord) error {
+	names, errRead := readOrderFile(dir)
+	if errRead != nil {
+		return fmt.Errorf("reading %s: %w", OrderFileName, errRead)
+	}
+	if names == nil {
+		return nil
+	}
+
+	positions := make(map[string]int, len(names))
+	for i, name := range names {
+		if _, ok := positions[name]; !ok {
+			positions[name] = i
+		}
+	}
+
+	found := map[string]bool{}
+	for _, record := range records {
+		if _, ok := positions[record.rel]; ok {
+			found[record.rel] = true
+		}
+	}
+	for _, name := range names {
+		if !found[name] {
+			slog.Warn("file of order file isn't packed", "dir", dir, "file", name)
+		}
+	}
+
+	slices.SortStableFunc(records, func(a, b fileRecord) int {
+		posA, listedA := positions[a.rel]
+		posB, listedB := positions[b.rel]
+		switch {
+		case listedA && listedB:
+			return cmp.Compare(posA, posB)
+		case listedA:
+			return -1
+		case listedB:
+			return 1
+		default:
+			return 0
+		}
+	})
+	return nil
+}
+
+// Keys files of a book are sorted by.
+const (
+	// SortTrack orders files by ID3 disc and track numbers, untagged ones follow by names
+	SortTrack = "track"
+	// SortName orders files by names only
+	SortName = "name"
+	// SortMTime orders files by modification time, oldest first
+	SortMTime = "mtime"
+	// SortSize orders files by size, smallest first
+	SortSize = "size"
+)
+
+// SortKeys are valid values of Options.SortBy.
+var SortKeys = []string{SortTrack, SortName, SortMTime, SortSize}
+
+// sortRecords orders records already sorted by names by sortBy, ties keep name order.
+// Tags aren't read from zipped records, they stay in name order with SortTrack.
+func (p *processor) sortRecords(records []fileRecord, zipped bool) error {
+	switch p.sortBy {
+	case SortTrack:
+		if !zipped {
+			sortByTrackTags(records)
+		}
+	case SortMTime, SortSize:
+		if err := sortByFileInfo(records, p.sortBy); err != nil {
+			return fmt.Errorf("sorting by %s: %w", p.sortBy, err)
+		}
+	}
+	if p.reverse {
+		slices.Reverse(records)
+	}
+	return nil
+}
+
+// sortByFileInfo stable sorts records by modification time or size of their sources.
+func sortByFileInfo(records []fileRecord, sortBy string) error {
+	keys := make(map[string]int64, len(records))
+	for _, record := range records {
+		var modTime time.Time
+		var size int64
+		if record.zipped != nil {
+			modTime, size = record.zipped.Modified, int64(record.zipped.UncompressedSize64)
+		} else {
+			info, err := os.Stat(record.path)
+			if err != nil {
+				return err
+			}
+			modTime, size = info.ModTime(), info.Size()
+		}
+		keys[record.path] = size
+		if sortBy == SortMTime {
+			keys[record.path] = modTime.UnixNano()
+		}
+	}
+
+	slices.SortStableFunc(records, func(a, b fileRecord) int {
+		return cmp.Compare(keys[a.path], keys[b.path])
+	})
+	return nil
+}
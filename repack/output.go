@@ -0,0 +1,328 @@
+package repack
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// tmpSuffix marks outputs which are being written.
+const tmpSuffix = ".tmp"
+
+// outputArchive is an archive written into temporary files, which replace
+// the outputs only on commit, so a failed run never destroys a previous good archive.
+type outputArchive interface {
+	archiveWriter
+	// commit closes the archive and renames temporary files into place
+	commit() error
+	// discard removes temporary files, it does nothing after commit
+	discard()
+}
+
+// fileArchive is an archive written into filename.tmp, closing it closes the file too.
+type fileArchive struct {
+	archiveWriter
+	file *os.File
+	// buffered collects small writes of archive headers and entries into large ones
+	buffered *bufio.Writer
+	written  *countingWriter
+	filename string
+
+	closed    bool
+	errClose  error
+	committed bool
+	// keepIncomplete leaves the temporary file on discard for -resume
+	keepIncomplete bool
+}
+
+func createArchiveFile(filename, format string, mode os.FileMode, opts archiveOptions) (*fileArchive, error) {
+	file, errFile := openNoFollow(filename+tmpSuffix, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if errFile != nil {
+		return nil, errFile
+	}
+
+	dst := io.Writer(file)
+	var buffered *bufio.Writer
+	if opts.bufferSize > 0 {
+		buffered = bufio.NewWriterSize(file, opts.bufferSize)
+		dst = buffered
+	}
+
+	if opts.entryDone != nil {
+		opts.sync = func() error {
+			if buffered != nil {
+				if err := buffered.Flush(); err != nil {
+					return err
+				}
+			}
+			return file.Sync()
+		}
+	}
+	opts.volume = strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+	if format == FormatISO || format == FormatSevenZip {
+		opts.writeAt = func(p []byte, offset int64) error {
+			if buffered != nil {
+				if err := buffered.Flush(); err != nil {
+					return err
+				}
+			}
+			_, err := file.WriteAt(p, offset)
+			return err
+		}
+	}
+	written := &countingWriter{dst: dst}
+	archive, errArchive := newArchiveWriter(format, written, opts)
+	if errArchive != nil {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+		return nil, errArchive
+	}
+
+	return &fileArchive{
+		archiveWriter:  archive,
+		file:           file,
+		buffered:       buffered,
+		written:        written,
+		filename:       filename,
+		keepIncomplete: opts.entryDone != nil,
+	}, nil
+}
+
+func (a *fileArchive) setComment(comment string) error {
+	writer, ok := a.archiveWriter.(commentWriter)
+	if !ok {
+		return fmt.Errorf("%w: output has no comment", errUnsupportedArchive)
+	}
+	return writer.setComment(comment)
+}
+
+func (a *fileArchive) createRaw(entry archiveEntry, raw rawData) (io.Writer, bool, error) {
+	writer, ok := a.archiveWriter.(rawArchiveWriter)
+	if !ok {
+		return nil, false, nil
+	}
+	return writer.createRaw(entry, raw)
+}
+
+func (a *fileArchive) dropEntry() error {
+	dropper, ok := a.archiveWriter.(entryDropper)
+	if !ok {
+		return fmt.Errorf("%w: output can't drop an entry", errUnsupportedArchive)
+	}
+	return dropper.dropEntry()
+}
+
+func (a *fileArchive) Close() error {
+	if !a.closed {
+		a.closed = true
+		errArchive := a.archiveWriter.Close()
+		if errArchive == nil && a.buffered != nil {
+			errArchive = a.buffered.Flush()
+		}
+		a.errClose = errors.Join(errArchive, a.file.Close())
+	}
+	return a.errClose
+}
+
+func (a *fileArchive) commit() error {
+	if err := a.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(a.file.Name(), a.filename); err != nil {
+		return fmt.Errorf("replacing output: %w", err)
+	}
+	a.committed = true
+	return nil
+}
+
+func (a *fileArchive) discard() {
+	if a.committed {
+		return
+	}
+	if a.keepIncomplete {
+		// the archive isn't finished, so its journaled entries can be resumed
+		if !a.closed {
+			a.closed = true
+			a.errClose = a.file.Close()
+			slog.Info("kept incomplete output to resume", "output", a.file.Name())
+		}
+		return
+	}
+	_ = a.Close()
+	removeIncomplete(a.file.Name())
+}
+
+// removeIncomplete removes a partially written output.
+func removeIncomplete(filename string) {
+	err := os.Remove(filename)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return
+	case err != nil:
+		slog.Error("removing incomplete output", "err", err)
+		return
+	}
+	slog.Info("removed incomplete output", "output", filename)
+}
+
+type countingWriter struct {
+	dst io.Writer
+	n   int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.dst.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+const (
+	// volumeTrailer is reserved for the archive end: zip central directory end, tar end blocks
+	volumeTrailer = 4 << 10
+	// entryOverhead is a rough upper bound of per-entry headers besides names
+	entryOverhead = 2 << 10
+)
+
+// splitArchive writes entries into numbered volumes, starting a new one
+// when the next entry would not fit into the size limit.
+// Entries are never split between volumes.
+type splitArchive struct {
+	base     string
+	limit    int64
+	openFile func(filename string) (*fileArchive, error)
+
+	current *fileArchive
+	// closed volumes are kept as temporary files until commit
+	closed  []*fileArchive
+	entries int
+	// reserved is an estimate of how much the central directory will take
+	reserved int64
+	volumes  []string
+}
+
+func newSplitArchive(base string, limit int64, openFile func(filename string) (*fileArchive, error)) *splitArchive {
+	return &splitArchive{base: base, limit: limit, openFile: openFile}
+}
+
+// volumeName inserts part number before the archive extension: book.zip -> book.part01.zip.
+func volumeName(base string, part int) string {
+	ext := filepath.Ext(base)
+	for _, known := range []string{".tar.gz", ".tgz", ".zip", ".tar"} {
+		if strings.HasSuffix(strings.ToLower(base), known) {
+			ext = base[len(base)-len(known):]
+			break
+		}
+	}
+	return fmt.Sprintf("%s.part%02d%s", strings.TrimSuffix(base, ext), part, ext)
+}
+
+func (s *splitArchive) create(entry archiveEntry) (io.Writer, error) {
+	if err := s.reserve(entry); err != nil {
+		return nil, err
+	}
+	return s.current.create(entry)
+}
+
+func (s *splitArchive) createRaw(entry archiveEntry, raw rawData) (io.Writer, bool, error) {
+	if err := s.reserve(entry); err != nil {
+		return nil, false, err
+	}
+	wr, copied, err := s.current.createRaw(entry, raw)
+	if !copied {
+		// the entry is reserved again when it's created decompressed
+		s.entries--
+		s.reserved -= headerOverhead(entry) / 2
+	}
+	return wr, copied, err
+}
+
+// headerOverhead is a rough upper bound of space taken by headers of the entry.
+func headerOverhead(entry archiveEntry) int64 {
+	return entryOverhead + 2*int64(len(entry.name)) + int64(len(entry.source))
+}
+
+// reserve makes room for the entry, starting a new volume if it doesn't fit into the current one.
+func (s *splitArchive) reserve(entry archiveEntry) error {
+	// deflate and zstd may slightly grow incompressible data
+	overhead := headerOverhead(entry)
+	need := entry.size + entry.size/1000 + overhead
+
+	if s.current != nil && s.entries > 0 && s.current.written.n+s.reserved+need+volumeTrailer > s.limit {
+		if err := s.closeVolume(); err != nil {
+			return err
+		}
+	}
+
+	if s.current == nil {
+		if err := s.openVolume(); err != nil {
+			return err
+		}
+	}
+
+	if need+volumeTrailer > s.limit {
+		slog.Warn("entry is larger than volume size limit, it gets a volume of its own", "name", entry.name)
+	}
+
+	s.entries++
+	s.reserved += overhead / 2
+	return nil
+}
+
+func (s *splitArchive) openVolume() error {
+	name := volumeName(s.base, len(s.volumes)+1)
+	volume, err := s.openFile(name)
+	if err != nil {
+		return fmt.Errorf("creating volume %q: %w", name, err)
+	}
+
+	slog.Info("writing volume", "volume", name)
+	s.current, s.entries, s.reserved = volume, 0, 0
+	s.volumes = append(s.volumes, name)
+	return nil
+}
+
+func (s *splitArchive) closeVolume() error {
+	err := s.current.Close()
+	s.closed = append(s.closed, s.current)
+	s.current = nil
+	if err != nil {
+		return fmt.Errorf("closing volume %q: %w", s.volumes[len(s.volumes)-1], err)
+	}
+	return nil
+}
+
+func (s *splitArchive) Close() error {
+	if s.current == nil {
+		return nil
+	}
+	return s.closeVolume()
+}
+
+// commit renames volumes into place after all of them were written.
+func (s *splitArchive) commit() error {
+	if err := s.Close(); err != nil {
+		return err
+	}
+	for _, volume := range s.closed {
+		if err := volume.commit(); err != nil {
+			return fmt.Errorf("volume %q: %w", volume.filename, err)
+		}
+	}
+	return nil
+}
+
+func (s *splitArchive) discard() {
+	if s.current != nil {
+		s.current.discard()
+		s.current = nil
+	}
+	for _, volume := range s.closed {
+		volume.discard()
+	}
+}
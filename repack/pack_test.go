@@ -0,0 +1,292 @@
+package repack
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"text/template"
+)
+
+func TestGlobs(t *testing.T) {
+	book := filepath.Join(t.TempDir(), "Book")
+	writeFiles(t, book, map[string]string{
+		"01.mp3":       "1",
+		"02.MP3":       "2",
+		"03.Flac":      "3",
+		"notes.txt":    "notes",
+		"NOTES.TXT":    "more notes",
+		"cover.jpg":    "cover",
+		"bonus/04.mp3": "4",
+	})
+
+	for _, tc := range []struct {
+		name string
+		opts Options
+		want []string
+	}{
+		{"default", Options{}, []string{"Book_01.mp3", "Book_02.MP3", "Book_03.Flac"}},
+		{"m4b defaults", Options{Globs: DefaultM4BGlobs}, []string{"Book_01.mp3", "Book_02.MP3"}},
+		{"custom", Options{Globs: []string{"*.txt"}}, []string{"Book_notes.txt"}},
+		{"custom ignoring case", Options{Globs: []string{"*.txt"}, GlobsIgnoreCase: true}, []string{"Book_NOTES.TXT", "Book_notes.txt"}},
+		{"subdirs", Options{Globs: []string{"**/*.mp3"}}, []string{"Book_01.mp3", "Book_bonus_04.mp3"}},
+		{"exclude", Options{Exclude: []string{"02.*"}}, []string{"Book_01.mp3", "Book_03.Flac"}},
+		{"exclude is case sensitive", Options{Exclude: []string{"0*.mp3"}}, []string{"Book_02.MP3", "Book_03.Flac"}},
+		{"exclude ignoring case", Options{Exclude: []string{"0*.mp3"}, GlobsIgnoreCase: true}, []string{"Book_03.Flac"}},
+		{"exclude default glob", Options{Exclude: []string{"*.mp3"}}, []string{"Book_03.Flac"}},
+		{"exclude subdir", Options{Globs: []string{"**/*.mp3", "**/*.jpg"}, Exclude: []string{"bonus/**"}}, []string{"Book_01.mp3", "Book_cover.jpg"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			output, err := pack(t, tc.opts, book)
+			if err != nil {
+				t.Fatal(err)
+			}
+			names := entryNames(t, output)
+			slices.Sort(names)
+			if !slices.Equal(names, tc.want) {
+				t.Errorf("entries are %q, want %q", names, tc.want)
+			}
+		})
+	}
+}
+
+func TestCollisions(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"Book/01.mp3":     "1",
+		"Book/sub/02.mp3": "3",
+		"Book/sub_02.mp3": "4",
+	})
+	book := filepath.Join(root, "Book")
+
+	for _, tc := range []struct {
+		policy string
+		opts   Options
+		want   []string
+	}{
+		{CollisionFail, Options{}, []string{"Book_01.mp3", "Book_sub_02.mp3"}},
+		{CollisionFail, Options{Globs: []string{"**/*.mp3"}}, nil},
+		{CollisionSuffix, Options{Globs: []string{"**/*.mp3"}}, []string{"Book_01.mp3", "Book_sub_02.mp3", "Book_sub_02_2.mp3"}},
+		{CollisionSuffix, Options{Globs: []string{"**/*.mp3"}, NameTemplate: mustParseNameTemplate(t, "book.mp3")}, []string{"book.mp3", "book_2.mp3", "book_3.mp3"}},
+	} {
+		t.Run(fmt.Sprintf("%s %q", tc.policy, tc.opts.Globs), func(t *testing.T) {
+			tc.opts.OnCollision = tc.policy
+			output, err := pack(t, tc.opts, book)
+			if tc.want == nil {
+				if !errors.Is(err, errNameCollision) {
+					t.Fatalf("packing failed with %v, want %v", err, errNameCollision)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if names := entryNames(t, output); !slices.Equal(names, tc.want) {
+				t.Errorf("entries are %q, want %q", names, tc.want)
+			}
+		})
+	}
+}
+
+func mustParseNameTemplate(t *testing.T, text string) *template.Template {
+	t.Helper()
+	tmpl, err := ParseNameTemplate(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tmpl
+}
+
+func TestEncryption(t *testing.T) {
+	book := filepath.Join(t.TempDir(), "Book")
+	files := map[string]string{
+		"01.mp3": strings.Repeat("first chapter\n", 10_000),
+		"02.mp3": "",
+		"03.mp3": "short",
+	}
+	writeFiles(t, book, files)
+	password := []byte("пароль")
+
+	for _, tc := range []struct {
+		name string
+		opts Options
+	}{
+		{"stored", Options{}},
+		{"deflate", Options{Compression: []string{"mp3=deflate"}}},
+		{"zstd ahead", Options{Compression: []string{"mp3=zstd"}, Workers: 4}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.opts.Password = password
+			output, err := pack(t, tc.opts, book)
+			if err != nil {
+				t.Fatal(err)
+			}
+			zr, err := zip.OpenReader(output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer zr.Close()
+
+			if len(zr.File) != len(files) {
+				t.Fatalf("archive has %d entries, want %d", len(zr.File), len(files))
+			}
+			for _, file := range zr.File {
+				if file.Method != zipAES {
+					t.Errorf("%s has method %d, want %d", file.Name, file.Method, zipAES)
+				}
+				if _, err := openEncrypted(file, []byte("wrong")); !errors.Is(err, errWrongPassword) {
+					t.Errorf("%s opened with a wrong password: %v", file.Name, err)
+				}
+
+				rc, err := openEncrypted(file, password)
+				if err != nil {
+					t.Fatalf("opening %s: %v", file.Name, err)
+				}
+				data, err := io.ReadAll(rc)
+				if errClose := rc.Close(); err == nil {
+					err = errClose
+				}
+				if err != nil {
+					t.Fatalf("reading %s: %v", file.Name, err)
+				}
+				if want := files[strings.TrimPrefix(file.Name, "Book_")]; string(data) != want {
+					t.Errorf("%s has %d bytes after decryption, want %d", file.Name, len(data), len(want))
+				}
+			}
+		})
+	}
+}
+
+func TestSplitVolumes(t *testing.T) {
+	book := filepath.Join(t.TempDir(), "Book")
+	files := map[string]string{}
+	var want []string
+	for i := range 6 {
+		name := fmt.Sprintf("%02d.mp3", i+1)
+		files[name] = strings.Repeat(name, 2_000)
+		want = append(want, "Book_"+name)
+	}
+	writeFiles(t, book, files)
+
+	const limit = 40 << 10
+	for _, tc := range []struct {
+		output  string
+		volumes []string
+	}{
+		{"out.zip", []string{"out.part01.zip", "out.part02.zip", "out.part03.zip"}},
+		{"out.tar", []string{"out.part01.tar", "out.part02.tar", "out.part03.tar"}},
+	} {
+		t.Run(tc.output, func(t *testing.T) {
+			dir := t.TempDir()
+			opts := Options{Output: filepath.Join(dir, tc.output), SplitSize: limit}
+			if strings.HasSuffix(tc.output, ".tar") {
+				opts.Format = FormatTar
+			}
+			if _, err := pack(t, opts, book); err != nil {
+				t.Fatal(err)
+			}
+
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var volumes, names []string
+			for _, entry := range entries {
+				volumes = append(volumes, entry.Name())
+				info, err := entry.Info()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if info.Size() > limit {
+					t.Errorf("%s has %d bytes, the limit is %d", entry.Name(), info.Size(), limit)
+				}
+				err = ListArchive(filepath.Join(dir, entry.Name()), false, nil, func(entry Entry) error {
+					names = append(names, entry.Name)
+					return nil
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !slices.Equal(volumes, tc.volumes) {
+				t.Errorf("volumes are %q, want %q", volumes, tc.volumes)
+			}
+			if !slices.Equal(names, want) {
+				t.Errorf("entries of volumes are %q, want %q", names, want)
+			}
+		})
+	}
+}
+
+func TestKeepGoing(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		output string
+		// removed drops 02.mp3 after discovery, otherwise it's replaced with a dir,
+		// which fails the first read once the entry is created
+		removed   bool
+		keepGoing bool
+		want      []string
+		wantErr   error
+	}{
+		{"removed", "out.zip", true, true, []string{"Book_01.mp3", "Book_03.mp3"}, ErrFilesSkipped},
+		{"removed without keep going", "out.zip", true, false, nil, os.ErrNotExist},
+		{"unreadable in dir", DirOutputPrefix + "out", false, true, []string{"Book_01.mp3", "Book_03.mp3"}, ErrFilesSkipped},
+		{"unreadable in zip", "out.zip", false, true, nil, errSourceRead},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			book := filepath.Join(root, "Book")
+			writeFiles(t, book, map[string]string{"01.mp3": "1", "02.mp3": "2", "03.mp3": "3"})
+
+			output := tc.output
+			if dir, ok := DirOutput(output); ok {
+				output = DirOutputPrefix + filepath.Join(root, dir)
+			} else {
+				output = filepath.Join(root, output)
+			}
+			broken := filepath.Join(book, "02.mp3")
+			_, err := pack(t, Options{
+				Output:    output,
+				KeepGoing: tc.keepGoing,
+				Hooks: Hooks{Discovered: func(books, entries int) {
+					if err := os.Remove(broken); err != nil {
+						t.Error(err)
+					}
+					if !tc.removed {
+						if err := os.Mkdir(broken, 0o755); err != nil {
+							t.Error(err)
+						}
+					}
+				}},
+			}, book)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("packing failed with %v, want %v", err, tc.wantErr)
+			}
+			if tc.want == nil {
+				return
+			}
+
+			var names []string
+			if dir, ok := DirOutput(output); ok {
+				entries, err := os.ReadDir(dir)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, entry := range entries {
+					names = append(names, entry.Name())
+				}
+			} else {
+				names = entryNames(t, output)
+			}
+			if !slices.Equal(names, tc.want) {
+				t.Errorf("entries are %q, want %q", names, tc.want)
+			}
+		})
+	}
+}
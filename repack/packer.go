@@ -0,0 +1,808 @@
+// Package repack finds audio files of book dirs, sorts them in playback order
+// and packs them into zip, tar or m4b archives.
+package repack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Options configure a Packer, fields mirror flags of the pack command.
+// The zero value packs audio files of book dirs matched by DefaultGlobs into a zip archive,
+// m4b output matches DefaultM4BGlobs instead.
+type Options struct {
+	// Output is the archive file, the base name of volumes if SplitSize is set.
+	// An s3:// or webdav:// URL uploads the archive while it's written, see IsRemoteOutput,
+	// StdoutOutput writes it into stdout. DirOutputPrefix followed by a dir copies entries
+	// into files of the dir instead of an archive.
+	Output string
+	// PerDirOutput names a separate archive for each book dir, see ParseNameTemplate.
+	// Template fields are DirBase, Dir and Index, Output must be empty then.
+	PerDirOutput *template.Template
+	// Mode is permission bits of the output, 0 means 0600.
+	Mode os.FileMode
+	// Format is one of Formats, empty means FormatZip.
+	Format string
+	// SplitSize limits size of volumes, 0 writes a single archive.
+	SplitSize int64
+	// Compression are zip entry compression specs, see ValidateCompression.
+	Compression []string
+	// VerifyOnClose checks CRC of each entry recorded by archive against copied data.
+	VerifyOnClose bool
+	// BufferSize is size of reads from sources and of writes into a local output,
+	// 0 means DefaultBufferSize.
+	BufferSize int
+	// Force packs even if the estimated output size exceeds free space of its filesystem,
+	// see ErrNoSpace.
+	Force bool
+	// BandwidthLimit caps the rate source files are copied at in bytes per second, 0 means unlimited.
+	BandwidthLimit int64
+	// Reproducible drops OS-specific zip extra fields and fixes entry times.
+	Reproducible bool
+	// Password encrypts zip entries with AES-256, nil writes them in plain.
+	// Entry names and comments stay readable, as WinZip AES doesn't cover them.
+	Password []byte
+
+	// Globs select files of book dirs, nil means DefaultGlobs, or DefaultM4BGlobs for m4b.
+	// Exclude drops files matched by Globs.
+	Globs, Exclude []string
+	// GlobsIgnoreCase matches Globs and Exclude ignoring case, *.mp3 matches 01.MP3.
+	GlobsIgnoreCase bool
+	// MinSize and MaxSize drop files matched by Globs smaller or larger than them, MinDuration drops
+	// shorter MP3 and MP4 files. Zero doesn't limit.
+	MinSize, MaxSize int64
+	MinDuration      time.Duration
+	// Files are packed besides dirs without searching, grouped into books by parent dirs.
+	// Globs and Exclude don't apply to them, a dir passed to Pack is searched as usual.
+	Files []string
+	// Dedup leaves out files byte-identical to an earlier file of any book, covers excepted.
+	Dedup bool
+	// MergeArchives takes zip files only and combines them: entries keep their names,
+	// unless PrefixMerged adds the zip name prefix, entries equal to an earlier one
+	// by name, size and CRC are dropped, and manifests of inputs are left out.
+	MergeArchives, PrefixMerged bool
+	// Workers is number of dirs discovered and, for zip output, of files compressed in parallel, 0 means 1.
+	Workers int
+	// MaxFiles aborts packing if dirs contain more files in total, 0 means unlimited.
+	MaxFiles int
+	// OrderByDuration is "asc", "desc" or empty to keep natural ordering.
+	OrderByDuration string
+	// SortLocale is a BCP 47 language, like ru or de, names are collated by its rules
+	// instead of byte order of letters. SortIgnoreCase compares letters regardless of case.
+	SortLocale     string
+	SortIgnoreCase bool
+	// SortRoman orders words which are Roman numerals, like Chapter IV, by value among numbers.
+	SortRoman bool
+	// SortBy is one of SortKeys files of each book are ordered by, empty means SortTrack.
+	// Reverse reverses the order. Both are overridden by OrderByDuration.
+	SortBy  string
+	Reverse bool
+	// Symlinks is one of SymlinkPolicies for symbolic links to files and dirs of books,
+	// empty means SymlinkError, which fails on links to matched files and leaves out links to dirs.
+	Symlinks string
+	// IncludeHidden packs dotfiles and system files like Thumbs.db or Synology @eaDir dirs,
+	// which are skipped by default.
+	IncludeHidden bool
+	// SanitizeNames is one of SanitizeTargets, entry names get characters illegal on the filesystem
+	// replaced and are shortened to fit its limits. Empty keeps names as they are.
+	SanitizeNames string
+	// NormalizeNames is one of NormalizationForms entry names are brought to, so names
+	// composed on Linux and decomposed on macOS look the same. Empty keeps names as they are.
+	NormalizeNames string
+	// Transliterate romanizes Cyrillic letters and strips diacritics in entry names
+	// for players which can't show anything but ASCII.
+	Transliterate bool
+
+	// NameTemplate renames entries, see ParseNameTemplate. Nil keeps flattened paths.
+	NameTemplate *template.Template
+	// KeepDirs keeps directory structure of books, it can't be used with NameTemplate.
+	KeepDirs bool
+	// RenumberDiscs renames files of books split into disc subdirs, like CD1 or Disc 02,
+	// to NN - NAME.ext numbered across discs. It can't be used with NameTemplate and OrderByDuration.
+	RenumberDiscs bool
+	// FolderFiles puts file entries of each book into a folder named after it, books of more
+	// files into several folders of at most FolderFiles entries. 0 keeps entries where they are.
+	FolderFiles int
+	// NameLength shortens path elements of entry names to at most so many characters,
+	// extensions are kept. 0 means no limit.
+	NameLength int
+	// WarnIncompatible logs audio files which aren't constant bitrate MP3.
+	WarnIncompatible bool
+	// OnCollision is CollisionFail or CollisionSuffix, empty means CollisionFail.
+	OnCollision string
+	// PadNumbers zero pads numbers in entry names to given width, 0 disables it.
+	PadNumbers int
+	// FixedTime overrides modification time of all entries, zero keeps source mtimes.
+	FixedTime time.Time
+
+	// Update copies unchanged entries of an existing zip Output as is.
+	Update bool
+	// UpdateBy is UpdateByMTime or UpdateByHash, empty means UpdateByMTime.
+	UpdateBy string
+	// Resume journals written entries of a zip Output, so a rerun with the same options
+	// after an interruption copies entries of unchanged sources from the incomplete output.
+	Resume bool
+
+	// Covers adds images matched by CoverGlobs, nil CoverGlobs means DefaultCoverGlobs.
+	Covers     bool
+	CoverGlobs []string
+	// SharedCover adds cover from the parent dir to books without their own.
+	SharedCover bool
+	// EmbedCover adds book cover to ID3 tags of MP3 files without pictures.
+	EmbedCover bool
+	// FixTags rewrites album, album artist and track numbers of MP3 files.
+	FixTags bool
+	// FetchMetadata looks books up in Google Books, results are cached in MetadataCache.
+	FetchMetadata bool
+	MetadataCache string
+
+	// BookDividers, Playlists, CueSheets and BookMetadata add extra entries for each book.
+	BookDividers bool
+	Playlists    bool
+	CueSheets    bool
+	BookMetadata bool
+	// Manifest adds ManifestName entry with SHA-256 checksums of archived files.
+	Manifest bool
+	// Summary sets the zip comment to a summary of packed books: titles, file counts,
+	// durations, the tool version and pack date. SummaryEntry adds it as SummaryName entry.
+	Summary, SummaryEntry bool
+	// Gap is duration of silence inserted between books, 0 disables it.
+	Gap time.Duration
+
+	// ValidateAudio is ValidateWarn, ValidateSkip or ValidateFail, empty disables validation.
+	ValidateAudio string
+	// MergePerBook concatenates MP3 files of each book into one with chapters.
+	MergePerBook bool
+	// FFmpeg is name or path of ffmpeg binary, empty means ffmpeg.
+	FFmpeg string
+	// Transcode is CODEC[:BITRATE] audio files are re-encoded with, see ValidateTranscode.
+	Transcode string
+	// Normalize is target loudness in LUFS, see ParseNormalize. 0 disables normalization.
+	Normalize float64
+
+	// KeepGoing skips files and dirs which can't be read instead of aborting.
+	KeepGoing bool
+	// VerifySize checks that copied byte count matches file size at open time.
+	VerifySize bool
+	// Verify compares entries of the output with their sources after packing,
+	// VerifyHash also compares SHA-256 checksums.
+	Verify, VerifyHash bool
+
+	// ReportFile receives JSON summary of the run, empty skips it.
+	ReportFile string
+	// PreHook and PostHook are shell commands run before packing and after outputs are written,
+	// PreBookHook and PostBookHook are run for every book: before its files are written and after
+	// the output with it is. REPACK_* environment variables describe the output and books,
+	// a failed hook aborts packing with ErrHookFailed.
+	PreHook, PostHook, PreBookHook, PostBookHook string
+
+	// Notify are targets the summary is sent to when Pack returns, see ValidateNotify.
+	Notify []string
+
+	// Catalog is a SQLite file packed books are recorded into with their files, SHA-256 checksums,
+	// the output and pack date, see SearchCatalog. Empty skips it.
+	Catalog string
+
+	// Progress receives progress bars, nil hides them.
+	Progress io.Writer
+	// Bars is BarsFile, BarsDir or BarsNone, empty means BarsFile.
+	Bars string
+	// MaxBars limits number of displayed per-file bars, 0 means unlimited.
+	MaxBars int
+	// Hooks are notified about packed books and files.
+	Hooks Hooks
+}
+
+// Hooks are called from the goroutine running Pack, nil hooks are skipped.
+type Hooks struct {
+	// Discovered is called before anything is written with the number of books and their entries.
+	Discovered func(books, entries int)
+	// BookStarted is called before the first entry of a book with the number of its entries.
+	BookStarted func(dir string, entries int)
+	// FileStarted is called when an entry of a source file is created, size is the entry size.
+	// Entries copied as is from the archive being updated or the interrupted output aren't reported.
+	FileStarted func(source, name string, size int64)
+	// FileProgress is called after every write into the entry of a source file.
+	FileProgress func(source string, written, size int64)
+	// FileWritten is called after a source file is written into entry name.
+	FileWritten func(dir, source, name string)
+	// BookDone is called after the last entry of a book.
+	BookDone func(dir string)
+	// Review is called after discovery with books in packing order, before name collisions are checked.
+	// It may drop, reorder and rename files of books, an error aborts packing.
+	Review func(books []ReviewBook) error
+}
+
+// Packer packs book dirs into an archive. A Packer is good for a single run.
+type Packer struct {
+	p       *processor
+	opts    Options
+	archive archiveOptions
+}
+
+// Granularity of progress bars below the total one.
+const (
+	// BarsFile shows bars of books and of every file being copied
+	BarsFile = "file"
+	// BarsDir shows bars of books only
+	BarsDir = "dir"
+	// BarsNone shows the total bar only
+	BarsNone = "none"
+)
+
+// DefaultBufferSize makes few enough syscalls for network filesystems and spinning disks.
+const DefaultBufferSize = 1 << 20
+
+// minBufferSize is the size of zip writer's own buffer, smaller ones don't save anything.
+const minBufferSize = 4 << 10
+
+// ErrInvalidOptions is returned by New for bad or conflicting options.
+var ErrInvalidOptions = errors.New("invalid options")
+
+// New validates options and creates a Packer.
+func New(opts Options) (*Packer, error) {
+	if opts.Mode == 0 {
+		opts.Mode = 0600
+	}
+	if opts.Format == "" {
+		opts.Format = FormatZip
+	}
+	if !slices.Contains(Formats, opts.Format) {
+		return nil, fmt.Errorf("%w: unknown format %q", ErrInvalidOptions, opts.Format)
+	}
+	if opts.Globs == nil {
+		opts.Globs = DefaultGlobs
+		if opts.Format == FormatM4B {
+			opts.Globs = DefaultM4BGlobs
+		}
+	}
+	for _, pattern := range append(slices.Clip(opts.Globs), opts.Exclude...) {
+		if err := ValidateGlob(pattern); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidOptions, err)
+		}
+	}
+	if opts.OnCollision == "" {
+		opts.OnCollision = CollisionFail
+	}
+	if opts.OnCollision != CollisionFail && opts.OnCollision != CollisionSuffix {
+		return nil, fmt.Errorf("%w: unknown collision policy %q, want %s or %s", ErrInvalidOptions, opts.OnCollision, CollisionFail, CollisionSuffix)
+	}
+	if opts.PerDirOutput != nil && opts.Output != "" {
+		return nil, fmt.Errorf("%w: -o and -per-dir-output can't be used together", ErrInvalidOptions)
+	}
+	if opts.UpdateBy == "" {
+		opts.UpdateBy = UpdateByMTime
+	}
+	if opts.FFmpeg == "" {
+		opts.FFmpeg = "ffmpeg"
+	}
+	if opts.BufferSize == 0 {
+		opts.BufferSize = DefaultBufferSize
+	}
+	if opts.BufferSize < minBufferSize {
+		return nil, fmt.Errorf("%w: -buffer-size must be at least %s", ErrInvalidOptions, formatSize(minBufferSize))
+	}
+
+	p := newProcessor(opts.Progress)
+	p.hooks = opts.Hooks
+	p.commands = hookCommands{
+		pre:      opts.PreHook,
+		post:     opts.PostHook,
+		preBook:  opts.PreBookHook,
+		postBook: opts.PostBookHook,
+		env:      []string{"REPACK_OUTPUT=" + redactURL(opts.Output), "REPACK_FORMAT=" + opts.Format},
+	}
+	p.durationOrder = opts.OrderByDuration
+	p.maxFiles = opts.MaxFiles
+	collation, errCollation := newNameCollation(opts.SortLocale, opts.SortIgnoreCase)
+	if errCollation != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidOptions, errCollation)
+	}
+	p.collation = collation
+	p.collation.roman = opts.SortRoman
+	if opts.SortBy == "" {
+		opts.SortBy = SortTrack
+	}
+	if !slices.Contains(SortKeys, opts.SortBy) {
+		return nil, fmt.Errorf("%w: unknown sort key %q, want one of %s", ErrInvalidOptions, opts.SortBy, strings.Join(SortKeys, ", "))
+	}
+	p.sortBy, p.reverse = opts.SortBy, opts.Reverse
+	if opts.Symlinks == "" {
+		opts.Symlinks = SymlinkError
+	}
+	if !slices.Contains(SymlinkPolicies, opts.Symlinks) {
+		return nil, fmt.Errorf("%w: unknown symlink policy %q, want one of %s", ErrInvalidOptions, opts.Symlinks, strings.Join(SymlinkPolicies, ", "))
+	}
+	p.symlinks = opts.Symlinks
+	p.includeHidden = opts.IncludeHidden
+	if opts.SanitizeNames != "" && !slices.Contains(SanitizeTargets, opts.SanitizeNames) {
+		return nil, fmt.Errorf("%w: unknown filesystem %q of -sanitize-names, want one of %s", ErrInvalidOptions, opts.SanitizeNames, strings.Join(SanitizeTargets, ", "))
+	}
+	p.sanitize = opts.SanitizeNames
+	if opts.NormalizeNames != "" && !slices.Contains(NormalizationForms, opts.NormalizeNames) {
+		return nil, fmt.Errorf("%w: unknown normalization form %q, want one of %s", ErrInvalidOptions, opts.NormalizeNames, strings.Join(NormalizationForms, ", "))
+	}
+	p.normalizeForm, p.transliterate = opts.NormalizeNames, opts.Transliterate
+	p.workers = opts.Workers
+	p.excludeGlobs, p.globsIgnoreCase = opts.Exclude, opts.GlobsIgnoreCase
+	if opts.MinSize < 0 || opts.MaxSize < 0 || opts.MinDuration < 0 {
+		return nil, fmt.Errorf("%w: negative file size or duration limit", ErrInvalidOptions)
+	}
+	if opts.MaxSize > 0 && opts.MinSize > opts.MaxSize {
+		return nil, fmt.Errorf("%w: minimum file size %s is over maximum %s", ErrInvalidOptions, formatSize(opts.MinSize), formatSize(opts.MaxSize))
+	}
+	p.filter = fileFilter{minSize: opts.MinSize, maxSize: opts.MaxSize, minDuration: opts.MinDuration}
+	p.listed = map[string][]string{}
+	for _, file := range opts.Files {
+		dir := filepath.Dir(file)
+		p.listed[dir] = append(p.listed[dir], filepath.Base(file))
+	}
+	p.bookDividers = opts.BookDividers
+	p.playlists = opts.Playlists
+	p.cueSheets = opts.CueSheets
+	p.bookMetadata = opts.BookMetadata
+	p.verifySize = opts.VerifySize
+	p.copyBuf = make([]byte, opts.BufferSize)
+	if opts.BandwidthLimit > 0 {
+		p.limiter = newRateLimiter(opts.BandwidthLimit)
+	}
+	p.forceSpace = opts.Force
+	p.sharedCover = opts.SharedCover
+	p.covers = opts.Covers
+	p.coverGlobs = DefaultCoverGlobs
+	if len(opts.CoverGlobs) > 0 {
+		p.coverGlobs = opts.CoverGlobs
+	}
+	p.embedCover = opts.EmbedCover
+	p.fixTags = opts.FixTags
+	p.ffmpeg = opts.FFmpeg
+
+	switch opts.ValidateAudio {
+	case "", ValidateWarn, ValidateSkip, ValidateFail:
+		p.validateAudio = opts.ValidateAudio
+	default:
+		return nil, fmt.Errorf("%w: unknown audio validation mode %q, want warn, skip or fail", ErrInvalidOptions, opts.ValidateAudio)
+	}
+
+	verify := opts.Verify || opts.VerifyHash
+	reencode := opts.Transcode != "" || opts.Normalize != 0
+	if opts.MergePerBook {
+		if reencode || opts.Format == FormatM4B {
+			return nil, fmt.Errorf("%w: -merge-per-book can't be used with -transcode, -normalize or m4b format", ErrInvalidOptions)
+		}
+		if verify {
+			return nil, fmt.Errorf("%w: -verify can't compare merged entries with their sources", ErrInvalidOptions)
+		}
+		if opts.Dedup {
+			return nil, fmt.Errorf("%w: -dedup can't be used with -merge-per-book", ErrInvalidOptions)
+		}
+		p.mergePerBook = true
+	}
+	p.dedup = opts.Dedup
+	if reencode {
+		if opts.Format == FormatM4B {
+			return nil, fmt.Errorf("%w: -transcode and -normalize can't be used with m4b format", ErrInvalidOptions)
+		}
+		if verify {
+			return nil, fmt.Errorf("%w: -verify can't compare transcoded or normalized entries with their sources", ErrInvalidOptions)
+		}
+		p.transcoder = &transcoder{ffmpeg: opts.FFmpeg, loudness: opts.Normalize}
+		if opts.Transcode != "" {
+			codec, bitrate, err := parseTranscode(opts.Transcode)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %w", ErrInvalidOptions, err)
+			}
+			p.transcoder.codec, p.transcoder.bitrate = &codec, bitrate
+		}
+	}
+	if opts.FetchMetadata {
+		if opts.MetadataCache == "" {
+			return nil, fmt.Errorf("%w: -fetch-metadata requires -metadata-cache, there is no user cache dir", ErrInvalidOptions)
+		}
+		p.fetcher = newMetadataFetcher(opts.MetadataCache)
+	}
+	p.gap = opts.Gap
+	p.onCollision = opts.OnCollision
+	p.padNumbers = opts.PadNumbers
+	p.nameTemplate = opts.NameTemplate
+	if opts.KeepDirs {
+		if opts.NameTemplate != nil {
+			return nil, fmt.Errorf("%w: -keep-dirs and -name-template can't be used together", ErrInvalidOptions)
+		}
+		p.nameTemplate = template.Must(ParseNameTemplate(keepDirsTemplate))
+		p.keepDirs = true
+	}
+	if opts.RenumberDiscs {
+		if opts.NameTemplate != nil || opts.OrderByDuration != "" {
+			return nil, fmt.Errorf("%w: -renumber-discs can't be used with -name-template or -order-by-duration", ErrInvalidOptions)
+		}
+		p.renumberDiscs = true
+	}
+	if opts.FolderFiles < 0 || opts.NameLength < 0 {
+		return nil, fmt.Errorf("%w: -folder-files and -name-length can't be negative", ErrInvalidOptions)
+	}
+	p.folderFiles, p.nameLength, p.warnCodecs = opts.FolderFiles, opts.NameLength, opts.WarnIncompatible
+	p.mergeArchives = opts.MergeArchives
+	p.prefixMerged = opts.PrefixMerged
+	p.fixedTime = opts.FixedTime
+	if opts.Reproducible && opts.FixedTime.IsZero() {
+		p.fixedTime = reproducibleTime
+	}
+	p.keepGoing = opts.KeepGoing
+	p.writeManifestEntry = opts.Manifest
+	p.hashFiles = opts.Manifest || opts.Catalog != ""
+	p.summaryComment = opts.Summary
+	p.writeSummaryEntry = opts.SummaryEntry
+	switch opts.Bars {
+	case "":
+		p.bars = BarsFile
+	case BarsFile, BarsDir, BarsNone:
+		p.bars = opts.Bars
+	default:
+		return nil, fmt.Errorf("%w: unknown bars %q, want %s, %s or %s", ErrInvalidOptions, opts.Bars, BarsFile, BarsDir, BarsNone)
+	}
+	if opts.MaxBars > 0 {
+		p.barSlots = make(chan struct{}, opts.MaxBars)
+	}
+
+	if opts.Update {
+		if opts.Format != FormatZip || opts.SplitSize > 0 {
+			return nil, fmt.Errorf("%w: -update is available for a single zip output only", ErrInvalidOptions)
+		}
+		if !p.fixedTime.IsZero() && opts.UpdateBy == UpdateByMTime {
+			return nil, fmt.Errorf("%w: -update can't compare fixed mtimes, use -update-by hash", ErrInvalidOptions)
+		}
+		if opts.UpdateBy != UpdateByMTime && opts.UpdateBy != UpdateByHash {
+			return nil, fmt.Errorf("%w: unknown update mode %q, want %s or %s", ErrInvalidOptions, opts.UpdateBy, UpdateByMTime, UpdateByHash)
+		}
+	}
+
+	if IsRemoteOutput(opts.Output) || opts.Output == StdoutOutput {
+		switch {
+		case opts.Format == FormatM4B, opts.Format == FormatISO, opts.Format == FormatSevenZip, opts.SplitSize > 0, opts.Update, opts.Resume:
+			return nil, fmt.Errorf("%w: remote or stdout output can't be used with m4b, iso or 7z format, -split-size, -update or -resume", ErrInvalidOptions)
+		case opts.Verify || opts.VerifyHash:
+			return nil, fmt.Errorf("%w: -verify can't read remote or stdout output back", ErrInvalidOptions)
+		}
+	}
+	if strings.HasPrefix(opts.Output, DirOutputPrefix) {
+		switch _, ok := DirOutput(opts.Output); {
+		case !ok:
+			return nil, fmt.Errorf("%w: dir output needs a path, like dir:/media/usb", ErrInvalidOptions)
+		case opts.Format != FormatZip, opts.SplitSize > 0, opts.Update, opts.Resume, len(opts.Password) > 0:
+			return nil, fmt.Errorf("%w: dir output can't be used with -format, -split-size, -update, -resume or -encrypt", ErrInvalidOptions)
+		case opts.Verify || opts.VerifyHash:
+			return nil, fmt.Errorf("%w: -verify reads archives, not dirs", ErrInvalidOptions)
+		}
+	}
+	if opts.Format == FormatISO || opts.Format == FormatSevenZip {
+		switch {
+		case opts.SplitSize > 0:
+			return nil, fmt.Errorf("%w: %s format can't be used with -split-size", ErrInvalidOptions, opts.Format)
+		case opts.Verify || opts.VerifyHash:
+			return nil, fmt.Errorf("%w: -verify reads zip and tar archives, not %s", ErrInvalidOptions, opts.Format)
+		}
+	}
+	for _, target := range opts.Notify {
+		if err := ValidateNotify(target); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidOptions, err)
+		}
+	}
+	if opts.Catalog != "" && opts.Output == StdoutOutput {
+		return nil, fmt.Errorf("%w: -catalog needs an output to find books in later, not stdout", ErrInvalidOptions)
+	}
+	if opts.Summary && (opts.Format != FormatZip || opts.SplitSize > 0 || strings.HasPrefix(opts.Output, DirOutputPrefix)) {
+		return nil, fmt.Errorf("%w: -summary sets the comment of a single zip output, use -summary-entry otherwise", ErrInvalidOptions)
+	}
+	if opts.Resume && (opts.Format != FormatZip || opts.SplitSize > 0 || opts.Update) {
+		return nil, fmt.Errorf("%w: -resume is available for a single zip output without -update only", ErrInvalidOptions)
+	}
+	if len(opts.Password) > 0 {
+		if opts.Format != FormatZip {
+			return nil, fmt.Errorf("%w: -encrypt is available for zip format only", ErrInvalidOptions)
+		}
+		if opts.Update || opts.Resume {
+			return nil, fmt.Errorf("%w: -encrypt can't be used with -update or -resume", ErrInvalidOptions)
+		}
+	}
+
+	archive := archiveOptions{
+		verifyCRC:    opts.VerifyOnClose,
+		reproducible: opts.Reproducible,
+		compression:  defaultCompressionPolicy(),
+		password:     opts.Password,
+		bufferSize:   opts.BufferSize,
+	}
+	for _, spec := range opts.Compression {
+		if err := archive.compression.set(spec); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidOptions, err)
+		}
+	}
+
+	return &Packer{p: p, opts: opts, archive: archive}, nil
+}
+
+// Plan writes entries the archive would get and name collisions into w without writing anything.
+func (pk *Packer) Plan(ctx context.Context, w io.Writer, dirs []string) error {
+	defer pk.p.closeInputs()
+	return pk.p.dryRun(ctx, w, pk.withListed(dirs), pk.opts.Globs)
+}
+
+// withListed appends parent dirs of Files to dirs in order of appearance.
+// Listed files of dirs which are searched anyway are dropped.
+func (pk *Packer) withListed(dirs []string) []string {
+	for _, dir := range dirs {
+		delete(pk.p.listed, filepath.Clean(dir))
+	}
+
+	all := slices.Clone(dirs)
+	for _, file := range pk.opts.Files {
+		dir := filepath.Dir(file)
+		if _, ok := pk.p.listed[dir]; ok && !slices.Contains(all, dir) {
+			all = append(all, dir)
+		}
+	}
+	return all
+}
+
+// Report returns summary of the run, it's complete after Pack returns.
+func (pk *Packer) Report() *Report {
+	return &pk.p.report
+}
+
+// Pack writes books found in dirs and listed in Files into the output.
+// A dir may be a zip file, its entries are packed like files of a dir.
+// The output is replaced only if packing succeeds, on cancellation of ctx
+// incomplete files are removed and the context error is returned.
+// An archive with files skipped by KeepGoing or ValidateSkip is kept,
+// but the returned error wraps ErrFilesSkipped. Notify targets get the outcome either way.
+func (pk *Packer) Pack(ctx context.Context, dirs []string) error {
+	err := pk.pack(ctx, dirs)
+	pk.notify(ctx, err)
+	return err
+}
+
+func (pk *Packer) pack(ctx context.Context, dirs []string) error {
+	p, opts := pk.p, pk.opts
+	defer p.closeInputs()
+
+	if p.transcoder != nil {
+		found, errLook := exec.LookPath(p.ffmpeg)
+		if errLook != nil {
+			return fmt.Errorf("%w: %w", errNoFFmpeg, errLook)
+		}
+		p.transcoder.ffmpeg = found
+	}
+
+	if err := p.commands.run(ctx, "pre-hook", p.commands.pre, "REPACK_DIRS="+strings.Join(pk.withListed(dirs), "\n")); err != nil {
+		return err
+	}
+
+	if opts.PerDirOutput != nil {
+		return pk.packPerDir(ctx, dirs)
+	}
+
+	if opts.Format == FormatM4B {
+		return pk.packM4B(ctx, dirs)
+	}
+
+	archiveOpts := pk.archive
+	if opts.Resume {
+		resume, errResume := openResumeState(opts.Output)
+		if errResume != nil {
+			return errResume
+		}
+		// state files are kept for the next run unless the output is committed
+		defer resume.Close()
+		p.resume = resume
+		archiveOpts.entryDone = resume.entryDone
+	}
+
+	createArchive := func(filename string) (*fileArchive, error) {
+		return createArchiveFile(filename, opts.Format, opts.Mode, archiveOpts)
+	}
+
+	if opts.Update {
+		previous, errPrevious := openPreviousArchive(opts.Output, opts.UpdateBy)
+		if errPrevious != nil {
+			return errPrevious
+		}
+		p.previous = previous
+	}
+
+	var archive outputArchive
+	outputs := []string{opts.Output}
+	switch {
+	case IsRemoteOutput(opts.Output), opts.Output == StdoutOutput:
+		output, errOutput := createStreamArchive(opts.Output, opts.Format, archiveOpts, &p.report)
+		if errOutput != nil {
+			return fmt.Errorf("creating output archive: %w", errOutput)
+		}
+		archive = output
+		outputs = []string{redactURL(opts.Output)}
+	case strings.HasPrefix(opts.Output, DirOutputPrefix):
+		dir, _ := DirOutput(opts.Output)
+		output, errOutput := createDirArchive(dir, &p.report)
+		if errOutput != nil {
+			return fmt.Errorf("creating output dir: %w", errOutput)
+		}
+		archive = output
+	case opts.SplitSize > 0:
+		archive = newSplitArchive(opts.Output, opts.SplitSize, createArchive)
+	default:
+		output, errOutput := createArchive(opts.Output)
+		if errOutput != nil {
+			return fmt.Errorf("creating output archive: %w", errOutput)
+		}
+		archive = output
+	}
+	// outputs are in place after commit, this one cleans up on error paths
+	defer archive.discard()
+
+	// dir outputs take no raw entries, encrypted and verified entries are compressed by the writer,
+	// unchanged files of -update and -resume are copied from the archive and packing them ahead is wasted
+	if opts.Workers > 1 && opts.Format == FormatZip && !strings.HasPrefix(opts.Output, DirOutputPrefix) &&
+		len(opts.Password) == 0 && !opts.VerifyOnClose && p.previous == nil && p.resume == nil {
+		ahead, errAhead := newPackAhead(opts.Workers, archiveOpts.compression)
+		if errAhead != nil {
+			return errAhead
+		}
+		p.ahead = ahead
+	}
+
+	errProcess := p.process(ctx, archive, pk.withListed(dirs), opts.Globs)
+	if p.previous != nil {
+		// previous archive is replaced on commit, it must not be open by then
+		_ = p.previous.Close()
+	}
+	// archive with skipped files is complete otherwise
+	if errProcess != nil && !errors.Is(errProcess, ErrFilesSkipped) {
+		archive.discard()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("processing dirs: %w", errProcess)
+	}
+
+	if err := archive.commit(); err != nil {
+		return fmt.Errorf("writing output: %w", err)
+	}
+	if p.resume != nil {
+		p.resume.finish()
+	}
+	if split, ok := archive.(*splitArchive); ok {
+		outputs = split.volumes
+	}
+	if err := pk.summarize(outputs); err != nil {
+		return err
+	}
+	if err := pk.recordCatalog(); err != nil {
+		return err
+	}
+	if err := p.runPostHooks(ctx, outputs); err != nil {
+		return err
+	}
+	if errProcess != nil {
+		return fmt.Errorf("processing dirs: %w", errProcess)
+	}
+
+	if opts.Verify || opts.VerifyHash {
+		// encrypted entries don't record their sources
+		var sources map[string]string
+		if len(opts.Password) > 0 {
+			sources = map[string]string{}
+			for _, b := range p.report.Books {
+				for _, f := range b.Files {
+					sources[f.Name] = f.Source
+				}
+			}
+		}
+		for _, output := range outputs {
+			if err := verifySources(output, opts.VerifyHash, p.embedCover || p.fixTags, opts.Password, sources); err != nil {
+				return fmt.Errorf("verifying output %s: %w", output, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// packM4B merges books into a single audiobook with ffmpeg.
+func (pk *Packer) packM4B(ctx context.Context, dirs []string) error {
+	output := pk.opts.Output
+	// ffmpeg writes into a temporary file, previous output is replaced on success only
+	tmpOutput := output + tmpSuffix
+	errProcess := pk.p.processM4B(ctx, tmpOutput, pk.withListed(dirs), pk.opts.Globs)
+	if errProcess != nil && !errors.Is(errProcess, ErrFilesSkipped) {
+		removeIncomplete(tmpOutput)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("processing dirs: %w", errProcess)
+	}
+	if err := os.Chmod(tmpOutput, pk.opts.Mode); err != nil {
+		removeIncomplete(tmpOutput)
+		return fmt.Errorf("setting output mode: %w", err)
+	}
+	if err := os.Rename(tmpOutput, output); err != nil {
+		removeIncomplete(tmpOutput)
+		return fmt.Errorf("replacing output: %w", err)
+	}
+	if err := pk.summarize([]string{output}); err != nil {
+		return err
+	}
+	if err := pk.recordCatalog(); err != nil {
+		return err
+	}
+	if err := pk.p.runPostHooks(ctx, []string{output}); err != nil {
+		return err
+	}
+	if errProcess != nil {
+		return fmt.Errorf("processing dirs: %w", errProcess)
+	}
+	return nil
+}
+
+// summarize logs totals of the run and writes them into the report file, if it's set.
+func (pk *Packer) summarize(outputs []string) error {
+	p := pk.p
+	if err := p.report.finish(p.started, outputs); err != nil {
+		slog.Error("summarizing run", "err", err)
+		return nil
+	}
+	p.report.logSummary()
+
+	if pk.opts.ReportFile != "" {
+		return p.report.writeJSON(pk.opts.ReportFile, pk.opts.Mode)
+	}
+	return nil
+}
+
+// recordCatalog adds packed books to the catalog, if it's set. Local outputs are recorded by absolute paths,
+// split archives by the name volumes are numbered after.
+func (pk *Packer) recordCatalog() error {
+	if pk.opts.Catalog == "" {
+		return nil
+	}
+	output := pk.opts.Output
+	switch {
+	case IsRemoteOutput(output):
+		output = redactURL(output)
+	case strings.HasPrefix(output, DirOutputPrefix):
+		dir, _ := DirOutput(output)
+		if abs, err := filepath.Abs(dir); err == nil {
+			output = DirOutputPrefix + abs
+		}
+	default:
+		if abs, err := filepath.Abs(output); err == nil {
+			output = abs
+		}
+	}
+	if err := pk.p.recordCatalog(pk.opts.Catalog, output); err != nil {
+		return fmt.Errorf("recording catalog: %w", err)
+	}
+	return nil
+}
+
+// ValidateCompression checks a zip entry compression spec: store, deflate[:1-9],
+// zstd[:1-22], or EXT=METHOD to override an extension, e.g. wav=zstd:3.
+func ValidateCompression(spec string) error {
+	policy := defaultCompressionPolicy()
+	return policy.set(spec)
+}
+
+// ValidateTranscode checks a CODEC[:BITRATE] spec, e.g. opus:32k.
+func ValidateTranscode(spec string) error {
+	_, _, err := parseTranscode(spec)
+	return err
+}
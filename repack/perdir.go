@@ -0,0 +1,121 @@
+package repack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/template"
+)
+
+// outputNameFields are values available to -per-dir-output.
+type outputNameFields struct {
+	// DirBase is base name of the book dir, Dir is the dir as it was passed
+	DirBase, Dir string
+	// Index is 1-based position of the book
+	Index int
+}
+
+// outputNames names an archive for each dir, all names must differ.
+func outputNames(tmpl *template.Template, dirs []string) ([]string, error) {
+	names := make([]string, 0, len(dirs))
+	for i, dir := range dirs {
+		name := &strings.Builder{}
+		fields := outputNameFields{
+			DirBase: strings.TrimSuffix(sanitizeDirPrefix(dir), "_"),
+			Dir:     dir,
+			Index:   i + 1,
+		}
+		if err := tmpl.Execute(name, fields); err != nil {
+			return nil, fmt.Errorf("naming output of %q: %w", dir, err)
+		}
+		if name.String() == "" {
+			return nil, fmt.Errorf("output of %q has an empty name", dir)
+		}
+		if j := slices.Index(names, name.String()); j >= 0 {
+			return nil, fmt.Errorf("%w: %q and %q get the same output %q", ErrInvalidOptions, dirs[j], dir, name.String())
+		}
+		names = append(names, name.String())
+	}
+	return names, nil
+}
+
+// packPerDir packs each dir into an archive of its own, one after another.
+// Failed dirs are skipped with KeepGoing, the report sums up all archives.
+func (pk *Packer) packPerDir(ctx context.Context, dirs []string) error {
+	all := pk.withListed(dirs)
+	outputs, errNames := outputNames(pk.opts.PerDirOutput, all)
+	if errNames != nil {
+		return errNames
+	}
+
+	skipped := false
+	failed := []error{}
+	for i, dir := range all {
+		opts := pk.opts
+		opts.PerDirOutput = nil
+		opts.Output = outputs[i]
+		// the report of all archives is written, hooks of the run are run and notifications are sent at the end
+		opts.ReportFile = ""
+		opts.PreHook, opts.PostHook = "", ""
+		opts.Notify = nil
+		opts.Files = nil
+		for _, file := range pk.opts.Files {
+			if filepath.Dir(file) == dir {
+				opts.Files = append(opts.Files, file)
+			}
+		}
+		searched := []string{}
+		if slices.Contains(dirs, dir) {
+			searched = append(searched, dir)
+		}
+
+		slog.Info("packing book", "dir", dir, "output", opts.Output)
+		err := pk.packDir(ctx, opts, searched)
+		switch {
+		case err == nil:
+		case errors.Is(err, ErrFilesSkipped):
+			skipped = true
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case pk.opts.KeepGoing:
+			pk.p.skip(dir, true, err)
+			failed = append(failed, fmt.Errorf("dir %q: %w", dir, err))
+		default:
+			return fmt.Errorf("dir %q: %w", dir, err)
+		}
+	}
+
+	// outputs of packed books, volumes of split ones
+	written := slices.Clone(pk.p.report.Outputs)
+	if len(written) == 0 && len(failed) > 0 {
+		return errors.Join(failed...)
+	}
+	errSkipped := pk.p.skipReport()
+	if err := pk.summarize(written); err != nil {
+		return err
+	}
+	// packers of books ran book hooks already
+	pk.p.commands.postBook = ""
+	if err := pk.p.runPostHooks(ctx, written); err != nil {
+		return err
+	}
+	if errSkipped == nil && skipped {
+		errSkipped = ErrFilesSkipped
+	}
+	return errSkipped
+}
+
+// packDir packs a single book with a Packer of its own and adds its report to the common one.
+func (pk *Packer) packDir(ctx context.Context, opts Options, dirs []string) error {
+	packer, errNew := New(opts)
+	if errNew != nil {
+		return errNew
+	}
+	errPack := packer.Pack(ctx, dirs)
+	pk.p.report.merge(packer.Report())
+	return errPack
+}
@@ -0,0 +1,61 @@
+package repack
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// playlistName is named after the book, it lies in the archive root next to entries it lists.
+func playlistName(dir string) string {
+	return filepath.Base(filepath.Clean(dir)) + ".m3u8"
+}
+
+// playlist builds extended M3U of audio records in playback order.
+// Unknown durations are written as -1.
+func playlist(records []fileRecord) string {
+	content := &strings.Builder{}
+	content.WriteString("#EXTM3U\n")
+	for _, record := range records {
+		if !isAudio(record.path) && len(record.parts) == 0 {
+			continue
+		}
+
+		total := time.Duration(0)
+		for _, source := range record.sources() {
+			d, err := audioDuration(source.path)
+			if err != nil {
+				total = -time.Second
+				break
+			}
+			total += d
+		}
+		seconds := int(total.Round(time.Second).Seconds())
+		title := strings.TrimSuffix(filepath.Base(record.path), filepath.Ext(record.path))
+		if len(record.parts) > 0 {
+			title = filepath.Base(filepath.Clean(record.path))
+		}
+		fmt.Fprintf(content, "#EXTINF:%d,%s\n%s\n", seconds, title, record.name)
+	}
+	return content.String()
+}
+
+// writePlaylist adds a playlist of written records of the book from dir.
+func (p *processor) writePlaylist(archive archiveWriter, dir string, records []fileRecord) error {
+	content := playlist(records)
+	wr, errCreate := archive.create(archiveEntry{
+		name:    p.generatedName(playlistName(dir)),
+		size:    int64(len(content)),
+		modTime: p.entryTime(nil),
+	})
+	if errCreate != nil {
+		return errCreate
+	}
+
+	slog.Debug("writing playlist", "name", playlistName(dir))
+	_, errWrite := io.WriteString(wr, content)
+	return errWrite
+}
@@ -0,0 +1,231 @@
+package repack
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Schemes of remote outputs, archives are uploaded while they are written.
+const (
+	schemeS3         = "s3"
+	schemeWebDAV     = "webdav"
+	schemeWebDAVHTTP = "webdav+http"
+)
+
+var errRemoteOutput = errors.New("remote output")
+
+// IsRemoteOutput reports whether output is an s3:// or webdav:// URL instead of a file.
+func IsRemoteOutput(output string) bool {
+	scheme, _, ok := strings.Cut(output, "://")
+	if !ok {
+		return false
+	}
+	switch strings.ToLower(scheme) {
+	case schemeS3, schemeWebDAV, schemeWebDAVHTTP:
+		return true
+	default:
+		return false
+	}
+}
+
+// uploader streams an archive to remote storage. Nothing is visible at the target until commit.
+type uploader interface {
+	io.Writer
+	// commit finishes the upload and puts the archive in place
+	commit() error
+	// abort drops uploaded data, it's safe to call after a failed write
+	abort()
+}
+
+// newUploader parses output URL and checks that credentials are available.
+// StdoutOutput streams the archive into stdout.
+func newUploader(output string) (uploader, error) {
+	if output == StdoutOutput {
+		return stdoutUpload{}, nil
+	}
+
+	target, errParse := url.Parse(output)
+	if errParse != nil {
+		return nil, fmt.Errorf("%w: %w", errRemoteOutput, errParse)
+	}
+
+	switch strings.ToLower(target.Scheme) {
+	case schemeS3:
+		return newS3Upload(target)
+	case schemeWebDAV, schemeWebDAVHTTP:
+		return newWebDAVUpload(target)
+	default:
+		return nil, fmt.Errorf("%w: unknown scheme %q", errRemoteOutput, target.Scheme)
+	}
+}
+
+// streamArchive is an archive uploaded or piped as it's written, it implements outputArchive.
+type streamArchive struct {
+	archiveWriter
+	upload  uploader
+	written *countingWriter
+	output  string
+	// report receives the uploaded size on commit, there is no file to stat
+	report *Report
+
+	closed             bool
+	errClose           error
+	committed, aborted bool
+}
+
+func createStreamArchive(output, format string, opts archiveOptions, report *Report) (*streamArchive, error) {
+	upload, errUpload := newUploader(output)
+	if errUpload != nil {
+		return nil, errUpload
+	}
+
+	written := &countingWriter{dst: upload}
+	archive, errArchive := newArchiveWriter(format, written, opts)
+	if errArchive != nil {
+		upload.abort()
+		return nil, errArchive
+	}
+
+	if output != StdoutOutput {
+		slog.Info("uploading output", "output", redactURL(output))
+	}
+	return &streamArchive{archiveWriter: archive, upload: upload, written: written, output: output, report: report}, nil
+}
+
+func (a *streamArchive) setComment(comment string) error {
+	writer, ok := a.archiveWriter.(commentWriter)
+	if !ok {
+		return fmt.Errorf("%w: output has no comment", errUnsupportedArchive)
+	}
+	return writer.setComment(comment)
+}
+
+func (a *streamArchive) createRaw(entry archiveEntry, raw rawData) (io.Writer, bool, error) {
+	writer, ok := a.archiveWriter.(rawArchiveWriter)
+	if !ok {
+		return nil, false, nil
+	}
+	return writer.createRaw(entry, raw)
+}
+
+// Close finishes the archive, the upload is finished by commit.
+func (a *streamArchive) Close() error {
+	if !a.closed {
+		a.closed = true
+		a.errClose = a.archiveWriter.Close()
+	}
+	return a.errClose
+}
+
+func (a *streamArchive) commit() error {
+	if err := a.Close(); err != nil {
+		return err
+	}
+	if err := a.upload.commit(); err != nil {
+		return fmt.Errorf("uploading output: %w", err)
+	}
+	a.committed = true
+	a.report.upload(redactURL(a.output), a.written.n)
+	return nil
+}
+
+func (a *streamArchive) discard() {
+	if a.committed || a.aborted {
+		return
+	}
+	a.closed, a.aborted = true, true
+	a.upload.abort()
+	if a.output == StdoutOutput {
+		slog.Warn("archive written into stdout is incomplete")
+		return
+	}
+	slog.Info("aborted incomplete upload", "output", redactURL(a.output))
+}
+
+// StdoutOutput as Output writes the archive into stdout, so it can be piped.
+const StdoutOutput = "-"
+
+// stdoutUpload pipes the archive, what is written can't be taken back.
+type stdoutUpload struct{}
+
+func (stdoutUpload) Write(p []byte) (int, error) {
+	return os.Stdout.Write(p)
+}
+
+func (stdoutUpload) commit() error { return nil }
+
+func (stdoutUpload) abort() {}
+
+// redactURL hides the password of output URL for logs.
+func redactURL(output string) string {
+	parsed, err := url.Parse(output)
+	if err != nil {
+		return output
+	}
+	return parsed.Redacted()
+}
+
+// Retries of remote requests, the delay doubles after each attempt.
+const (
+	remoteAttempts   = 4
+	remoteRetryDelay = time.Second
+)
+
+// statusError is an unexpected HTTP response.
+type statusError struct {
+	status int
+	body   string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s: %s", http.StatusText(e.status), e.body)
+}
+
+// checkStatus turns a non-2xx response into statusError, the body is closed either way.
+func checkStatus(resp *http.Response) error {
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+	return &statusError{status: resp.StatusCode, body: strings.TrimSpace(string(body))}
+}
+
+// retry runs request until it succeeds, fails with a permanent error or runs out of attempts.
+// Network errors, throttling and server errors are retried.
+func retry(what string, request func() error) error {
+	delay := remoteRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := request()
+		if err == nil || attempt == remoteAttempts || !retryable(err) {
+			return err
+		}
+		slog.Warn("retrying", "request", what, "attempt", attempt, "err", err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func retryable(err error) bool {
+	var (
+		status *statusError
+		netErr net.Error
+	)
+	switch {
+	case errors.As(err, &status):
+		return status.status >= 500 || status.status == http.StatusTooManyRequests
+	case errors.As(err, &netErr), errors.Is(err, io.ErrUnexpectedEOF):
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,1367 @@
+package repack
+
+import (
+	"archive/zip"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/vbauerster/mpb/v8"
+	"github.com/vbauerster/mpb/v8/decor"
+)
+
+// reproducibleTime is entry modification time of -reproducible archives,
+// the earliest date representable in zip headers.
+var reproducibleTime = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+type fileRecord struct {
+	path, name string
+	// rel is slash separated path relative to the book dir, empty for covers
+	rel string
+	// tagEdit changes ID3 tag of the file in archive, nil copies it as is
+	tagEdit *tagEdit
+	// parts are MP3 files merged into this record by -merge-per-book, path is the book dir then
+	parts []fileRecord
+	// zipped is the entry of an input zip the record is packed from, path is inside of the zip then
+	zipped *zip.File
+}
+
+// sources returns files of record, the merged parts or the record itself.
+func (r fileRecord) sources() []fileRecord {
+	if len(r.parts) > 0 {
+		return r.parts
+	}
+	return []fileRecord{r}
+}
+
+// flattenPath replaces separators of fs.FS paths and stray Windows
+// backslashes, which unpackers may treat as separators too.
+var flattenPath = strings.NewReplacer(
+	"/", "_",
+	`\`, "_",
+).Replace
+
+var ErrNoFilesFound = errors.New("no files found")
+
+// searchRecords walks fsys and collects files matching any of fileGlobs
+// and none of excludeGlobs. Exclusions are matched against both relative path and base name.
+// Matched files are dropped by filter.
+// Hidden and system files and dirs are left out unless includeHidden is set, so are ones
+// matched by ignore files, except in archives being merged.
+// Symbolic links to matched files and dirs are handled by symlinks policy, except that dir links
+// are skipped by SymlinkError. Followed files are packed from their targets,
+// followed dirs are walked unless they were walked already.
+func (p *processor) searchRecords(dir string, fsys fs.FS, fileGlobs []string) ([]fileRecord, error) {
+	found := []fileRecord{}
+	walked := map[string]bool{}
+	var ignore ignoreRules
+	if real, err := filepath.EvalSymlinks(dir); err == nil {
+		walked[real] = true
+	}
+
+	var visit fs.WalkDirFunc
+	visit = func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !p.includeHidden && path != "." && isHidden(d.Name()) {
+			slog.Debug("skipped hidden file", "file", path)
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !p.mergeArchives {
+			if ignore.ignored(path, d.IsDir()) {
+				slog.Debug("ignored file", "file", path)
+				if d.IsDir() {
+					return fs.SkipDir
+				}
+				return nil
+			}
+			if d.IsDir() {
+				rules, errIgnore := readIgnoreFile(fsys, path)
+				if errIgnore != nil {
+					return errIgnore
+				}
+				ignore = append(ignore, rules...)
+			} else if d.Name() == IgnoreFileName {
+				return nil
+			}
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		if excluded(path, p.excludeGlobs, p.globsIgnoreCase) {
+			slog.Debug("excluded file", "file", path)
+			return nil
+		}
+
+		matched := slices.ContainsFunc(fileGlobs, func(pattern string) bool { return matchFileGlob(pattern, path, p.globsIgnoreCase) })
+		source := filepath.Join(dir, path)
+		if d.Type()&fs.ModeSymlink != 0 {
+			info, errStat := fs.Stat(fsys, path)
+			linksDir := errStat == nil && info.IsDir()
+			if !matched && !linksDir {
+				return nil
+			}
+			if linksDir && p.symlinks == SymlinkError {
+				// walking never followed dir links, only files can't be packed through a link
+				slog.Debug("skipped symlink to dir", "dir", source)
+				return nil
+			}
+			follow, errLink := checkSymlink(p.symlinks, source)
+			switch {
+			case errLink != nil || !follow:
+				return errLink
+			case errStat != nil:
+				return fmt.Errorf("following symlink: %w", errStat)
+			case !linksDir && !info.Mode().IsRegular():
+				// links in zip inputs point nowhere
+				slog.Warn("can't follow symlink", "file", source)
+				return nil
+			}
+
+			real, errReal := filepath.EvalSymlinks(source)
+			if errReal != nil {
+				return fmt.Errorf("following symlink: %w", errReal)
+			}
+			if linksDir {
+				if walked[real] {
+					slog.Debug("dir is walked already", "dir", source, "target", real)
+					return nil
+				}
+				walked[real] = true
+				return fs.WalkDir(fsys, path, visit)
+			}
+			source = real
+		}
+
+		if matched {
+			keep, errFilter := p.filter.keep(fsys, path, source)
+			if errFilter != nil || !keep {
+				return errFilter
+			}
+			name := sanitizeDirPrefix(dir) + flattenPath(path)
+			slog.Debug("found file", "file", path, "name", name)
+			found = append(found, fileRecord{
+				name: name,
+				path: source,
+				rel:  path,
+			})
+		}
+		return nil
+	}
+	errWalk := fs.WalkDir(fsys, ".", visit)
+	if errWalk != nil {
+		return nil, fmt.Errorf("walking dir: %w", errWalk)
+	}
+
+	if len(found) == 0 {
+		return nil, ErrNoFilesFound
+	}
+
+	return found, nil
+}
+
+// listedRecords makes records of files of dir listed by name instead of searching the dir.
+func listedRecords(dir string, names []string, symlinks string) ([]fileRecord, error) {
+	found := make([]fileRecord, 0, len(names))
+	for _, name := range names {
+		filename := filepath.Join(dir, name)
+		info, err := os.Lstat(filename)
+		if err != nil {
+			return nil, err
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			follow, errLink := checkSymlink(symlinks, filename)
+			if errLink != nil {
+				return nil, errLink
+			}
+			if !follow {
+				continue
+			}
+			if filename, err = filepath.EvalSymlinks(filename); err != nil {
+				return nil, fmt.Errorf("following symlink: %w", err)
+			}
+			if info, err = os.Stat(filename); err != nil {
+				return nil, err
+			}
+		}
+		if !info.Mode().IsRegular() {
+			return nil, fmt.Errorf("%q is not a regular file", filename)
+		}
+
+		found = append(found, fileRecord{
+			name: sanitizeDirPrefix(dir) + flattenPath(name),
+			path: filename,
+			rel:  name,
+		})
+	}
+	return found, nil
+}
+
+func excluded(name string, excludeGlobs []string, fold bool) bool {
+	for _, pattern := range excludeGlobs {
+		if matchFileGlob(pattern, name, fold) || matchFileGlob(pattern, path.Base(name), fold) {
+			return true
+		}
+	}
+	return false
+}
+
+// sortFileRecords sorts records by names naturally, see naturalCompare and nameCollation.
+func sortFileRecords(records []fileRecord, collation nameCollation) {
+	compareText := collation.compare()
+	keys := make(map[string]string, len(records))
+	for _, record := range records {
+		keys[record.name] = record.name
+		if collation.roman {
+			keys[record.name] = replaceRomanNumerals(record.name)
+		}
+	}
+
+	slices.SortStableFunc(records, func(a, b fileRecord) int {
+		// names equal for compareText, like "Ch 1" and "ch 1" ignoring case, must not depend on walk order
+		return cmp.Or(naturalCompare(keys[a.name], keys[b.name], compareText), cmp.Compare(a.name, b.name))
+	})
+}
+
+// orderByDuration stable sorts records by audio duration and renames them
+// to zero-padded sequence numbers, keeping the dir prefix and extension.
+func orderByDuration(dir string, records []fileRecord, desc bool) error {
+	durations := make(map[string]time.Duration, len(records))
+	for _, record := range records {
+		d, err := audioDuration(record.path)
+		if err != nil {
+			return fmt.Errorf("file %q: %w", record.path, err)
+		}
+		durations[record.path] = d
+	}
+
+	slices.SortStableFunc(records, func(a, b fileRecord) int {
+		if desc {
+			a, b = b, a
+		}
+		return cmp.Compare(durations[a.path], durations[b.path])
+	})
+
+	width := max(2, len(strconv.Itoa(len(records))))
+	prefix := sanitizeDirPrefix(dir)
+	for i := range records {
+		ext := filepath.Ext(records[i].name)
+		records[i].name = fmt.Sprintf("%s%0*d%s", prefix, width, i+1, ext)
+	}
+
+	return nil
+}
+
+// sortByTrackTags stable sorts records by disc and track numbers from ID3 tags.
+// Records without track number follow the tagged ones in natural order.
+func sortByTrackTags(records []fileRecord) {
+	type position struct {
+		tagged      bool
+		disc, track int
+	}
+
+	positions := make(map[string]position, len(records))
+	for _, record := range records {
+		tag, errTag := readID3v2File(record.path)
+		if errTag != nil {
+			slog.Warn("reading tags", "file", record.path, "err", errTag)
+			continue
+		}
+
+		track, ok := id3Number(tag.text("TRCK"))
+		if !ok {
+			continue
+		}
+		disc, _ := id3Number(tag.text("TPOS"))
+		positions[record.path] = position{tagged: true, disc: disc, track: track}
+	}
+
+	if len(positions) == 0 {
+		return
+	}
+
+	slices.SortStableFunc(records, func(a, b fileRecord) int {
+		posA, posB := positions[a.path], positions[b.path]
+		if posA.tagged != posB.tagged {
+			if posA.tagged {
+				return -1
+			}
+			return 1
+		}
+		return cmp.Or(
+			cmp.Compare(posA.disc, posB.disc),
+			cmp.Compare(posA.track, posB.track),
+		)
+	})
+}
+
+type processor struct {
+	bar     *mpb.Progress
+	started time.Time
+
+	// durationOrder is "asc", "desc" or empty to keep natural ordering
+	durationOrder string
+	// excludeGlobs drop files matched by include globs
+	excludeGlobs []string
+	// globsIgnoreCase matches include and exclude globs ignoring case
+	globsIgnoreCase bool
+	// filter drops matched files by size and duration
+	filter fileFilter
+	// listed are names of files packed from dirs instead of searching them, by dir
+	listed map[string][]string
+	// inputs are zip files packed as book dirs, they are open until packing is done
+	inputsMu sync.Mutex
+	inputs   []*zip.ReadCloser
+	// mergeArchives packs zip inputs only, keeping entry names unless prefixMerged is set
+	mergeArchives, prefixMerged bool
+	// dedup leaves out files identical to an earlier one, duplicates are noted in the manifest
+	dedup      bool
+	duplicates []duplicateFile
+	// maxFiles limits total number of files across all dirs, 0 means unlimited
+	maxFiles int
+	// workers is number of dirs discovered in parallel
+	workers int
+	// bookDividers adds a marker entry before each book
+	bookDividers bool
+	// playlists adds an M3U8 playlist after each book
+	playlists bool
+	// cueSheets adds a cue sheet after each book
+	cueSheets bool
+	// bookMetadata adds Audiobookshelf metadata.json after each book
+	bookMetadata bool
+	// verifySize checks that copied byte count matches file size at open time
+	verifySize bool
+	// copyBuf is reused by every copy into archive, files are written one at a time
+	copyBuf []byte
+	// ahead compresses files in workers before they are written, nil compresses them while writing
+	ahead *packAhead
+	// collation compares text of names while sorting them
+	collation nameCollation
+	// sortBy is one of SortKeys, reverse reverses the sorted files of each book
+	sortBy  string
+	reverse bool
+	// symlinks is one of SymlinkPolicies
+	symlinks string
+	// includeHidden disables skipping of dotfiles and system files, see isHidden
+	includeHidden bool
+	// sanitize is one of SanitizeTargets entry names are made safe for, empty keeps them
+	sanitize string
+	// renumberDiscs names files of multi-disc books by their number across discs
+	renumberDiscs bool
+	// folderFiles is the most entries of a book folder, 0 keeps entries where they are
+	folderFiles int
+	// nameLength is the most characters of path elements of entry names, 0 is no limit
+	nameLength int
+	// warnCodecs logs audio files which aren't constant bitrate MP3
+	warnCodecs bool
+	// normalizeForm is one of NormalizationForms of entry names, transliterate romanizes them
+	normalizeForm string
+	transliterate bool
+	// limiter throttles reads of copied files, nil reads at full speed
+	limiter *rateLimiter
+	// forceSpace packs even if the output won't fit into free space
+	forceSpace bool
+	// covers adds cover images matched by coverGlobs in book dirs
+	covers     bool
+	coverGlobs []string
+	// sharedCover adds cover from the parent dir to books without their own
+	sharedCover bool
+	// embedCover adds book cover to ID3 tags of MP3 files without pictures
+	embedCover  bool
+	coverFrames map[string]id3Frame
+	// fixTags rewrites album, album artist and track numbers of MP3 files
+	fixTags bool
+	// fetcher looks books up online, nil keeps packing offline
+	fetcher *metadataFetcher
+	// nameTemplate renames entries, nil keeps dir prefixed flattened paths
+	nameTemplate *template.Template
+	// onCollision is CollisionFail or CollisionSuffix
+	onCollision string
+	// padNumbers is width numbers in entry names are zero padded to, 0 disables it
+	padNumbers int
+	// previous is the archive being updated, nil packs everything anew
+	previous *previousArchive
+	// resume copies entries of an interrupted run and journals new ones, nil disables it
+	resume *resumeState
+	// keepDirs places shared covers inside of book dirs
+	keepDirs bool
+	// fixedTime overrides modification time of all entries, zero keeps source mtimes
+	fixedTime time.Time
+	// gap is duration of silence inserted between books, 0 disables it
+	gap time.Duration
+
+	// mergePerBook concatenates MP3 files of each book into one with chapters
+	mergePerBook bool
+	// ffmpeg is name or path of ffmpeg binary
+	ffmpeg string
+	// transcoder re-encodes audio files, nil packs them as is
+	transcoder *transcoder
+
+	// validateAudio is ValidateWarn, ValidateSkip or ValidateFail, empty disables validation
+	validateAudio string
+
+	// keepGoing skips files and dirs which can't be read instead of aborting
+	keepGoing bool
+	skipped   []skippedFile
+
+	// writeManifestEntry adds SHA-256 checksums of archived files as the last entry
+	writeManifestEntry bool
+	// hashFiles collects checksums of archived files into manifest, for the manifest entry or the catalog
+	hashFiles bool
+	manifest  []manifestLine
+	// titles are titles of packed books by dirs, for the catalog
+	titles map[string]string
+	// summaryComment and writeSummaryEntry put the summary of packed books into the zip comment and SummaryName entry
+	summaryComment    bool
+	writeSummaryEntry bool
+
+	// bars is BarsFile, BarsDir or BarsNone
+	bars string
+	// barSlots limits number of displayed per-file bars, nil means unlimited
+	barSlots chan struct{}
+	// totalBar shows bytes copied from all books, filesDone counts written files
+	totalBar  *mpb.Bar
+	filesDone atomic.Int64
+
+	// report sums up packed files for the end of run summary
+	report Report
+	// hooks are notified about written books and files
+	hooks Hooks
+	// commands are run before and after packing and every book
+	commands hookCommands
+}
+
+// newProcessor creates a processor drawing progress bars into w, nil hides them.
+func newProcessor(w io.Writer) *processor {
+	return &processor{
+		bar:     mpb.New(mpb.WithOutput(w)),
+		started: time.Now(),
+	}
+}
+
+// entryTime returns modification time of an entry.
+// Info is nil for generated entries, they get the time of the run start.
+func (p *processor) entryTime(info fs.FileInfo) time.Time {
+	switch {
+	case !p.fixedTime.IsZero():
+		return p.fixedTime
+	case info != nil:
+		return info.ModTime()
+	default:
+		return p.started
+	}
+}
+
+// book is a set of sorted records found in a single input dir.
+type book struct {
+	dir     string
+	records []fileRecord
+	// meta is found online with -fetch-metadata, nil otherwise
+	meta *fetchedMetadata
+}
+
+var errTooManyFiles = errors.New("too many files")
+
+func (p *processor) process(ctx context.Context, archive archiveWriter, dirs, fileGlobs []string) error {
+	books, errDiscover := p.discover(ctx, dirs, fileGlobs)
+	if errDiscover != nil {
+		return errDiscover
+	}
+
+	if p.mergeArchives {
+		dropDuplicates(books)
+	}
+	if !p.mergePerBook {
+		if err := p.dropLinked(books); err != nil {
+			return fmt.Errorf("looking for hardlinks: %w", err)
+		}
+	}
+	if p.dedup {
+		if err := p.dropIdentical(books); err != nil {
+			return fmt.Errorf("looking for duplicates: %w", err)
+		}
+	}
+
+	books, errReview := p.review(books)
+	if errReview != nil {
+		return errReview
+	}
+	p.splitFolders(books)
+	if err := p.sanitizeNames(books); err != nil {
+		return err
+	}
+	p.warnIncompatible(books)
+
+	if err := p.resolveCollisions(books); err != nil {
+		return err
+	}
+
+	if err := p.checkSpace(archive, books); err != nil {
+		return err
+	}
+
+	p.totalBar = p.addTotalBar(books)
+	p.titles = bookTitles(books)
+
+	if p.hooks.Discovered != nil {
+		files := 0
+		for _, b := range books {
+			files += len(b.records)
+		}
+		p.hooks.Discovered(len(books), files)
+	}
+
+	if p.ahead != nil {
+		stop := p.ahead.start(ctx, p, books)
+		defer stop()
+	}
+
+	for i, b := range books {
+		if i > 0 && p.gap > 0 {
+			if err := p.writeGap(archive, books[i-1].dir); err != nil {
+				return fmt.Errorf("writing gap after %q: %w", books[i-1].dir, err)
+			}
+		}
+
+		if err := p.writeBook(ctx, archive, b); err != nil {
+			return fmt.Errorf("dir %q: %w", b.dir, err)
+		}
+	}
+
+	// sizes of retagged and transcoded files differ from sources, so total is settled here
+	p.totalBar.SetTotal(-1, true)
+	p.bar.Wait()
+
+	if !p.summaryComment {
+		// the summary has the same line
+		if err := writeProvenance(archive); err != nil {
+			return fmt.Errorf("writing comment: %w", err)
+		}
+	}
+	if p.summaryComment || p.writeSummaryEntry {
+		if err := p.writeSummary(archive, books); err != nil {
+			return fmt.Errorf("writing summary: %w", err)
+		}
+	}
+	if p.writeManifestEntry {
+		if err := p.writeManifest(archive); err != nil {
+			return fmt.Errorf("writing manifest: %w", err)
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		return fmt.Errorf("closing archive: %w", err)
+	}
+
+	return p.skipReport()
+}
+
+// discover searches and sorts records of all dirs before anything is written,
+// so file count limits are checked up front.
+// Dirs are discovered by p.workers goroutines, books keep order of dirs.
+func (p *processor) discover(ctx context.Context, dirs, fileGlobs []string) ([]book, error) {
+	books := make([]book, len(dirs))
+	errs := make([]error, len(dirs))
+
+	total := atomic.Int64{}
+	overLimit := atomic.Bool{}
+
+	jobs := make(chan int)
+	wg := sync.WaitGroup{}
+	for range max(1, p.workers) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if overLimit.Load() || ctx.Err() != nil {
+					continue
+				}
+
+				books[i], errs[i] = p.discoverDir(ctx, dirs[i], fileGlobs)
+				if errs[i] != nil {
+					errs[i] = fmt.Errorf("dir %q: %w", dirs[i], errs[i])
+					continue
+				}
+
+				found := total.Add(int64(len(books[i].records)))
+				if p.maxFiles > 0 && found > int64(p.maxFiles) {
+					overLimit.Store(true)
+				}
+			}
+		}()
+	}
+
+	for i := range dirs {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if overLimit.Load() {
+		return nil, fmt.Errorf("%w: found at least %d files, limit is %d", errTooManyFiles, total.Load(), p.maxFiles)
+	}
+
+	err := errors.Join(errs...)
+	if err == nil || !p.keepGoing {
+		return books, err
+	}
+
+	// dirs which can't be read or have no files are left out, unless all of them fail
+	found := books[:0]
+	for i, b := range books {
+		if errs[i] != nil {
+			// the error is wrapped with the dir already
+			p.skip(dirs[i], true, errors.Unwrap(errs[i]))
+			continue
+		}
+		found = append(found, b)
+	}
+	if len(found) == 0 {
+		return nil, err
+	}
+
+	return found, nil
+}
+
+func (p *processor) discoverDir(ctx context.Context, dir string, fileGlobs []string) (book, error) {
+	var found []fileRecord
+	var errFind error
+	zipped := false
+	if names, ok := p.listed[dir]; ok {
+		found, errFind = listedRecords(dir, names, p.symlinks)
+	} else if zipped = isZipInput(dir); zipped {
+		found, errFind = p.zipRecords(dir, fileGlobs)
+	} else if p.mergeArchives {
+		return book{}, fmt.Errorf("%w: only zip archives can be merged", errZipInput)
+	} else {
+		found, errFind = p.searchRecords(dir, os.DirFS(dir), fileGlobs)
+	}
+	if errFind != nil {
+		return book{}, fmt.Errorf("searching files: %w", errFind)
+	}
+
+	sortFileRecords(found, p.collation)
+	if !zipped {
+		// the order file is for packing only, even if globs match it
+		found = slices.DeleteFunc(found, func(record fileRecord) bool { return record.rel == OrderFileName })
+	}
+	if err := p.sortRecords(found, zipped); err != nil {
+		return book{}, err
+	}
+	if !zipped {
+		if err := applyOrderFile(dir, found); err != nil {
+			return book{}, err
+		}
+	}
+
+	if p.durationOrder != "" && !zipped {
+		if err := orderByDuration(dir, found, p.durationOrder == "desc"); err != nil {
+			return book{}, fmt.Errorf("ordering by duration: %w", err)
+		}
+	}
+
+	if p.nameTemplate != nil {
+		if err := applyNameTemplate(p.nameTemplate, dir, found); err != nil {
+			return book{}, err
+		}
+	}
+
+	if p.renumberDiscs {
+		renumberDiscs(dir, found, p.keepDirs)
+	}
+
+	if p.padNumbers > 0 {
+		for i := range found {
+			found[i].name = padNumbers(found[i].name, p.padNumbers)
+		}
+	}
+
+	if zipped {
+		// tags, durations and covers are read from files on disk, entries of zips are packed as they are
+		return book{dir: dir, records: found}, nil
+	}
+
+	var meta *fetchedMetadata
+	if p.fetcher != nil {
+		var errFetch error
+		meta, errFetch = p.fetcher.lookup(ctx, dir)
+		if ctx.Err() != nil {
+			return book{}, ctx.Err()
+		}
+		if errFetch != nil {
+			slog.Warn("packing without online metadata", "dir", dir, "err", errFetch)
+		}
+	}
+
+	if p.transcoder != nil {
+		for i := range found {
+			if isAudio(found[i].path) {
+				found[i].name = p.transcoder.rename(found[i].name, found[i].path)
+			}
+		}
+	}
+
+	if p.fixTags {
+		fixTags(dir, found, meta)
+	}
+
+	covers, errCovers := p.coverRecords(dir, found, meta)
+	if errCovers != nil {
+		return book{}, fmt.Errorf("looking for covers: %w", errCovers)
+	}
+	found = append(covers, found...)
+
+	if p.mergePerBook {
+		found = p.mergeRecords(dir, found)
+	}
+
+	return book{dir: dir, records: found, meta: meta}, nil
+}
+
+func (p *processor) writeBook(ctx context.Context, archive archiveWriter, b book) error {
+	advance := p.addBookBar(b)
+
+	if err := p.runPreBookHook(ctx, b); err != nil {
+		return err
+	}
+	if p.hooks.BookStarted != nil {
+		p.hooks.BookStarted(b.dir, len(b.records))
+	}
+
+	if p.bookDividers {
+		if err := p.writeDivider(archive, b.dir); err != nil {
+			return fmt.Errorf("writing divider: %w", err)
+		}
+	}
+
+	written := make([]fileRecord, 0, len(b.records))
+	for _, record := range b.records {
+		if len(record.parts) > 0 {
+			if err := p.writeMerged(ctx, archive, record); err != nil {
+				return fmt.Errorf("writing merged file to archive: %w", err)
+			}
+			written = append(written, record)
+			p.fileWritten(b.dir, record)
+			advance()
+			continue
+		}
+
+		if record.zipped != nil {
+			if err := p.writeZipped(ctx, archive, record); err != nil {
+				return fmt.Errorf("writing zip entry to archive: %w", err)
+			}
+			written = append(written, record)
+			p.report.add(b.dir, record, int64(record.zipped.UncompressedSize64), 0)
+			p.fileWritten(b.dir, record)
+			advance()
+			continue
+		}
+
+		// source is opened before the entry is created,
+		// so a skipped file leaves no trace in the archive
+		file, info, errOpen := openSourceFile(record.path)
+		if errOpen != nil {
+			if !p.keepGoing {
+				return fmt.Errorf("writing file to archive: %w", errOpen)
+			}
+			p.skip(record.path, false, errOpen)
+			advance()
+			continue
+		}
+
+		resumed, errResume := p.resumeRecord(archive, record, info)
+		if errResume != nil {
+			_ = file.Close()
+			return fmt.Errorf("writing file to archive: %w", errResume)
+		}
+		if resumed {
+			_ = file.Close()
+			written = append(written, record)
+			p.report.add(b.dir, record, info.Size(), fileDuration(record.path))
+			p.fileWritten(b.dir, record)
+			advance()
+			continue
+		}
+
+		valid, errValid := p.validateRecord(record, file, info.Size())
+		if errValid != nil {
+			_ = file.Close()
+			return fmt.Errorf("validating audio: %w", errValid)
+		}
+		if !valid {
+			_ = file.Close()
+			advance()
+			continue
+		}
+
+		source := info
+		file, info, errOpen = p.transcodeRecord(ctx, record, file, info)
+		if errOpen != nil {
+			if !p.keepGoing || ctx.Err() != nil {
+				return errOpen
+			}
+			p.skip(record.path, false, errOpen)
+			advance()
+			continue
+		}
+
+		packed, errPacked := p.ahead.take(ctx, record)
+		if errPacked != nil {
+			closeSource(record, file)
+			if !p.keepGoing || !errors.Is(errPacked, errSourceRead) {
+				return fmt.Errorf("writing file to archive: %w", errPacked)
+			}
+			// nothing of the entry is written yet
+			p.skip(record.path, false, errPacked)
+			advance()
+			continue
+		}
+
+		errWrite := p.writeRecord(ctx, archive, record, file, info, packed)
+		closeSource(record, file)
+		packed.remove()
+		if errWrite != nil {
+			if !p.keepGoing || !errors.Is(errWrite, errSourceRead) {
+				return fmt.Errorf("writing file to archive: %w", errWrite)
+			}
+			// a started entry can be skipped only if the output can drop it
+			dropper, ok := archive.(entryDropper)
+			if !ok {
+				return fmt.Errorf("writing file to archive: %w", errWrite)
+			}
+			if err := dropper.dropEntry(); err != nil {
+				return fmt.Errorf("writing file to archive: %w", errors.Join(errWrite, err))
+			}
+			p.skip(record.path, false, errWrite)
+			advance()
+			continue
+		}
+		if p.resume != nil {
+			p.resume.written(record, source, p.lastSum(record))
+		}
+		written = append(written, record)
+		p.report.add(b.dir, record, source.Size(), fileDuration(record.path))
+		p.fileWritten(b.dir, record)
+		advance()
+	}
+
+	if p.playlists {
+		if err := p.writePlaylist(archive, b.dir, written); err != nil {
+			return fmt.Errorf("writing playlist: %w", err)
+		}
+	}
+
+	if p.cueSheets {
+		if err := p.writeCueSheet(archive, b.dir, written); err != nil {
+			return fmt.Errorf("writing cue sheet: %w", err)
+		}
+	}
+
+	if p.bookMetadata {
+		if err := p.writeMetadata(archive, b.dir, written, b.meta); err != nil {
+			return fmt.Errorf("writing metadata: %w", err)
+		}
+	}
+
+	if p.hooks.BookDone != nil {
+		p.hooks.BookDone(b.dir)
+	}
+
+	return nil
+}
+
+// fileWritten notifies the hook about an entry of a source file.
+func (p *processor) fileWritten(dir string, record fileRecord) {
+	p.filesDone.Add(1)
+	if p.hooks.FileWritten != nil {
+		p.hooks.FileWritten(dir, record.path, record.name)
+	}
+}
+
+// writeRecord copies file of record into archive, packed is its data compressed ahead or nil.
+func (p *processor) writeRecord(ctx context.Context, archive archiveWriter, record fileRecord, file *os.File, info fs.FileInfo, packed *packedFile) error {
+	retag, errRetag := p.retag(record, file)
+	if errRetag != nil {
+		return fmt.Errorf("rewriting tags of %q: %w", record.path, errRetag)
+	}
+
+	reused, errReuse := p.reuseRecord(archive, record, file, info, retag)
+	if errReuse != nil || reused {
+		return errReuse
+	}
+
+	if packed != nil {
+		written, errPacked := p.writePacked(ctx, archive, record, info, packed)
+		if errPacked != nil || written {
+			return errPacked
+		}
+	}
+
+	size := retag.size(info)
+	wr, errCreate := archive.create(archiveEntry{
+		name:    record.name,
+		source:  record.path,
+		size:    size,
+		modTime: p.entryTime(info),
+	})
+	if errCreate != nil {
+		return errCreate
+	}
+
+	dst := p.trackEntry(wr, record, size)
+	sum := sha256.New()
+	if p.hashFiles {
+		dst = io.MultiWriter(dst, sum)
+	}
+
+	audioSize := info.Size()
+	if retag != nil {
+		if _, err := dst.Write(retag.tag); err != nil {
+			return fmt.Errorf("writing tags of %q: %w", record.path, err)
+		}
+		audioSize -= retag.skip
+	}
+
+	if err := p.copyFileTo(ctx, dst, file, audioSize); err != nil {
+		return err
+	}
+
+	if p.hashFiles {
+		p.manifest = append(p.manifest, manifestLine{
+			sum:    sum.Sum(nil),
+			name:   record.name,
+			source: record.path,
+		})
+	}
+
+	return nil
+}
+
+// lastSum is the checksum of record if it's the last manifest line, nil otherwise.
+func (p *processor) lastSum(record fileRecord) []byte {
+	if len(p.manifest) == 0 || p.manifest[len(p.manifest)-1].name != record.name {
+		return nil
+	}
+	return p.manifest[len(p.manifest)-1].sum
+}
+
+var ErrFilesSkipped = errors.New("files skipped")
+
+// skippedFile is a source file or a book dir left out of archive in -keep-going mode.
+type skippedFile struct {
+	path string
+	dir  bool
+	err  error
+}
+
+// skip logs and records a source left out of archive.
+func (p *processor) skip(path string, dir bool, err error) {
+	slog.Warn("skipping", "path", path, "err", err)
+	p.skipped = append(p.skipped, skippedFile{path: path, dir: dir, err: err})
+}
+
+// skipReport adds skipped sources to the report and returns an error if there are any.
+func (p *processor) skipReport() error {
+	if len(p.skipped) == 0 {
+		return nil
+	}
+
+	for _, skipped := range p.skipped {
+		p.report.Skipped = append(p.report.Skipped, skippedReport{
+			Path:  skipped.path,
+			Dir:   skipped.dir,
+			Error: skipped.err.Error(),
+		})
+	}
+
+	return fmt.Errorf("%w: %d", ErrFilesSkipped, len(p.skipped))
+}
+
+// writeDivider adds a tiny text entry named after the book,
+// so players listing entries show where the next book starts.
+func (p *processor) writeDivider(archive archiveWriter, dir string) error {
+	title := filepath.Base(filepath.Clean(dir))
+	content := title + "\n"
+	wr, errCreate := archive.create(archiveEntry{
+		name:    p.generatedName(dividerName(dir)),
+		size:    int64(len(content)),
+		modTime: p.entryTime(nil),
+	})
+	if errCreate != nil {
+		return errCreate
+	}
+
+	_, errWrite := io.WriteString(wr, content)
+	return errWrite
+}
+
+func dividerName(dir string) string {
+	return "==== " + filepath.Base(filepath.Clean(dir)) + " ====.txt"
+}
+
+// gapName is named to sort after all files of the book from dir.
+func gapName(dir string) string {
+	return sanitizeDirPrefix(dir) + "~gap.mp3"
+}
+
+// writeGap adds a silent track after the book from dir.
+func (p *processor) writeGap(archive archiveWriter, dir string) error {
+	wr, errCreate := archive.create(archiveEntry{
+		name:    p.generatedName(gapName(dir)),
+		size:    silenceSize(p.gap),
+		modTime: p.entryTime(nil),
+	})
+	if errCreate != nil {
+		return errCreate
+	}
+
+	return writeSilence(wr, p.gap)
+}
+
+var errSizeMismatch = errors.New("size mismatch")
+
+// errSourceRead marks copy errors of the source, not of the archive.
+var errSourceRead = errors.New("reading source")
+
+func openSourceFile(filename string) (*os.File, fs.FileInfo, error) {
+	file, errFile := openNoFollow(filename, os.O_RDONLY, 0600)
+	if errFile != nil {
+		return nil, nil, fmt.Errorf("unable to open file %q: %w", filename, errFile)
+	}
+
+	info, errInfo := file.Stat()
+	if errInfo != nil {
+		_ = file.Close()
+		return nil, nil, fmt.Errorf("unable to stat file %q: %w", filename, errInfo)
+	}
+
+	return file, info, nil
+}
+
+// copyFileTo copies size bytes from the current offset of file.
+func (p *processor) copyFileTo(ctx context.Context, dst io.Writer, file *os.File, size int64) error {
+	return p.copyTo(ctx, dst, file, file.Name(), size)
+}
+
+// copyTo copies size bytes of the source called filename from file.
+// Data always passes through user space, even stored entries need CRC of it,
+// so copy_file_range and sendfile can't be used.
+func (p *processor) copyTo(ctx context.Context, dst io.Writer, file io.Reader, filename string, size int64) error {
+	return p.copyBuffer(ctx, dst, file, filename, size, p.copyBuf)
+}
+
+// copyBuffer is copyTo through buf, copies running in parallel need their own.
+func (p *processor) copyBuffer(ctx context.Context, dst io.Writer, file io.Reader, filename string, size int64, buf []byte) error {
+	bar := p.addFileBar(filename, size)
+	progress := dst
+	if bar != nil {
+		progress = &barWriter{dst: dst, bar: bar}
+	}
+
+	src := io.Reader(contextReader{ctx: ctx, src: sourceReader{src: file}})
+	if p.limiter != nil {
+		src = throttledReader{ctx: ctx, src: src, limiter: p.limiter}
+	}
+	if p.totalBar != nil {
+		// proxy is nil if the bar is done already
+		if proxy := p.totalBar.ProxyReader(src); proxy != nil {
+			src = proxy
+		}
+	}
+
+	// src is wrapped, so reads always go through buf and are as large as it is
+	written, errCopy := io.CopyBuffer(progress, src, buf)
+	bar.done(written, errCopy)
+	if errCopy != nil {
+		return fmt.Errorf("unable to write file %q: %w", filename, errCopy)
+	}
+
+	if p.verifySize && written != size {
+		return fmt.Errorf("%w: file %q: copied %d bytes, expected %d, was it modified during copy?",
+			errSizeMismatch, filename, written, size)
+	}
+
+	return nil
+}
+
+// addBookBar adds a bar of written files of the book unless bars are limited to BarsNone.
+// The returned function advances the bar by a file.
+func (p *processor) addBookBar(b book) func() {
+	if p.bars == BarsNone {
+		return func() {}
+	}
+	bar := p.bar.AddBar(int64(len(b.records)),
+		mpb.PrependDecorators(
+			decor.Name(b.dir),
+			decor.Percentage(decor.WCSyncSpace),
+			decor.OnComplete(
+				decor.Spinner(nil, decor.WCSyncSpace), "done",
+			),
+		),
+	)
+	return bar.Increment
+}
+
+// addTotalBar adds a bar of bytes and files of all books with throughput and ETA.
+// It stays on top as it's added before bars of books and files.
+func (p *processor) addTotalBar(books []book) *mpb.Bar {
+	size, files := sourcesSize(books)
+
+	bar := p.bar.AddBar(0,
+		mpb.PrependDecorators(
+			decor.Name("total"),
+			decor.Any(func(decor.Statistics) string {
+				return fmt.Sprintf("%d/%d files", p.filesDone.Load(), files)
+			}, decor.WCSyncSpace),
+			decor.Counters(decor.SizeB1024(0), "% .1f / % .1f", decor.WCSyncSpace),
+		),
+		mpb.AppendDecorators(
+			decor.EwmaSpeed(decor.SizeB1024(0), "% .1f", 30, decor.WCSyncSpace),
+			decor.OnComplete(decor.EwmaETA(decor.ET_STYLE_GO, 30, decor.WCSyncSpace), "done"),
+		),
+	)
+	// a total set after creation doesn't complete the bar when it's reached
+	bar.SetTotal(size, false)
+	return bar
+}
+
+// addFileBar adds a per-file progress bar, it's nil if bars are limited to books.
+func (p *processor) addFileBar(name string, size int64) *fileBar {
+	if p.bars != BarsFile {
+		return nil
+	}
+	bar := &fileBar{p: p, name: name, size: size}
+	bar.show()
+	return bar
+}
+
+// fileBar is the progress bar of a copied file.
+// If the number of displayed bars is limited and all slots are taken,
+// the bar is shown once a finished file frees its slot.
+type fileBar struct {
+	p       *processor
+	name    string
+	size    int64
+	written int64
+	// bar is nil until it gets a slot
+	bar *mpb.Bar
+	// slot is held by bar and released when it's done
+	slot bool
+}
+
+// show adds the bar if it's not displayed yet and a slot is free.
+func (b *fileBar) show() {
+	if b.bar != nil {
+		return
+	}
+	options := []mpb.BarOption{
+		mpb.PrependDecorators(
+			decor.Name(b.name),
+			decor.Counters(decor.SizeB1024(0), " % .1f / % .1f"),
+			decor.Percentage(decor.WCSyncSpace),
+		),
+	}
+	if b.p.barSlots != nil {
+		select {
+		case b.p.barSlots <- struct{}{}:
+			b.slot = true
+			options = append(options, mpb.BarRemoveOnComplete())
+		default:
+			return
+		}
+	}
+	b.bar = b.p.bar.AddBar(b.size, options...)
+	b.bar.SetCurrent(b.written)
+}
+
+func (b *fileBar) add(n int) {
+	b.written += int64(n)
+	if b.bar != nil {
+		b.bar.IncrBy(n)
+		return
+	}
+	b.show()
+}
+
+// done finishes the bar of a copy which wrote written bytes and frees its slot.
+func (b *fileBar) done(written int64, err error) {
+	if b == nil || b.bar == nil {
+		return
+	}
+	switch {
+	case err != nil:
+		b.bar.Abort(true)
+	case written != b.size:
+		// file changed while copying, bar would never complete otherwise
+		b.bar.Abort(false)
+	case b.size == 0:
+		// bars of zero total don't complete by themselves
+		b.bar.SetTotal(0, true)
+	}
+	b.bar.Wait()
+	if b.slot {
+		<-b.p.barSlots
+	}
+}
+
+// barWriter advances bar by bytes written to dst.
+type barWriter struct {
+	dst io.Writer
+	bar *fileBar
+}
+
+func (w *barWriter) Write(p []byte) (int, error) {
+	n, err := w.dst.Write(p)
+	w.bar.add(n)
+	return n, err
+}
+
+// trackEntry notifies hooks about a new entry of record and returns wr reporting written bytes.
+func (p *processor) trackEntry(wr io.Writer, record fileRecord, size int64) io.Writer {
+	if p.hooks.FileStarted != nil {
+		p.hooks.FileStarted(record.path, record.name, size)
+	}
+	if p.hooks.FileProgress == nil {
+		return wr
+	}
+	return &progressWriter{dst: wr, fn: func(written int64) {
+		p.hooks.FileProgress(record.path, written, size)
+	}}
+}
+
+// progressWriter calls fn with the total number of bytes written after every write.
+type progressWriter struct {
+	dst     io.Writer
+	written int64
+	fn      func(written int64)
+}
+
+func (w *progressWriter) Write(b []byte) (int, error) {
+	n, err := w.dst.Write(b)
+	w.written += int64(n)
+	w.fn(w.written)
+	return n, err
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// contextReader stops reading once ctx is done, so a copy can be interrupted.
+type contextReader struct {
+	ctx context.Context
+	src io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.src.Read(p)
+}
+
+// sourceReader wraps read errors of src with errSourceRead.
+type sourceReader struct {
+	src io.Reader
+}
+
+func (r sourceReader) Read(p []byte) (int, error) {
+	n, err := r.src.Read(p)
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("%w: %w", errSourceRead, err)
+	}
+	return n, err
+}
+
+// naturalCompare compares names with runs of ASCII digits compared by their values,
+// however long they are, and text between them compared with compareText.
+// A number goes before text at the same position. Numbers equal by value
+// are told apart by the first difference in leading zeros, fewer go first: 1 < 01 < 001.
+func naturalCompare(strA, strB string, compareText func(a, b string) int) int {
+	zeros := 0
+	for strA != "" && strB != "" {
+		digitA, digitB := isDigit(strA[0]), isDigit(strB[0])
+		switch {
+		case digitA && digitB:
+			var numA, numB string
+			numA, strA = cutRun(strA, true)
+			numB, strB = cutRun(strB, true)
+			if c := compareNumbers(numA, numB); c != 0 {
+				return c
+			}
+			if zeros == 0 {
+				zeros = cmp.Compare(len(numA), len(numB))
+			}
+		case digitA:
+			return -1
+		case digitB:
+			return 1
+		default:
+			var textA, textB string
+			textA, strA = cutRun(strA, false)
+			textB, strB = cutRun(strB, false)
+			if c := compareText(textA, textB); c != 0 {
+				return c
+			}
+		}
+	}
+	// a name which is a prefix of the other one goes first
+	return cmp.Or(cmp.Compare(len(strA), len(strB)), zeros)
+}
+
+// compareNumbers compares runs of decimal digits by value without parsing them.
+func compareNumbers(a, b string) int {
+	a, b = strings.TrimLeft(a, "0"), strings.TrimLeft(b, "0")
+	return cmp.Or(cmp.Compare(len(a), len(b)), strings.Compare(a, b))
+}
+
+// cutRun splits s after its leading run of digits, or of non-digits.
+func cutRun(s string, digits bool) (run, rest string) {
+	i := 0
+	for i < len(s) && isDigit(s[i]) == digits {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+// isDigit reports ASCII digits only, digits of other scripts are compared as text.
+func isDigit(b byte) bool {
+	return '0' <= b && b <= '9'
+}
+
+func sanitizeDirPrefix(dir string) string {
+	if isZipInput(dir) {
+		dir = strings.TrimSuffix(dir, filepath.Ext(dir))
+	}
+	dir = filepath.Base(dir)
+	dir = filepath.Clean(dir)
+	if dir == "." {
+		return ""
+	}
+
+	return dir + "_"
+}
@@ -0,0 +1,49 @@
+package repack
+
+import (
+	"cmp"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	// packing logs every book and warning, failures are reported by tests
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+func FuzzNaturalCompare(f *testing.F) {
+	f.Add("01", "1", "001")
+	f.Add("track01.mp3", "track1.mp3", "track001.mp3")
+	f.Add("123456789012345678901234567890", "123456789012345678901234567891", "99999999999999999999999")
+	f.Add("part 000000000000000000000042", "part 42", "part 0042b")
+	f.Add("a1b01", "a01b1", "a1b1")
+	f.Add("Chapter 2", "Chapter 10", "Chapter 2a")
+	f.Add("", "0", "a")
+
+	sign := func(c int) int { return cmp.Compare(c, 0) }
+	compare := func(a, b string) int { return naturalCompare(a, b, strings.Compare) }
+
+	f.Fuzz(func(t *testing.T, a, b, c string) {
+		if ab, ba := sign(compare(a, b)), sign(compare(b, a)); ab != -ba {
+			t.Fatalf("compare(%q, %q) = %d, but compare(%q, %q) = %d", a, b, ab, b, a, ba)
+		}
+		if compare(a, b) == 0 && a != b {
+			t.Fatalf("compare(%q, %q) = 0 for different names", a, b)
+		}
+
+		names := []string{a, b, c}
+		slices.SortFunc(names, compare)
+		for i := range names {
+			for j := i + 1; j < len(names); j++ {
+				if compare(names[i], names[j]) > 0 {
+					t.Fatalf("not transitive: sorted %q, but compare(%q, %q) > 0", names, names[i], names[j])
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,173 @@
+package repack
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// Report sums up a pack run, durations are in seconds.
+type Report struct {
+	Books    []bookReport `json:"books"`
+	Files    int          `json:"files"`
+	BytesIn  int64        `json:"bytesIn"`
+	BytesOut int64        `json:"bytesOut"`
+	// Ratio is BytesOut to BytesIn
+	Ratio    float64  `json:"ratio"`
+	Duration float64  `json:"duration"`
+	Runtime  float64  `json:"runtime"`
+	Outputs  []string `json:"outputs"`
+	// Invalid are sources packed despite -validate-audio errors
+	Invalid []string `json:"invalid,omitempty"`
+	// Skipped are files and dirs left out by -keep-going and -validate-audio skip
+	Skipped []skippedReport `json:"skipped,omitempty"`
+	// Duplicates are files left out by -dedup and hardlinks of packed files
+	Duplicates []duplicateReport `json:"duplicates,omitempty"`
+
+	// uploaded are sizes of remote outputs, which can't be stat'ed
+	uploaded map[string]int64
+}
+
+type bookReport struct {
+	Dir      string       `json:"dir"`
+	Bytes    int64        `json:"bytes"`
+	Duration float64      `json:"duration"`
+	Files    []fileReport `json:"files"`
+}
+
+// skippedReport is a source left out of the archive and the reason why.
+type skippedReport struct {
+	Path  string `json:"path"`
+	Dir   bool   `json:"dir,omitempty"`
+	Error string `json:"error"`
+}
+
+// duplicateReport is a source identical to the file packed as entry Of.
+type duplicateReport struct {
+	Path string `json:"path"`
+	Of   string `json:"of"`
+	Link bool   `json:"link,omitempty"`
+}
+
+// fileReport is a packed file, duration is 0 for non-audio files and unknown Formats.
+type fileReport struct {
+	Name     string  `json:"name"`
+	Source   string  `json:"source"`
+	Bytes    int64   `json:"bytes"`
+	Duration float64 `json:"duration"`
+}
+
+// add records a packed file of the book from dir, books are expected one after another.
+func (r *Report) add(dir string, record fileRecord, size int64, d time.Duration) {
+	if len(r.Books) == 0 || r.Books[len(r.Books)-1].Dir != dir {
+		r.Books = append(r.Books, bookReport{Dir: dir, Files: []fileReport{}})
+	}
+	b := &r.Books[len(r.Books)-1]
+	b.Files = append(b.Files, fileReport{Name: record.name, Source: record.path, Bytes: size, Duration: d.Seconds()})
+	b.Bytes += size
+	b.Duration += d.Seconds()
+
+	r.Files++
+	r.BytesIn += size
+	r.Duration += d.Seconds()
+}
+
+// merge adds books, files and outputs of another run.
+func (r *Report) merge(other *Report) {
+	r.Books = append(r.Books, other.Books...)
+	r.Files += other.Files
+	r.BytesIn += other.BytesIn
+	r.Duration += other.Duration
+	r.Outputs = append(r.Outputs, other.Outputs...)
+	r.Invalid = append(r.Invalid, other.Invalid...)
+	r.Skipped = append(r.Skipped, other.Skipped...)
+	r.Duplicates = append(r.Duplicates, other.Duplicates...)
+	for output, size := range other.uploaded {
+		r.upload(output, size)
+	}
+}
+
+// upload records size of an uploaded remote output.
+func (r *Report) upload(output string, size int64) {
+	if r.uploaded == nil {
+		r.uploaded = map[string]int64{}
+	}
+	r.uploaded[output] = size
+}
+
+// fileDuration is play time of audio files, 0 for other files or if it's unknown.
+func fileDuration(filename string) time.Duration {
+	if !isAudio(filename) {
+		return 0
+	}
+	d, err := audioDuration(filename)
+	if err != nil {
+		slog.Warn("unknown duration", "file", filename, "err", err)
+		return 0
+	}
+	return d
+}
+
+// finish fills output sizes and run time.
+func (r *Report) finish(started time.Time, outputs []string) error {
+	r.Outputs = outputs
+	r.BytesOut = 0
+	for _, output := range outputs {
+		if size, ok := r.uploaded[output]; ok {
+			r.BytesOut += size
+			continue
+		}
+		info, err := os.Stat(output)
+		if err != nil {
+			return err
+		}
+		r.BytesOut += info.Size()
+	}
+	if r.BytesIn > 0 {
+		r.Ratio = float64(r.BytesOut) / float64(r.BytesIn)
+	}
+	r.Runtime = time.Since(started).Seconds()
+	return nil
+}
+
+// logSummary prints totals of the run.
+func (r *Report) logSummary() {
+	slog.Info("packed",
+		"books", len(r.Books),
+		"files", r.Files,
+		"audio", formatDuration(r.Duration),
+		"runtime", time.Duration(r.Runtime*float64(time.Second)).Round(time.Millisecond).String(),
+		"read", formatSize(r.BytesIn),
+		"wrote", formatSize(r.BytesOut),
+		"ratio", fmt.Sprintf("%.3f", r.Ratio),
+	)
+	for _, invalid := range r.Invalid {
+		slog.Warn("packed corrupt audio", "file", invalid)
+	}
+	for _, skipped := range r.Skipped {
+		slog.Warn("skipped", "path", skipped.Path, "dir", skipped.Dir, "err", skipped.Error)
+	}
+	if len(r.Invalid) > 0 || len(r.Skipped) > 0 {
+		slog.Warn("incomplete run", "corrupt", len(r.Invalid), "skipped", len(r.Skipped))
+	}
+}
+
+// writeJSON writes the report into filename.
+func (r *Report) writeJSON(filename string, mode os.FileMode) error {
+	content, errJSON := json.MarshalIndent(r, "", "  ")
+	if errJSON != nil {
+		return errJSON
+	}
+	if err := os.WriteFile(filename, append(content, '\n'), mode); err != nil {
+		return fmt.Errorf("writing report: %w", err)
+	}
+	return nil
+}
+
+// formatDuration prints seconds as H:MM:SS.
+func formatDuration(seconds float64) string {
+	total := int64(seconds + 0.5)
+	return fmt.Sprintf("%d:%02d:%02d", total/3600, total/60%60, total%60)
+}
@@ -0,0 +1,237 @@
+package repack
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+)
+
+const (
+	// stateSuffix marks the journal of entries written into OUTPUT.tmp
+	stateSuffix = ".state"
+	// partialSuffix marks the output of an interrupted run entries are resumed from
+	partialSuffix = ".partial"
+)
+
+// stateEntry is a journaled entry of an interrupted output. Source size and mtime
+// tell if the source is unchanged, the rest locates compressed data in the output.
+type stateEntry struct {
+	Name           string `json:"name"`
+	Source         string `json:"source"`
+	SourceSize     int64  `json:"source_size"`
+	SourceModTime  int64  `json:"source_mtime"`
+	Method         uint16 `json:"method"`
+	CRC32          uint32 `json:"crc32"`
+	CompressedSize uint64 `json:"compressed_size"`
+	Size           uint64 `json:"size"`
+	Offset         int64  `json:"offset"`
+	SHA256         []byte `json:"sha256,omitempty"`
+}
+
+// resumeState journals finished entries of the output and copies entries
+// of the interrupted run as is when their sources are unchanged.
+//
+// The journal of an interrupted run and its output are moved to OUTPUT.partial.state
+// and OUTPUT.partial, unless the run didn't journal anything, then the older pair is kept.
+type resumeState struct {
+	output  string
+	journal *os.File
+	enc     *json.Encoder
+	// pending are written entries which aren't finished yet, keyed by name
+	pending map[string]stateEntry
+
+	partial  *os.File
+	previous map[string]stateEntry
+	resumed  int
+}
+
+// openResumeState picks up the journal of an interrupted run of output and starts a new one.
+func openResumeState(output string) (*resumeState, error) {
+	state := &resumeState{output: output, pending: map[string]stateEntry{}}
+
+	previous, errRead := readJournal(output + stateSuffix)
+	if errRead != nil {
+		return nil, errRead
+	}
+	_, errTmp := os.Stat(output + tmpSuffix)
+	if len(previous) > 0 && errTmp == nil {
+		if err := os.Rename(output+tmpSuffix, output+partialSuffix); err != nil {
+			return nil, fmt.Errorf("keeping interrupted output: %w", err)
+		}
+		if err := os.Rename(output+stateSuffix, output+partialSuffix+stateSuffix); err != nil {
+			return nil, fmt.Errorf("keeping interrupted output state: %w", err)
+		}
+	} else {
+		previous, errRead = readJournal(output + partialSuffix + stateSuffix)
+		if errRead != nil {
+			return nil, errRead
+		}
+	}
+
+	if len(previous) > 0 {
+		partial, err := os.Open(output + partialSuffix)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			previous = nil
+		case err != nil:
+			return nil, fmt.Errorf("opening interrupted output: %w", err)
+		default:
+			state.partial = partial
+			slog.Info("resuming interrupted output", "output", output, "entries", len(previous))
+		}
+	}
+	state.previous = previous
+
+	journal, errJournal := openNoFollow(output+stateSuffix, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if errJournal != nil {
+		_ = state.Close()
+		return nil, fmt.Errorf("creating output state: %w", errJournal)
+	}
+	state.journal, state.enc = journal, json.NewEncoder(journal)
+	return state, nil
+}
+
+// readJournal reads entries of a state file, a missing file has none.
+// Reading stops at the first broken line, which a killed run may leave.
+func readJournal(filename string) (map[string]stateEntry, error) {
+	file, errOpen := os.Open(filename)
+	if errors.Is(errOpen, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if errOpen != nil {
+		return nil, fmt.Errorf("reading output state: %w", errOpen)
+	}
+	defer file.Close()
+
+	entries := map[string]stateEntry{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry stateEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			slog.Warn("ignoring the rest of output state", "state", filename, "err", err)
+			break
+		}
+		entries[entry.Name] = entry
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading output state: %w", err)
+	}
+	return entries, nil
+}
+
+// written registers an entry of a source file, it's journaled once finished.
+func (state *resumeState) written(record fileRecord, info fs.FileInfo, sum []byte) {
+	state.pending[record.name] = stateEntry{
+		Name:          record.name,
+		Source:        record.path,
+		SourceSize:    info.Size(),
+		SourceModTime: info.ModTime().UnixNano(),
+		SHA256:        sum,
+	}
+}
+
+// entryDone journals a finished entry if it's one of a source file.
+func (state *resumeState) entryDone(header *zip.FileHeader, offset int64) error {
+	entry, ok := state.pending[header.Name]
+	if !ok {
+		return nil
+	}
+	delete(state.pending, header.Name)
+
+	entry.Method = header.Method
+	entry.CRC32 = header.CRC32
+	entry.CompressedSize = header.CompressedSize64
+	entry.Size = header.UncompressedSize64
+	entry.Offset = offset
+	if err := state.enc.Encode(entry); err != nil {
+		return fmt.Errorf("writing output state: %w", err)
+	}
+	return nil
+}
+
+// lookup returns the entry of an interrupted run packed from the same source.
+func (state *resumeState) lookup(record fileRecord, info fs.FileInfo) (stateEntry, bool) {
+	entry, ok := state.previous[record.name]
+	if !ok || entry.Source != record.path ||
+		entry.SourceSize != info.Size() || entry.SourceModTime != info.ModTime().UnixNano() {
+		return stateEntry{}, false
+	}
+	return entry, true
+}
+
+// copyContent copies compressed data of an entry of the interrupted run.
+func (state *resumeState) copyContent(dst io.Writer, entry stateEntry) error {
+	size := int64(entry.CompressedSize)
+	_, err := io.CopyN(dst, io.NewSectionReader(state.partial, entry.Offset, size), size)
+	return err
+}
+
+// Close closes the state files and keeps them for the next run.
+func (state *resumeState) Close() error {
+	var errs []error
+	if state.journal != nil {
+		errs = append(errs, state.journal.Close())
+	}
+	if state.partial != nil {
+		errs = append(errs, state.partial.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// finish removes the state files after the output is in place.
+func (state *resumeState) finish() {
+	_ = state.Close()
+	if state.resumed > 0 {
+		slog.Info("resumed output", "output", state.output, "copied", state.resumed)
+	}
+	for _, suffix := range []string{stateSuffix, partialSuffix, partialSuffix + stateSuffix} {
+		if err := os.Remove(state.output + suffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("removing output state", "err", err)
+		}
+	}
+}
+
+// resumeRecord copies the entry of record from the interrupted output if its source is unchanged.
+// It reports false if the record has to be written anew.
+func (p *processor) resumeRecord(archive archiveWriter, record fileRecord, info fs.FileInfo) (bool, error) {
+	raw, ok := archive.(rawArchiveWriter)
+	if p.resume == nil || !ok {
+		return false, nil
+	}
+	entry, ok := p.resume.lookup(record, info)
+	if !ok || (p.hashFiles && len(entry.SHA256) == 0) {
+		return false, nil
+	}
+
+	wr, copied, errCreate := raw.createRaw(archiveEntry{
+		name:    record.name,
+		source:  record.path,
+		size:    int64(entry.Size),
+		modTime: p.entryTime(info),
+	}, rawData{
+		method:         entry.Method,
+		crc32:          entry.CRC32,
+		compressedSize: entry.CompressedSize,
+		size:           entry.Size,
+	})
+	if errCreate != nil || !copied {
+		return false, errCreate
+	}
+	if err := p.resume.copyContent(wr, entry); err != nil {
+		return false, fmt.Errorf("copying %q from interrupted output: %w", record.name, err)
+	}
+
+	if p.hashFiles {
+		p.manifest = append(p.manifest, manifestLine{sum: entry.SHA256, name: record.name, source: record.path})
+	}
+	p.resume.written(record, info, entry.SHA256)
+	p.resume.resumed++
+	slog.Debug("resumed", "file", record.path)
+	return true, nil
+}
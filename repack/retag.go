@@ -0,0 +1,205 @@
+package repack
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// tagEdit describes changes of ID3 tag made while a file is copied into archive.
+type tagEdit struct {
+	// cover is an image embedded as front cover into files without pictures
+	cover string
+
+	// fix sets album, album artist and track number, drops disc number and comments
+	fix                bool
+	album, albumArtist string
+	track, tracks      int
+}
+
+// edit returns tag changes of the record, creating them if needed.
+func (r *fileRecord) edit() *tagEdit {
+	if r.tagEdit == nil {
+		r.tagEdit = &tagEdit{}
+	}
+	return r.tagEdit
+}
+
+// retagged is a rewritten tag, which replaces the first skip bytes of the file.
+type retagged struct {
+	tag  []byte
+	skip int64
+}
+
+// size is entry size of the file with info after retagging.
+func (r *retagged) size(info os.FileInfo) int64 {
+	if r == nil {
+		return info.Size()
+	}
+	return int64(len(r.tag)) + info.Size() - r.skip
+}
+
+// retag builds new ID3 tag for record, nil means the file is copied as is.
+// File offset is left at the start of audio data to copy.
+func (p *processor) retag(record fileRecord, file *os.File) (*retagged, error) {
+	// transcoded files are checked by their new extension
+	if record.tagEdit == nil || !isMP3(file.Name()) {
+		return nil, nil
+	}
+
+	header := make([]byte, 10)
+	n, _ := io.ReadFull(file, header)
+	skip := int64(id3v2Size(header[:n]))
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	tag, errTag := readID3v2(file)
+	if errTag != nil {
+		return nil, errTag
+	}
+	if tag == nil {
+		tag = &id3Tag{version: 3}
+	}
+	if tag.version < 3 {
+		slog.Debug("keeping old ID3v2 tag as is", "version", tag.version, "file", record.path)
+		return nil, rewind(file, 0)
+	}
+
+	changed := false
+	edit := record.tagEdit
+	if edit.fix {
+		tag.set(textFrame(tag.version, "TALB", edit.album))
+		if edit.albumArtist != "" {
+			tag.set(textFrame(tag.version, "TPE2", edit.albumArtist))
+		}
+		tag.set(textFrame(tag.version, "TRCK", fmt.Sprintf("%d/%d", edit.track, edit.tracks)))
+		tag.remove("TPOS")
+		tag.remove("COMM")
+		changed = true
+	}
+
+	if edit.cover != "" && !tag.has("APIC") {
+		frame, errFrame := p.coverFrame(edit.cover)
+		if errFrame != nil {
+			return nil, errFrame
+		}
+		tag.frames = append(tag.frames, frame)
+		changed = true
+	}
+
+	if !changed {
+		return nil, rewind(file, 0)
+	}
+	return &retagged{tag: tag.encode(), skip: skip}, rewind(file, skip)
+}
+
+func isMP3(filename string) bool {
+	return strings.EqualFold(filepath.Ext(filename), ".mp3")
+}
+
+// skipID3v2 returns content of re past ID3v2 tag at its start.
+func skipID3v2(re io.Reader) io.Reader {
+	header := make([]byte, 10)
+	n, _ := io.ReadFull(re, header)
+	size := id3v2Size(header[:n])
+	if size == 0 {
+		return io.MultiReader(bytes.NewReader(header[:n]), re)
+	}
+	_, _ = io.CopyN(io.Discard, re, int64(size-n))
+	return re
+}
+
+func rewind(file *os.File, offset int64) error {
+	_, err := file.Seek(offset, io.SeekStart)
+	return err
+}
+
+// coverFrame returns APIC frame with front cover image, images are read once.
+func (p *processor) coverFrame(filename string) (id3Frame, error) {
+	if frame, ok := p.coverFrames[filename]; ok {
+		return frame, nil
+	}
+
+	image, errRead := os.ReadFile(filename)
+	if errRead != nil {
+		return id3Frame{}, fmt.Errorf("reading cover: %w", errRead)
+	}
+
+	mime := "image/jpeg"
+	if strings.EqualFold(filepath.Ext(filename), ".png") {
+		mime = "image/png"
+	}
+
+	data := &bytes.Buffer{}
+	data.WriteByte(0) // ISO-8859-1 description
+	data.WriteString(mime)
+	data.WriteByte(0)
+	data.WriteByte(3) // front cover
+	data.WriteByte(0) // empty description
+	data.Write(image)
+
+	frame := id3Frame{id: "APIC", data: data.Bytes()}
+	if p.coverFrames == nil {
+		p.coverFrames = map[string]id3Frame{}
+	}
+	p.coverFrames[filename] = frame
+	return frame, nil
+}
+
+// fixTags plans consistent tags for MP3 records of the book from dir:
+// album is the dir name, album artist is the most common artist
+// and tracks are numbered in archive order across discs.
+// Title and authors of meta found online take precedence, if there is one.
+func fixTags(dir string, records []fileRecord, meta *fetchedMetadata) {
+	mp3s := []int{}
+	artists := map[string]int{}
+	for i, record := range records {
+		if !isMP3(record.path) {
+			continue
+		}
+		mp3s = append(mp3s, i)
+
+		tag, errTag := readID3v2File(record.path)
+		if errTag != nil {
+			slog.Warn("reading tags", "file", record.path, "err", errTag)
+		}
+		artist := tag.text("TPE2")
+		if artist == "" {
+			artist = tag.text("TPE1")
+		}
+		if artist != "" {
+			artists[artist]++
+		}
+	}
+
+	albumArtist := mostCommon(artists)
+	album := filepath.Base(filepath.Clean(dir))
+	if meta != nil {
+		album = meta.Title
+		if len(meta.Authors) > 0 {
+			albumArtist = strings.Join(meta.Authors, ", ")
+		}
+	}
+	for track, i := range mp3s {
+		edit := records[i].edit()
+		edit.fix = true
+		edit.album, edit.albumArtist = album, albumArtist
+		edit.track, edit.tracks = track+1, len(mp3s)
+	}
+}
+
+// mostCommon returns the most counted value, the least one on ties.
+func mostCommon(counts map[string]int) string {
+	common := ""
+	for value, n := range counts {
+		if n > counts[common] || n == counts[common] && value < common {
+			common = value
+		}
+	}
+	return common
+}
@@ -0,0 +1,94 @@
+package repack
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"path"
+	"strings"
+)
+
+// ReviewBook is a discovered book with its files in packing order, see Hooks.Review.
+type ReviewBook struct {
+	Dir   string
+	Files []ReviewFile
+}
+
+// ReviewFile is a file of a reviewed book. Only Name can be changed,
+// files can be dropped and reordered within their book.
+type ReviewFile struct {
+	// Name is the entry name
+	Name string
+	// Source is the packed file, Size is its size
+	Source string
+	Size   int64
+
+	// index is the position of the file among discovered files of its book
+	index int
+}
+
+var errBadReview = errors.New("bad review")
+
+// review lets Hooks.Review drop, reorder and rename discovered files.
+// Books left without files are dropped.
+func (p *processor) review(books []book) ([]book, error) {
+	if p.hooks.Review == nil {
+		return books, nil
+	}
+
+	reviewed := make([]ReviewBook, len(books))
+	for i, b := range books {
+		reviewed[i].Dir = b.dir
+		for j, record := range b.records {
+			size := int64(0)
+			for _, source := range record.sources() {
+				n, _ := sourceSize(source)
+				size += n
+			}
+			reviewed[i].Files = append(reviewed[i].Files, ReviewFile{Name: record.name, Source: record.path, Size: size, index: j})
+		}
+	}
+
+	if err := p.hooks.Review(reviewed); err != nil {
+		return nil, err
+	}
+	if len(reviewed) != len(books) {
+		return nil, fmt.Errorf("%w: books can't be added or removed, drop their files instead", errBadReview)
+	}
+
+	kept := make([]book, 0, len(books))
+	for i, b := range books {
+		records := make([]fileRecord, 0, len(reviewed[i].Files))
+		seen := map[int]bool{}
+		for _, file := range reviewed[i].Files {
+			if file.index < 0 || file.index >= len(b.records) || seen[file.index] {
+				return nil, fmt.Errorf("%w: file %q of %q wasn't discovered there", errBadReview, file.Source, b.dir)
+			}
+			seen[file.index] = true
+			if err := checkEntryName(file.Name); err != nil {
+				return nil, fmt.Errorf("%w: %w", errBadReview, err)
+			}
+
+			record := b.records[file.index]
+			record.name = file.Name
+			records = append(records, record)
+		}
+
+		if len(records) == 0 {
+			slog.Info("book left out", "dir", b.dir)
+			continue
+		}
+		b.records = records
+		kept = append(kept, b)
+	}
+	return kept, nil
+}
+
+// checkEntryName refuses names which are empty or unpack outside of the target dir.
+func checkEntryName(name string) error {
+	clean := path.Clean(name)
+	if name == "" || clean != name || path.IsAbs(name) || clean == ".." || strings.HasPrefix(clean, "../") || strings.Contains(name, `\`) {
+		return fmt.Errorf("bad entry name %q", name)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package repack
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var romanDigits = map[byte]int{'I': 1, 'V': 5, 'X': 10, 'L': 50, 'C': 100, 'D': 500, 'M': 1000}
+
+// parseRoman parses an uppercase Roman numeral from 1 to 3999 in its canonical form,
+// so words like DIM or IIII aren't taken for numbers.
+func parseRoman(s string) (int, bool) {
+	if s == "" {
+		return 0, false
+	}
+	value := 0
+	for i := 0; i < len(s); i++ {
+		digit, ok := romanDigits[s[i]]
+		if !ok {
+			return 0, false
+		}
+		if i+1 < len(s) && romanDigits[s[i+1]] > digit {
+			value -= digit
+		} else {
+			value += digit
+		}
+	}
+	if value < 1 || value > 3999 || formatRoman(value) != s {
+		return 0, false
+	}
+	return value, true
+}
+
+var romanNumerals = []struct {
+	value   int
+	numeral string
+}{
+	{1000, "M"}, {900, "CM"}, {500, "D"}, {400, "CD"}, {100, "C"}, {90, "XC"},
+	{50, "L"}, {40, "XL"}, {10, "X"}, {9, "IX"}, {5, "V"}, {4, "IV"}, {1, "I"},
+}
+
+func formatRoman(value int) string {
+	numeral := &strings.Builder{}
+	for _, r := range romanNumerals {
+		for ; value >= r.value; value -= r.value {
+			numeral.WriteString(r.numeral)
+		}
+	}
+	return numeral.String()
+}
+
+// replaceRomanNumerals replaces words which are Roman numerals with Arabic numbers:
+// Part_XII.mp3 becomes Part_12.mp3. A word is a run of letters between characters
+// which are neither letters nor digits, so CD1 and XIth are left as they are.
+func replaceRomanNumerals(name string) string {
+	replaced := &strings.Builder{}
+	for i := 0; i < len(name); {
+		r, size := utf8.DecodeRuneInString(name[i:])
+		if !unicode.IsLetter(r) {
+			replaced.WriteString(name[i : i+size])
+			i += size
+			continue
+		}
+
+		end := i
+		for end < len(name) {
+			r, size := utf8.DecodeRuneInString(name[end:])
+			if !unicode.IsLetter(r) {
+				break
+			}
+			end += size
+		}
+		word := name[i:end]
+		value, ok := parseRoman(word)
+		if ok && !digitBefore(name[:i]) && !digitAfter(name[end:]) {
+			word = strconv.Itoa(value)
+		}
+		replaced.WriteString(word)
+		i = end
+	}
+	return replaced.String()
+}
+
+func digitBefore(s string) bool {
+	r, _ := utf8.DecodeLastRuneInString(s)
+	return unicode.IsDigit(r)
+}
+
+func digitAfter(s string) bool {
+	r, _ := utf8.DecodeRuneInString(s)
+	return unicode.IsDigit(r)
+}
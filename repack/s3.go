@@ -0,0 +1,323 @@
+package repack
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// s3PartSize is size of multipart upload parts, S3 takes up to 10000 parts,
+// so archives up to about 156 GiB can be uploaded.
+const s3PartSize = 16 << 20
+
+// s3Client signs requests to a bucket with AWS Signature Version 4.
+// Credentials, region and endpoint are read from the usual AWS_* variables.
+type s3Client struct {
+	http *http.Client
+	// endpoint is the bucket URL, the object key is appended to its path
+	endpoint *url.URL
+	region   string
+
+	accessKey, secretKey, sessionToken string
+}
+
+// newS3Client configures access to bucket. AWS_ENDPOINT_URL_S3 or AWS_ENDPOINT_URL
+// select S3-compatible storage, which is addressed path-style: ENDPOINT/BUCKET/KEY.
+func newS3Client(bucket string) (*s3Client, error) {
+	client := &s3Client{
+		http:         http.DefaultClient,
+		region:       firstEnv("AWS_REGION", "AWS_DEFAULT_REGION"),
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if client.accessKey == "" || client.secretKey == "" {
+		return nil, fmt.Errorf("%w: AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set", errRemoteOutput)
+	}
+	if client.region == "" {
+		client.region = "us-east-1"
+	}
+
+	endpoint := firstEnv("AWS_ENDPOINT_URL_S3", "AWS_ENDPOINT_URL")
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.s3.%s.amazonaws.com", bucket, client.region)
+	} else {
+		endpoint = strings.TrimSuffix(endpoint, "/") + "/" + bucket
+	}
+	parsed, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("%w: endpoint: %w", errRemoteOutput, err)
+	}
+	client.endpoint = parsed
+	return client, nil
+}
+
+// firstEnv is the first of variables which is set.
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// do sends a signed request for the object key and returns the response body of a 2xx response.
+func (c *s3Client) do(method, key string, query url.Values, body []byte) ([]byte, http.Header, error) {
+	target := *c.endpoint
+	target.Path = strings.TrimSuffix(target.Path, "/") + "/" + key
+	// the path is sent encoded exactly like it's signed
+	target.RawPath = awsEscape(target.Path, true)
+	target.RawQuery = awsQuery(query)
+
+	req, errReq := http.NewRequest(method, target.String(), bytes.NewReader(body))
+	if errReq != nil {
+		return nil, nil, errReq
+	}
+	c.sign(req, body, time.Now().UTC())
+
+	resp, errDo := c.http.Do(req)
+	if errDo != nil {
+		return nil, nil, errDo
+	}
+	defer resp.Body.Close()
+
+	content, errRead := io.ReadAll(resp.Body)
+	if errRead != nil {
+		return nil, nil, errRead
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, nil, &statusError{status: resp.StatusCode, body: strings.TrimSpace(string(content))}
+	}
+	return content, resp.Header, nil
+}
+
+// sign adds Signature Version 4 headers to req.
+func (c *s3Client) sign(req *http.Request, body []byte, now time.Time) {
+	payload := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(payload[:])
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	canonicalHeaders := &strings.Builder{}
+	for _, name := range names {
+		fmt.Fprintf(canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + c.secretKey)
+	for _, part := range []string{date, c.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsEscape percent-encodes everything but unreserved characters, and slashes if keepSlash is set.
+func awsEscape(s string, keepSlash bool) string {
+	escaped := &strings.Builder{}
+	for _, b := range []byte(s) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9',
+			b == '-', b == '_', b == '.', b == '~', b == '/' && keepSlash:
+			escaped.WriteByte(b)
+		default:
+			fmt.Fprintf(escaped, "%%%02X", b)
+		}
+	}
+	return escaped.String()
+}
+
+// awsQuery encodes query sorted by key the way it's signed.
+func awsQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	pairs := []string{}
+	for _, key := range keys {
+		for _, value := range query[key] {
+			pairs = append(pairs, awsEscape(key, false)+"="+awsEscape(value, false))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// s3Upload is a multipart upload, parts are uploaded as soon as they're filled.
+type s3Upload struct {
+	client   *s3Client
+	key      string
+	uploadID string
+
+	buf   []byte
+	parts []s3Part
+	// err fails writes after a part couldn't be uploaded
+	err error
+}
+
+type s3Part struct {
+	Number int    `xml:"PartNumber"`
+	ETag   string `xml:"ETag"`
+}
+
+// newS3Upload starts a multipart upload of s3://BUCKET/KEY.
+func newS3Upload(target *url.URL) (*s3Upload, error) {
+	key := strings.TrimPrefix(target.Path, "/")
+	if target.Host == "" || key == "" {
+		return nil, fmt.Errorf("%w: want s3://BUCKET/KEY, got %q", errRemoteOutput, target.Redacted())
+	}
+
+	client, errClient := newS3Client(target.Host)
+	if errClient != nil {
+		return nil, errClient
+	}
+	upload := &s3Upload{client: client, key: key, buf: make([]byte, 0, s3PartSize)}
+
+	var created struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err := retry("create multipart upload", func() error {
+		content, _, err := client.do(http.MethodPost, key, url.Values{"uploads": {""}}, nil)
+		if err != nil {
+			return err
+		}
+		return xml.Unmarshal(content, &created)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: starting upload: %w", errRemoteOutput, err)
+	}
+	upload.uploadID = created.UploadID
+	return upload, nil
+}
+
+func (u *s3Upload) Write(p []byte) (int, error) {
+	if u.err != nil {
+		return 0, u.err
+	}
+
+	n := 0
+	for len(p) > 0 {
+		chunk := min(len(p), s3PartSize-len(u.buf))
+		u.buf = append(u.buf, p[:chunk]...)
+		p, n = p[chunk:], n+chunk
+		if len(u.buf) == s3PartSize {
+			if err := u.uploadPart(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// uploadPart uploads the buffered part and empties the buffer.
+func (u *s3Upload) uploadPart() error {
+	number := len(u.parts) + 1
+	query := url.Values{"partNumber": {fmt.Sprint(number)}, "uploadId": {u.uploadID}}
+	err := retry(fmt.Sprintf("upload part %d", number), func() error {
+		_, header, err := u.client.do(http.MethodPut, u.key, query, u.buf)
+		if err != nil {
+			return err
+		}
+		u.parts = append(u.parts, s3Part{Number: number, ETag: header.Get("ETag")})
+		return nil
+	})
+	if err != nil {
+		u.err = fmt.Errorf("uploading part %d: %w", number, err)
+		return u.err
+	}
+	u.buf = u.buf[:0]
+	return nil
+}
+
+// commit uploads the last part and completes the upload, the object appears only then.
+func (u *s3Upload) commit() error {
+	if u.err != nil {
+		return u.err
+	}
+	if len(u.buf) > 0 || len(u.parts) == 0 {
+		if err := u.uploadPart(); err != nil {
+			return err
+		}
+	}
+
+	complete, errMarshal := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: u.parts})
+	if errMarshal != nil {
+		return errMarshal
+	}
+
+	return retry("complete multipart upload", func() error {
+		content, _, err := u.client.do(http.MethodPost, u.key, url.Values{"uploadId": {u.uploadID}}, complete)
+		if err != nil {
+			return err
+		}
+		// S3 may report a failure in the body of 200 OK
+		if bytes.Contains(content, []byte("<Error>")) {
+			return &statusError{status: http.StatusInternalServerError, body: string(content)}
+		}
+		return nil
+	})
+}
+
+// abort drops uploaded parts, storage keeps them otherwise.
+func (u *s3Upload) abort() {
+	err := retry("abort multipart upload", func() error {
+		_, _, err := u.client.do(http.MethodDelete, u.key, url.Values{"uploadId": {u.uploadID}}, nil)
+		return err
+	})
+	if err != nil {
+		slog.Error("aborting upload, parts may be left in the bucket", "upload", u.uploadID, "err", err)
+	}
+}
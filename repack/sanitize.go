@@ -0,0 +1,178 @@
+package repack
+
+import (
+	"fmt"
+	"log/slog"
+	"path"
+	"strings"
+	"unicode/utf8"
+)
+
+// Filesystems entry names are made safe for, see Options.SanitizeNames.
+const (
+	SanitizeFAT32 = "fat32"
+	SanitizeNTFS  = "ntfs"
+	SanitizePOSIX = "posix"
+)
+
+// SanitizeTargets are valid values of Options.SanitizeNames.
+var SanitizeTargets = []string{SanitizeFAT32, SanitizeNTFS, SanitizePOSIX}
+
+// fat32MaxFile is the largest file FAT32 can hold.
+const fat32MaxFile = 1<<32 - 1
+
+// nameRules are limits of a filesystem names are sanitized for.
+type nameRules struct {
+	// illegal characters are replaced with "_", control characters always are
+	illegal string
+	// windows trims trailing dots and spaces and renames reserved device names
+	windows bool
+	// maxName and maxPath are limits of a path element and of the whole name in units of length
+	maxName, maxPath int
+	length           func(string) int
+}
+
+var sanitizeRules = map[string]nameRules{
+	// Windows limits paths to 260 characters, some are left for the dir an archive is extracted into
+	SanitizeFAT32: {illegal: `<>:"|?*\`, windows: true, maxName: 255, maxPath: 240, length: utf16Len},
+	SanitizeNTFS:  {illegal: `<>:"|?*\`, windows: true, maxName: 255, maxPath: 240, length: utf16Len},
+	SanitizePOSIX: {maxName: 255, maxPath: 4095, length: func(s string) int { return len(s) }},
+}
+
+// windowsReserved are device names Windows doesn't allow as file names, with any extension.
+var windowsReserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+func utf16Len(s string) int {
+	n := 0
+	for _, r := range s {
+		n++
+		if r > 0xffff {
+			// a surrogate pair
+			n++
+		}
+	}
+	return n
+}
+
+// sanitizeName makes a slash separated entry name extractable on the filesystem of rules:
+// illegal characters are replaced, path elements and then the file name are shortened
+// keeping extensions. Names which can't fit even with a one character file name fail.
+func sanitizeName(name string, rules nameRules) (string, error) {
+	elements := strings.Split(name, "/")
+	for i, element := range elements {
+		elements[i] = shortenElement(sanitizeElement(element, rules), rules.maxName, rules.length)
+	}
+
+	sanitized := strings.Join(elements, "/")
+	if over := rules.length(sanitized) - rules.maxPath; over > 0 {
+		last := len(elements) - 1
+		elements[last] = shortenElement(elements[last], max(rules.length(elements[last])-over, 1), rules.length)
+		sanitized = strings.Join(elements, "/")
+	}
+	if rules.length(sanitized) > rules.maxPath {
+		return "", fmt.Errorf("entry name %q is longer than %d characters", sanitized, rules.maxPath)
+	}
+	return sanitized, nil
+}
+
+func sanitizeElement(element string, rules nameRules) string {
+	element = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || r == utf8.RuneError || strings.ContainsRune(rules.illegal, r) {
+			return '_'
+		}
+		return r
+	}, element)
+	if !rules.windows {
+		return element
+	}
+
+	element = strings.TrimRight(element, ". ")
+	if element == "" {
+		return "_"
+	}
+	base, _, _ := strings.Cut(element, ".")
+	if windowsReserved[strings.ToUpper(strings.TrimSpace(base))] {
+		element = "_" + element
+	}
+	return element
+}
+
+// shortenElement cuts the base of element, keeping the extension, until it fits into limit.
+func shortenElement(element string, limit int, length func(string) int) string {
+	if length(element) <= limit {
+		return element
+	}
+	ext := path.Ext(element)
+	if length(ext) >= limit {
+		ext = ""
+	}
+	base := []rune(strings.TrimSuffix(element, ext))
+	for len(base) > 1 && length(string(base))+length(ext) > limit {
+		base = base[:len(base)-1]
+	}
+	return string(base) + ext
+}
+
+// sanitizeNames renames records of books by -normalize-names, -transliterate,
+// -name-length and for the filesystem of -sanitize-names.
+// FAT32 can't hold files of 4 GiB and more, they are logged.
+func (p *processor) sanitizeNames(books []book) error {
+	if p.sanitize == "" && p.normalizeForm == "" && !p.transliterate && p.nameLength == 0 {
+		return nil
+	}
+	for i := range books {
+		for j := range books[i].records {
+			record := &books[i].records[j]
+			name, err := p.entryName(record.name)
+			if err != nil {
+				return err
+			}
+			if name != record.name {
+				slog.Debug("sanitized entry name", "name", record.name, "sanitized", name)
+				record.name = name
+			}
+			if p.sanitize != SanitizeFAT32 || record.rel == "" {
+				continue
+			}
+			if size, err := sourceSize(*record); err == nil && size > fat32MaxFile {
+				slog.Warn("file is too large for FAT32", "file", record.path, "size", formatSize(size))
+			}
+		}
+	}
+	return nil
+}
+
+// entryName normalizes, transliterates, shortens and sanitizes name as options say, in this order.
+func (p *processor) entryName(name string) (string, error) {
+	if p.normalizeForm != "" {
+		name = normForms[p.normalizeForm].String(name)
+	}
+	if p.transliterate {
+		name = transliterate(name)
+	}
+	if p.nameLength > 0 {
+		elements := strings.Split(name, "/")
+		for i, element := range elements {
+			elements[i] = shortenElement(element, p.nameLength, utf8.RuneCountInString)
+		}
+		name = strings.Join(elements, "/")
+	}
+	if p.sanitize == "" {
+		return name, nil
+	}
+	return sanitizeName(name, sanitizeRules[p.sanitize])
+}
+
+// generatedName is entryName of a generated entry, like playlists named after the book dir.
+// A name which can't fit is kept as is.
+func (p *processor) generatedName(name string) string {
+	renamed, err := p.entryName(name)
+	if err != nil {
+		return name
+	}
+	return renamed
+}
@@ -0,0 +1,307 @@
+package repack
+
+import (
+	"archive/zip"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"time"
+	"unicode/utf16"
+
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// 7z archive where each non-empty entry is a folder of its own: stored with the copy
+// coder if the compression policy stores it, LZMA2 compressed otherwise.
+// Data follows the signature header, the header listing folders and files is
+// written after all entries, then the signature header is written over its reserved bytes.
+const (
+	sevenZipSignatureSize = 32
+	// sevenZipDictSize is dictionary size of LZMA2 coders, default of lzma writer
+	sevenZipDictSize = 8 << 20
+	// windowsEpoch is 1601-01-01 in 100ns ticks before the Unix epoch
+	windowsEpoch = 116444736000000000
+)
+
+var sevenZipSignature = []byte{'7', 'z', 0xBC, 0xAF, 0x27, 0x1C, 0, 4}
+
+// header property ids
+const (
+	sevenZipEnd             = 0x00
+	sevenZipHeader          = 0x01
+	sevenZipMainStreamsInfo = 0x04
+	sevenZipFilesInfo       = 0x05
+	sevenZipPackInfo        = 0x06
+	sevenZipUnpackInfo      = 0x07
+	sevenZipSubStreamsInfo  = 0x08
+	sevenZipSize            = 0x09
+	sevenZipCRC             = 0x0A
+	sevenZipFolder          = 0x0B
+	sevenZipCodersUnpack    = 0x0C
+	sevenZipEmptyStream     = 0x0E
+	sevenZipEmptyFile       = 0x0F
+	sevenZipName            = 0x11
+	sevenZipMTime           = 0x14
+)
+
+// coder ids
+var (
+	sevenZipCopy  = []byte{0x00}
+	sevenZipLZMA2 = []byte{0x21}
+)
+
+type sevenZipFile struct {
+	name    string
+	modTime time.Time
+	lzma2   bool
+	// size and CRC of data, packed is size of its stream
+
+	size   int64
+	packed int64
+	crc32  uint32
+	// hasStream is false for empty files
+	hasStream bool
+}
+
+// sevenZipArchive writes entries into a 7z archive, writeAt overwrites the reserved signature header.
+type sevenZipArchive struct {
+	dst         io.Writer
+	writeAt     func(p []byte, offset int64) error
+	compression compressionPolicy
+
+	offset  int64
+	files   []*sevenZipFile
+	current *sevenZipFile
+	// encoder is the LZMA2 writer of the current entry, nil if it's stored
+	encoder *lzma.Writer2
+	crc     hash.Hash32
+}
+
+func newSevenZipArchive(dst io.Writer, writeAt func(p []byte, offset int64) error, compression compressionPolicy) (*sevenZipArchive, error) {
+	if writeAt == nil {
+		return nil, fmt.Errorf("%w: 7z format needs a local output file", errUnsupportedArchive)
+	}
+	a := &sevenZipArchive{dst: dst, writeAt: writeAt, compression: compression}
+	// the signature header is written on Close
+	if err := a.write(make([]byte, sevenZipSignatureSize)); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *sevenZipArchive) write(p []byte) error {
+	n, err := a.dst.Write(p)
+	a.offset += int64(n)
+	return err
+}
+
+func (a *sevenZipArchive) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	a.current.size += int64(len(p))
+	a.crc.Write(p)
+	if a.current.lzma2 {
+		if a.encoder == nil {
+			// empty entries get no stream, so the encoder starts with data
+			encoder, err := lzma.Writer2Config{DictCap: sevenZipDictSize}.NewWriter2(writerFunc(a.write))
+			if err != nil {
+				return 0, err
+			}
+			a.encoder = encoder
+		}
+		return a.encoder.Write(p)
+	}
+	if err := a.write(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (a *sevenZipArchive) create(entry archiveEntry) (io.Writer, error) {
+	if err := a.finish(); err != nil {
+		return nil, err
+	}
+
+	a.current = &sevenZipFile{
+		name:    entry.name,
+		modTime: entry.modTime,
+		lzma2:   a.compression.forName(entry.name).method != zip.Store,
+	}
+	a.files = append(a.files, a.current)
+	a.crc = crc32.NewIEEE()
+	a.current.packed = a.offset
+	return a, nil
+}
+
+// finish closes the stream of the current entry, packed becomes its size.
+func (a *sevenZipArchive) finish() error {
+	if a.current == nil {
+		return nil
+	}
+	file := a.current
+	a.current = nil
+	if a.encoder != nil {
+		err := a.encoder.Close()
+		a.encoder = nil
+		if err != nil {
+			return err
+		}
+	}
+	file.packed = a.offset - file.packed
+	file.crc32 = a.crc.Sum32()
+	file.hasStream = file.size > 0
+	return nil
+}
+
+func (a *sevenZipArchive) Close() error {
+	if err := a.finish(); err != nil {
+		return err
+	}
+
+	headerOffset := a.offset - sevenZipSignatureSize
+	header := a.header()
+	if err := a.write(header); err != nil {
+		return err
+	}
+
+	start := make([]byte, 20)
+	binary.LittleEndian.PutUint64(start, uint64(headerOffset))
+	binary.LittleEndian.PutUint64(start[8:], uint64(len(header)))
+	binary.LittleEndian.PutUint32(start[16:], crc32.ChecksumIEEE(header))
+	signature := append([]byte{}, sevenZipSignature...)
+	signature = binary.LittleEndian.AppendUint32(signature, crc32.ChecksumIEEE(start))
+	return a.writeAt(append(signature, start...), 0)
+}
+
+// header lists pack streams and folders of non-empty files, then names and mtimes of all files.
+func (a *sevenZipArchive) header() []byte {
+	streams := []*sevenZipFile{}
+	for _, file := range a.files {
+		if file.hasStream {
+			streams = append(streams, file)
+		}
+	}
+
+	h := []byte{sevenZipHeader}
+	if len(streams) > 0 {
+		h = append(h, sevenZipMainStreamsInfo, sevenZipPackInfo)
+		h = append7zNumber(h, 0)
+		h = append7zNumber(h, uint64(len(streams)))
+		h = append(h, sevenZipSize)
+		for _, file := range streams {
+			h = append7zNumber(h, uint64(file.packed))
+		}
+		h = append(h, sevenZipEnd)
+
+		h = append(h, sevenZipUnpackInfo, sevenZipFolder)
+		h = append7zNumber(h, uint64(len(streams)))
+		h = append(h, 0) // folders aren't external
+		for _, file := range streams {
+			h = append(h, 1) // a single coder
+			if file.lzma2 {
+				h = append(h, 0x20|byte(len(sevenZipLZMA2)))
+				h = append(h, sevenZipLZMA2...)
+				h = append(h, 1, lzma2DictProperty(sevenZipDictSize))
+			} else {
+				h = append(h, byte(len(sevenZipCopy)))
+				h = append(h, sevenZipCopy...)
+			}
+		}
+		h = append(h, sevenZipCodersUnpack)
+		for _, file := range streams {
+			h = append7zNumber(h, uint64(file.size))
+		}
+		h = append(h, sevenZipCRC, 1) // all CRCs are defined
+		for _, file := range streams {
+			h = binary.LittleEndian.AppendUint32(h, file.crc32)
+		}
+		h = append(h, sevenZipEnd)
+		// a stream per folder, readers need the section even if it's empty
+		h = append(h, sevenZipSubStreamsInfo, sevenZipEnd, sevenZipEnd)
+	}
+
+	h = append(h, sevenZipFilesInfo)
+	h = append7zNumber(h, uint64(len(a.files)))
+	if len(streams) < len(a.files) {
+		empty := make([]bool, len(a.files))
+		emptyFiles := []bool{}
+		for i, file := range a.files {
+			empty[i] = !file.hasStream
+			if empty[i] {
+				emptyFiles = append(emptyFiles, true)
+			}
+		}
+		h = append7zProperty(h, sevenZipEmptyStream, bitVector(empty))
+		h = append7zProperty(h, sevenZipEmptyFile, bitVector(emptyFiles))
+	}
+
+	names := []byte{0} // names aren't external
+	for _, file := range a.files {
+		for _, unit := range utf16.Encode([]rune(file.name)) {
+			names = binary.LittleEndian.AppendUint16(names, unit)
+		}
+		names = append(names, 0, 0)
+	}
+	h = append7zProperty(h, sevenZipName, names)
+
+	times := []byte{1, 0} // all times are defined and not external
+	for _, file := range a.files {
+		times = binary.LittleEndian.AppendUint64(times, uint64(file.modTime.UnixNano()/100+windowsEpoch))
+	}
+	h = append7zProperty(h, sevenZipMTime, times)
+
+	return append(h, sevenZipEnd, sevenZipEnd)
+}
+
+// append7zNumber encodes v with the count of extra bytes in leading one bits of the first byte.
+func append7zNumber(b []byte, v uint64) []byte {
+	for n := 0; n < 8; n++ {
+		if v < 1<<(7*(n+1)) {
+			b = append(b, ^byte(0xFF>>n)|byte(v>>(8*n)))
+			for i := 0; i < n; i++ {
+				b = append(b, byte(v>>(8*i)))
+			}
+			return b
+		}
+	}
+	return binary.LittleEndian.AppendUint64(append(b, 0xFF), v)
+}
+
+func append7zProperty(b []byte, id byte, data []byte) []byte {
+	b = append(b, id)
+	b = append7zNumber(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// bitVector packs bits starting from the high bit of the first byte.
+func bitVector(bits []bool) []byte {
+	vector := make([]byte, (len(bits)+7)/8)
+	for i, bit := range bits {
+		if bit {
+			vector[i/8] |= 0x80 >> (i % 8)
+		}
+	}
+	return vector
+}
+
+// lzma2DictProperty encodes the smallest dictionary size of form 2 or 3 times a power of 2 holding size.
+func lzma2DictProperty(size int) byte {
+	for p := byte(0); p < 40; p++ {
+		if (2|int(p&1))<<(p/2+11) >= size {
+			return p
+		}
+	}
+	return 40
+}
+
+type writerFunc func(p []byte) error
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	if err := f(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
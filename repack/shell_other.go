@@ -0,0 +1,8 @@
+//go:build !unix
+
+package repack
+
+// hookShell runs hook commands, cmd.exe is the shell available everywhere here.
+func hookShell() (shell, flag string) {
+	return "cmd", "/C"
+}
@@ -0,0 +1,8 @@
+//go:build unix
+
+package repack
+
+// hookShell runs hook commands.
+func hookShell() (shell, flag string) {
+	return "sh", "-c"
+}
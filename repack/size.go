@@ -0,0 +1,49 @@
+package repack
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// sizeUnits are decimal and binary suffixes, longest first to match them greedily.
+var sizeUnits = []struct {
+	suffix string
+	factor int64
+}{
+	{"kib", 1 << 10}, {"mib", 1 << 20}, {"gib", 1 << 30}, {"tib", 1 << 40},
+	{"kb", 1e3}, {"mb", 1e6}, {"gb", 1e9}, {"tb", 1e12},
+	{"k", 1e3}, {"m", 1e6}, {"g", 1e9}, {"t", 1e12},
+	{"b", 1},
+}
+
+// ParseSize parses byte sizes like 700MB, 4GB or 4GiB. Plain numbers are bytes.
+func ParseSize(value string) (int64, error) {
+	lower := strings.ToLower(strings.TrimSpace(value))
+	factor := int64(1)
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(lower, unit.suffix) {
+			lower, factor = strings.TrimSuffix(lower, unit.suffix), unit.factor
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(strings.TrimSpace(lower), 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad size %q", value)
+	}
+
+	return int64(n * float64(factor)), nil
+}
+
+// formatSize prints n bytes with a binary unit, e.g. 1.5 MiB.
+func formatSize(n int64) string {
+	if n < 1<<10 {
+		return fmt.Sprintf("%d B", n)
+	}
+	value, unit := float64(n)/(1<<10), 0
+	for value >= 1<<10 && unit < 3 {
+		value, unit = value/(1<<10), unit+1
+	}
+	return fmt.Sprintf("%.1f %s", value, []string{"KiB", "MiB", "GiB", "TiB"}[unit])
+}
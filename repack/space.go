@@ -0,0 +1,83 @@
+package repack
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// ErrNoSpace is returned before writing if the output won't fit into free space of its filesystem.
+var ErrNoSpace = errors.New("not enough free space")
+
+// localOutput is an archive written into files of a local dir, its free space can be checked.
+type localOutput interface {
+	outputDir() string
+}
+
+func (a *fileArchive) outputDir() string {
+	return filepath.Dir(a.filename)
+}
+
+func (s *splitArchive) outputDir() string {
+	return filepath.Dir(s.base)
+}
+
+// sourcesSize sums sizes of files records of books are packed from.
+func sourcesSize(books []book) (size int64, files int) {
+	for _, b := range books {
+		for _, record := range b.records {
+			for _, source := range record.sources() {
+				if source.zipped != nil {
+					size += int64(source.zipped.UncompressedSize64)
+				} else if info, err := os.Stat(source.path); err == nil {
+					size += info.Size()
+				}
+			}
+			files++
+		}
+	}
+	return size, files
+}
+
+// estimateSize is an upper bound of the archive size: audio is stored as is,
+// compression of other files only makes them smaller, headers are added to each entry.
+func estimateSize(books []book) int64 {
+	size, _ := sourcesSize(books)
+	for _, b := range books {
+		for _, record := range b.records {
+			size += headerOverhead(archiveEntry{name: record.name, source: record.path})
+		}
+	}
+	return size + volumeTrailer
+}
+
+// checkSpace fails with ErrNoSpace if the estimated archive doesn't fit into free space
+// of a local output, forceSpace turns the failure into a warning. Transcoded sizes can't be
+// estimated before ffmpeg is done, so they aren't checked.
+func (p *processor) checkSpace(archive archiveWriter, books []book) error {
+	output, ok := archive.(localOutput)
+	if !ok || p.transcoder != nil {
+		return nil
+	}
+
+	free, errFree := freeSpace(output.outputDir())
+	if errFree != nil {
+		slog.Debug("free space is unknown", "dir", output.outputDir(), "err", errFree)
+		return nil
+	}
+	// the temporary file of the archive already exists, but it's empty yet
+	need := estimateSize(books)
+	if need <= free {
+		slog.Debug("output fits", "estimate", formatSize(need), "free", formatSize(free))
+		return nil
+	}
+
+	if p.forceSpace {
+		slog.Warn("output may not fit into free space", "estimate", formatSize(need), "free", formatSize(free))
+		return nil
+	}
+	return fmt.Errorf("%w: output needs up to %s, %s has %s free, -force packs anyway",
+		ErrNoSpace, formatSize(need), output.outputDir(), formatSize(free))
+}
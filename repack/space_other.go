@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || freebsd)
+
+package repack
+
+import "errors"
+
+// freeSpace isn't known here, the check of free space is skipped.
+func freeSpace(string) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,14 @@
+//go:build linux || darwin || freebsd
+
+package repack
+
+import "syscall"
+
+// freeSpace is the number of bytes available to unprivileged users on the filesystem of dir.
+func freeSpace(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
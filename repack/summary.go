@@ -0,0 +1,98 @@
+package repack
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// SummaryName is the entry -summary-entry writes the summary of packed books into.
+const SummaryName = "README.txt"
+
+// maxZipComment is the longest comment the zip end record holds.
+const maxZipComment = 1<<16 - 1
+
+// commentWriter is an archive with a comment of its own, like zip.
+type commentWriter interface {
+	setComment(comment string) error
+}
+
+// bookTitle is the title of fetched metadata or the dir name.
+func bookTitle(b book) string {
+	if b.meta != nil && b.meta.Title != "" {
+		return b.meta.Title
+	}
+	return filepath.Base(filepath.Clean(b.dir))
+}
+
+// bookTitles are titles of books by dirs.
+func bookTitles(books []book) map[string]string {
+	titles := make(map[string]string, len(books))
+	for _, b := range books {
+		titles[b.dir] = bookTitle(b)
+	}
+	return titles
+}
+
+// summary lists packed books with file counts and durations, totals, the tool version and pack date.
+func (p *processor) summary(books []book) string {
+	titles := bookTitles(books)
+	content := &strings.Builder{}
+	for _, b := range p.report.Books {
+		fmt.Fprintf(content, "%s: %d files, %s\n", titles[b.Dir], len(b.Files), formatDuration(b.Duration))
+	}
+	fmt.Fprintf(content, "\n%d books, %d files, %s\n", len(p.report.Books), p.report.Files, formatDuration(p.report.Duration))
+	fmt.Fprintf(content, "packed by %s on %s\n", BuildInfo(), p.entryTime(nil).UTC().Format(time.DateOnly))
+	return content.String()
+}
+
+// writeProvenance sets the comment of archives which have one to the build of the tool which packed them.
+func writeProvenance(archive archiveWriter) error {
+	commented, ok := archive.(commentWriter)
+	if !ok {
+		return nil
+	}
+	err := commented.setComment("packed by " + BuildInfo() + "\n")
+	if errors.Is(err, errUnsupportedArchive) {
+		return nil
+	}
+	return err
+}
+
+// writeSummary sets the summary as the archive comment and adds it as SummaryName entry.
+// A comment too long for zip keeps the leading books and totals.
+func (p *processor) writeSummary(archive archiveWriter, books []book) error {
+	summary := p.summary(books)
+
+	if p.writeSummaryEntry {
+		wr, errCreate := archive.create(archiveEntry{
+			name:    SummaryName,
+			size:    int64(len(summary)),
+			modTime: p.entryTime(nil),
+		})
+		if errCreate != nil {
+			return errCreate
+		}
+		if _, err := io.WriteString(wr, summary); err != nil {
+			return err
+		}
+	}
+
+	if !p.summaryComment {
+		return nil
+	}
+	commented, ok := archive.(commentWriter)
+	if !ok {
+		return fmt.Errorf("%w: output has no comment", errUnsupportedArchive)
+	}
+	if len(summary) > maxZipComment {
+		books, totals, _ := strings.Cut(summary, "\n\n")
+		const more = "...\n\n"
+		books = books[:maxZipComment-len(totals)-len(more)]
+		summary = books[:strings.LastIndexByte(books, '\n')+1] + more + totals
+	}
+	return commented.setComment(summary)
+}
@@ -0,0 +1,32 @@
+package repack
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+// Policies for symbolic links found in book dirs, see Options.Symlinks.
+const (
+	SymlinkError  = "error"
+	SymlinkSkip   = "skip"
+	SymlinkFollow = "follow"
+)
+
+// SymlinkPolicies are valid values of Options.Symlinks.
+var SymlinkPolicies = []string{SymlinkError, SymlinkSkip, SymlinkFollow}
+
+var errSymlinkFound = errors.New("found symbolic link")
+
+// checkSymlink applies policy to the link at path, it reports whether the link is followed.
+// Files are opened without following links, so a link which isn't followed can't be packed.
+func checkSymlink(policy, path string) (bool, error) {
+	switch policy {
+	case SymlinkFollow:
+		return true, nil
+	case SymlinkSkip:
+		slog.Debug("skipped symlink", "file", path)
+		return false, nil
+	}
+	return false, fmt.Errorf("%w %q, -symlinks skip or follow handles links", errSymlinkFound, path)
+}
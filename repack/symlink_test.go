@@ -0,0 +1,83 @@
+package repack
+
+import (
+	"archive/zip"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// entryNames lists entries of a zip output.
+func entryNames(t *testing.T, output string) []string {
+	t.Helper()
+	zr, err := zip.OpenReader(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	var names []string
+	for _, file := range zr.File {
+		names = append(names, file.Name)
+	}
+	return names
+}
+
+func TestSymlinks(t *testing.T) {
+	root := t.TempDir()
+	book := filepath.Join(root, "Book")
+	writeFiles(t, book, map[string]string{"01.mp3": "one"})
+	writeFiles(t, root, map[string]string{"extras/scans.txt": "scan", "shared/02.mp3": "two"})
+
+	linkedDir := func(t *testing.T, target string) {
+		t.Helper()
+		link := filepath.Join(book, filepath.Base(target))
+		if err := os.Symlink(filepath.Join(root, target), link); err != nil {
+			t.Skip("symlinks aren't available:", err)
+		}
+		t.Cleanup(func() { _ = os.Remove(link) })
+	}
+
+	t.Run("dir without audio", func(t *testing.T) {
+		linkedDir(t, "extras")
+		output, err := pack(t, Options{Globs: []string{"**/*.mp3"}}, book)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if names := entryNames(t, output); !slices.Equal(names, []string{"Book_01.mp3"}) {
+			t.Errorf("entries are %q", names)
+		}
+	})
+
+	for _, tc := range []struct {
+		policy string
+		want   []string
+	}{
+		{SymlinkError, []string{"Book_01.mp3"}},
+		{SymlinkSkip, []string{"Book_01.mp3"}},
+		{SymlinkFollow, []string{"Book_01.mp3", "Book_shared_02.mp3"}},
+	} {
+		t.Run("dir with audio, "+tc.policy, func(t *testing.T) {
+			linkedDir(t, "shared")
+			output, err := pack(t, Options{Symlinks: tc.policy, Globs: []string{"**/*.mp3"}}, book)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if names := entryNames(t, output); !slices.Equal(names, tc.want) {
+				t.Errorf("entries are %q, want %q", names, tc.want)
+			}
+		})
+	}
+
+	t.Run("matched file", func(t *testing.T) {
+		link := filepath.Join(book, "03.mp3")
+		if err := os.Symlink(filepath.Join(root, "shared", "02.mp3"), link); err != nil {
+			t.Skip("symlinks aren't available:", err)
+		}
+		defer os.Remove(link)
+		if _, err := pack(t, Options{}, book); !errors.Is(err, errSymlinkFound) {
+			t.Errorf("packing a linked file failed with %v, want %v", err, errSymlinkFound)
+		}
+	})
+}
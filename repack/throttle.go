@@ -0,0 +1,91 @@
+package repack
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ParseRate parses a bandwidth like 20MB/s or 512KiB, the /s suffix is optional.
+func ParseRate(value string) (int64, error) {
+	trimmed := strings.TrimSpace(value)
+	trimmed = strings.TrimSuffix(strings.TrimSuffix(trimmed, "/s"), "ps")
+	rate, err := ParseSize(trimmed)
+	if err != nil || rate == 0 {
+		return 0, fmt.Errorf("bad rate %q", value)
+	}
+	return rate, nil
+}
+
+// rateLimiter spreads reads over time to keep their average rate under a limit.
+// It's shared by the writer and -j workers packing files ahead, so reads of all of them fit the rate.
+type rateLimiter struct {
+	// rate is in bytes per second
+	rate int64
+
+	mu    sync.Mutex
+	start time.Time
+	done  int64
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	return &rateLimiter{rate: rate, start: time.Now()}
+}
+
+// chunk is the largest read, a whole copy buffer at a low rate would come in bursts.
+func (l *rateLimiter) chunk() int {
+	return int(max(l.rate/8, 32<<10))
+}
+
+// wait accounts n read bytes and sleeps until they fit the rate.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	delay := l.account(n)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// account adds n read bytes and returns how long to sleep until they fit the rate.
+func (l *rateLimiter) account(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.done += int64(n)
+	due := l.start.Add(time.Duration(float64(l.done) / float64(l.rate) * float64(time.Second)))
+	now := time.Now()
+	if now.Sub(due) > time.Second {
+		// the limiter was idle between files, it must not let the next one through in a burst
+		l.start, l.done = now, 0
+		return 0
+	}
+	return due.Sub(now)
+}
+
+// throttledReader reads from src no faster than limiter allows.
+type throttledReader struct {
+	ctx     context.Context
+	src     io.Reader
+	limiter *rateLimiter
+}
+
+func (r throttledReader) Read(p []byte) (int, error) {
+	if len(p) > r.limiter.chunk() {
+		p = p[:r.limiter.chunk()]
+	}
+	n, err := r.src.Read(p)
+	if errWait := r.limiter.wait(r.ctx, n); errWait != nil {
+		return n, errWait
+	}
+	return n, err
+}
@@ -0,0 +1,166 @@
+package repack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+)
+
+// transcodeCodec is an ffmpeg encoder with its container.
+type transcodeCodec struct {
+	encoder, format, ext string
+	defaultBitrate       string
+}
+
+var transcodeCodecs = map[string]transcodeCodec{
+	"opus": {encoder: "libopus", format: "opus", ext: ".opus", defaultBitrate: "32k"},
+	"mp3":  {encoder: "libmp3lame", format: "mp3", ext: ".mp3", defaultBitrate: "64k"},
+	"aac":  {encoder: "aac", format: "ipod", ext: ".m4a", defaultBitrate: "64k"},
+}
+
+// sameCodecs re-encode files with their own codec and extension when only -normalize is set.
+var sameCodecs = map[string]string{
+	".mp3": "mp3", ".m4a": "aac", ".m4b": "aac", ".opus": "opus",
+}
+
+var errTranscode = errors.New("transcoding")
+
+// transcoder re-encodes audio files with ffmpeg into temporary files before packing.
+type transcoder struct {
+	ffmpeg string
+	// codec is used for all audio files, nil keeps codec of each file, see sameCodecs
+	codec   *transcodeCodec
+	bitrate string
+	// loudness is EBU R128 integrated loudness target in LUFS, 0 disables normalization
+	loudness float64
+}
+
+// parseTranscode parses CODEC[:BITRATE] value of -transcode, e.g. opus:32k.
+func parseTranscode(value string) (transcodeCodec, string, error) {
+	name, bitrate, _ := strings.Cut(value, ":")
+	codec, ok := transcodeCodecs[name]
+	if !ok {
+		return transcodeCodec{}, "", fmt.Errorf("unknown codec %q, want opus, mp3 or aac", name)
+	}
+	if bitrate == "" {
+		bitrate = codec.defaultBitrate
+	}
+	if _, err := ParseSize(bitrate); err != nil {
+		return transcodeCodec{}, "", fmt.Errorf("bad bitrate %q", bitrate)
+	}
+	return codec, bitrate, nil
+}
+
+// codecFor returns codec and bitrate source is encoded with, false if it's packed as is.
+func (t *transcoder) codecFor(source string) (transcodeCodec, string, bool) {
+	if t.codec != nil {
+		return *t.codec, t.bitrate, true
+	}
+	ext := strings.ToLower(path.Ext(source))
+	name, ok := sameCodecs[ext]
+	codec := transcodeCodecs[name]
+	codec.ext = ext
+	return codec, codec.defaultBitrate, ok
+}
+
+// rename replaces audio extension of entry name with the one of the codec source is encoded with.
+func (t *transcoder) rename(name, source string) string {
+	codec, _, ok := t.codecFor(source)
+	if !ok {
+		return name
+	}
+	return strings.TrimSuffix(name, path.Ext(name)) + codec.ext
+}
+
+// transcode encodes source into a temporary file, the caller removes it.
+// Tags are kept, cover pictures are dropped.
+func (t *transcoder) transcode(ctx context.Context, source string) (*os.File, error) {
+	codec, bitrate, _ := t.codecFor(source)
+
+	args := []string{
+		"-hide_banner", "-loglevel", "error", "-nostdin", "-y",
+		"-i", source,
+		"-vn", "-map_metadata", "0",
+	}
+	if t.loudness != 0 {
+		filter, errMeasure := t.loudnorm(ctx, source)
+		if errMeasure != nil {
+			return nil, fmt.Errorf("%w %q: measuring loudness: %w", errTranscode, source, errMeasure)
+		}
+		args = append(args, "-af", filter)
+	}
+
+	tmp, errTmp := os.CreateTemp("", "audiobook-repack-*"+codec.ext)
+	if errTmp != nil {
+		return nil, errTmp
+	}
+	_ = tmp.Close()
+
+	args = append(args,
+		"-c:a", codec.encoder, "-b:a", bitrate,
+		"-f", codec.format, tmp.Name(),
+	)
+	cmd := exec.CommandContext(ctx, t.ffmpeg, args...)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return nil, fmt.Errorf("%w %q: %w", errTranscode, source, err)
+	}
+
+	encoded, errOpen := os.Open(tmp.Name())
+	if errOpen != nil {
+		_ = os.Remove(tmp.Name())
+		return nil, errOpen
+	}
+	return encoded, nil
+}
+
+// transcodedInfo is stat of encoded file with modification time of its source.
+type transcodedInfo struct {
+	fs.FileInfo
+	modTime time.Time
+}
+
+func (info transcodedInfo) ModTime() time.Time {
+	return info.modTime
+}
+
+// transcodeRecord replaces source file of audio record with its encoded version,
+// see closeSource. The source file is closed in any case if it's replaced.
+func (p *processor) transcodeRecord(ctx context.Context, record fileRecord, file *os.File, info fs.FileInfo) (*os.File, fs.FileInfo, error) {
+	if p.transcoder == nil || !isAudio(record.path) {
+		return file, info, nil
+	}
+	if _, _, ok := p.transcoder.codecFor(record.path); !ok {
+		slog.Warn("packing as is, it can be normalized only with -transcode", "file", record.path)
+		return file, info, nil
+	}
+	_ = file.Close()
+
+	encoded, errEncode := p.transcoder.transcode(ctx, record.path)
+	if errEncode != nil {
+		return nil, nil, errEncode
+	}
+	encodedInfo, errStat := encoded.Stat()
+	if errStat != nil {
+		closeSource(record, encoded)
+		return nil, nil, errStat
+	}
+
+	return encoded, transcodedInfo{FileInfo: encodedInfo, modTime: info.ModTime()}, nil
+}
+
+// closeSource closes file opened for record, removing it if it's a transcoded copy.
+func closeSource(record fileRecord, file *os.File) {
+	_ = file.Close()
+	if file.Name() != record.path {
+		_ = os.Remove(file.Name())
+	}
+}
@@ -0,0 +1,60 @@
+package repack
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// NormalizationForms are valid values of Options.NormalizeNames.
+var NormalizationForms = []string{"nfc", "nfd", "nfkc", "nfkd"}
+
+var normForms = map[string]norm.Form{
+	"nfc":  norm.NFC,
+	"nfd":  norm.NFD,
+	"nfkc": norm.NFKC,
+	"nfkd": norm.NFKD,
+}
+
+// cyrillicLatin romanizes Russian, Ukrainian and Belarusian letters in the common
+// passport style, capital letters are capitalized romanizations.
+var cyrillicLatin = map[rune]string{
+	'а': "a", 'б': "b", 'в': "v", 'г': "g", 'д': "d", 'е': "e", 'ё': "yo", 'ж': "zh",
+	'з': "z", 'и': "i", 'й': "y", 'к': "k", 'л': "l", 'м': "m", 'н': "n", 'о': "o",
+	'п': "p", 'р': "r", 'с': "s", 'т': "t", 'у': "u", 'ф': "f", 'х': "kh", 'ц': "ts",
+	'ч': "ch", 'ш': "sh", 'щ': "shch", 'ъ': "", 'ы': "y", 'ь': "", 'э': "e", 'ю': "yu",
+	'я': "ya", 'є': "ye", 'і': "i", 'ї': "yi", 'ґ': "g", 'ў': "u",
+}
+
+// latinLetters are letters which don't decompose into a base letter and diacritics.
+var latinLetters = strings.NewReplacer(
+	"ß", "ss", "æ", "ae", "Æ", "AE", "œ", "oe", "Œ", "OE", "ø", "o", "Ø", "O",
+	"ł", "l", "Ł", "L", "đ", "d", "Đ", "D", "ð", "d", "Ð", "D", "þ", "th", "Þ", "Th", "ı", "i",
+)
+
+// transliterate romanizes Cyrillic letters and strips diacritics from Latin ones,
+// other scripts are kept.
+func transliterate(name string) string {
+	romanized := &strings.Builder{}
+	for _, r := range norm.NFC.String(name) {
+		latin, ok := cyrillicLatin[unicode.ToLower(r)]
+		switch {
+		case !ok:
+			romanized.WriteRune(r)
+		case unicode.IsUpper(r) && latin != "":
+			romanized.WriteString(strings.ToUpper(latin[:1]) + latin[1:])
+		default:
+			romanized.WriteString(latin)
+		}
+	}
+
+	stripMarks := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	stripped, _, err := transform.String(stripMarks, romanized.String())
+	if err != nil {
+		return latinLetters.Replace(romanized.String())
+	}
+	return latinLetters.Replace(stripped)
+}
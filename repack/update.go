@@ -0,0 +1,183 @@
+package repack
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+)
+
+const (
+	UpdateByMTime = "mtime"
+	UpdateByHash  = "hash"
+)
+
+var errUpdate = errors.New("can't update archive")
+
+// previousArchive is the archive being updated, its unchanged entries
+// are copied into the new one without recompression.
+type previousArchive struct {
+	zr      *zip.ReadCloser
+	entries map[string]*zip.File
+	// sums are checksums from the previous manifest, if there was one
+	sums map[string][]byte
+	// by is UpdateByMTime or UpdateByHash
+	by string
+
+	reused, written int
+}
+
+// openPreviousArchive opens filename for -update, nil means there is nothing to update yet.
+func openPreviousArchive(filename, by string) (*previousArchive, error) {
+	zr, errOpen := zip.OpenReader(filename)
+	if errors.Is(errOpen, fs.ErrNotExist) {
+		slog.Info("previous archive doesn't exist, packing everything", "output", filename)
+		return nil, nil
+	}
+	if errOpen != nil {
+		return nil, fmt.Errorf("%w: %w", errUpdate, errOpen)
+	}
+	registerDecompressors(&zr.Reader)
+
+	prev := &previousArchive{zr: zr, entries: map[string]*zip.File{}, sums: map[string][]byte{}, by: by}
+	for _, file := range zr.File {
+		prev.entries[file.Name] = file
+	}
+
+	if manifest, ok := prev.entries[ManifestName]; ok {
+		content, errContent := manifest.Open()
+		if errContent != nil {
+			_ = zr.Close()
+			return nil, fmt.Errorf("%w: reading manifest: %w", errUpdate, errContent)
+		}
+		sums, errParse := parseManifest(content)
+		_ = content.Close()
+		if errParse != nil {
+			slog.Warn("ignoring previous manifest", "err", errParse)
+		} else {
+			prev.sums = sums
+		}
+	}
+
+	return prev, nil
+}
+
+func (prev *previousArchive) Close() error {
+	slog.Info("updated archive", "unchanged", prev.reused, "written", prev.written)
+	return prev.zr.Close()
+}
+
+// unchanged returns the previous entry of record if it holds the same data as file
+// with optionally rewritten tag. File offset is restored if it had to be read.
+func (prev *previousArchive) unchanged(record fileRecord, file *os.File, size int64, retag *retagged, modTime int64) (*zip.File, error) {
+	old, ok := prev.entries[record.name]
+	if !ok || old.Comment != record.path || int64(old.UncompressedSize64) != size {
+		return nil, nil
+	}
+
+	if prev.by == UpdateByMTime {
+		if old.Modified.Unix() != modTime {
+			return nil, nil
+		}
+		return old, nil
+	}
+
+	offset, errOffset := file.Seek(0, io.SeekCurrent)
+	if errOffset != nil {
+		return nil, errOffset
+	}
+	content := io.Reader(file)
+	if retag != nil {
+		content = io.MultiReader(bytes.NewReader(retag.tag), file)
+	}
+	got, errDigest := digest(content, false)
+	if err := rewind(file, offset); err != nil {
+		return nil, err
+	}
+	if errDigest != nil {
+		return nil, fmt.Errorf("reading %q: %w", file.Name(), errDigest)
+	}
+	if got.crc != old.CRC32 {
+		return nil, nil
+	}
+	return old, nil
+}
+
+// sum returns SHA-256 of the previous entry for the new manifest.
+func (prev *previousArchive) sum(old *zip.File) ([]byte, error) {
+	if sum, ok := prev.sums[old.Name]; ok {
+		return sum, nil
+	}
+
+	content, errOpen := old.Open()
+	if errOpen != nil {
+		return nil, errOpen
+	}
+	defer content.Close()
+
+	sum := sha256.New()
+	if _, err := io.Copy(sum, content); err != nil {
+		return nil, err
+	}
+	return sum.Sum(nil), nil
+}
+
+// rawCopier is implemented by archives which can take entries of another zip as is.
+type rawCopier interface {
+	copyRaw(file *zip.File) error
+}
+
+func (z *zipArchive) copyRaw(file *zip.File) error {
+	if err := z.zw.Copy(file); err != nil {
+		return fmt.Errorf("copying zip file record: %w", err)
+	}
+	// copy finishes the previous entry, so its CRC is final now
+	if err := z.verifyLastCRC(); err != nil {
+		return err
+	}
+	return z.finishLast(nil)
+}
+
+func (a *fileArchive) copyRaw(file *zip.File) error {
+	copier, ok := a.archiveWriter.(rawCopier)
+	if !ok {
+		return fmt.Errorf("%w: raw copy is available for zip only", errUnsupportedArchive)
+	}
+	return copier.copyRaw(file)
+}
+
+// reuseRecord copies the previous entry of record if the source file is unchanged.
+// It reports false if the record has to be written anew.
+func (p *processor) reuseRecord(archive archiveWriter, record fileRecord, file *os.File, info fs.FileInfo, retag *retagged) (bool, error) {
+	copier, ok := archive.(rawCopier)
+	if p.previous == nil || !ok {
+		return false, nil
+	}
+
+	old, errOld := p.previous.unchanged(record, file, retag.size(info), retag, p.entryTime(info).Unix())
+	if errOld != nil || old == nil {
+		p.previous.written++
+		return false, errOld
+	}
+
+	if p.hashFiles {
+		sum, errSum := p.previous.sum(old)
+		if errSum != nil {
+			return false, fmt.Errorf("checksum of previous entry %q: %w", old.Name, errSum)
+		}
+		p.manifest = append(p.manifest, manifestLine{sum: sum, name: record.name, source: record.path})
+	}
+
+	if err := copier.copyRaw(old); err != nil {
+		return false, err
+	}
+
+	slog.Debug("unchanged", "file", record.path)
+	p.previous.reused++
+	return true, nil
+}
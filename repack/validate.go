@@ -0,0 +1,159 @@
+package repack
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	ValidateWarn = "warn"
+	ValidateSkip = "skip"
+	ValidateFail = "fail"
+)
+
+var errCorruptAudio = errors.New("corrupt audio")
+
+// trailingTags are tags which may follow the last MPEG frame: ID3v1, APEv2 and Lyrics3.
+var trailingTags = [][]byte{[]byte("TAG"), []byte("APETAGEX"), []byte("LYRICS")}
+
+// validateAudio checks that audio file is complete and its headers are intact.
+// Formats other than MP3 and MP4 are not checked. File offset is restored to 0.
+func validateAudio(file *os.File, size int64) error {
+	var err error
+	switch strings.ToLower(filepath.Ext(file.Name())) {
+	case ".mp3":
+		err = validateMP3(bufio.NewReaderSize(file, 64*1024), size)
+	case ".m4a", ".m4b", ".mp4":
+		err = validateMP4(file, size)
+	}
+	if err != nil {
+		err = fmt.Errorf("%w: %q: %w", errCorruptAudio, file.Name(), err)
+	}
+	return errors.Join(err, rewind(file, 0))
+}
+
+// validateMP3 walks MPEG frames looking for garbage between them and a cut off end.
+// Junk before the first frame is tolerated, encoders and taggers leave it often.
+func validateMP3(re *bufio.Reader, size int64) error {
+	offset := int64(0)
+	head, _ := re.Peek(10)
+	if tagSize := int64(id3v2Size(head)); tagSize > 0 {
+		if tagSize > size {
+			return fmt.Errorf("ID3v2 tag of %d bytes is longer than the file", tagSize)
+		}
+		if _, err := re.Discard(int(tagSize)); err != nil {
+			return err
+		}
+		offset = tagSize
+	}
+
+	frames, expected := 0, 0
+	for offset < size {
+		header, errPeek := re.Peek(4)
+		if errPeek != nil && !errors.Is(errPeek, io.EOF) {
+			return errPeek
+		}
+
+		frame, ok := parseMP3Frame(header)
+		if !ok {
+			if frames > 0 {
+				if tail, _ := re.Peek(8); hasTrailingTag(tail) {
+					break
+				}
+				return fmt.Errorf("broken frame header at offset %d after %d frames", offset, frames)
+			}
+			if _, err := re.Discard(1); err != nil {
+				return err
+			}
+			offset++
+			continue
+		}
+
+		if frames == 0 {
+			expected, _ = vbrFrameCount(re, frame)
+		}
+		if offset+int64(frame.size()) > size {
+			return fmt.Errorf("truncated: frame at offset %d needs %d bytes, %d left", offset, frame.size(), size-offset)
+		}
+		if _, err := re.Discard(frame.size()); err != nil {
+			return err
+		}
+		offset += int64(frame.size())
+		frames++
+	}
+
+	if frames == 0 {
+		return errNotMP3
+	}
+	// Xing/Info frame counts either itself or not, depending on encoder
+	if expected > frames {
+		return fmt.Errorf("truncated: header promises %d frames, file has %d", expected, frames)
+	}
+	return nil
+}
+
+func hasTrailingTag(data []byte) bool {
+	for _, tag := range trailingTags {
+		if bytes.HasPrefix(data, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateMP4 checks that top level boxes cover the file exactly,
+// and movie header and media data are present.
+func validateMP4(file io.ReaderAt, size int64) error {
+	boxes := map[string]mp4Box{}
+	errWalk := walkMP4Boxes(file, 0, size, func(boxType string, box mp4Box) bool {
+		boxes[boxType] = box
+		return true
+	})
+	if errWalk != nil {
+		return errWalk
+	}
+	for _, required := range []string{"moov", "mdat"} {
+		if _, ok := boxes[required]; !ok {
+			return fmt.Errorf("%w: no %q box", errNotMP4, required)
+		}
+	}
+
+	mvhd, errMvhd := findMP4Box(file, boxes["moov"].start, boxes["moov"].end, "mvhd")
+	if errMvhd != nil {
+		return errMvhd
+	}
+	_, errMVHD := readMVHD(io.NewSectionReader(file, mvhd.start, mvhd.end-mvhd.start))
+	return errMVHD
+}
+
+// validateRecord checks audio of record according to -validate-audio mode.
+// It reports false if the file must be left out of archive.
+func (p *processor) validateRecord(record fileRecord, file *os.File, size int64) (bool, error) {
+	if p.validateAudio == "" || !isAudio(record.path) {
+		return true, nil
+	}
+
+	err := validateAudio(file, size)
+	switch {
+	case err == nil:
+		return true, nil
+	case !errors.Is(err, errCorruptAudio):
+		return false, err
+	case p.validateAudio == ValidateWarn:
+		slog.Warn("packing anyway", "err", err)
+		p.report.Invalid = append(p.report.Invalid, record.path)
+		return true, nil
+	case p.validateAudio == ValidateSkip:
+		p.skip(record.path, false, err)
+		return false, nil
+	default:
+		return false, err
+	}
+}
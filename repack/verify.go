@@ -0,0 +1,337 @@
+package repack
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrVerifyFailed = errors.New("verification failed")
+
+// Entry is a file stored in an archive.
+type Entry struct {
+	Name     string
+	Size     int64
+	Modified time.Time
+	// Source is the original file path, empty for generated entries and foreign archives
+	Source string
+	// Method, CompressedSize and CRC32 are known for zip entries only.
+	// Method is store, deflate, zstd or a method number, +aes is appended for encrypted entries.
+	Method         string
+	CompressedSize int64
+	CRC32          uint32
+	// Duration is play time of audio entries listed with durations, 0 if it's unknown
+	Duration time.Duration
+}
+
+// ListArchive calls fn for each entry of a zip, tar or tar.gz archive in order.
+// With durations audio entries are read to find their play time, password decrypts encrypted ones.
+func ListArchive(filename string, durations bool, password []byte, fn func(entry Entry) error) error {
+	return readArchive(filename, password, func(entry archiveEntry, content io.Reader) error {
+		listed := Entry{Name: entry.name, Size: entry.size, Modified: entry.modTime, Source: entry.source}
+		if entry.raw != nil {
+			listed.Method = methodName(*entry.raw)
+			listed.CompressedSize = int64(entry.raw.compressedSize)
+			listed.CRC32 = entry.raw.crc32
+		}
+		if durations && isAudio(entry.name) {
+			d, err := readDuration(entry.name, content, entry.size)
+			if err != nil {
+				slog.Warn("unknown duration", "entry", entry.name, "err", err)
+			}
+			listed.Duration = d
+		}
+		return fn(listed)
+	})
+}
+
+// methodName names the compression method of zip entry data.
+func methodName(raw rawData) string {
+	const encrypted = 0x1
+	name := strconv.Itoa(int(raw.method))
+	switch raw.method {
+	case zip.Store:
+		name = "store"
+	case zip.Deflate:
+		name = "deflate"
+	case zipZstd:
+		name = "zstd"
+	}
+	if raw.flags&encrypted != 0 {
+		name += "+aes"
+	}
+	return name
+}
+
+// IsEncrypted reports whether a zip archive has AES encrypted entries, which need a password to be read.
+func IsEncrypted(filename string) (bool, error) {
+	if archiveFormatOf(filename) != FormatZip {
+		return false, nil
+	}
+	zr, errOpen := zip.OpenReader(filename)
+	if errOpen != nil {
+		return false, errOpen
+	}
+	defer zr.Close()
+	for _, file := range zr.File {
+		if file.Method == zipAES {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// VerifyArchive reads every entry to the end, zip reader checks CRC and size on the way.
+// If archive has a manifest, entries are checked against its checksums too.
+// Password decrypts encrypted entries, without it they fail the check.
+func VerifyArchive(filename string, password []byte) error {
+	entries, failed := 0, 0
+	sums := map[string][]byte{}
+	manifest := map[string][]byte(nil)
+
+	fail := func(name string, err error) {
+		failed++
+		slog.Error("FAIL", "entry", name, "err", err)
+	}
+
+	err := readArchive(filename, password, func(entry archiveEntry, content io.Reader) error {
+		if entry.name == ManifestName {
+			parsed, errManifest := parseManifest(content)
+			if errManifest != nil {
+				fail(entry.name, errManifest)
+				return nil
+			}
+			manifest = parsed
+			return nil
+		}
+
+		entries++
+		sum := sha256.New()
+		n, errRead := io.Copy(sum, content)
+		if errRead == nil && n != entry.size {
+			errRead = fmt.Errorf("read %d bytes, header says %d", n, entry.size)
+		}
+		if errRead != nil {
+			fail(entry.name, errRead)
+			return nil
+		}
+		sums[entry.name] = sum.Sum(nil)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for name, want := range manifest {
+		got, ok := sums[name]
+		switch {
+		case !ok:
+			fail(name, errors.New("listed in manifest, but missing in archive"))
+		case !bytes.Equal(got, want):
+			fail(name, fmt.Errorf("sha256 is %x, manifest says %x", got, want))
+		}
+	}
+
+	slog.Info("checked archive", "entries", entries, "failed", failed)
+	if failed > 0 {
+		return fmt.Errorf("%w: %d problems in %d entries", ErrVerifyFailed, failed, entries)
+	}
+
+	return nil
+}
+
+// fileDigest is a summary of content used to compare entries with source files.
+type fileDigest struct {
+	size int64
+	crc  uint32
+	sum  []byte
+}
+
+func digest(re io.Reader, withHash bool) (fileDigest, error) {
+	crc := crc32.NewIEEE()
+	var dst io.Writer = crc
+	sum := sha256.New()
+	if withHash {
+		dst = io.MultiWriter(crc, sum)
+	}
+
+	n, err := io.Copy(dst, re)
+	if err != nil {
+		return fileDigest{}, err
+	}
+
+	d := fileDigest{size: n, crc: crc.Sum32()}
+	if withHash {
+		d.sum = sum.Sum(nil)
+	}
+	return d, nil
+}
+
+func digestFile(filename string, withHash, skipTags bool) (fileDigest, error) {
+	file, _, errOpen := openSourceFile(filename)
+	if errOpen != nil {
+		// entries packed from input zips have sources like book.zip/01.mp3
+		zipped, ok, errZipped := openZippedSource(filename)
+		if !ok {
+			return fileDigest{}, errOpen
+		}
+		if errZipped != nil {
+			return fileDigest{}, errZipped
+		}
+		defer zipped.Close()
+		return digestContent(zipped, filename, withHash, skipTags)
+	}
+	defer file.Close()
+
+	return digestContent(file, filename, withHash, skipTags)
+}
+
+// digestContent digests content of filename, skipping ID3v2 tags of MP3 files with skipTags.
+func digestContent(content io.Reader, filename string, withHash, skipTags bool) (fileDigest, error) {
+	if skipTags && isMP3(filename) {
+		content = skipID3v2(content)
+	}
+	return digest(content, withHash)
+}
+
+// VerifySources re-reads every entry which has a source path and compares
+// its size, CRC and optionally SHA-256 with the source file.
+// With skipTags MP3 files are compared past their ID3v2 tags.
+// Encrypted archives have no source paths, their entries aren't compared.
+func VerifySources(filename string, withHash, skipTags bool, password []byte) error {
+	return verifySources(filename, withHash, skipTags, password, nil)
+}
+
+// verifySources is VerifySources with sources of entries by name, for archives which don't record them.
+func verifySources(filename string, withHash, skipTags bool, password []byte, sources map[string]string) error {
+	entries, failed := 0, 0
+	fail := func(name string, err error) {
+		failed++
+		slog.Error("FAIL", "entry", name, "err", err)
+	}
+
+	err := readArchive(filename, password, func(entry archiveEntry, content io.Reader) error {
+		if entry.source == "" {
+			entry.source = sources[entry.name]
+		}
+		if entry.source == "" {
+			return nil
+		}
+		entries++
+
+		if skipTags && isMP3(entry.source) {
+			content = skipID3v2(content)
+		}
+		got, errEntry := digest(content, withHash)
+		if errEntry != nil {
+			fail(entry.name, errEntry)
+			return nil
+		}
+
+		want, errSource := digestFile(entry.source, withHash, skipTags)
+		switch {
+		case errSource != nil:
+			fail(entry.name, errSource)
+		case got.size != want.size:
+			fail(entry.name, fmt.Errorf("size is %d, source %q has %d", got.size, entry.source, want.size))
+		case got.crc != want.crc:
+			fail(entry.name, fmt.Errorf("crc is %08x, source %q has %08x", got.crc, entry.source, want.crc))
+		case !bytes.Equal(got.sum, want.sum):
+			fail(entry.name, fmt.Errorf("sha256 is %x, source %q has %x", got.sum, entry.source, want.sum))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	slog.Info("compared with sources", "entries", entries, "failed", failed)
+	if failed > 0 {
+		return fmt.Errorf("%w: %d of %d entries differ from sources", ErrVerifyFailed, failed, entries)
+	}
+
+	return nil
+}
+
+var errUnsafeName = errors.New("unsafe entry name")
+
+// ExtractArchive unpacks entries into dir. Existing files are never overwritten.
+// With byBook flattened entries are unpacked into book dirs by their source paths, see bookPath,
+// otherwise entry names are kept.
+func ExtractArchive(filename, dir string, byBook bool, password []byte) error {
+	return readArchive(filename, password, func(entry archiveEntry, content io.Reader) error {
+		name := entry.name
+		if byBook {
+			name = bookPath(entry.name, entry.source)
+		}
+		name = filepath.FromSlash(name)
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("%w: %q", errUnsafeName, entry.name)
+		}
+
+		target := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return fmt.Errorf("creating dir for %q: %w", entry.name, err)
+		}
+
+		return writeNewFile(target, content)
+	})
+}
+
+// bookPath reverses flattening of an entry name by the source path stored in the archive:
+// Book_sub_01.mp3 packed from /books/Book/sub/01.mp3 becomes Book/sub/01.mp3.
+// Renamed entries go into the dir of their source without the dir prefix.
+// Entries without a source and names with dirs, like ones packed with -keep-dirs, are kept.
+func bookPath(name, source string) string {
+	if source == "" || strings.Contains(name, "/") {
+		return name
+	}
+
+	elems := strings.Split(filepath.ToSlash(filepath.Clean(source)), "/")
+	if len(elems) < 2 {
+		return name
+	}
+	// books packed from zips are prefixed with the zip name without extension
+	dirName := func(elem string) string {
+		if strings.EqualFold(path.Ext(elem), ".zip") {
+			return strings.TrimSuffix(elem, path.Ext(elem))
+		}
+		return elem
+	}
+
+	for i := len(elems) - 2; i >= 0; i-- {
+		dir, rel := dirName(elems[i]), elems[i+1:]
+		if dir+"_"+strings.Join(rel, "_") == name {
+			return path.Join(dir, path.Join(rel...))
+		}
+	}
+
+	dir := dirName(elems[len(elems)-2])
+	return path.Join(dir, strings.TrimPrefix(name, dir+"_"))
+}
+
+func writeNewFile(filename string, content io.Reader) error {
+	file, errFile := openNoFollow(filename, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if errFile != nil {
+		return fmt.Errorf("creating file: %w", errFile)
+	}
+
+	_, errCopy := io.Copy(file, content)
+	errClose := file.Close()
+	if err := errors.Join(errCopy, errClose); err != nil {
+		return fmt.Errorf("writing file %q: %w", filename, err)
+	}
+
+	return nil
+}
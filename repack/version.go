@@ -0,0 +1,66 @@
+package repack
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// Version, Commit and BuildDate describe the build when they are set with
+//
+//	go build -ldflags "-X github.com/ninedraft/audiobook-repack/repack.Version=v1.2.3 -X ...Commit=... -X ...BuildDate=..."
+//
+// Empty ones are taken from the module version and VCS stamps Go embeds into binaries.
+var (
+	Version   string
+	Commit    string
+	BuildDate string
+)
+
+// ToolVersion is Version or the module version the binary is built from, (devel) for local builds.
+func ToolVersion() string {
+	if Version != "" {
+		return Version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "(devel)"
+}
+
+// BuildInfo is the tool name with its version, commit, build or commit date and Go version,
+// unknown parts are left out.
+func BuildInfo() string {
+	commit, date := Commit, "built "+BuildDate
+	if BuildDate == "" {
+		date = ""
+	}
+	dirty := false
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && commit == "":
+				commit = setting.Value
+			case setting.Key == "vcs.time" && date == "":
+				date = "committed " + setting.Value
+			case setting.Key == "vcs.modified":
+				dirty = setting.Value == "true"
+			}
+		}
+	}
+	details := []string{}
+	if commit != "" {
+		const shortCommit = 12
+		commit = commit[:min(len(commit), shortCommit)]
+		if dirty && Commit == "" {
+			commit += "-dirty"
+		}
+		details = append(details, "commit "+commit)
+	}
+	if date != "" {
+		details = append(details, date)
+	}
+	details = append(details, runtime.Version())
+	return fmt.Sprintf("audiobook-repack %s (%s)", ToolVersion(), strings.Join(details, ", "))
+}
@@ -0,0 +1,146 @@
+package repack
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// webdavUpload streams an archive into TARGET.tmp with a single PUT and moves it
+// into place on commit. A streamed body can't be sent again, so only MOVE and DELETE are retried.
+// Credentials are taken from the URL or WEBDAV_USER and WEBDAV_PASSWORD.
+type webdavUpload struct {
+	client      *http.Client
+	target, tmp string
+	user, pass  string
+
+	body *io.PipeWriter
+	// done receives the result of PUT, which is kept in errPut
+	done   chan error
+	errPut error
+}
+
+var errUploadAborted = errors.New("upload aborted")
+
+// newWebDAVUpload starts uploading to webdav://HOST/PATH over HTTPS, webdav+http:// uses plain HTTP.
+func newWebDAVUpload(target *url.URL) (*webdavUpload, error) {
+	if target.Host == "" || strings.TrimPrefix(target.Path, "/") == "" {
+		return nil, fmt.Errorf("%w: want webdav://HOST/PATH, got %q", errRemoteOutput, target.Redacted())
+	}
+
+	upload := &webdavUpload{
+		client: http.DefaultClient,
+		user:   os.Getenv("WEBDAV_USER"),
+		pass:   os.Getenv("WEBDAV_PASSWORD"),
+		done:   make(chan error, 1),
+	}
+	if target.User != nil {
+		upload.user = target.User.Username()
+		upload.pass, _ = target.User.Password()
+	}
+
+	location := *target
+	location.User = nil
+	location.Scheme = "https"
+	if strings.EqualFold(target.Scheme, schemeWebDAVHTTP) {
+		location.Scheme = "http"
+	}
+	upload.target = location.String()
+	location.Path += tmpSuffix
+	upload.tmp = location.String()
+
+	body, pipe := io.Pipe()
+	upload.body = pipe
+	req, errReq := upload.request(http.MethodPut, upload.tmp, body)
+	if errReq != nil {
+		return nil, errReq
+	}
+	go func() {
+		err := upload.send(req)
+		// writes fail right away once the server gave up
+		if err != nil {
+			_ = body.CloseWithError(err)
+		} else {
+			_ = body.CloseWithError(errUploadAborted)
+		}
+		upload.done <- err
+	}()
+	return upload, nil
+}
+
+// wait returns the result of PUT once the server responded.
+func (u *webdavUpload) wait() error {
+	if u.done != nil {
+		u.errPut = <-u.done
+		u.done = nil
+	}
+	return u.errPut
+}
+
+func (u *webdavUpload) request(method, target string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errRemoteOutput, err)
+	}
+	if u.user != "" {
+		req.SetBasicAuth(u.user, u.pass)
+	}
+	return req, nil
+}
+
+func (u *webdavUpload) send(req *http.Request) error {
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return err
+	}
+	return checkStatus(resp)
+}
+
+func (u *webdavUpload) Write(p []byte) (int, error) {
+	return u.body.Write(p)
+}
+
+// commit finishes PUT of the temporary file and moves it over the target.
+func (u *webdavUpload) commit() error {
+	_ = u.body.Close()
+	if err := u.wait(); err != nil {
+		return err
+	}
+
+	return retry("move uploaded output", func() error {
+		req, err := u.request("MOVE", u.tmp, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Destination", u.target)
+		req.Header.Set("Overwrite", "T")
+		return u.send(req)
+	})
+}
+
+// abort stops PUT and deletes whatever the server kept of the temporary file.
+func (u *webdavUpload) abort() {
+	_ = u.body.CloseWithError(errUploadAborted)
+	_ = u.wait()
+
+	err := retry("delete incomplete output", func() error {
+		req, err := u.request(http.MethodDelete, u.tmp, nil)
+		if err != nil {
+			return err
+		}
+		errSend := u.send(req)
+		var status *statusError
+		if errors.As(errSend, &status) && status.status == http.StatusNotFound {
+			return nil
+		}
+		return errSend
+	})
+	if err != nil {
+		slog.Error("deleting incomplete upload", "output", redactURL(u.tmp), "err", err)
+	}
+}
@@ -0,0 +1,211 @@
+package repack
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var errZipInput = errors.New("unsupported zip input")
+
+// isZipInput reports whether a book "dir" is a zip file, its entries are packed like files of a dir.
+func isZipInput(dir string) bool {
+	if !strings.EqualFold(filepath.Ext(dir), ".zip") {
+		return false
+	}
+	info, err := os.Stat(dir)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// zipRecords searches entries of the zip file like searchRecords searches a dir.
+// The zip stays open until closeInputs.
+func (p *processor) zipRecords(filename string, fileGlobs []string) ([]fileRecord, error) {
+	zr, errOpen := zip.OpenReader(filename)
+	if errOpen != nil {
+		return nil, fmt.Errorf("opening zip: %w", errOpen)
+	}
+	registerDecompressors(&zr.Reader)
+
+	p.inputsMu.Lock()
+	p.inputs = append(p.inputs, zr)
+	p.inputsMu.Unlock()
+
+	found, errSearch := p.searchRecords(filename, &zr.Reader, fileGlobs)
+	if errSearch != nil {
+		return nil, errSearch
+	}
+
+	byName := make(map[string]*zip.File, len(zr.File))
+	for _, file := range zr.File {
+		byName[file.Name] = file
+	}
+	records := found[:0]
+	for _, record := range found {
+		record.zipped = byName[record.rel]
+		if record.zipped == nil {
+			// fs.FS of zip cleans names like "./a.mp3" or "a//b.mp3"
+			return nil, fmt.Errorf("entry %q has a non canonical name", record.rel)
+		}
+		if p.mergeArchives && record.rel == ManifestName {
+			// checksums of the input don't match the merged archive
+			continue
+		}
+		if p.mergeArchives && p.writeSummaryEntry && record.rel == SummaryName {
+			// the merged archive gets a summary of all books
+			continue
+		}
+		if p.mergeArchives && !p.prefixMerged {
+			record.name = record.rel
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// dropDuplicates leaves out entries of merged zips equal to an earlier one by name, size and CRC.
+func dropDuplicates(books []book) {
+	type entryKey struct {
+		name string
+		size uint64
+		crc  uint32
+	}
+
+	seen := map[entryKey]bool{}
+	for i := range books {
+		kept := books[i].records[:0]
+		for _, record := range books[i].records {
+			if record.zipped == nil {
+				kept = append(kept, record)
+				continue
+			}
+			key := entryKey{name: record.name, size: record.zipped.UncompressedSize64, crc: record.zipped.CRC32}
+			if seen[key] {
+				slog.Info("dropping duplicate entry", "name", record.name, "source", record.path)
+				continue
+			}
+			seen[key] = true
+			kept = append(kept, record)
+		}
+		books[i].records = kept
+	}
+}
+
+// closeInputs closes zip files opened as book dirs.
+func (p *processor) closeInputs() {
+	for _, zr := range p.inputs {
+		_ = zr.Close()
+	}
+	p.inputs = nil
+}
+
+// writeZipped copies an entry of an input zip. Zip outputs take compressed data as is
+// if the entry is compressed the way the output would compress it, otherwise it's decompressed.
+func (p *processor) writeZipped(ctx context.Context, archive archiveWriter, record fileRecord) error {
+	file := record.zipped
+	entry := archiveEntry{
+		name:    record.name,
+		source:  record.path,
+		size:    int64(file.UncompressedSize64),
+		modTime: p.entryTime(file.FileInfo()),
+	}
+
+	// the manifest needs checksums of decompressed data
+	if raw, ok := archive.(rawArchiveWriter); ok && !p.hashFiles {
+		wr, copied, errCreate := raw.createRaw(entry, rawDataOf(file))
+		if errCreate != nil {
+			return errCreate
+		}
+		if copied {
+			content, errOpen := file.OpenRaw()
+			if errOpen != nil {
+				return fmt.Errorf("reading %q: %w", record.path, errOpen)
+			}
+			size := int64(file.CompressedSize64)
+			return p.copyTo(ctx, p.trackEntry(wr, record, size), content, record.path, size)
+		}
+	}
+
+	content, errOpen := file.Open()
+	if errOpen != nil {
+		return fmt.Errorf("reading %q: %w", record.path, errOpen)
+	}
+	defer content.Close()
+
+	wr, errCreate := archive.create(entry)
+	if errCreate != nil {
+		return errCreate
+	}
+
+	dst := p.trackEntry(wr, record, entry.size)
+	sum := sha256.New()
+	if p.hashFiles {
+		dst = io.MultiWriter(dst, sum)
+	}
+	if err := p.copyTo(ctx, dst, content, record.path, entry.size); err != nil {
+		return err
+	}
+
+	if p.hashFiles {
+		p.manifest = append(p.manifest, manifestLine{sum: sum.Sum(nil), name: record.name, source: record.path})
+	}
+	return nil
+}
+
+var errNotInZip = errors.New("no such entry in zip")
+
+// openZippedSource opens an entry of an input zip by a source path like book.zip/01.mp3.
+// The returned closer closes both the entry and the zip, ok is false if source isn't inside of a zip.
+func openZippedSource(source string) (content io.ReadCloser, ok bool, err error) {
+	dir := source
+	for {
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return nil, false, nil
+		}
+		dir = parent
+		if isZipInput(dir) {
+			break
+		}
+	}
+
+	name, errRel := filepath.Rel(dir, source)
+	if errRel != nil {
+		return nil, true, errRel
+	}
+	zr, errOpen := zip.OpenReader(dir)
+	if errOpen != nil {
+		return nil, true, fmt.Errorf("opening zip: %w", errOpen)
+	}
+	registerDecompressors(&zr.Reader)
+
+	for _, file := range zr.File {
+		if file.Name != filepath.ToSlash(name) {
+			continue
+		}
+		rc, errEntry := file.Open()
+		if errEntry != nil {
+			_ = zr.Close()
+			return nil, true, errEntry
+		}
+		return zippedSource{ReadCloser: rc, zr: zr}, true, nil
+	}
+
+	_ = zr.Close()
+	return nil, true, fmt.Errorf("%w: %q", errNotInZip, source)
+}
+
+type zippedSource struct {
+	io.ReadCloser
+	zr *zip.ReadCloser
+}
+
+func (s zippedSource) Close() error {
+	return errors.Join(s.ReadCloser.Close(), s.zr.Close())
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/ninedraft/audiobook-repack/repack"
+)
+
+// releasesURL is the GitHub API endpoint of releases of the tool.
+const releasesURL = "https://api.github.com/repos/ninedraft/audiobook-repack/releases"
+
+// checksumsAsset lists SHA-256 of release binaries in sha256sum format,
+// checksumsAsset+".sig" is its base64 ed25519 signature.
+const checksumsAsset = "checksums.txt"
+
+// maxAssetSize limits downloads of self-update.
+const maxAssetSize = 256 << 20
+
+// updateKey is the hex ed25519 public key release checksums are signed with, release builds set it with
+// -ldflags "-X main.updateKey=...". Builds with a key refuse to install releases without a valid signature,
+// builds without one install releases only with -unsigned.
+var updateKey string
+
+var errReleaseVerification = errors.New("release verification failed")
+
+type release struct {
+	TagName string         `json:"tag_name"`
+	Assets  []releaseAsset `json:"assets"`
+}
+
+type releaseAsset struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	URL  string `json:"browser_download_url"`
+}
+
+func (r *release) asset(name string) (releaseAsset, error) {
+	for _, asset := range r.Assets {
+		if asset.Name == name {
+			return asset, nil
+		}
+	}
+	return releaseAsset{}, fmt.Errorf("release %s has no %s asset", r.TagName, name)
+}
+
+// releaseAssetName is the name of the release binary for the platform the tool runs on.
+func releaseAssetName() string {
+	name := "audiobook-repack_" + runtime.GOOS + "_" + runtime.GOARCH
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	return name
+}
+
+func selfUpdate(args []string) error {
+	flags := flag.NewFlagSet("self-update", flag.ExitOnError)
+	check := false
+	flags.BoolVar(&check, "check", check, "only print whether another release is available")
+	tag := ""
+	flags.StringVar(&tag, "version", tag, "install the release with tag, e.g. v1.4.0, instead of the latest one; it may be older than the running version")
+	force := false
+	flags.BoolVar(&force, "force", force, "reinstall the release even if it's the running version")
+	releases := releasesURL
+	flags.StringVar(&releases, "releases", releases, "GitHub API URL of releases to update from, for forks")
+	unsigned := false
+	flags.BoolVar(&unsigned, "unsigned", unsigned, "install releases in builds without an update key, the checksum then only guards against broken downloads, not forged releases")
+	_ = flags.Parse(args)
+	if flags.NArg() != 0 {
+		return usageError{errors.New("self-update takes no arguments")}
+	}
+	if updateKey == "" && !unsigned && !check {
+		return usageError{errors.New("this build has no update key to verify releases with, pass -unsigned to install them anyway")}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	link := releases + "/latest"
+	if tag != "" {
+		link = releases + "/tags/" + url.PathEscape(tag)
+	}
+	rel, errRelease := fetchRelease(ctx, link)
+	if errRelease != nil {
+		return fmt.Errorf("looking up release: %w", errRelease)
+	}
+
+	current := repack.ToolVersion()
+	if rel.TagName == current && !force {
+		fmt.Printf("%s is up to date\n", current)
+		return nil
+	}
+	if check {
+		fmt.Printf("%s is available, running %s\n", rel.TagName, current)
+		return nil
+	}
+
+	binary, errBinary := rel.asset(releaseAssetName())
+	if errBinary != nil {
+		return errBinary
+	}
+	sum, errSum := releaseChecksum(ctx, rel, binary.Name)
+	if errSum != nil {
+		return errSum
+	}
+
+	executable, errExecutable := os.Executable()
+	if errExecutable != nil {
+		return fmt.Errorf("locating executable: %w", errExecutable)
+	}
+	if resolved, err := filepath.EvalSymlinks(executable); err == nil {
+		executable = resolved
+	}
+	if err := replaceExecutable(ctx, executable, binary, sum); err != nil {
+		return fmt.Errorf("replacing %s: %w", executable, err)
+	}
+	fmt.Printf("updated %s from %s to %s\n", executable, current, rel.TagName)
+	return nil
+}
+
+func fetchRelease(ctx context.Context, link string) (*release, error) {
+	resp, errGet := githubGet(ctx, link)
+	if errGet != nil {
+		return nil, errGet
+	}
+	defer resp.Body.Close()
+	rel := &release{}
+	if err := json.NewDecoder(resp.Body).Decode(rel); err != nil {
+		return nil, fmt.Errorf("decoding release: %w", err)
+	}
+	return rel, nil
+}
+
+// githubGet requests link, GITHUB_TOKEN is sent to the API to raise its rate limit.
+// Responses other than 200 are errors.
+func githubGet(ctx context.Context, link string) (*http.Response, error) {
+	req, errReq := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+	if errReq != nil {
+		return nil, errReq
+	}
+	req.Header.Set("User-Agent", "audiobook-repack/"+repack.ToolVersion())
+	if req.URL.Host == "api.github.com" {
+		req.Header.Set("Accept", "application/vnd.github+json")
+		if token := os.Getenv("GITHUB_TOKEN"); token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+	resp, errDo := http.DefaultClient.Do(req)
+	if errDo != nil {
+		return nil, errDo
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		return nil, fmt.Errorf("GET %s: %s: %s", link, resp.Status, bytes.TrimSpace(body))
+	}
+	return resp, nil
+}
+
+// download reads asset into w, it fails if the asset is larger than maxAssetSize or its size in the release.
+func download(ctx context.Context, asset releaseAsset, w io.Writer) error {
+	if asset.Size > maxAssetSize {
+		return fmt.Errorf("%s is %d bytes, more than %d", asset.Name, asset.Size, maxAssetSize)
+	}
+	resp, errGet := githubGet(ctx, asset.URL)
+	if errGet != nil {
+		return errGet
+	}
+	defer resp.Body.Close()
+	n, errCopy := io.Copy(w, io.LimitReader(resp.Body, asset.Size+1))
+	if errCopy != nil {
+		return fmt.Errorf("downloading %s: %w", asset.Name, errCopy)
+	}
+	if n != asset.Size {
+		return fmt.Errorf("downloading %s: got %d bytes, want %d", asset.Name, n, asset.Size)
+	}
+	return nil
+}
+
+// releaseChecksum is SHA-256 of asset name listed in the checksums of the release.
+// The checksums are verified with updateKey if the build has one.
+func releaseChecksum(ctx context.Context, rel *release, name string) ([]byte, error) {
+	checksums, errChecksums := rel.asset(checksumsAsset)
+	if errChecksums != nil {
+		return nil, errChecksums
+	}
+	sums := &bytes.Buffer{}
+	if err := download(ctx, checksums, sums); err != nil {
+		return nil, err
+	}
+
+	if updateKey != "" {
+		signature, errSignature := rel.asset(checksumsAsset + ".sig")
+		if errSignature != nil {
+			return nil, fmt.Errorf("%w: %w", errReleaseVerification, errSignature)
+		}
+		sig := &bytes.Buffer{}
+		if err := download(ctx, signature, sig); err != nil {
+			return nil, err
+		}
+		if err := verifyChecksums(sums.Bytes(), sig.Bytes()); err != nil {
+			return nil, err
+		}
+	}
+
+	scanner := bufio.NewScanner(sums)
+	for scanner.Scan() {
+		// sha256sum prefixes names of files read in binary mode with *
+		sum, file, ok := strings.Cut(scanner.Text(), " ")
+		if !ok || strings.TrimPrefix(strings.TrimSpace(file), "*") != name {
+			continue
+		}
+		decoded, err := hex.DecodeString(sum)
+		if err != nil || len(decoded) != sha256.Size {
+			return nil, fmt.Errorf("%w: bad checksum of %s in %s", errReleaseVerification, name, checksumsAsset)
+		}
+		return decoded, nil
+	}
+	return nil, fmt.Errorf("%w: %s has no checksum of %s", errReleaseVerification, checksumsAsset, name)
+}
+
+func verifyChecksums(sums, signature []byte) error {
+	key, errKey := hex.DecodeString(updateKey)
+	if errKey != nil || len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("%w: bad update key built in", errReleaseVerification)
+	}
+	sig, errSig := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(signature)))
+	if errSig != nil {
+		return fmt.Errorf("%w: decoding signature: %w", errReleaseVerification, errSig)
+	}
+	if !ed25519.Verify(ed25519.PublicKey(key), sums, sig) {
+		return fmt.Errorf("%w: bad signature of %s", errReleaseVerification, checksumsAsset)
+	}
+	return nil
+}
+
+// replaceExecutable downloads asset next to executable and renames it over executable once its checksum matches sum.
+// Windows doesn't allow replacing a running binary, there it's moved to executable+".old" first.
+func replaceExecutable(ctx context.Context, executable string, asset releaseAsset, sum []byte) error {
+	info, errStat := os.Stat(executable)
+	if errStat != nil {
+		return errStat
+	}
+	file, errCreate := os.CreateTemp(filepath.Dir(executable), ".audiobook-repack-update-*")
+	if errCreate != nil {
+		return errCreate
+	}
+	defer os.Remove(file.Name())
+
+	hash := sha256.New()
+	errDownload := download(ctx, asset, io.MultiWriter(file, hash))
+	if err := errors.Join(errDownload, file.Close()); err != nil {
+		return err
+	}
+	if !bytes.Equal(hash.Sum(nil), sum) {
+		return fmt.Errorf("%w: SHA-256 of %s doesn't match %s", errReleaseVerification, asset.Name, checksumsAsset)
+	}
+	if err := os.Chmod(file.Name(), info.Mode().Perm()); err != nil {
+		return err
+	}
+
+	if runtime.GOOS != "windows" {
+		return os.Rename(file.Name(), executable)
+	}
+	old := executable + ".old"
+	_ = os.Remove(old)
+	if err := os.Rename(executable, old); err != nil {
+		return err
+	}
+	if err := os.Rename(file.Name(), executable); err != nil {
+		return errors.Join(err, os.Rename(old, executable))
+	}
+	return nil
+}
@@ -0,0 +1,576 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Job states, a job is queued until one of -jobs slots is free.
+const (
+	jobQueued   = "queued"
+	jobRunning  = "running"
+	jobDone     = "done"
+	jobFailed   = "failed"
+	jobCanceled = "canceled"
+)
+
+// serveDeniedFlags are pack flags jobs can't set: the server picks the output and progress,
+// the rest run commands, write files outside of the outputs dir, need a terminal,
+// make the server send requests anywhere or write volumes which can't be downloaded as a result.
+var serveDeniedFlags = []string{
+	"o", "per-dir-output", "progress", "progress-fd", "quiet", "log-format",
+	"interactive", "watch", "watch-delay", "dry-run", "sauce", "version", "config",
+	"pre-hook", "post-hook", "pre-book-hook", "post-book-hook", "ffmpeg",
+	"cpu-profile", "mem-profile", "pprof-addr", "report", "catalog", "metadata-cache",
+	"encrypt", "passfile", "notify", "split-size",
+}
+
+// maxJobLog is how much of stderr of a job is kept.
+const maxJobLog = 64 << 10
+
+// maxFinishedJobs is how many finished jobs are kept, older ones are forgotten,
+// their outputs stay in the outputs dir.
+const maxFinishedJobs = 100
+
+// jobRequest is the body of POST /jobs. Flags are pack flags without dashes,
+// values are strings, numbers, booleans or arrays of them for repeated flags.
+type jobRequest struct {
+	Dirs   []string       `json:"dirs"`
+	Output string         `json:"output"`
+	Flags  map[string]any `json:"flags"`
+}
+
+// jobStatus is a job as the API shows it, progress is a percentage of files packed.
+type jobStatus struct {
+	ID        string     `json:"id"`
+	State     string     `json:"state"`
+	Dirs      []string   `json:"dirs"`
+	Output    string     `json:"output"`
+	Progress  float64    `json:"progress"`
+	Books     int        `json:"books"`
+	BooksDone int        `json:"booksDone"`
+	Files     int        `json:"files"`
+	FilesDone int        `json:"filesDone"`
+	Error     string     `json:"error,omitempty"`
+	ExitCode  int        `json:"exitCode,omitempty"`
+	Created   time.Time  `json:"created"`
+	Started   *time.Time `json:"started,omitempty"`
+	Finished  *time.Time `json:"finished,omitempty"`
+}
+
+// job is a pack run in a child process reporting -progress json events through a pipe.
+type job struct {
+	args   []string
+	path   string
+	cancel context.CancelFunc
+
+	mu     sync.Mutex
+	status jobStatus
+	// written is the share of the current file copied so far
+	written float64
+	log     tailBuffer
+}
+
+func (j *job) snapshot() jobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	status := j.status
+	if status.Files > 0 {
+		status.Progress = min(100, 100*(float64(status.FilesDone)+j.written)/float64(status.Files))
+	}
+	if status.State == jobDone {
+		status.Progress = 100
+	}
+	return status
+}
+
+func (j *job) update(fn func(status *jobStatus)) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	fn(&j.status)
+}
+
+// track follows progress events of the child until the pipe is closed.
+func (j *job) track(events io.Reader) {
+	scanner := bufio.NewScanner(events)
+	for scanner.Scan() {
+		var event progressEvent
+		if json.Unmarshal(scanner.Bytes(), &event) != nil {
+			continue
+		}
+		j.mu.Lock()
+		switch event.Event {
+		case "discovered":
+			j.status.Books, j.status.Files = event.Books, event.Files
+		case "file_start":
+			j.written = 0
+		case "file_progress":
+			if event.Size > 0 {
+				j.written = float64(event.Written) / float64(event.Size)
+			}
+		case "file_done":
+			j.status.FilesDone++
+			j.written = 0
+		case "book_done":
+			j.status.BooksDone++
+		}
+		j.mu.Unlock()
+	}
+}
+
+// tailBuffer keeps the last maxJobLog bytes written into it.
+type tailBuffer struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > maxJobLog {
+		t.buf = slices.Clone(t.buf[len(t.buf)-maxJobLog:])
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) Bytes() []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return slices.Clone(t.buf)
+}
+
+// jobServer runs pack jobs submitted over HTTP, at most cap(slots) at once.
+type jobServer struct {
+	executable string
+	outputs    string
+	token      string
+	slots      chan struct{}
+	running    sync.WaitGroup
+
+	mu   sync.Mutex
+	jobs map[string]*job
+	ids  []string
+}
+
+func serve(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := "localhost:8080"
+	flags.StringVar(&addr, "addr", addr, "address to listen on, anyone who can reach it can pack any dirs the server can read")
+	outputs := "."
+	flags.StringVar(&outputs, "outputs", outputs, "dir job outputs are written into and downloaded from")
+	parallel := 1
+	flags.IntVar(&parallel, "jobs", parallel, "number of jobs run at once, others are queued")
+	tokenFile := ""
+	flags.StringVar(&tokenFile, "token-file", tokenFile, "require 'Authorization: Bearer TOKEN' with the token from the first line of file")
+	_ = flags.Parse(args)
+	if flags.NArg() != 0 {
+		return usageError{errors.New("serve takes no arguments")}
+	}
+	if parallel < 1 {
+		return usageError{errors.New("-jobs must be at least 1")}
+	}
+
+	executable, errExecutable := os.Executable()
+	if errExecutable != nil {
+		return fmt.Errorf("finding own binary for jobs: %w", errExecutable)
+	}
+	outputs, errAbs := filepath.Abs(outputs)
+	if errAbs != nil {
+		return errAbs
+	}
+	if err := os.MkdirAll(outputs, 0700); err != nil {
+		return fmt.Errorf("creating outputs dir: %w", err)
+	}
+	srv := &jobServer{
+		executable: executable,
+		outputs:    outputs,
+		slots:      make(chan struct{}, parallel),
+		jobs:       map[string]*job{},
+	}
+	if tokenFile != "" {
+		token, err := readPassfile(tokenFile)
+		if err != nil {
+			return err
+		}
+		srv.token = string(token)
+	}
+
+	listener, errListen := net.Listen("tcp", addr)
+	if errListen != nil {
+		return fmt.Errorf("serving: %w", errListen)
+	}
+	server := &http.Server{Handler: srv.handler(), ReadHeaderTimeout: 10 * time.Second}
+
+	ctx, stop := interruptContext()
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdown)
+	}()
+
+	slog.Info("serving", "url", "http://"+listener.Addr().String()+"/jobs", "outputs", outputs)
+	errServe := server.Serve(listener)
+	srv.cancelAll()
+	srv.running.Wait()
+	if !errors.Is(errServe, http.ErrServerClosed) {
+		return fmt.Errorf("serving: %w", errServe)
+	}
+	return nil
+}
+
+func (srv *jobServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /jobs", srv.submit)
+	mux.HandleFunc("GET /jobs", srv.list)
+	mux.HandleFunc("GET /jobs/{id}", srv.withJob(func(w http.ResponseWriter, r *http.Request, j *job) {
+		writeJSON(w, http.StatusOK, j.snapshot())
+	}))
+	mux.HandleFunc("DELETE /jobs/{id}", srv.withJob(srv.cancel))
+	mux.HandleFunc("GET /jobs/{id}/result", srv.withJob(srv.result))
+	mux.HandleFunc("GET /jobs/{id}/log", srv.withJob(func(w http.ResponseWriter, r *http.Request, j *job) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = w.Write(j.log.Bytes())
+	}))
+
+	if srv.token == "" {
+		return mux
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(srv.token)) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("missing or wrong bearer token"))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (srv *jobServer) withJob(handle func(w http.ResponseWriter, r *http.Request, j *job)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		srv.mu.Lock()
+		j, ok := srv.jobs[r.PathValue("id")]
+		srv.mu.Unlock()
+		if !ok {
+			writeError(w, http.StatusNotFound, errors.New("no such job"))
+			return
+		}
+		handle(w, r, j)
+	}
+}
+
+func (srv *jobServer) submit(w http.ResponseWriter, r *http.Request) {
+	var req jobRequest
+	decoder := json.NewDecoder(io.LimitReader(r.Body, 1<<20))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("parsing job: %w", err))
+		return
+	}
+	flagArgs, errFlags := jobFlagArgs(req.Flags)
+	if errFlags != nil {
+		writeError(w, http.StatusBadRequest, errFlags)
+		return
+	}
+	if len(req.Dirs) == 0 && req.Flags["dirs-from"] == nil && req.Flags["files-from"] == nil {
+		writeError(w, http.StatusBadRequest, errors.New("job needs dirs, dirs-from or files-from"))
+		return
+	}
+
+	id, errID := newJobID()
+	if errID != nil {
+		writeError(w, http.StatusInternalServerError, errID)
+		return
+	}
+	if req.Output == "" {
+		format, _ := req.Flags["format"].(string)
+		if format == "" {
+			format = "zip"
+		}
+		req.Output = id + "." + format
+	}
+	if req.Output != filepath.Base(req.Output) || req.Output == "." || req.Output == ".." || strings.ContainsAny(req.Output, `:\`) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("output %q must be a file name in the outputs dir", req.Output))
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &job{
+		path:   filepath.Join(srv.outputs, req.Output),
+		cancel: cancel,
+		status: jobStatus{ID: id, State: jobQueued, Dirs: req.Dirs, Output: req.Output, Created: time.Now().UTC()},
+	}
+	j.args = append([]string{"pack", "-progress", "json", "-progress-fd", "3", "-o", j.path}, flagArgs...)
+	j.args = append(append(j.args, "--"), req.Dirs...)
+
+	srv.mu.Lock()
+	for _, other := range srv.jobs {
+		if other.path == j.path && !other.snapshot().finished() {
+			srv.mu.Unlock()
+			cancel()
+			writeError(w, http.StatusConflict, fmt.Errorf("job %s writes %q already", other.status.ID, req.Output))
+			return
+		}
+	}
+	srv.jobs[id] = j
+	srv.ids = append(srv.ids, id)
+	srv.prune()
+	srv.running.Add(1)
+	srv.mu.Unlock()
+
+	go srv.run(ctx, j)
+	writeJSON(w, http.StatusCreated, j.snapshot())
+}
+
+// prune forgets the oldest finished jobs beyond maxFinishedJobs, srv.mu must be held.
+func (srv *jobServer) prune() {
+	finished := 0
+	for _, id := range srv.ids {
+		if srv.jobs[id].snapshot().finished() {
+			finished++
+		}
+	}
+	srv.ids = slices.DeleteFunc(srv.ids, func(id string) bool {
+		if finished <= maxFinishedJobs || !srv.jobs[id].snapshot().finished() {
+			return false
+		}
+		finished--
+		delete(srv.jobs, id)
+		return true
+	})
+}
+
+// jobFlagArgs turns flags of a job into -name=value arguments, so values can't be taken for dirs.
+func jobFlagArgs(flags map[string]any) ([]string, error) {
+	names := make([]string, 0, len(flags))
+	for name := range flags {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	args := []string{}
+	for _, name := range names {
+		if slices.Contains(serveDeniedFlags, name) || name == "" || strings.HasPrefix(name, "-") {
+			return nil, fmt.Errorf("flag %q can't be set by jobs", name)
+		}
+		values, isList := flags[name].([]any)
+		if !isList {
+			values = []any{flags[name]}
+		}
+		for _, value := range values {
+			var text string
+			switch value := value.(type) {
+			case string:
+				text = value
+			case bool:
+				text = strconv.FormatBool(value)
+			case float64:
+				text = strconv.FormatFloat(value, 'f', -1, 64)
+			default:
+				return nil, fmt.Errorf("flag %q: want a string, number, boolean or array of them", name)
+			}
+			args = append(args, "-"+name+"="+text)
+		}
+	}
+	return args, nil
+}
+
+func newJobID() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+func (status jobStatus) finished() bool {
+	return status.State == jobDone || status.State == jobFailed || status.State == jobCanceled
+}
+
+// run waits for a free slot and packs the job in a child process. Canceling ctx interrupts the child,
+// so it removes the incomplete output like on Ctrl+C.
+func (srv *jobServer) run(ctx context.Context, j *job) {
+	defer srv.running.Done()
+	defer j.cancel()
+
+	select {
+	case srv.slots <- struct{}{}:
+		defer func() { <-srv.slots }()
+	case <-ctx.Done():
+		j.update(func(status *jobStatus) {
+			status.State = jobCanceled
+			finished := time.Now().UTC()
+			status.Finished = &finished
+		})
+		return
+	}
+
+	events, progress, errPipe := os.Pipe()
+	if errPipe != nil {
+		srv.finish(j, errPipe, false)
+		return
+	}
+	defer events.Close()
+
+	cmd := exec.CommandContext(ctx, srv.executable, j.args...)
+	cmd.Cancel = func() error { return cmd.Process.Signal(os.Interrupt) }
+	cmd.WaitDelay = 30 * time.Second
+	cmd.Stdout, cmd.Stderr = &j.log, &j.log
+	cmd.ExtraFiles = []*os.File{progress}
+
+	j.update(func(status *jobStatus) {
+		status.State = jobRunning
+		started := time.Now().UTC()
+		status.Started = &started
+	})
+	slog.Info("job started", "id", j.status.ID, "output", j.path)
+	errStart := cmd.Start()
+	// the child has its own copy, events end when it exits
+	_ = progress.Close()
+	if errStart != nil {
+		srv.finish(j, errStart, false)
+		return
+	}
+	tracked := make(chan struct{})
+	go func() {
+		defer close(tracked)
+		j.track(events)
+	}()
+	errWait := cmd.Wait()
+	<-tracked
+	srv.finish(j, errWait, ctx.Err() != nil)
+}
+
+// finish records the outcome of the child process, an archive with skipped files is done too.
+func (srv *jobServer) finish(j *job, err error, canceled bool) {
+	code := 0
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		code = exitErr.ExitCode()
+	}
+	message := ""
+	if err != nil && !canceled {
+		message = jobError(j.log.Bytes(), filepath.Base(srv.executable), err)
+	}
+
+	j.update(func(status *jobStatus) {
+		finished := time.Now().UTC()
+		status.Finished = &finished
+		status.ExitCode, status.Error = code, message
+		switch {
+		case canceled:
+			status.State = jobCanceled
+		case err == nil, code == exitSkipped:
+			status.State = jobDone
+		default:
+			status.State = jobFailed
+		}
+	})
+	status := j.snapshot()
+	slog.Info("job finished", "id", status.ID, "state", status.State, "err", status.Error)
+}
+
+// jobError is the error line the child printed before exiting or, for bad flags, the first line of its output.
+func jobError(log []byte, name string, err error) string {
+	lines := strings.Split(strings.TrimSpace(string(log)), "\n")
+	for i := len(lines) - 1; i >= 0; i-- {
+		if message, ok := strings.CutPrefix(lines[i], name+": "); ok {
+			return message
+		}
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == exitUsage && lines[0] != "" {
+		return lines[0]
+	}
+	return err.Error()
+}
+
+func (srv *jobServer) list(w http.ResponseWriter, r *http.Request) {
+	srv.mu.Lock()
+	jobs := make([]*job, 0, len(srv.ids))
+	for _, id := range srv.ids {
+		jobs = append(jobs, srv.jobs[id])
+	}
+	srv.mu.Unlock()
+
+	statuses := make([]jobStatus, 0, len(jobs))
+	for _, j := range jobs {
+		statuses = append(statuses, j.snapshot())
+	}
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+func (srv *jobServer) cancel(w http.ResponseWriter, r *http.Request, j *job) {
+	if j.snapshot().finished() {
+		writeError(w, http.StatusConflict, errors.New("job is finished"))
+		return
+	}
+	j.cancel()
+	writeJSON(w, http.StatusAccepted, j.snapshot())
+}
+
+func (srv *jobServer) result(w http.ResponseWriter, r *http.Request, j *job) {
+	if j.snapshot().State != jobDone {
+		writeError(w, http.StatusConflict, errors.New("job isn't done"))
+		return
+	}
+	file, errOpen := os.Open(j.path)
+	if errOpen != nil {
+		writeError(w, http.StatusNotFound, errOpen)
+		return
+	}
+	defer file.Close()
+	info, errStat := file.Stat()
+	if errStat != nil {
+		writeError(w, http.StatusInternalServerError, errStat)
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(j.path)))
+	http.ServeContent(w, r, filepath.Base(j.path), info.ModTime(), file)
+}
+
+// cancelAll interrupts queued and running jobs when the server stops.
+func (srv *jobServer) cancelAll() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for _, j := range srv.jobs {
+		j.cancel()
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, value any) {
+	body := &bytes.Buffer{}
+	if err := json.NewEncoder(body).Encode(value); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_, _ = w.Write(body.Bytes())
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestJobFlagArgs(t *testing.T) {
+	args, err := jobFlagArgs(map[string]any{"format": "tar", "x": []any{"*.txt", "*.nfo"}, "manifest": true, "j": 4.0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"-format=tar", "-j=4", "-manifest=true", "-x=*.txt", "-x=*.nfo"}
+	if !slices.Equal(args, want) {
+		t.Errorf("args are %q, want %q", args, want)
+	}
+
+	for _, name := range []string{"o", "notify", "split-size", "post-hook", "-o", ""} {
+		if _, err := jobFlagArgs(map[string]any{name: "x"}); err == nil {
+			t.Errorf("flag %q is accepted", name)
+		}
+	}
+}
+
+func TestJobServerPrune(t *testing.T) {
+	srv := &jobServer{jobs: map[string]*job{}}
+	add := func(id, state string) {
+		srv.jobs[id] = &job{status: jobStatus{ID: id, State: state}}
+		srv.ids = append(srv.ids, id)
+	}
+	add("running", jobRunning)
+	for i := range maxFinishedJobs + 5 {
+		add(fmt.Sprint("done", i), jobDone)
+	}
+	add("queued", jobQueued)
+
+	srv.prune()
+	if len(srv.ids) != maxFinishedJobs+2 || len(srv.jobs) != len(srv.ids) {
+		t.Fatalf("kept %d ids and %d jobs, want %d", len(srv.ids), len(srv.jobs), maxFinishedJobs+2)
+	}
+	if srv.ids[0] != "running" || srv.ids[1] != "done5" || srv.ids[len(srv.ids)-1] != "queued" {
+		t.Errorf("kept %q ... %q", srv.ids[:2], srv.ids[len(srv.ids)-1])
+	}
+}
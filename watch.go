@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/ninedraft/audiobook-repack/repack"
+)
+
+// defaultWatchDelay is how long -watch waits for changes to settle before repacking.
+const defaultWatchDelay = 5 * time.Second
+
+// watcher repacks books when files under watched dirs change.
+type watcher struct {
+	fsw *fsnotify.Watcher
+	// delay debounces changes, a copy of a book touches many files
+	delay time.Duration
+	// ignored are prefixes of paths written by packing itself, outputs and report
+	ignored []string
+}
+
+// watchAndPack packs once, then packs again each time dirs change and stay unchanged for delay.
+// Failed runs are logged and watching goes on, it stops when ctx is canceled or options are invalid.
+func watchAndPack(ctx context.Context, dirs []string, delay time.Duration, ignored []string, pack func(ctx context.Context) error) error {
+	fsw, errWatcher := fsnotify.NewWatcher()
+	if errWatcher != nil {
+		return fmt.Errorf("watching dirs: %w", errWatcher)
+	}
+	defer fsw.Close()
+
+	w := &watcher{fsw: fsw, delay: delay}
+	for _, prefix := range ignored {
+		if prefix == "" {
+			continue
+		}
+		abs, err := filepath.Abs(prefix)
+		if err != nil {
+			return err
+		}
+		w.ignored = append(w.ignored, abs)
+	}
+	for _, dir := range dirs {
+		if err := w.add(dir); err != nil {
+			return err
+		}
+	}
+
+	for {
+		if err := w.packOnce(ctx, pack); err != nil {
+			return err
+		}
+		slog.Info("watching for changes", "dirs", len(dirs))
+		if err := w.wait(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+// packOnce runs pack and tells whether watching can go on after its error.
+func (w *watcher) packOnce(ctx context.Context, pack func(ctx context.Context) error) error {
+	err := pack(ctx)
+	switch {
+	case err == nil:
+		return nil
+	case ctx.Err() != nil:
+		return ctx.Err()
+	case errors.As(err, new(usageError)), errors.Is(err, repack.ErrInvalidOptions):
+		return err
+	case errors.Is(err, repack.ErrFilesSkipped):
+		slog.Warn("packed with skipped files", "err", err)
+	case errors.Is(err, repack.ErrNoFilesFound):
+		slog.Warn("nothing to pack yet", "err", err)
+	default:
+		slog.Error("packing failed, waiting for changes", "err", err)
+	}
+	return nil
+}
+
+// add watches dir and all its subdirs, fsnotify doesn't watch trees by itself.
+func (w *watcher) add(dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return err
+		}
+		if err := w.fsw.Add(path); err != nil {
+			return fmt.Errorf("watching %q: %w", path, err)
+		}
+		return nil
+	})
+}
+
+// wait returns once something changed and then nothing changed for delay.
+func (w *watcher) wait(ctx context.Context) error {
+	var settled <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-settled:
+			return nil
+		case err := <-w.fsw.Errors:
+			// the queue overflows when many files land at once, a run picks all of them anyway
+			slog.Warn("watching dirs", "err", err)
+			settled = time.After(w.delay)
+		case event := <-w.fsw.Events:
+			if w.isIgnored(event.Name) {
+				continue
+			}
+			slog.Debug("changed", "path", event.Name, "op", event.Op.String())
+			if event.Has(fsnotify.Create) {
+				// a new book dir, its files are watched from now on
+				if err := w.add(event.Name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+					slog.Warn("watching new dir", "err", err)
+				}
+			}
+			settled = time.After(w.delay)
+		}
+	}
+}
+
+// isIgnored reports whether path is written by packing: the output, its temporary files and volumes, the report.
+func (w *watcher) isIgnored(path string) bool {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	for _, prefix := range w.ignored {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}